@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/livepeer/lpms/tsrepair"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "Print the analysis as JSON")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: [-json] <segment.ts>...")
+		os.Exit(2)
+	}
+	failed := false
+	for _, fname := range flag.Args() {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		a := tsrepair.AnalyzeTS(data)
+		if *asJSON {
+			out, _ := json.MarshalIndent(struct {
+				File string
+				*tsrepair.Analysis
+			}{fname, a}, "", "  ")
+			fmt.Println(string(out))
+			continue
+		}
+		printAnalysis(fname, a)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printAnalysis(fname string, a *tsrepair.Analysis) {
+	fmt.Printf("%s: %d packets, %v", fname, a.Packets, a.Duration)
+	if a.DroppedBytes > 0 {
+		fmt.Printf(", %d bytes outside of packets", a.DroppedBytes)
+	}
+	fmt.Printf(", PMT PID %d, PCR PID %d\n\n", a.PMTPID, a.PCRPID)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tKind\tType\tPackets\tCC errors\tPCRs\tPCR interval\tPES\tNo TS\tPTS\tDTS\tKeyframes")
+	for _, p := range a.PIDs {
+		fmt.Fprintf(w, "%d\t%s\t0x%02x\t%d\t%d\t%d\t", p.PID, p.Kind, p.StreamType, p.Packets, p.ContinuityErrors, p.PCRs)
+		if p.PCRs > 1 {
+			fmt.Fprintf(w, "%v-%v", p.MinPCRInterval, p.MaxPCRInterval)
+		}
+		fmt.Fprintf(w, "\t%d\t%d\t", p.PES, p.MissingTimestamps)
+		if p.PES > p.MissingTimestamps {
+			fmt.Fprintf(w, "%v-%v\t%v-%v", p.MinPTS, p.MaxPTS, p.FirstDTS, p.LastDTS)
+		} else {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprintf(w, "\t%v\n", p.Keyframes)
+	}
+	w.Flush()
+
+	fmt.Println()
+	if len(a.Problems) == 0 {
+		fmt.Println("No problems found")
+	}
+	for _, p := range a.Problems {
+		fmt.Println(p)
+	}
+	fmt.Println()
+}
@@ -11,3 +11,6 @@ import (
 type RTMPSegmenter interface {
 	SegmentRTMPToHLS(ctx context.Context, rs stream.RTMPVideoStream, hs stream.HLSVideoStream, segOptions segmenter.SegmenterOptions) error
 }
+
+var _ RTMPSegmenter = (*LPMS)(nil)
+var _ RTMPSegmenter = segmenter.GoRTMPSegmenter{}
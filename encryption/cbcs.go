@@ -0,0 +1,500 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+)
+
+// Pattern of cbcs video tracks: of every ten blocks, the first is encrypted
+// and the others left clear. Other tracks have no pattern, encrypting every
+// block.
+const cbcsVideoPattern = 1<<4 | 9
+
+// A track encrypted with the cenc scheme
+type cencTrack struct {
+	id    uint32
+	video bool
+	// Boxes from the movie box down to the tenc box, and the scheme type of
+	// the schm box
+	chain  []box
+	schm   int
+	ivSize int
+	// Size of the samples of fragments that don't give any
+	defaultSize uint32
+}
+
+// A sample, at its offset in the file
+type sample struct {
+	off, size int
+}
+
+// Body of the box, which is in data
+func (bx box) body(data []byte) []byte {
+	return data[bx.off+bx.hdr : bx.off+bx.size]
+}
+
+// Boxes in the body of parent after skip bytes, at their offsets in data
+func childBoxes(data []byte, parent box, skip int) []box {
+	start := parent.off + parent.hdr + skip
+	if start > parent.off+parent.size {
+		return nil
+	}
+	boxes := mp4Boxes(data[start : parent.off+parent.size])
+	for i := range boxes {
+		boxes[i].off += start
+	}
+	return boxes
+}
+
+// First of the boxes of the type
+func firstBox(boxes []box, typ string) (box, bool) {
+	for _, bx := range boxes {
+		if bx.typ == typ {
+			return bx, true
+		}
+	}
+	return box{}, false
+}
+
+// Boxes along the path of types from parent, nil if one is missing
+func boxPath(data []byte, parent box, path ...string) []box {
+	chain := make([]box, 0, len(path))
+	for _, typ := range path {
+		bx, ok := firstBox(childBoxes(data, parent, 0), typ)
+		if !ok {
+			return nil
+		}
+		chain = append(chain, bx)
+		parent = bx
+	}
+	return chain
+}
+
+// ReencryptCBCS returns the MP4 in data, as encrypted by the mov muxer with
+// the cenc scheme, encrypted with the cbcs scheme instead. Samples are
+// decrypted with the key and encrypted again in place, restarting from the
+// constant IV with each subsample. Video encrypts one block in ten, other
+// tracks every block, and partial blocks stay clear.
+//
+// The per-sample IVs of cenc give way to free boxes, while the constant IV
+// grows the movie box, moving along what points past it like InsertPSSH.
+func ReencryptCBCS(data, key, iv []byte) ([]byte, error) {
+	if len(key) != KeySize || len(iv) != KeySize {
+		return nil, ErrKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	copy(out, data)
+	boxes := mp4Boxes(out)
+	moov, ok := firstBox(boxes, "moov")
+	if !ok {
+		return nil, ErrMP4
+	}
+	tracks := cencTracks(out, moov)
+	if len(tracks) == 0 {
+		return nil, ErrMP4
+	}
+
+	for _, t := range tracks {
+		stbl := t.chain[4]
+		senc, ok := firstBox(childBoxes(out, stbl, 0), "senc")
+		if !ok {
+			// fragmented
+			continue
+		}
+		samples, err := chunkSamples(out, stbl)
+		if err != nil {
+			return nil, err
+		}
+		if err := reencryptSamples(out, t, stbl, senc, samples, block, iv); err != nil {
+			return nil, err
+		}
+	}
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		for _, traf := range childBoxes(out, moof, 0) {
+			if traf.typ != "traf" {
+				continue
+			}
+			if err := reencryptFragment(out, tracks, moof, traf, block, iv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// constant IV, from the last track on so that the boxes of the others
+	// stay where they are
+	for i := len(tracks) - 1; i >= 0; i-- {
+		t := tracks[i]
+		copy(out[t.schm:], "cbcs")
+		tenc := t.chain[len(t.chain)-1]
+		b := tenc.body(out)
+		b[0] = 1
+		b[5] = 0
+		if t.video {
+			b[5] = cbcsVideoPattern
+		}
+		b[7] = 0
+		ext := append([]byte{KeySize}, iv...)
+		if out, err = insertBytes(out, t.chain, tenc.off+tenc.size, ext); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Tracks of the movie box encrypted with the cenc scheme, by the offset of
+// their tenc box
+func cencTracks(data []byte, moov box) []*cencTrack {
+	defaultSizes := map[uint32]uint32{}
+	for _, trex := range childBoxes(data, moov, 0) {
+		if trex.typ != "mvex" {
+			continue
+		}
+		for _, bx := range childBoxes(data, trex, 0) {
+			if b := bx.body(data); bx.typ == "trex" && len(b) >= 24 {
+				defaultSizes[binary.BigEndian.Uint32(b[4:])] = binary.BigEndian.Uint32(b[16:])
+			}
+		}
+	}
+	var tracks []*cencTrack
+	for _, trak := range childBoxes(data, moov, 0) {
+		if trak.typ != "trak" {
+			continue
+		}
+		tkhd := boxPath(data, trak, "tkhd")
+		stsd := boxPath(data, trak, "mdia", "minf", "stbl", "stsd")
+		if tkhd == nil || stsd == nil {
+			continue
+		}
+		t := &cencTrack{}
+		if b := tkhd[0].body(data); len(b) >= 24 && b[0] == 1 {
+			t.id = binary.BigEndian.Uint32(b[20:])
+		} else if len(b) >= 16 {
+			t.id = binary.BigEndian.Uint32(b[12:])
+		} else {
+			continue
+		}
+		t.defaultSize = defaultSizes[t.id]
+		for _, entry := range childBoxes(data, stsd[3], 8) {
+			// fields of the sample entry ahead of its boxes
+			skip := 0
+			switch b := entry.body(data); {
+			case entry.typ == "encv":
+				skip, t.video = 78, true
+			case entry.typ == "enca" && len(b) >= 10:
+				skip = []int{28, 44, 64, 0}[b[9]&3]
+			}
+			if skip == 0 {
+				continue
+			}
+			sinf, ok := firstBox(childBoxes(data, entry, skip), "sinf")
+			if !ok {
+				continue
+			}
+			schm := boxPath(data, sinf, "schm")
+			tenc := boxPath(data, sinf, "schi", "tenc")
+			if schm == nil || tenc == nil {
+				continue
+			}
+			sb, tb := schm[0].body(data), tenc[1].body(data)
+			if len(sb) < 8 || string(sb[4:8]) != "cenc" || len(tb) < 24 || tb[6] != 1 ||
+				(tb[7] != 8 && tb[7] != 16) {
+				continue
+			}
+			t.schm = schm[0].off + schm[0].hdr + 4
+			t.ivSize = int(tb[7])
+			t.chain = append([]box{moov, trak}, stsd...)
+			t.chain = append(t.chain, entry, sinf)
+			t.chain = append(t.chain, tenc...)
+			tracks = append(tracks, t)
+			break
+		}
+	}
+	return tracks
+}
+
+// Samples of a progressive file, from the chunks of the sample table
+func chunkSamples(data []byte, stbl box) ([]sample, error) {
+	boxes := childBoxes(data, stbl, 0)
+	stsz, ok1 := firstBox(boxes, "stsz")
+	stsc, ok2 := firstBox(boxes, "stsc")
+	if !ok1 || !ok2 {
+		return nil, ErrMP4
+	}
+	var chunks []int
+	if stco, ok := firstBox(boxes, "stco"); ok {
+		b := stco.body(data)
+		for i := 8; len(b) >= 8 && i+4 <= len(b); i += 4 {
+			chunks = append(chunks, int(binary.BigEndian.Uint32(b[i:])))
+		}
+	} else if co64, ok := firstBox(boxes, "co64"); ok {
+		b := co64.body(data)
+		for i := 8; len(b) >= 8 && i+8 <= len(b); i += 8 {
+			chunks = append(chunks, int(binary.BigEndian.Uint64(b[i:])))
+		}
+	} else {
+		return nil, ErrMP4
+	}
+
+	sz, sc := stsz.body(data), stsc.body(data)
+	if len(sz) < 12 || len(sc) < 8 {
+		return nil, ErrMP4
+	}
+	size := int(binary.BigEndian.Uint32(sz[4:]))
+	count := int(binary.BigEndian.Uint32(sz[8:]))
+	if size == 0 && 12+4*count > len(sz) {
+		return nil, ErrMP4
+	}
+	entries := int(binary.BigEndian.Uint32(sc[4:]))
+	if 8+12*entries > len(sc) {
+		return nil, ErrMP4
+	}
+	samples := make([]sample, 0, count)
+	for e := 0; e < entries && len(samples) < count; e++ {
+		first := int(binary.BigEndian.Uint32(sc[8+12*e:]))
+		per := int(binary.BigEndian.Uint32(sc[12+12*e:]))
+		last := len(chunks) + 1
+		if e+1 < entries {
+			last = int(binary.BigEndian.Uint32(sc[8+12*(e+1):]))
+		}
+		for c := first; c < last && len(samples) < count; c++ {
+			if c < 1 || c > len(chunks) {
+				return nil, ErrMP4
+			}
+			off := chunks[c-1]
+			for i := 0; i < per && len(samples) < count; i++ {
+				n := size
+				if n == 0 {
+					n = int(binary.BigEndian.Uint32(sz[12+4*len(samples):]))
+				}
+				samples = append(samples, sample{off: off, size: n})
+				off += n
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Re-encrypts the samples of the track fragment
+func reencryptFragment(data []byte, tracks []*cencTrack, moof, traf box, block cipher.Block, iv []byte) error {
+	boxes := childBoxes(data, traf, 0)
+	tfhd, ok := firstBox(boxes, "tfhd")
+	if !ok {
+		return ErrMP4
+	}
+	b := tfhd.body(data)
+	if len(b) < 8 {
+		return ErrMP4
+	}
+	var t *cencTrack
+	for _, tr := range tracks {
+		if tr.id == binary.BigEndian.Uint32(b[4:]) {
+			t = tr
+		}
+	}
+	senc, ok := firstBox(boxes, "senc")
+	if t == nil || !ok {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint32(b) & 0xffffff
+	base, defaultSize, p := moof.off, int(t.defaultSize), 8
+	if flags&0x01 != 0 {
+		if p+8 > len(b) {
+			return ErrMP4
+		}
+		base = int(binary.BigEndian.Uint64(b[p:]))
+		p += 8
+	}
+	if flags&0x02 != 0 {
+		p += 4
+	}
+	if flags&0x08 != 0 {
+		p += 4
+	}
+	if flags&0x10 != 0 {
+		if p+4 > len(b) {
+			return ErrMP4
+		}
+		defaultSize = int(binary.BigEndian.Uint32(b[p:]))
+	}
+
+	var samples []sample
+	off := base
+	for _, trun := range boxes {
+		if trun.typ != "trun" {
+			continue
+		}
+		b := trun.body(data)
+		if len(b) < 8 {
+			return ErrMP4
+		}
+		flags := binary.BigEndian.Uint32(b) & 0xffffff
+		count := int(binary.BigEndian.Uint32(b[4:]))
+		p := 8
+		if flags&0x01 != 0 {
+			if p+4 > len(b) {
+				return ErrMP4
+			}
+			off = base + int(int32(binary.BigEndian.Uint32(b[p:])))
+			p += 4
+		}
+		if flags&0x04 != 0 {
+			p += 4
+		}
+		for i := 0; i < count; i++ {
+			size := defaultSize
+			if flags&0x100 != 0 {
+				p += 4
+			}
+			if flags&0x200 != 0 {
+				if p+4 > len(b) {
+					return ErrMP4
+				}
+				size = int(binary.BigEndian.Uint32(b[p:]))
+				p += 4
+			}
+			if flags&0x400 != 0 {
+				p += 4
+			}
+			if flags&0x800 != 0 {
+				p += 4
+			}
+			samples = append(samples, sample{off: off, size: size})
+			off += size
+		}
+	}
+	return reencryptSamples(data, t, traf, senc, samples, block, iv)
+}
+
+// Re-encrypts the samples of the senc box, which is in parent along with
+// the saiz and saio boxes of the sample auxiliary information. The box is
+// rewritten without the per-sample IVs, followed by a free box in their
+// place, so the auxiliary information stays where saio points.
+func reencryptSamples(data []byte, t *cencTrack, parent, senc box, samples []sample, block cipher.Block, iv []byte) error {
+	b := senc.body(data)
+	if len(b) < 8 {
+		return ErrMP4
+	}
+	subsamples := b[3]&0x02 != 0
+	count := int(binary.BigEndian.Uint32(b[4:]))
+	if count > len(samples) {
+		return ErrMP4
+	}
+	entries := make([]byte, 0, len(b)-8)
+	sizes := make([]int, count)
+	p := 8
+	for i := 0; i < count; i++ {
+		s := samples[i]
+		if s.off < 0 || s.size < 0 || s.off+s.size > len(data) || p+t.ivSize > len(b) {
+			return ErrMP4
+		}
+		ctr := make([]byte, aes.BlockSize)
+		copy(ctr, b[p:p+t.ivSize])
+		p += t.ivSize
+		ranges := [][]byte{data[s.off : s.off+s.size]}
+		if subsamples {
+			if p+2 > len(b) {
+				return ErrMP4
+			}
+			n := int(binary.BigEndian.Uint16(b[p:]))
+			if p+2+6*n > len(b) {
+				return ErrMP4
+			}
+			entries = append(entries, b[p:p+2+6*n]...)
+			sizes[i] = 2 + 6*n
+			ranges = ranges[:0]
+			pos := s.off
+			for j := 0; j < n; j++ {
+				clear := int(binary.BigEndian.Uint16(b[p+2+6*j:]))
+				protected := int(binary.BigEndian.Uint32(b[p+4+6*j:]))
+				pos += clear
+				if pos+protected > s.off+s.size {
+					return ErrMP4
+				}
+				ranges = append(ranges, data[pos:pos+protected])
+				pos += protected
+			}
+			p += 2 + 6*n
+		}
+		// cenc runs the counter on through the subsamples of a sample
+		stream := cipher.NewCTR(block, ctr)
+		for _, r := range ranges {
+			stream.XORKeyStream(r, r)
+			cbcsEncrypt(block, iv, r, t.video)
+		}
+	}
+
+	// senc without the IVs, and a free box in their place
+	n := senc.hdr + 8 + len(entries)
+	if free := senc.size - n; free > 0 {
+		if free < 8 {
+			return ErrMP4
+		}
+		binary.BigEndian.PutUint32(data[senc.off+n:], uint32(free))
+		copy(data[senc.off+n+4:], "free")
+		for i := senc.off + n + 8; i < senc.off+senc.size; i++ {
+			data[i] = 0
+		}
+	}
+	copy(data[senc.off+senc.hdr+8:], entries)
+	if senc.hdr == 8 {
+		binary.BigEndian.PutUint32(data[senc.off:], uint32(n))
+	} else {
+		binary.BigEndian.PutUint64(data[senc.off+8:], uint64(n))
+	}
+
+	boxes := childBoxes(data, parent, 0)
+	saiz, ok := firstBox(boxes, "saiz")
+	if !ok {
+		return nil
+	}
+	if !subsamples {
+		// no auxiliary information left
+		copy(data[saiz.off+4:], "free")
+		if saio, ok := firstBox(boxes, "saio"); ok {
+			copy(data[saio.off+4:], "free")
+		}
+		return nil
+	}
+	b = saiz.body(data)
+	p = 4
+	if b[3]&0x01 != 0 {
+		p += 8
+	}
+	if p+5 > len(b) {
+		return ErrMP4
+	}
+	if b[p] != 0 {
+		b[p] -= byte(t.ivSize)
+		return nil
+	}
+	if p+5+count > len(b) {
+		return ErrMP4
+	}
+	for i, size := range sizes {
+		b[p+5+i] = byte(size)
+	}
+	return nil
+}
+
+// Encrypts b with the cbcs pattern of the track, from the constant IV. A
+// partial block at the end stays clear.
+func cbcsEncrypt(block cipher.Block, iv, b []byte, video bool) {
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	if !video {
+		n := len(b) / aes.BlockSize * aes.BlockSize
+		cbc.CryptBlocks(b[:n], b[:n])
+		return
+	}
+	for i := 0; i+aes.BlockSize <= len(b); i += 10 * aes.BlockSize {
+		cbc.CryptBlocks(b[i:i+aes.BlockSize], b[i:i+aes.BlockSize])
+	}
+}
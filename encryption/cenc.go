@@ -0,0 +1,256 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMP4 = errors.New("EncryptionInvalidMP4")
+var ErrPSSH = errors.New("EncryptionInvalidPSSH")
+
+// ContentKey is a key of ISO Common Encryption, which DRM systems know by its
+// key ID.
+type ContentKey struct {
+	KeyID []byte
+	Key   []byte
+	// Protection system specific header boxes, for the DRM systems that
+	// license the key
+	PSSH [][]byte
+}
+
+// ContentKeyProvider hands out the Common Encryption keys of streams.
+type ContentKeyProvider interface {
+	ContentKey(streamID string) (*ContentKey, error)
+}
+
+// StaticKeyProvider hands out the same key for every stream, eg for tests or
+// clear key playback.
+type StaticKeyProvider struct {
+	key *ContentKey
+}
+
+// NewStaticKeyProvider returns a provider of the key.
+func NewStaticKeyProvider(key *ContentKey) *StaticKeyProvider {
+	return &StaticKeyProvider{key: key}
+}
+
+// ContentKey returns the key of the provider, whatever the stream.
+func (p *StaticKeyProvider) ContentKey(streamID string) (*ContentKey, error) {
+	if p.key == nil || len(p.key.KeyID) != KeySize || len(p.key.Key) != KeySize {
+		return nil, ErrKey
+	}
+	return p.key, nil
+}
+
+// PSSH returns a protection system specific header box for the system, with
+// its data. Version 1 boxes list the key IDs they apply to.
+func PSSH(systemID []byte, keyIDs [][]byte, data []byte) ([]byte, error) {
+	if len(systemID) != 16 {
+		return nil, ErrPSSH
+	}
+	var version byte
+	if len(keyIDs) > 0 {
+		version = 1
+	}
+	b := make([]byte, 12, 36+16*len(keyIDs)+len(data))
+	copy(b[4:], "pssh")
+	b[8] = version
+	b = append(b, systemID...)
+	if version == 1 {
+		b = appendUint32(b, uint32(len(keyIDs)))
+		for _, kid := range keyIDs {
+			if len(kid) != KeySize {
+				return nil, ErrPSSH
+			}
+			b = append(b, kid...)
+		}
+	}
+	b = appendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b, nil
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// Whether b is a single pssh box
+func validPSSH(b []byte) bool {
+	return len(b) >= 32 && int(binary.BigEndian.Uint32(b)) == len(b) && string(b[4:8]) == "pssh"
+}
+
+// Box of an MP4 at an offset, with the size of its header
+type box struct {
+	typ       string
+	off, size int
+	hdr       int
+}
+
+// Boxes in b, nil if they don't add up
+func mp4Boxes(b []byte) []box {
+	var boxes []box
+	for off := 0; off < len(b); {
+		if len(b)-off < 8 {
+			return nil
+		}
+		size, hdr := int(binary.BigEndian.Uint32(b[off:])), 8
+		switch size {
+		case 0:
+			size = len(b) - off
+		case 1:
+			if len(b)-off < 16 {
+				return nil
+			}
+			n := binary.BigEndian.Uint64(b[off+8:])
+			if n > uint64(len(b)-off) {
+				return nil
+			}
+			size, hdr = int(n), 16
+		}
+		if size < hdr || size > len(b)-off {
+			return nil
+		}
+		boxes = append(boxes, box{typ: string(b[off+4 : off+8]), off: off, size: size, hdr: hdr})
+		off += size
+	}
+	return boxes
+}
+
+// Calls fn with the body of each box along the path of types in b
+func walkBoxes(b []byte, path []string, fn func(body []byte)) {
+	for _, bx := range mp4Boxes(b) {
+		if bx.typ != path[0] {
+			continue
+		}
+		body := b[bx.off+bx.hdr : bx.off+bx.size]
+		if len(path) == 1 {
+			fn(body)
+		} else {
+			walkBoxes(body, path[1:], fn)
+		}
+	}
+}
+
+// InsertPSSH returns the MP4 in data with the pssh boxes added to its movie
+// box. Offsets into the file past the movie box are moved along, for chunks
+// of progressive files as well as for fragments.
+func InsertPSSH(data []byte, pssh [][]byte) ([]byte, error) {
+	var ext []byte
+	for _, b := range pssh {
+		if !validPSSH(b) {
+			return nil, ErrPSSH
+		}
+		ext = append(ext, b...)
+	}
+	boxes := mp4Boxes(data)
+	moov := -1
+	for i, bx := range boxes {
+		if bx.typ == "moov" {
+			moov = i
+			break
+		}
+	}
+	if moov < 0 {
+		return nil, ErrMP4
+	}
+	if len(ext) == 0 {
+		return data, nil
+	}
+	return insertBytes(data, []box{boxes[moov]}, boxes[moov].off+boxes[moov].size, ext)
+}
+
+// Returns data with ext inserted at pos, growing the boxes of chain that
+// hold it, from the movie box down. Offsets into the file from pos on are
+// moved along, for chunks and sample auxiliary information of progressive
+// files as well as for fragments.
+func insertBytes(data []byte, chain []box, pos int, ext []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)+len(ext))
+	out = append(out, data[:pos]...)
+	out = append(out, ext...)
+	out = append(out, data[pos:]...)
+	delta := uint64(len(ext))
+	for _, bx := range chain {
+		if bx.hdr == 8 {
+			size := uint64(binary.BigEndian.Uint32(out[bx.off:])) + delta
+			if size >= 1<<32 {
+				return nil, ErrMP4
+			}
+			binary.BigEndian.PutUint32(out[bx.off:], uint32(size))
+		} else {
+			binary.BigEndian.PutUint64(out[bx.off+8:], binary.BigEndian.Uint64(out[bx.off+8:])+delta)
+		}
+	}
+
+	m := chain[0]
+	size := int(binary.BigEndian.Uint32(out[m.off:]))
+	if m.hdr != 8 {
+		size = int(binary.BigEndian.Uint64(out[m.off+8:]))
+	}
+	end := uint64(pos)
+	body := out[m.off+m.hdr : m.off+size]
+	walkBoxes(body, []string{"trak", "mdia", "minf", "stbl", "stco"}, func(b []byte) {
+		for i := 8; i+4 <= len(b); i += 4 {
+			if off := uint64(binary.BigEndian.Uint32(b[i:])); off >= end {
+				binary.BigEndian.PutUint32(b[i:], uint32(off+delta))
+			}
+		}
+	})
+	walkBoxes(body, []string{"trak", "mdia", "minf", "stbl", "co64"}, func(b []byte) {
+		for i := 8; i+8 <= len(b); i += 8 {
+			if off := binary.BigEndian.Uint64(b[i:]); off >= end {
+				binary.BigEndian.PutUint64(b[i:], off+delta)
+			}
+		}
+	})
+	walkBoxes(body, []string{"trak", "mdia", "minf", "stbl", "saio"}, func(b []byte) {
+		if len(b) < 4 {
+			return
+		}
+		i := 4
+		if b[3]&0x01 != 0 {
+			i += 8
+		}
+		for i += 4; b[0] == 0 && i+4 <= len(b); i += 4 {
+			if off := uint64(binary.BigEndian.Uint32(b[i:])); off >= end {
+				binary.BigEndian.PutUint32(b[i:], uint32(off+delta))
+			}
+		}
+		for ; b[0] == 1 && i+8 <= len(b); i += 8 {
+			if off := binary.BigEndian.Uint64(b[i:]); off >= end {
+				binary.BigEndian.PutUint64(b[i:], off+delta)
+			}
+		}
+	})
+	rest := out[m.off+size:]
+	walkBoxes(rest, []string{"moof", "traf", "tfhd"}, func(b []byte) {
+		// explicit base data offset
+		if len(b) >= 16 && b[3]&1 != 0 {
+			if off := binary.BigEndian.Uint64(b[8:]); off >= end {
+				binary.BigEndian.PutUint64(b[8:], off+delta)
+			}
+		}
+	})
+	walkBoxes(rest, []string{"mfra", "tfra"}, func(b []byte) {
+		if len(b) < 16 {
+			return
+		}
+		v1 := b[0] == 1
+		sizes := binary.BigEndian.Uint32(b[8:])
+		n := int(binary.BigEndian.Uint32(b[12:]))
+		entry := 8 + int(sizes>>4&3+1) + int(sizes>>2&3+1) + int(sizes&3+1)
+		if v1 {
+			entry += 8
+		}
+		for i, off := 0, 16; i < n && off+entry <= len(b); i, off = i+1, off+entry {
+			if v1 {
+				if o := binary.BigEndian.Uint64(b[off+8:]); o >= end {
+					binary.BigEndian.PutUint64(b[off+8:], o+delta)
+				}
+			} else if o := uint64(binary.BigEndian.Uint32(b[off+4:])); o >= end {
+				binary.BigEndian.PutUint32(b[off+4:], uint32(o+delta))
+			}
+		}
+	})
+	return out, nil
+}
@@ -0,0 +1,158 @@
+// Package encryption protects HLS segments for premium content, either by
+// encrypting whole segments with AES-128 or their samples with SAMPLE-AES.
+//
+// Keys come from a KeyProvider, which players fetch them from through the
+// URI of the key:
+//
+//	keys := encryption.NewLocalKeyProvider("/keys/")
+//	key, err := keys.Key(streamID, 0)
+//	data, err = encryption.Encrypt(encryption.AES128, data, key.Key, encryption.SequenceIV(seqNo))
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+var ErrMethod = errors.New("EncryptionInvalidMethod")
+var ErrKey = errors.New("EncryptionInvalidKey")
+
+// KeySize is the size of AES-128 keys and IVs
+const KeySize = 16
+
+// Method is how segments are encrypted, named like the METHOD of EXT-X-KEY.
+type Method string
+
+const (
+	// AES128 encrypts whole segments with AES-128 in CBC mode
+	AES128 Method = "AES-128"
+	// SampleAES encrypts the samples of H.264 video and AAC audio in MPEG-TS
+	// segments, leaving the container in the clear
+	SampleAES Method = "SAMPLE-AES"
+)
+
+// Key is a content key, along with the URI players fetch it from.
+type Key struct {
+	URI string
+	Key []byte
+}
+
+// KeyProvider hands out the keys of streams. Streams rotate their keys
+// periodically; period counts the rotations since the stream started.
+type KeyProvider interface {
+	Key(streamID string, period uint64) (*Key, error)
+	// Expire is called once the periods of the stream before period have
+	// left its playlist, so their keys are no longer needed.
+	Expire(streamID string, period uint64)
+}
+
+// LocalKeyProvider makes random keys and keeps them to be served locally,
+// eg by vidplayer.HandleHLSKeys.
+type LocalKeyProvider struct {
+	baseURI string
+	mu      sync.Mutex
+	keys    map[string]*Key // by URI path
+	// URI paths of the keys of each stream, by period
+	periods map[string]map[uint64]string
+}
+
+// NewLocalKeyProvider returns a provider with keys under baseURI.
+func NewLocalKeyProvider(baseURI string) *LocalKeyProvider {
+	return &LocalKeyProvider{baseURI: baseURI, keys: map[string]*Key{}, periods: map[string]map[uint64]string{}}
+}
+
+// Key returns the key of the stream for the period, making one if needed.
+func (p *LocalKeyProvider) Key(streamID string, period uint64) (*Key, error) {
+	uri := fmt.Sprintf("%s%s/%d.key", p.baseURI, url.PathEscape(streamID), period)
+	path, err := keyPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[path]; ok {
+		return key, nil
+	}
+	key := &Key{URI: uri, Key: make([]byte, KeySize)}
+	if _, err := rand.Read(key.Key); err != nil {
+		return nil, err
+	}
+	p.keys[path] = key
+	if p.periods[streamID] == nil {
+		p.periods[streamID] = map[uint64]string{}
+	}
+	p.periods[streamID][period] = path
+	return key, nil
+}
+
+// Expire drops the keys of the stream for the periods before period, which
+// are no longer served.
+func (p *LocalKeyProvider) Expire(streamID string, period uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for n, path := range p.periods[streamID] {
+		if n < period {
+			delete(p.keys, path)
+			delete(p.periods[streamID], n)
+		}
+	}
+	if len(p.periods[streamID]) == 0 {
+		delete(p.periods, streamID)
+	}
+}
+
+// Lookup returns the key served at the path of its URI, nil if there is
+// none.
+func (p *LocalKeyProvider) Lookup(path string) *Key {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keys[path]
+}
+
+func keyPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+// SequenceIV returns the IV of the segment with the media sequence number,
+// which players also use when EXT-X-KEY has no IV.
+func SequenceIV(seqNo uint64) []byte {
+	iv := make([]byte, KeySize)
+	binary.BigEndian.PutUint64(iv[8:], seqNo)
+	return iv
+}
+
+// Encrypt returns the segment in data encrypted with the method.
+func Encrypt(method Method, data, key, iv []byte) ([]byte, error) {
+	if len(key) != KeySize || len(iv) != KeySize {
+		return nil, ErrKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case AES128:
+		// padded as PKCS7
+		n := KeySize - len(data)%KeySize
+		out := make([]byte, len(data)+n)
+		copy(out, data)
+		for i := len(data); i < len(out); i++ {
+			out[i] = byte(n)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+		return out, nil
+	case SampleAES:
+		return encryptSamples(data, block, iv)
+	}
+	return nil, ErrMethod
+}
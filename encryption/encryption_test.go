@@ -0,0 +1,498 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/livepeer/lpms/internal/mpegts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func TestEncrypt_AES128(t *testing.T) {
+	iv := SequenceIV(7)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}, iv)
+	block, err := aes.NewCipher(testKey)
+	require.NoError(t, err)
+	for _, n := range []int{0, 1, 15, 16, 188 * 3} {
+		data := bytes.Repeat([]byte{0x47}, n)
+		out, err := Encrypt(AES128, data, testKey, iv)
+		require.NoError(t, err)
+		// padded up to the next block, a whole one if the data fills its last
+		require.Equal(t, n/16*16+16, len(out))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, out)
+		pad := int(out[len(out)-1])
+		assert.Equal(t, bytes.Repeat([]byte{byte(pad)}, pad), out[len(out)-pad:])
+		assert.Equal(t, data, out[:len(out)-pad])
+	}
+
+	_, err = Encrypt(AES128, nil, testKey[:15], iv)
+	assert.Equal(t, ErrKey, err)
+	_, err = Encrypt(AES128, nil, testKey, iv[:8])
+	assert.Equal(t, ErrKey, err)
+	_, err = Encrypt("NONE", nil, testKey, iv)
+	assert.Equal(t, ErrMethod, err)
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	keys := NewLocalKeyProvider("https://example.com/keys/")
+	key, err := keys.Key("stream a", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/keys/stream%20a/0.key", key.URI)
+	assert.Len(t, key.Key, KeySize)
+	same, err := keys.Key("stream a", 0)
+	require.NoError(t, err)
+	assert.Equal(t, key, same)
+	next, err := keys.Key("stream a", 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, key.Key, next.Key)
+
+	assert.Equal(t, key, keys.Lookup("/keys/stream a/0.key"))
+	assert.Equal(t, next, keys.Lookup("/keys/stream a/1.key"))
+	assert.Nil(t, keys.Lookup("/keys/stream a/2.key"))
+
+	// keys of periods that left the playlist are dropped, for that stream only
+	other, err := keys.Key("stream b", 0)
+	require.NoError(t, err)
+	keys.Expire("stream a", 1)
+	assert.Nil(t, keys.Lookup("/keys/stream a/0.key"))
+	assert.Equal(t, next, keys.Lookup("/keys/stream a/1.key"))
+	assert.Equal(t, other, keys.Lookup("/keys/stream b/0.key"))
+	keys.Expire("stream a", 2)
+	assert.Nil(t, keys.Lookup("/keys/stream a/1.key"))
+	assert.Empty(t, keys.periods["stream a"])
+}
+
+func TestEscape(t *testing.T) {
+	raw := []byte{0x65, 0, 0, 0, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4, 0}
+	escaped := escape(raw)
+	assert.Equal(t, []byte{0x65, 0, 0, 3, 0, 0, 3, 0, 1, 0, 0, 3, 2, 0, 0, 3, 3, 0, 0, 4, 0}, escaped)
+	assert.Equal(t, -1, startCode(escaped))
+	assert.Equal(t, raw, unescape(escaped))
+}
+
+// Elementary stream data of each PES packet on pid
+func esData(t *testing.T, pkts []*packet, pid uint16) [][]byte {
+	var es [][]byte
+	for _, unit := range pesUnits(pkts, pid) {
+		data, hdr := pesData(pkts, unit)
+		require.NotNil(t, data)
+		if n := int(data[4])<<8 | int(data[5]); n > 0 {
+			require.Equal(t, len(data)-6, n)
+		}
+		es = append(es, data[hdr:])
+	}
+	return es
+}
+
+func TestEncrypt_SampleAES(t *testing.T) {
+	data, err := ioutil.ReadFile("../data/bad-cuvid.ts")
+	require.NoError(t, err)
+	out, err := Encrypt(SampleAES, data, testKey, SequenceIV(1))
+	require.NoError(t, err)
+
+	in, err := splitPackets(data)
+	require.NoError(t, err)
+	pkts, err := splitPackets(out)
+	require.NoError(t, err)
+	pmtPID, ok := findPMT(pkts)
+	require.True(t, ok)
+	var streams []mpegts.Stream
+	for _, p := range pkts {
+		if mpegts.PID(p.b) == pmtPID {
+			sec := mpegts.Section(p.b)
+			require.NotNil(t, sec)
+			assert.Equal(t, uint32(0), mpegts.CRC32(sec))
+			streams = mpegts.Streams(sec)
+		}
+	}
+	require.Len(t, streams, 2)
+	var videoPID, audioPID uint16
+	for _, es := range streams {
+		switch es.Type {
+		case streamTypeSampleAESH264:
+			videoPID = es.PID
+			assert.Contains(t, string(es.Info), "zavc")
+		case streamTypeSampleAESAAC:
+			audioPID = es.PID
+			assert.Contains(t, string(es.Info), "aacd")
+			// AAC-LC at 48kHz in stereo
+			assert.Contains(t, string(es.Info), "apadzaac\x00\x00\x01\x02\x11\x90")
+		}
+	}
+	require.NotZero(t, videoPID)
+	require.NotZero(t, audioPID)
+
+	// continuity counters still count
+	cc := map[uint16]byte{}
+	for _, p := range pkts {
+		if last, ok := cc[mpegts.PID(p.b)]; ok && p.b[3]&0x10 != 0 {
+			assert.Equal(t, (last+1)&0x0f, p.b[3]&0x0f)
+		}
+		if p.b[3]&0x10 != 0 {
+			cc[mpegts.PID(p.b)] = p.b[3] & 0x0f
+		}
+	}
+
+	// samples decrypt back to the input, their headers left in the clear
+	block, err := aes.NewCipher(testKey)
+	require.NoError(t, err)
+	video, audio := esData(t, in, videoPID), esData(t, in, audioPID)
+	encVideo, encAudio := esData(t, pkts, videoPID), esData(t, pkts, audioPID)
+	require.Len(t, encVideo, len(video))
+	require.Len(t, encAudio, len(audio))
+	changed := 0
+	for i := range video {
+		if !bytes.Equal(video[i], encVideo[i]) {
+			changed++
+		}
+		assert.Equal(t, video[i], cryptH264(encVideo[i], block, SequenceIV(1), false))
+	}
+	assert.Equal(t, len(video), changed)
+	changed = 0
+	for i := range audio {
+		assert.Equal(t, len(audio[i]), len(encAudio[i]))
+		assert.Equal(t, audio[i][:7+aacLeader], encAudio[i][:7+aacLeader])
+		if !bytes.Equal(audio[i], encAudio[i]) {
+			changed++
+		}
+		cryptAAC(encAudio[i], block, SequenceIV(1), false)
+		assert.Equal(t, audio[i], encAudio[i])
+	}
+	assert.Equal(t, len(audio), changed)
+}
+
+func TestEncrypt_SampleAESUnsupported(t *testing.T) {
+	data, err := ioutil.ReadFile("../data/bad-cuvid.ts")
+	require.NoError(t, err)
+	_, err = Encrypt(SampleAES, data[:100], testKey, SequenceIV(1))
+	assert.Equal(t, ErrInvalidTS, err)
+
+	// HEVC has no sample encryption format
+	pkts, err := splitPackets(data)
+	require.NoError(t, err)
+	pmtPID, _ := findPMT(pkts)
+	var hevc []byte
+	for _, p := range pkts {
+		if mpegts.PID(p.b) == pmtPID {
+			sec := mpegts.Section(p.b)
+			n := 12 + (int(sec[10]&0x0f)<<8 | int(sec[11]))
+			sec[n] = 0x24
+			crc := mpegts.CRC32(sec[:len(sec)-4])
+			sec[len(sec)-4], sec[len(sec)-3], sec[len(sec)-2], sec[len(sec)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		}
+		hevc = append(hevc, p.b...)
+	}
+	_, err = Encrypt(SampleAES, hevc, testKey, SequenceIV(1))
+	assert.Equal(t, ErrUnsupported, err)
+}
+
+func mp4Box(typ string, body ...[]byte) []byte {
+	b := append([]byte{0, 0, 0, 0}, typ...)
+	for _, c := range body {
+		b = append(b, c...)
+	}
+	b[0], b[1], b[2], b[3] = byte(len(b)>>24), byte(len(b)>>16), byte(len(b)>>8), byte(len(b))
+	return b
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	key := &ContentKey{KeyID: []byte("fedcba9876543210"), Key: testKey}
+	got, err := NewStaticKeyProvider(key).ContentKey("any")
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+	_, err = NewStaticKeyProvider(&ContentKey{KeyID: key.KeyID}).ContentKey("any")
+	assert.Equal(t, ErrKey, err)
+}
+
+func TestInsertPSSH(t *testing.T) {
+	systemID := bytes.Repeat([]byte{0xed}, 16)
+	kid := []byte("fedcba9876543210")
+	pssh, err := PSSH(systemID, [][]byte{kid}, []byte("data"))
+	require.NoError(t, err)
+	assert.Equal(t, mp4Box("pssh", []byte{1, 0, 0, 0}, systemID, []byte{0, 0, 0, 1}, kid, []byte{0, 0, 0, 4}, []byte("data")), pssh)
+	v0, err := PSSH(systemID, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, v0, 32)
+	_, err = PSSH(systemID[:8], nil, nil)
+	assert.Equal(t, ErrPSSH, err)
+
+	// chunks after the movie box move along, those before it stay
+	ftyp := mp4Box("ftyp", []byte("isom"))
+	before := mp4Box("mdat", []byte("before"))
+	stco := func(offs ...uint32) []byte {
+		b := []byte{0, 0, 0, 0, 0, 0, 0, byte(len(offs))}
+		for _, o := range offs {
+			b = appendUint32(b, o)
+		}
+		return mp4Box("stco", b)
+	}
+	moovLen := len(mp4Box("moov", mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", stco(0, 0)))))))
+	first := uint32(len(ftyp) + 8)
+	after := uint32(len(ftyp) + len(before) + moovLen + 8)
+	moov := mp4Box("moov", mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", stco(first, after))))))
+	data := bytes.Join([][]byte{ftyp, before, moov, mp4Box("mdat", []byte("after"))}, nil)
+	out, err := InsertPSSH(data, [][]byte{pssh, v0})
+	require.NoError(t, err)
+	require.Len(t, out, len(data)+len(pssh)+len(v0))
+	boxes := mp4Boxes(out)
+	require.Len(t, boxes, 4)
+	assert.Equal(t, "moov", boxes[2].typ)
+	assert.Equal(t, len(moov)+len(pssh)+len(v0), boxes[2].size)
+	var offs []uint32
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "stco"}, func(b []byte) {
+		offs = append(offs, binary.BigEndian.Uint32(b[8:]), binary.BigEndian.Uint32(b[12:]))
+	})
+	assert.Equal(t, "before", string(out[offs[0]:offs[0]+6]))
+	assert.Equal(t, "after", string(out[offs[1]:offs[1]+5]))
+	var found [][]byte
+	walkBoxes(out, []string{"moov", "pssh"}, func(b []byte) { found = append(found, b) })
+	assert.Equal(t, [][]byte{pssh[8:], v0[8:]}, found)
+
+	// fragments with explicit base offsets move along too
+	tfhd := mp4Box("tfhd", []byte{0, 0, 0, 1, 0, 0, 0, 1}, make([]byte, 8))
+	moof := mp4Box("moof", mp4Box("traf", tfhd))
+	base := uint64(len(ftyp) + len(moov) + len(moof) + 8)
+	binary.BigEndian.PutUint64(moof[len(moof)-8:], base)
+	data = bytes.Join([][]byte{ftyp, moov, moof, mp4Box("mdat", []byte("sample"))}, nil)
+	out, err = InsertPSSH(data, [][]byte{pssh})
+	require.NoError(t, err)
+	walkBoxes(out, []string{"moof", "traf", "tfhd"}, func(b []byte) {
+		base = binary.BigEndian.Uint64(b[8:])
+	})
+	assert.Equal(t, "sample", string(out[base:base+6]))
+
+	// fragments based on their own box stay as they are
+	data, err = ioutil.ReadFile("../data/videotest.mp4")
+	require.NoError(t, err)
+	out, err = InsertPSSH(data, [][]byte{pssh})
+	require.NoError(t, err)
+	moovEnd := mp4Boxes(data)[1].off + mp4Boxes(data)[1].size
+	n := len(data) - moovEnd
+	assert.Equal(t, data[len(data)-n:], out[len(out)-n:])
+
+	_, err = InsertPSSH(data, [][]byte{pssh[:20]})
+	assert.Equal(t, ErrPSSH, err)
+	_, err = InsertPSSH(data[:20], [][]byte{pssh})
+	assert.Equal(t, ErrMP4, err)
+}
+
+// Samples of a test track, encrypted with cenc as the mov muxer does
+type cencSamples struct {
+	video   bool
+	clear   [][]byte
+	samples [][]byte
+	// senc entries, with 8 byte IVs
+	entries [][]byte
+	// protected ranges of each sample
+	ranges [][][2]int
+}
+
+func newCENCSamples(t *testing.T, video bool, sizes ...[]int) *cencSamples {
+	block, err := aes.NewCipher(testKey)
+	require.NoError(t, err)
+	s := &cencSamples{video: video}
+	for i, nals := range sizes {
+		var sample, entry []byte
+		var ranges [][2]int
+		iv := []byte{0, 0, 0, 0, 0, 0, 1, byte(i)}
+		entry = append(entry, iv...)
+		if video {
+			// NAL units, their length and header in the clear
+			entry = append(entry, 0, byte(len(nals)))
+			for _, n := range nals {
+				ranges = append(ranges, [2]int{len(sample) + 5, len(sample) + 5 + n})
+				sample = append(sample, 0, 0, byte((n+1)>>8), byte(n+1), 0x65)
+				for j := 0; j < n; j++ {
+					sample = append(sample, byte(i+j))
+				}
+				entry = append(entry, 0, 5, 0, 0, byte(n>>8), byte(n))
+			}
+		} else {
+			for j := 0; j < nals[0]; j++ {
+				sample = append(sample, byte(i*j))
+			}
+			ranges = append(ranges, [2]int{0, len(sample)})
+		}
+		clear := append([]byte{}, sample...)
+		stream := cipher.NewCTR(block, append(iv, make([]byte, 8)...))
+		for _, r := range ranges {
+			stream.XORKeyStream(sample[r[0]:r[1]], sample[r[0]:r[1]])
+		}
+		s.clear = append(s.clear, clear)
+		s.samples = append(s.samples, sample)
+		s.entries = append(s.entries, entry)
+		s.ranges = append(s.ranges, ranges)
+	}
+	return s
+}
+
+func (s *cencSamples) sampleEntry() []byte {
+	tenc := mp4Box("tenc", []byte{0, 0, 0, 0, 0, 0, 1, 8}, []byte("fedcba9876543210"))
+	sinf := mp4Box("sinf", mp4Box("frma", []byte("avc1")), mp4Box("schm", []byte{0, 0, 0, 0}, []byte("cenc"), []byte{0, 1, 0, 0}), mp4Box("schi", tenc))
+	if s.video {
+		return mp4Box("encv", make([]byte, 78), sinf)
+	}
+	return mp4Box("enca", make([]byte, 28), sinf)
+}
+
+// senc, saiz and saio boxes, with the auxiliary information at off
+func (s *cencSamples) auxBoxes(off int) []byte {
+	senc := mp4Box("senc", []byte{0, 0, 0, 0}, appendUint32(nil, uint32(len(s.entries))), bytes.Join(s.entries, nil))
+	saiz := []byte{0, 0, 0, 0, 8}
+	if s.video {
+		senc[11] = 2
+		saiz[4] = 0
+	}
+	saiz = appendUint32(saiz, uint32(len(s.entries)))
+	if s.video {
+		for _, e := range s.entries {
+			saiz = append(saiz, byte(len(e)))
+		}
+	}
+	return bytes.Join([][]byte{senc, mp4Box("saiz", saiz), mp4Box("saio", []byte{0, 0, 0, 0, 0, 0, 0, 1}, appendUint32(nil, uint32(off)))}, nil)
+}
+
+func (s *cencSamples) size() int {
+	return len(bytes.Join(s.samples, nil))
+}
+
+// Checks the samples in data decrypt with the cbcs scheme of the track
+func (s *cencSamples) check(t *testing.T, data []byte, iv []byte) {
+	block, err := aes.NewCipher(testKey)
+	require.NoError(t, err)
+	for i, sample := range s.samples {
+		b := append([]byte{}, data[:len(sample)]...)
+		data = data[len(sample):]
+		assert.NotEqual(t, s.clear[i], b)
+		for _, r := range s.ranges[i] {
+			cbc := cipher.NewCBCDecrypter(block, iv)
+			for j := r[0]; j+16 <= r[1]; j += 16 {
+				if !s.video || (j-r[0])%160 == 0 {
+					cbc.CryptBlocks(b[j:j+16], b[j:j+16])
+				}
+			}
+		}
+		assert.Equal(t, s.clear[i], b, "sample %d", i)
+	}
+}
+
+func TestReencryptCBCS(t *testing.T) {
+	video := newCENCSamples(t, true, []int{80}, []int{150, 331})
+	audio := newCENCSamples(t, false, []int{37}, []int{64})
+	iv := []byte("constant iv 0123")
+	ftyp := mp4Box("ftyp", []byte("isom"))
+	tkhd := func(id byte) []byte { return mp4Box("tkhd", make([]byte, 15), []byte{id}, make([]byte, 68)) }
+	// table of the samples of the track, all in one chunk at off
+	stbl := func(s *cencSamples, off, aux int, moof bool) []byte {
+		if moof {
+			return mp4Box("stbl", mp4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, s.sampleEntry()),
+				mp4Box("stsz", make([]byte, 12)), mp4Box("stsc", make([]byte, 8)), mp4Box("stco", make([]byte, 8)))
+		}
+		stsz := appendUint32(make([]byte, 8), uint32(len(s.samples)))
+		for _, sample := range s.samples {
+			stsz = appendUint32(stsz, uint32(len(sample)))
+		}
+		return mp4Box("stbl", mp4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, s.sampleEntry()), mp4Box("stsz", stsz),
+			mp4Box("stsc", []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, appendUint32(nil, uint32(len(s.samples))), []byte{0, 0, 0, 1}),
+			mp4Box("stco", []byte{0, 0, 0, 0, 0, 0, 0, 1}, appendUint32(nil, uint32(off))), s.auxBoxes(aux))
+	}
+	trak := func(id byte, s *cencSamples, off, aux int, moof bool) []byte {
+		return mp4Box("trak", tkhd(id), mp4Box("mdia", mp4Box("minf", stbl(s, off, aux, moof))))
+	}
+	// offset of the auxiliary information in the senc box of the stbl
+	auxOff := func(moov []byte, s *cencSamples) int {
+		return bytes.Index(moov, bytes.Join(s.entries, nil))
+	}
+
+	// progressive, with the movie box ahead of the samples
+	moov := mp4Box("moov", trak(1, video, 0, 0, false), trak(2, audio, 0, 0, false))
+	mdat := len(ftyp) + len(moov) + 8
+	moov = mp4Box("moov", trak(1, video, mdat, len(ftyp)+auxOff(moov, video), false),
+		trak(2, audio, mdat+video.size(), len(ftyp)+auxOff(moov, audio), false))
+	data := bytes.Join([][]byte{ftyp, moov, mp4Box("mdat", bytes.Join(video.samples, nil), bytes.Join(audio.samples, nil))}, nil)
+	out, err := ReencryptCBCS(data, testKey, iv)
+	require.NoError(t, err)
+	require.Len(t, out, len(data)+2*(1+KeySize))
+	var tencs [][]byte
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "stsd"}, func(b []byte) {
+		for _, entry := range mp4Boxes(b[8:]) {
+			skip := map[string]int{"encv": 78, "enca": 28}[entry.typ]
+			entry := b[8+entry.off+entry.hdr+skip : 8+entry.off+entry.size]
+			walkBoxes(entry, []string{"sinf", "schm"}, func(b []byte) { assert.Equal(t, "cbcs", string(b[4:8])) })
+			walkBoxes(entry, []string{"sinf", "schi", "tenc"}, func(b []byte) { tencs = append(tencs, b) })
+		}
+	})
+	tenc := func(pattern byte) []byte {
+		return bytes.Join([][]byte{{1, 0, 0, 0, 0, pattern, 1, 0}, []byte("fedcba9876543210"), {KeySize}, iv}, nil)
+	}
+	assert.Equal(t, [][]byte{tenc(0x19), tenc(0)}, tencs)
+	var offs, saio []int
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "stco"}, func(b []byte) {
+		offs = append(offs, int(binary.BigEndian.Uint32(b[8:])))
+	})
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "saio"}, func(b []byte) {
+		saio = append(saio, int(binary.BigEndian.Uint32(b[8:])))
+	})
+	var sencs, saizs [][]byte
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "senc"}, func(b []byte) { sencs = append(sencs, b) })
+	walkBoxes(out, []string{"moov", "trak", "mdia", "minf", "stbl", "saiz"}, func(b []byte) { saizs = append(saizs, b) })
+	// video keeps its subsamples, audio has no auxiliary information left
+	require.Len(t, sencs, 2)
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 2, 0, 1, 0, 5, 0, 0, 0, 80, 0, 2, 0, 5, 0, 0, 0, 150, 0, 5, 0, 0, 1, 75}, sencs[0])
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, sencs[1])
+	assert.Equal(t, [][]byte{{0, 0, 0, 0, 0, 0, 0, 0, 2, 8, 14}}, saizs)
+	require.Len(t, saio, 1)
+	assert.Equal(t, sencs[0][8:], out[saio[0]:saio[0]+len(sencs[0])-8])
+	require.Len(t, offs, 2)
+	video.check(t, out[offs[0]:], iv)
+	audio.check(t, out[offs[1]:], iv)
+	assert.Equal(t, out[offs[0]:], out[len(out)-video.size()-audio.size():])
+
+	// fragmented, with the samples after the track fragments
+	trex := func(id byte) []byte { return mp4Box("trex", []byte{0, 0, 0, 0, 0, 0, 0, id}, make([]byte, 16)) }
+	moov = mp4Box("moov", trak(1, video, 0, 0, true), trak(2, audio, 0, 0, true), mp4Box("mvex", trex(1), trex(2)))
+	traf := func(id byte, s *cencSamples, dataOff, aux int) []byte {
+		trun := appendUint32([]byte{0, 0, 2, 1}, uint32(len(s.samples)))
+		trun = appendUint32(trun, uint32(dataOff))
+		for _, sample := range s.samples {
+			trun = appendUint32(trun, uint32(len(sample)))
+		}
+		return mp4Box("traf", mp4Box("tfhd", []byte{0, 2, 0, 0, 0, 0, 0, id}), mp4Box("trun", trun), s.auxBoxes(aux))
+	}
+	moof := mp4Box("moof", mp4Box("mfhd", make([]byte, 8)), traf(1, video, 0, 0), traf(2, audio, 0, 0))
+	moof = mp4Box("moof", mp4Box("mfhd", make([]byte, 8)), traf(1, video, len(moof)+8, auxOff(moof, video)),
+		traf(2, audio, len(moof)+8+video.size(), auxOff(moof, audio)))
+	data = bytes.Join([][]byte{ftyp, moov, moof, mp4Box("mdat", bytes.Join(video.samples, nil), bytes.Join(audio.samples, nil))}, nil)
+	out, err = ReencryptCBCS(data, testKey, iv)
+	require.NoError(t, err)
+	require.Len(t, out, len(data)+2*(1+KeySize))
+	boxes := mp4Boxes(out)
+	require.Len(t, boxes, 4)
+	sencs = nil
+	walkBoxes(out, []string{"moof", "traf", "senc"}, func(b []byte) { sencs = append(sencs, b) })
+	require.Len(t, sencs, 2)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, sencs[1])
+	var frees int
+	walkBoxes(out, []string{"moof", "traf", "free"}, func(b []byte) { frees++ })
+	assert.Equal(t, 4, frees)
+	// moof-relative offsets are left alone
+	mdatBody := out[boxes[3].off+8:]
+	video.check(t, mdatBody, iv)
+	audio.check(t, mdatBody[video.size():], iv)
+	assert.Equal(t, out[boxes[2].off+auxOff(moof, video):][:len(sencs[0])-8], sencs[0][8:])
+
+	// only what the mov muxer writes
+	_, err = ReencryptCBCS(out, testKey, iv)
+	assert.Equal(t, ErrMP4, err)
+	_, err = ReencryptCBCS(data[:20], testKey, iv)
+	assert.Equal(t, ErrMP4, err)
+	_, err = ReencryptCBCS(data, testKey[:8], iv)
+	assert.Equal(t, ErrKey, err)
+}
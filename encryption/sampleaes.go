@@ -0,0 +1,404 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"errors"
+
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+var ErrInvalidTS = errors.New("EncryptionInvalidTS")
+var ErrUnsupported = errors.New("EncryptionUnsupportedStream")
+
+const (
+	packetSize = mpegts.PacketSize
+	syncByte   = mpegts.SyncByte
+
+	// Stream types of the PMT, in the clear and encrypted
+	streamTypeH264          = 0x1b
+	streamTypeAAC           = 0x0f
+	streamTypeSampleAESH264 = 0xdb
+	streamTypeSampleAESAAC  = 0xcf
+
+	// Bytes of a NAL unit left in the clear ahead of the encrypted blocks,
+	// and between them
+	nalLeader  = 32
+	nalSkipped = 144
+	// Bytes of an AAC frame left in the clear after its ADTS header
+	aacLeader = 16
+)
+
+// Audio and video stream types SAMPLE-AES has no format for. Segments with
+// them aren't encrypted rather than leaving part of the content clear.
+var unsupportedStreams = map[byte]bool{
+	0x01: true, 0x02: true, // MPEG-1/2 video
+	0x03: true, 0x04: true, // MPEG audio
+	0x10: true, // MPEG-4 video
+	0x11: true, // AAC in LATM
+	0x24: true, // HEVC
+	0x81: true, // AC-3
+	0x87: true, // E-AC-3
+}
+
+type packet struct {
+	b []byte
+}
+
+// Builds a packet carrying the adaptation field af, without stuffing, and as
+// much of payload as fits. Returns the packet and the payload bytes it holds.
+func newPacket(pid uint16, start bool, af, payload []byte) (*packet, int) {
+	b, n := mpegts.NewPacket(pid, start, af, payload)
+	return &packet{b: b}, n
+}
+
+// Packet like p, carrying the section instead
+func sectionPacket(p *packet, sec []byte) *packet {
+	b := make([]byte, packetSize)
+	copy(b, p.b[:4])
+	b[3] = b[3]&0xcf | 0x10 // payload only
+	n := copy(b[5:], sec)
+	for i := 5 + n; i < packetSize; i++ {
+		b[i] = 0xff
+	}
+	return &packet{b: b}
+}
+
+func splitPackets(data []byte) ([]*packet, error) {
+	if len(data) == 0 || len(data)%packetSize != 0 {
+		return nil, ErrInvalidTS
+	}
+	pkts := make([]*packet, 0, len(data)/packetSize)
+	for i := 0; i < len(data); i += packetSize {
+		if data[i] != syncByte {
+			return nil, ErrInvalidTS
+		}
+		b := make([]byte, packetSize)
+		copy(b, data[i:])
+		pkts = append(pkts, &packet{b: b})
+	}
+	return pkts, nil
+}
+
+// PID of the PMT, from the first PAT of the packets
+func findPMT(pkts []*packet) (uint16, bool) {
+	for _, p := range pkts {
+		sec := mpegts.Section(p.b)
+		if mpegts.PID(p.b) != tsio.PAT_PID || len(sec) < 12 || sec[0] != tsio.TableIdPAT {
+			continue
+		}
+		var pat tsio.PAT
+		if _, err := pat.Unmarshal(sec[8 : len(sec)-4]); err != nil {
+			continue
+		}
+		for _, e := range pat.Entries {
+			if e.ProgramNumber != 0 {
+				return e.ProgramMapPID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// PMT section with the encrypted streams signalled, as the HLS sample
+// encryption format has it: their stream types changed, and descriptors
+// telling the format of the encrypted samples.
+func encryptedPMT(sec []byte, audioConfig []byte) []byte {
+	streams := mpegts.Streams(sec)
+	for i, s := range streams {
+		info := append([]byte{}, s.Info...)
+		switch s.Type {
+		case streamTypeH264:
+			s.Type = streamTypeSampleAESH264
+			info = append(info, 0x0f, 4, 'z', 'a', 'v', 'c') // private_data_indicator
+		case streamTypeAAC:
+			s.Type = streamTypeSampleAESAAC
+			info = append(info, 0x0f, 4, 'a', 'a', 'c', 'd')
+			// registration with the audio_setup_information
+			info = append(info, 0x05, byte(12+len(audioConfig)), 'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0, 0, 1, byte(len(audioConfig)))
+			info = append(info, audioConfig...)
+		}
+		s.Info = info
+		streams[i] = s
+	}
+	return mpegts.NewPMT(sec, mpegts.ProgramInfo(sec), streams)
+}
+
+// Packets of each PES packet of the stream on pid, by index
+func pesUnits(pkts []*packet, pid uint16) [][]int {
+	var units [][]int
+	for i, p := range pkts {
+		if mpegts.PID(p.b) != pid {
+			continue
+		}
+		if mpegts.Start(p.b) {
+			units = append(units, []int{i})
+		} else if len(units) > 0 {
+			units[len(units)-1] = append(units[len(units)-1], i)
+		}
+	}
+	return units
+}
+
+// Elementary stream data of a PES packet, with the length of its header
+func pesData(pkts []*packet, unit []int) ([]byte, int) {
+	var data []byte
+	for _, i := range unit {
+		data = append(data, mpegts.Payload(pkts[i].b)...)
+	}
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 || 9+int(data[8]) > len(data) {
+		return nil, 0
+	}
+	return data, 9 + int(data[8])
+}
+
+// AudioSpecificConfig of the first ADTS header of the stream
+func audioConfig(pkts []*packet, pid uint16) []byte {
+	for _, unit := range pesUnits(pkts, pid) {
+		data, hdr := pesData(pkts, unit)
+		if b := data[hdr:]; len(b) >= 7 && b[0] == 0xff && b[1]&0xf0 == 0xf0 {
+			object := b[2]>>6 + 1
+			freq := b[2] >> 2 & 0x0f
+			channels := b[2]&1<<2 | b[3]>>6
+			return []byte{object<<3 | freq>>1, freq<<7 | channels<<3}
+		}
+	}
+	return nil
+}
+
+// Encrypts or decrypts the samples of the ADTS frames in es in place
+func cryptAAC(es []byte, block cipher.Block, iv []byte, encrypt bool) {
+	for len(es) >= 7 && es[0] == 0xff && es[1]&0xf0 == 0xf0 {
+		hdr := 7
+		if es[1]&1 == 0 { // CRC
+			hdr = 9
+		}
+		n := int(es[3]&3)<<11 | int(es[4])<<3 | int(es[5]>>5)
+		if n < hdr || n > len(es) {
+			return
+		}
+		if blocks := (n - hdr - aacLeader) / block.BlockSize(); blocks > 0 {
+			b := es[hdr+aacLeader : hdr+aacLeader+blocks*block.BlockSize()]
+			newCBC(block, iv, encrypt).CryptBlocks(b, b)
+		}
+		es = es[n:]
+	}
+}
+
+// Encrypts or decrypts the samples of the slices in the Annex B data es,
+// returning the data with emulation prevention redone
+func cryptH264(es []byte, block cipher.Block, iv []byte, encrypt bool) []byte {
+	out := make([]byte, 0, len(es)+len(es)/64)
+	for len(es) > 0 {
+		start := startCode(es)
+		if start < 0 {
+			return append(out, es...)
+		}
+		out = append(out, es[:start+3]...)
+		es = es[start+3:]
+		end := startCode(es)
+		if end < 0 {
+			end = len(es)
+		}
+		for end > 0 && es[end-1] == 0 { // zeros of the next start code
+			end--
+		}
+		nal := es[:end]
+		es = es[end:]
+		if len(nal) == 0 || nal[0]&0x1f != 1 && nal[0]&0x1f != 5 {
+			out = append(out, nal...)
+			continue
+		}
+		raw := unescape(nal)
+		if len(raw) <= 48 {
+			out = append(out, nal...)
+			continue
+		}
+		mode := newCBC(block, iv, encrypt)
+		bs := block.BlockSize()
+		for b := raw[nalLeader:]; len(b) > bs; {
+			mode.CryptBlocks(b[:bs], b[:bs])
+			b = b[bs:]
+			if len(b) > nalSkipped {
+				b = b[nalSkipped:]
+			} else {
+				b = nil
+			}
+		}
+		out = append(out, escape(raw)...)
+	}
+	return out
+}
+
+func newCBC(block cipher.Block, iv []byte, encrypt bool) cipher.BlockMode {
+	if encrypt {
+		return cipher.NewCBCEncrypter(block, iv)
+	}
+	return cipher.NewCBCDecrypter(block, iv)
+}
+
+// Offset of the first 00 00 01 start code, -1 if there is none
+func startCode(b []byte) int {
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// NAL unit without emulation prevention bytes
+func unescape(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// NAL unit with emulation prevention bytes added
+func escape(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+	for _, c := range raw {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// Writes the PES packet into the packets of unit, which keep their
+// adaptation fields. Returns replacements for packets that changed size,
+// with any bytes that no longer fit in packets following the last one.
+func repacketize(pkts []*packet, unit []int, data []byte, replaced map[int][]*packet) {
+	pid := mpegts.PID(pkts[unit[0]].b)
+	for k, i := range unit {
+		orig := pkts[i]
+		af := mpegts.AdaptationField(orig.b)
+		if len(data) == 0 && len(af) == 0 {
+			replaced[i] = nil
+			continue
+		}
+		p, n := newPacket(pid, k == 0, af, data)
+		data = data[n:]
+		replaced[i] = []*packet{p}
+	}
+	last := unit[len(unit)-1]
+	for len(data) > 0 {
+		p, n := newPacket(pid, false, nil, data)
+		data = data[n:]
+		replaced[last] = append(replaced[last], p)
+	}
+}
+
+// Encrypts the samples of a MPEG-TS segment as the HLS sample encryption
+// format has them: the slices of H.264 video, and the frames of AAC audio.
+func encryptSamples(data []byte, block cipher.Block, iv []byte) ([]byte, error) {
+	pkts, err := splitPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	pmtPID, ok := findPMT(pkts)
+	if !ok {
+		return nil, ErrInvalidTS
+	}
+	var pmt []byte
+	for _, p := range pkts {
+		if sec := mpegts.Section(p.b); mpegts.PID(p.b) == pmtPID && len(sec) >= 16 && sec[0] == tsio.TableIdPMT {
+			pmt = sec
+			break
+		}
+	}
+	if pmt == nil {
+		return nil, ErrInvalidTS
+	}
+	var config []byte
+	replaced := map[int][]*packet{}
+	renumber := map[uint16]bool{}
+	for _, es := range mpegts.Streams(pmt) {
+		if unsupportedStreams[es.Type] {
+			return nil, ErrUnsupported
+		}
+		if es.Type != streamTypeH264 && es.Type != streamTypeAAC {
+			continue
+		}
+		if es.Type == streamTypeAAC && config == nil {
+			config = audioConfig(pkts, es.PID)
+		}
+		for _, unit := range pesUnits(pkts, es.PID) {
+			data, hdr := pesData(pkts, unit)
+			if data == nil {
+				continue
+			}
+			if es.Type == streamTypeAAC {
+				cryptAAC(data[hdr:], block, iv, true)
+			} else {
+				data = append(data[:hdr:hdr], cryptH264(data[hdr:], block, iv, true)...)
+				if n := int(data[4])<<8 | int(data[5]); n > 0 {
+					if n = len(data) - 6; n > 0xffff {
+						n = 0
+					}
+					data[4], data[5] = byte(n>>8), byte(n)
+				}
+			}
+			size := 0
+			for _, i := range unit {
+				size += len(mpegts.Payload(pkts[i].b))
+			}
+			if len(data) != size {
+				repacketize(pkts, unit, data, replaced)
+				renumber[es.PID] = true
+				continue
+			}
+			for _, i := range unit {
+				data = data[copy(mpegts.Payload(pkts[i].b), data):]
+			}
+		}
+	}
+
+	sec := encryptedPMT(pmt, config)
+	if 1+len(sec) > packetSize-4 {
+		return nil, ErrUnsupported
+	}
+	cc := map[uint16]byte{}
+	out := make([]byte, 0, len(data)+packetSize*len(replaced))
+	for i, p := range pkts {
+		ps := []*packet{p}
+		if r, ok := replaced[i]; ok {
+			ps = r
+		}
+		for _, p := range ps {
+			pid := mpegts.PID(p.b)
+			if pid == pmtPID && len(mpegts.Section(p.b)) > 0 {
+				p = sectionPacket(p, sec)
+			}
+			if renumber[pid] && p.b[3]&0x10 != 0 {
+				if _, ok := cc[pid]; !ok {
+					cc[pid] = pkts[i].b[3] & 0x0f
+				}
+				p.b[3] = p.b[3]&0xf0 | cc[pid]
+				cc[pid] = (cc[pid] + 1) & 0x0f
+			}
+			out = append(out, p.b...)
+		}
+	}
+	return out, nil
+}
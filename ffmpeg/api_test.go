@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -1376,6 +1377,102 @@ func TestTranscoder_AudioOnly(t *testing.T) {
 	audioOnlySegment(t, Software)
 }
 
+func TestTranscoder_AudioOnlyInput(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	for _, in := range []string{"audio.mp3", "audio.ogg"} {
+		t.Run(in, func(t *testing.T) {
+			// Video profiles are ignored, only audio renditions come out
+			out := []TranscodeOptions{{
+				Oname:        fmt.Sprintf("%s/%s-aac.ts", dir, in),
+				Profile:      P144p30fps16x9,
+				AudioEncoder: ComponentOptions{Name: "aac"},
+			}, {
+				Oname:        fmt.Sprintf("%s/%s-aac.mp4", dir, in),
+				Profile:      VideoProfile{Format: FormatMP4},
+				AudioEncoder: ComponentOptions{Name: "aac"},
+				Muxer:        ComponentOptions{Name: "mp4"},
+			}, {
+				Oname:        fmt.Sprintf("%s/%s-opus.mka", dir, in),
+				AudioEncoder: ComponentOptions{Name: "opus"},
+				Muxer:        ComponentOptions{Name: "matroska"},
+			}}
+			res, err := Transcode3(&TranscodeOptionsIn{Fname: "../data/" + in}, out)
+			require.NoError(t, err)
+			require.Zero(t, res.Decoded.Frames)
+			for _, r := range res.Encoded {
+				require.Zero(t, r.Frames)
+			}
+		})
+	}
+
+	cmd := `
+	for f in audio.mp3 audio.ogg
+	do
+		for o in $f-aac.ts $f-aac.mp4 $f-opus.mka
+		do
+			ffprobe -loglevel warning -show_streams -select_streams v $o > $o.video
+			test ! -s $o.video
+		done
+		ffprobe -loglevel warning -show_streams $f-aac.ts | grep codec_name=aac
+		ffprobe -loglevel warning -show_streams $f-aac.ts | grep sample_rate=44100
+		ffprobe -loglevel warning -show_streams $f-aac.mp4 | grep codec_name=aac
+		# opus does not encode at 44.1kHz
+		ffprobe -loglevel warning -show_streams $f-opus.mka | grep codec_name=opus
+		ffprobe -loglevel warning -show_streams $f-opus.mka | grep sample_rate=48000
+	done
+	`
+	run(cmd)
+
+	// Audio renditions are listed in HLS audio groups
+	alt := AudioRenditionToAlternative("audio", "English", "eng", "audio/index.m3u8", true)
+	require.Equal(t, "AUDIO", alt.Type)
+	require.Equal(t, "audio", alt.GroupId)
+	require.Equal(t, "YES", alt.Autoselect)
+}
+
+func TestTranscoder_AudioOnlySegments(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	run(`
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -c copy -f hls -hls_time 2 seg.m3u8
+		# the video stream goes away in the middle
+		ffmpeg -loglevel warning -i seg1.ts -vn -c:a copy -copyts seg1-audio.ts
+		ffmpeg -loglevel warning -i seg2.ts -vn -c:a copy -copyts seg2-audio.ts
+	`)
+	sessions := [][]string{
+		{"seg0.ts", "seg1-audio.ts", "seg2.ts"},
+		// starting audio-only
+		{"seg1-audio.ts", "seg2-audio.ts", "seg3.ts"},
+	}
+	for n, segs := range sessions {
+		tc := NewTranscoder()
+		for i, seg := range segs {
+			oname := fmt.Sprintf("%s/out%d-%d.ts", dir, n, i)
+			res, err := tc.Transcode(&TranscodeOptionsIn{Fname: dir + "/" + seg}, []TranscodeOptions{{
+				Oname:        oname,
+				Profile:      P144p30fps16x9,
+				AudioEncoder: ComponentOptions{Name: "aac"},
+			}})
+			require.NoError(t, err, seg)
+			info, err := ProbeMedia(oname)
+			require.NoError(t, err)
+			require.Len(t, info.AudioStreams(), 1, seg)
+			if strings.HasSuffix(seg, "-audio.ts") {
+				require.Zero(t, res.Decoded.Frames, seg)
+				require.Empty(t, info.VideoStreams(), seg)
+			} else {
+				require.NotZero(t, res.Encoded[0].Frames, seg)
+				require.Len(t, info.VideoStreams(), 1, seg)
+				require.Equal(t, 256, info.VideoStreams()[0].Width, seg)
+			}
+		}
+		tc.StopTranscoder()
+	}
+}
+
 func outputFPS(t *testing.T, accel Acceleration) {
 	run, dir := setupTest(t)
 	defer os.RemoveAll(dir)
@@ -1702,3 +1799,106 @@ func discontinuityAudioSegment(t *testing.T, accel Acceleration) {
 func TestTranscoder_discontinuityAudioSegment(t *testing.T) {
 	discontinuityAudioSegment(t, Software)
 }
+
+func TestTranscoder_RateControlConfig(t *testing.T) {
+	// Invalid rate control configs should be rejected before transcoding
+	bad := []VideoProfile{
+		{RateControl: RateControlCBR},
+		{RateControl: RateControlVBR, Bitrate: "1000k", MaxBitrate: "500k"},
+		{RateControl: RateControlCappedCRF, Bitrate: "1000k"},
+		{RateControl: RateControlCappedCRF, Quality: 23},
+		{RateControl: RateControlCQP},
+		{RateControl: RateControl(100), Bitrate: "1000k"},
+	}
+	for _, p := range bad {
+		bitrate, _ := parseBitrate(p.Bitrate)
+		_, err := rateControlLimits(p, bitrate)
+		require.Equal(t, ErrTranscoderRateControl, err, "profile %+v", p)
+	}
+
+	// Legacy behaviour: bitrate used as min, avg, max and buffer size
+	rc, err := rateControlLimits(VideoProfile{Bitrate: "1000k"}, 1000000)
+	require.NoError(t, err)
+	require.Equal(t, rateControlParams{1000000, 1000000, 1000000, 1000000}, rc)
+
+	// VBR: no min rate, buffer defaults to the peak
+	vbr := VideoProfile{RateControl: RateControlVBR, Bitrate: "1000k", MaxBitrate: "1500k"}
+	rc, err = rateControlLimits(vbr, 1000000)
+	require.NoError(t, err)
+	require.Equal(t, rateControlParams{bitrate: 1000000, maxrate: 1500000, bufsize: 1500000}, rc)
+
+	// Capped CRF: no target bitrate, Bitrate becomes the cap
+	crf := VideoProfile{RateControl: RateControlCappedCRF, Bitrate: "1000k", Quality: 23, BufferSize: "2000k"}
+	rc, err = rateControlLimits(crf, 1000000)
+	require.NoError(t, err)
+	require.Equal(t, rateControlParams{maxrate: 1000000, bufsize: 2000000}, rc)
+
+	// Check per-encoder translation
+	opts := map[string]string{}
+	_, err = rateControlOpts(crf, Software, rc, opts)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"crf": "23"}, opts)
+	opts = map[string]string{}
+	_, err = rateControlOpts(crf, Nvidia, rc, opts)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"rc": "vbr", "cq": "30"}, opts)
+	xcoder, err := rateControlOpts(crf, Netint, rc, map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, "crf=23:vbvMaxRate=1000000:vbvBufferSize=2000", xcoder)
+	cbr := VideoProfile{RateControl: RateControlCBR, Bitrate: "1000k"}
+	opts = map[string]string{}
+	_, err = rateControlOpts(cbr, Software, rateControlParams{}, opts)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"nal-hrd": "cbr"}, opts)
+	cbr.Encoder = H265
+	opts = map[string]string{}
+	_, err = rateControlOpts(cbr, Software, rateControlParams{}, opts)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"x265-params": "strict-cbr=1"}, opts)
+	cbr.Encoder = VP9
+	opts = map[string]string{}
+	_, err = rateControlOpts(cbr, Software, rateControlParams{}, opts)
+	require.NoError(t, err)
+	require.Empty(t, opts)
+
+	// Custom encoder options are kept, unless they conflict
+	custom := map[string]string{"preset": "fast"}
+	merged, err := mergeRateControlOpts(custom, map[string]string{"crf": "23"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"preset": "fast", "crf": "23"}, merged)
+	require.Equal(t, map[string]string{"preset": "fast"}, custom)
+	_, err = mergeRateControlOpts(map[string]string{"crf": "18"}, map[string]string{"crf": "23"})
+	require.Equal(t, ErrTranscoderRateControl, err)
+
+	// Peak rate should be advertised in the variant BANDWIDTH
+	require.Equal(t, uint32(1500000), VideoProfileToVariantParams(vbr).Bandwidth)
+}
+
+func TestTranscoder_RateControl(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	run(`cp "$1/../transcoder/test.ts" test.ts`)
+
+	modes := map[string]VideoProfile{
+		"cbr":       {RateControl: RateControlCBR, Bitrate: "400k", BufferSize: "800k"},
+		"vbr":       {RateControl: RateControlVBR, Bitrate: "300k", MaxBitrate: "400k"},
+		"cappedcrf": {RateControl: RateControlCappedCRF, Quality: 28, MaxBitrate: "400k"},
+		"cqp":       {RateControl: RateControlCQP, Quality: 30},
+	}
+	for name, p := range modes {
+		p.Resolution = P144p30fps16x9.Resolution
+		p.Framerate = P144p30fps16x9.Framerate
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.ts"}, []TranscodeOptions{{
+			Oname:   fmt.Sprintf("%s/out_%s.ts", dir, name),
+			Profile: p,
+		}})
+		require.NoError(t, err, name)
+	}
+
+	run(`
+		for i in cbr vbr cappedcrf cqp
+		do
+			ffprobe -loglevel warning -show_streams -select_streams v out_$i.ts | grep codec_name=h264
+		done
+	`)
+}
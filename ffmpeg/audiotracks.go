@@ -0,0 +1,256 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// #include <stdlib.h>
+// #include "extras.h"
+import "C"
+
+// AudioTrack selects an audio stream of the input. A non-empty Language
+// matches the first audio stream tagged with that language, otherwise Index
+// is the position of the stream among the input's audio streams, counting
+// from zero.
+type AudioTrack struct {
+	Index    int
+	Language string
+}
+
+func hasAudioTracks(ps []TranscodeOptions) bool {
+	for _, p := range ps {
+		if len(p.AudioTracks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Position of the track among the audio streams of the input
+func audioTrackPosition(audio []StreamInfo, track AudioTrack) (int, error) {
+	if track.Language == "" {
+		if track.Index < 0 || track.Index >= len(audio) {
+			return -1, ErrTranscoderAudioTrack
+		}
+		return track.Index, nil
+	}
+	for i, a := range audio {
+		if a.Language == track.Language {
+			return i, nil
+		}
+	}
+	glog.Warningf("No audio track with language %s", track.Language)
+	return -1, ErrTranscoderAudioTrack
+}
+
+// Parts of an output are written to mpegts if the output is mpegts itself,
+// so timestamps stay exact. Anything else goes to matroska, which takes
+// every codec we can encode.
+func partMuxer(p TranscodeOptions) string {
+	if isMPEGTSOutput(p) {
+		return "mpegts"
+	}
+	return "matroska"
+}
+
+func outputMuxer(p TranscodeOptions) string {
+	switch p.Profile.Format {
+	case FormatMPEGTS:
+		return "mpegts"
+	case FormatMP4:
+		return "mp4"
+	}
+	return p.Muxer.Name
+}
+
+// Stream copy all streams of the inputs into a single output, in order
+func mergeStreams(inputs []string, oname, muxer string) error {
+	cinputs := make([]*C.char, len(inputs))
+	for i, in := range inputs {
+		cinputs[i] = C.CString(in)
+		defer C.free(unsafe.Pointer(cinputs[i]))
+	}
+	coname := C.CString(oname)
+	defer C.free(unsafe.Pointer(coname))
+	var cmuxer *C.char
+	if muxer != "" {
+		cmuxer = C.CString(muxer)
+		defer C.free(unsafe.Pointer(cmuxer))
+	}
+	ret := int(C.lpms_merge(&cinputs[0], C.int(len(inputs)), coname, cmuxer))
+	if ret < 0 {
+		return ErrorMap[ret]
+	}
+	return nil
+}
+
+// The decoder of a session handles a single audio track, so outputs carrying
+// other tracks are put together from parts. Video and the input's selected
+// track come from this session, while every other track is decoded by a
+// session of its own. Parts are merged into the output afterwards.
+func (t *Transcoder) transcodeAudioTracks(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
+	if input.Transmuxing || !hasVideoMetadata(input.Fname) {
+		// tracks are resolved by probing the input, which can't be done on pipes
+		glog.Warning("Audio tracks can only be mapped from files")
+		return nil, ErrTranscoderAudioTrack
+	}
+	info, err := ProbeMedia(input.Fname)
+	if err != nil {
+		return nil, err
+	}
+	audio := info.AudioStreams()
+	main := -1 // unknown if the session picks the best track by itself
+	if input.AudioTrack != nil {
+		if main, err = audioTrackPosition(audio, *input.AudioTrack); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "lpms-tracks")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	var mainOuts []TranscodeOptions
+	mainIdx := make([]int, len(ps))
+	trackOuts := map[int][]TranscodeOptions{}
+	// outputs of the parts of each track
+	trackIdx := map[int][]int{}
+	parts := make([][]string, len(ps))
+	for i, p := range ps {
+		mainIdx[i] = -1
+		if len(p.AudioTracks) == 0 || p.AudioEncoder.Name == "drop" {
+			p.AudioTracks = nil
+			mainIdx[i] = len(mainOuts)
+			mainOuts = append(mainOuts, p)
+			continue
+		}
+		if p.From != 0 || p.To != 0 {
+			glog.Warning("Clipping is not supported together with audio tracks")
+			return nil, ErrTranscoderClipConfig
+		}
+		if p.Encryption != nil {
+			// the tracks are merged by stream copy, which can't read encrypted parts
+			glog.Warning("Encryption is not supported together with audio tracks")
+			return nil, ErrTranscoderEncryption
+		}
+		tracks := make([]int, len(p.AudioTracks))
+		for j, track := range p.AudioTracks {
+			if tracks[j], err = audioTrackPosition(audio, track); err != nil {
+				return nil, err
+			}
+		}
+		withMain := p.VideoEncoder.Name != "drop" && len(info.VideoStreams()) > 0 || tracks[0] == main
+		nbParts := len(tracks)
+		if withMain && tracks[0] != main {
+			nbParts++
+		}
+		part := func(out TranscodeOptions) TranscodeOptions {
+			out.AudioTracks = nil
+			if nbParts > 1 {
+				out.Oname = filepath.Join(dir, fmt.Sprintf("%d-%d", i, len(parts[i])))
+				out.Profile.Format = FormatNone
+				out.Muxer = ComponentOptions{Name: partMuxer(p)}
+			}
+			parts[i] = append(parts[i], out.Oname)
+			return out
+		}
+		if withMain {
+			out := p
+			if tracks[0] == main {
+				tracks = tracks[1:]
+			} else {
+				out.AudioEncoder = ComponentOptions{Name: "drop"}
+			}
+			mainIdx[i] = len(mainOuts)
+			mainOuts = append(mainOuts, part(out))
+		}
+		for _, track := range tracks {
+			out := p
+			out.VideoEncoder = ComponentOptions{Name: "drop"}
+			trackOuts[track] = append(trackOuts[track], part(out))
+			trackIdx[track] = append(trackIdx[track], i)
+		}
+	}
+
+	res := &TranscodeResults{Encoded: make([]MediaInfo, len(ps))}
+	if len(mainOuts) > 0 {
+		r, err := t.transcode(input, mainOuts)
+		if err != nil {
+			return nil, err
+		}
+		res.Decoded = r.Decoded
+		res.Discontinuity = r.Discontinuity
+		res.ConfigChange = r.ConfigChange
+		res.SpliceEvents = r.SpliceEvents
+		res.cues, res.cueStart = r.cues, r.cueStart
+		if r.Signatures != nil {
+			res.Signatures = make([][]byte, len(ps))
+		}
+		for i, j := range mainIdx {
+			if j >= 0 {
+				res.Encoded[i] = r.Encoded[j]
+				if r.Signatures != nil {
+					res.Signatures[i] = r.Signatures[j]
+				}
+			}
+		}
+	}
+
+	tracks := make([]int, 0, len(trackOuts))
+	for track := range trackOuts {
+		tracks = append(tracks, track)
+	}
+	sort.Ints(tracks)
+	for _, track := range tracks {
+		tc, ok := t.tracks[track]
+		if !ok {
+			if t.tracks == nil {
+				t.tracks = map[int]*Transcoder{}
+			}
+			tc = NewTranscoder()
+			// log under the session ID of the main transcoder
+			tc.logAs = t.logSession
+			tc.limits = t.limits
+			t.tracks[track] = tc
+		}
+		in := &TranscodeOptionsIn{
+			Fname:      input.Fname,
+			Demuxer:    input.Demuxer,
+			AudioTrack: &AudioTrack{Index: track},
+		}
+		r, err := tc.Transcode(in, trackOuts[track])
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range trackIdx[track] {
+			if mainIdx[i] < 0 && j < len(r.Encoded) {
+				// made of tracks only
+				res.Encoded[i].Frames += r.Encoded[j].Frames
+				res.Encoded[i].Pixels += r.Encoded[j].Pixels
+			}
+		}
+	}
+
+	for i, names := range parts {
+		if len(names) < 2 {
+			continue
+		}
+		if err := mergeStreams(names, ps[i].Oname, outputMuxer(ps[i])); err != nil {
+			return nil, err
+		}
+		// the parts drop SCTE-35 when merged
+		if err := insertSpliceCues(ps[i:i+1], res.cues, res.cueStart, false); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
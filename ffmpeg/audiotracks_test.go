@@ -0,0 +1,118 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudioTracks_Transcode(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Two language tracks that can be told apart after stream copy
+	run(`
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 2 \
+			-map 0:v -map 0:a -map 0:a -c:v copy -c:a aac \
+			-ar:a:0 44100 -ac:a:0 2 -ar:a:1 22050 -ac:a:1 1 \
+			-metadata:s:a:0 language=eng -metadata:s:a:1 language=spa \
+			tracks.ts
+	`)
+	fname := filepath.Join(dir, "tracks.ts")
+	probe := func(t *testing.T, name string) ProbeInfo {
+		info, err := ProbeMedia(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return info
+	}
+
+	t.Run("select on input", func(t *testing.T) {
+		in := &TranscodeOptionsIn{Fname: fname, AudioTrack: &AudioTrack{Language: "spa"}}
+		_, err := Transcode3(in, []TranscodeOptions{{
+			Oname:        filepath.Join(dir, "spa.ts"),
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}})
+		require.NoError(t, err)
+		spa := probe(t, "spa.ts")
+		a := spa.AudioStreams()
+		require.Len(t, a, 1)
+		assert.Equal(t, "spa", a[0].Language)
+		assert.Equal(t, 22050, a[0].SampleRate)
+
+		in.AudioTrack = &AudioTrack{Index: 2}
+		_, err = Transcode3(in, []TranscodeOptions{{
+			Oname:        filepath.Join(dir, "none.ts"),
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}})
+		assert.Error(t, err)
+	})
+
+	t.Run("split and map", func(t *testing.T) {
+		tc := NewTranscoder()
+		defer tc.StopTranscoder()
+		in := &TranscodeOptionsIn{Fname: fname}
+		out := []TranscodeOptions{{
+			// video with both tracks
+			Oname:       filepath.Join(dir, "all.mp4"),
+			Profile:     P144p30fps16x9,
+			Muxer:       ComponentOptions{Name: "mp4"},
+			AudioTracks: []AudioTrack{{Language: "spa"}, {Index: 0}},
+		}, {
+			// one audio-only rendition per track
+			Oname:        filepath.Join(dir, "eng.ts"),
+			VideoEncoder: ComponentOptions{Name: "drop"},
+			AudioTracks:  []AudioTrack{{Language: "eng"}},
+		}, {
+			Oname:        filepath.Join(dir, "spa-aac.ts"),
+			VideoEncoder: ComponentOptions{Name: "drop"},
+			AudioTracks:  []AudioTrack{{Index: 1}},
+		}}
+		tc.SetSessionID("tracks")
+		res, err := tc.Transcode(in, out)
+		require.NoError(t, err)
+		assert.NotZero(t, res.Decoded.Frames)
+		assert.NotZero(t, res.Encoded[0].Frames)
+		// track sessions have sessions of their own, logging under the main one
+		require.NotEmpty(t, tc.tracks)
+		for _, track := range tc.tracks {
+			assert.NotEqual(t, tc.logSession, track.logSession)
+			assert.Equal(t, tc.logSession, track.logAs)
+			track.StopTranscoder()
+		}
+		assert.Equal(t, "tracks", logSessionID(tc.logSession))
+
+		all := probe(t, "all.mp4")
+		require.Len(t, all.VideoStreams(), 1)
+		a := all.AudioStreams()
+		require.Len(t, a, 2)
+		assert.Equal(t, "spa", a[0].Language)
+		assert.Equal(t, "eng", a[1].Language)
+
+		for name, lang := range map[string]string{"eng.ts": "eng", "spa-aac.ts": "spa"} {
+			info := probe(t, name)
+			assert.Empty(t, info.VideoStreams())
+			require.Len(t, info.AudioStreams(), 1)
+			assert.Equal(t, lang, info.AudioStreams()[0].Language)
+			assert.Equal(t, "aac", info.AudioStreams()[0].Codec)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: fname}, []TranscodeOptions{{
+			Oname:       filepath.Join(dir, "fra.ts"),
+			Profile:     P144p30fps16x9,
+			AudioTracks: []AudioTrack{{Language: "fra"}},
+		}})
+		assert.Equal(t, ErrTranscoderAudioTrack, err)
+		_, err = Transcode3(&TranscodeOptionsIn{Fname: "pipe:0"}, []TranscodeOptions{{
+			Oname:       filepath.Join(dir, "pipe.ts"),
+			Profile:     P144p30fps16x9,
+			AudioTracks: []AudioTrack{{Index: 0}},
+		}})
+		assert.Equal(t, ErrTranscoderAudioTrack, err)
+	})
+}
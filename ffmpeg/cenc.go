@@ -0,0 +1,137 @@
+package ffmpeg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/lpms/encryption"
+)
+
+var ErrTranscoderEncryption = errors.New("TranscoderInvalidEncryption")
+
+// EncryptionScheme is a protection scheme of ISO Common Encryption.
+type EncryptionScheme string
+
+const (
+	// AES-CTR over whole samples, or the video data of subsamples
+	SchemeCENC EncryptionScheme = "cenc"
+	// AES-CBC over a pattern of blocks, for fMP4 HLS. The mov muxer only
+	// writes cenc, so the samples are encrypted again once the output is
+	// written, which has to be a file.
+	SchemeCBCS EncryptionScheme = "cbcs"
+)
+
+// CommonEncryption protects an MP4 output for DASH or fMP4 HLS. The key of
+// the stream comes from Keys, along with the PSSH boxes of the DRM systems
+// licensing it, which are written into the movie box after the transcode.
+type CommonEncryption struct {
+	Scheme   EncryptionScheme
+	Keys     encryption.ContentKeyProvider
+	StreamID string
+}
+
+// Whether the output is written by the mov muxer, which encrypts samples
+func isMP4Output(p TranscodeOptions) bool {
+	switch outputMuxer(p) {
+	case "mp4", "mov", "ismv", "ipod":
+		return true
+	case "":
+		switch strings.ToLower(filepath.Ext(p.Oname)) {
+		case ".mp4", ".m4v", ".m4a", ".mov", ".ismv":
+			return true
+		}
+	}
+	return false
+}
+
+// Keys of the outputs, indexed like them and nil for outputs that aren't
+// encrypted
+func contentKeys(ps []TranscodeOptions) ([]*encryption.ContentKey, error) {
+	var keys []*encryption.ContentKey
+	for i, p := range ps {
+		enc := p.Encryption
+		if enc == nil {
+			continue
+		}
+		if enc.Scheme != SchemeCENC && enc.Scheme != SchemeCBCS {
+			glog.Warningf("Unsupported encryption scheme %q for %s", enc.Scheme, p.Oname)
+			return nil, ErrTranscoderEncryption
+		}
+		if enc.Keys == nil || !isMP4Output(p) {
+			return nil, ErrTranscoderEncryption
+		}
+		key, err := enc.Keys.ContentKey(enc.StreamID)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil || len(key.KeyID) != encryption.KeySize || len(key.Key) != encryption.KeySize {
+			return nil, ErrTranscoderEncryption
+		}
+		if (len(key.PSSH) > 0 || enc.Scheme == SchemeCBCS) && strings.HasPrefix(strings.ToLower(p.Oname), "pipe:") {
+			glog.Warning("PSSH boxes and cbcs can only be written into files")
+			return nil, ErrTranscoderEncryption
+		}
+		if keys == nil {
+			keys = make([]*encryption.ContentKey, len(ps))
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// Muxer options encrypting the output with the key
+func cencOpts(opts map[string]string, key *encryption.ContentKey) map[string]string {
+	if key == nil {
+		return opts
+	}
+	out := map[string]string{}
+	for k, v := range opts {
+		out[k] = v
+	}
+	out["encryption_scheme"] = "cenc-aes-ctr"
+	out["encryption_key"] = hex.EncodeToString(key.Key)
+	out["encryption_kid"] = hex.EncodeToString(key.KeyID)
+	return out
+}
+
+// Encrypts the outputs asking for cbcs again, and writes the PSSH boxes of
+// the keys into their outputs
+func finishEncryption(ps []TranscodeOptions, keys []*encryption.ContentKey) error {
+	for i, key := range keys {
+		if key == nil || (len(key.PSSH) == 0 && ps[i].Encryption.Scheme != SchemeCBCS) {
+			continue
+		}
+		info, err := os.Stat(ps[i].Oname)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(ps[i].Oname)
+		if err != nil {
+			return err
+		}
+		if ps[i].Encryption.Scheme == SchemeCBCS {
+			iv := make([]byte, encryption.KeySize)
+			if _, err := rand.Read(iv); err != nil {
+				return err
+			}
+			if data, err = encryption.ReencryptCBCS(data, key.Key, iv); err != nil {
+				glog.Errorf("Unable to encrypt %s with cbcs: %v", ps[i].Oname, err)
+				return err
+			}
+		}
+		out, err := encryption.InsertPSSH(data, key.PSSH)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(ps[i].Oname, out, info.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
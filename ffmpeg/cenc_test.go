@@ -0,0 +1,100 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/livepeer/lpms/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCENC_Transcode(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -c copy -t 2 test.ts
+	`
+	require.True(t, run(cmd))
+
+	// Clear Key system
+	systemID := []byte{0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02, 0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b}
+	kid := []byte("fedcba9876543210")
+	pssh, err := encryption.PSSH(systemID, [][]byte{kid}, nil)
+	require.NoError(t, err)
+	keys := encryption.NewStaticKeyProvider(&encryption.ContentKey{
+		KeyID: kid,
+		Key:   []byte{0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66},
+		PSSH:  [][]byte{pssh},
+	})
+	enc := &CommonEncryption{Scheme: SchemeCENC, Keys: keys, StreamID: "test"}
+	cbcs := &CommonEncryption{Scheme: SchemeCBCS, Keys: keys, StreamID: "test"}
+	// copied, so the outputs carry the same samples
+	copied := func(oname string, enc *CommonEncryption, muxer ComponentOptions) TranscodeOptions {
+		return TranscodeOptions{Oname: oname, VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"}, Muxer: muxer, Encryption: enc}
+	}
+	_, err = Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.ts"}, []TranscodeOptions{
+		copied(dir+"/clear.mp4", nil, ComponentOptions{}),
+		copied(dir+"/out.mp4", enc, ComponentOptions{}),
+		copied(dir+"/frag.mp4", enc, ComponentOptions{Name: "mp4", Opts: map[string]string{"movflags": "frag_keyframe+empty_moov"}}),
+		copied(dir+"/cbcs.mp4", cbcs, ComponentOptions{}),
+		copied(dir+"/cbcs-frag.mp4", cbcs, ComponentOptions{Name: "mp4", Opts: map[string]string{"movflags": "frag_keyframe+empty_moov"}}),
+	})
+	require.NoError(t, err)
+
+	for _, f := range []string{"out.mp4", "frag.mp4", "cbcs.mp4", "cbcs-frag.mp4"} {
+		data, err := ioutil.ReadFile(dir + "/" + f)
+		require.NoError(t, err)
+		assert.True(t, bytes.Contains(data, pssh), "no pssh in %s", f)
+		assert.True(t, bytes.Contains(data, []byte("tenc")), "no tenc in %s", f)
+		assert.Equal(t, strings.HasPrefix(f, "cbcs"), bytes.Contains(data, []byte("schm\x00\x00\x00\x00cbcs")), "scheme of %s", f)
+	}
+
+	// samples decrypt to those of the clear output
+	cmd = `
+		ffmpeg -loglevel warning -i clear.mp4 -c copy -f framemd5 clear.md5
+		for f in out frag cbcs cbcs-frag; do
+			ffmpeg -loglevel warning -decryption_key 30313233343536373839616263646566 -i $f.mp4 -c copy -f framemd5 $f.md5
+			diff -u clear.md5 $f.md5
+		done
+		# and not without the key
+		ffmpeg -loglevel warning -i out.mp4 -c copy -f framemd5 nokey.md5
+		! diff -q clear.md5 nokey.md5
+	`
+	require.True(t, run(cmd))
+}
+
+func TestCENC_Invalid(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -c copy -t 1 test.ts
+	`
+	require.True(t, run(cmd))
+
+	keys := encryption.NewStaticKeyProvider(&encryption.ContentKey{KeyID: []byte("fedcba9876543210"), Key: []byte("0123456789abcdef")})
+	invalid := []TranscodeOptions{
+		// cbcs is encrypted after the muxer is done
+		{Oname: "pipe:1", Profile: P144p30fps16x9, Muxer: ComponentOptions{Name: "mp4"}, Encryption: &CommonEncryption{Scheme: SchemeCBCS, Keys: keys}},
+		{Oname: dir + "/out.mp4", Profile: P144p30fps16x9, Encryption: &CommonEncryption{Scheme: "cens", Keys: keys}},
+		{Oname: dir + "/out.mp4", Profile: P144p30fps16x9, Encryption: &CommonEncryption{Scheme: SchemeCENC}},
+		// not MP4
+		{Oname: dir + "/out.ts", Profile: P144p30fps16x9, Encryption: &CommonEncryption{Scheme: SchemeCENC, Keys: keys}},
+		{Oname: dir + "/out.mkv", Profile: P144p30fps16x9, Encryption: &CommonEncryption{Scheme: SchemeCENC, Keys: keys}},
+	}
+	for _, p := range invalid {
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.ts"}, []TranscodeOptions{p})
+		assert.Equal(t, ErrTranscoderEncryption, err)
+	}
+	_, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.ts"}, []TranscodeOptions{{
+		Oname: dir + "/out.mp4", Profile: P144p30fps16x9,
+		Encryption: &CommonEncryption{Scheme: SchemeCENC, Keys: encryption.NewStaticKeyProvider(nil)},
+	}})
+	assert.Equal(t, encryption.ErrKey, err)
+}
@@ -0,0 +1,257 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var ErrConcatStreams = errors.New("ConcatMismatchedStreams")
+
+// ConcatInput describes where an input ended up in the concatenated output
+type ConcatInput struct {
+	Fname string
+	// Position of the input's first frame within the output
+	Offset   time.Duration
+	Duration time.Duration
+	// Whether the input had to be re-encoded to match the first input
+	Reencoded bool
+}
+
+type ConcatResults struct {
+	Inputs   []ConcatInput
+	Duration time.Duration
+}
+
+// Whether video b can be stream copied after video a. Outputs other than
+// MPEG-TS keep a single set of codec parameters for the whole stream, so the
+// extradata has to match as well.
+func videoCompatible(a, b StreamInfo, inBand bool) bool {
+	if a.Codec != b.Codec || a.Profile != b.Profile || a.Level != b.Level ||
+		a.Width != b.Width || a.Height != b.Height || a.PixFormat != b.PixFormat {
+		return false
+	}
+	if inBand {
+		return true
+	}
+	switch a.Codec {
+	case "h264", "hevc":
+		return sameParameterSets(a, b)
+	}
+	return bytes.Equal(a.Extradata, b.Extradata)
+}
+
+func audioCompatible(a, b StreamInfo) bool {
+	return a.Codec == b.Codec && a.SampleRate == b.SampleRate && a.Channels == b.Channels
+}
+
+// Limits of the sessions of Concat, which turns recordings of any length
+// into a single output
+func concatLimits() Limits {
+	l := DefaultLimits
+	l.MaxDuration = 0
+	return l
+}
+
+// Stream copy the segments one after another into the output. Timestamps of
+// each segment are rebased to continue where the previous one ended. Returns
+// where each segment ended up.
+func joinSegments(names []string, out TranscodeOptions) ([]writtenSpan, error) {
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	tc.limits = concatLimits()
+	spans := make([]writtenSpan, len(names))
+	for i, name := range names {
+		if i > 0 {
+			tc.Discontinuity()
+		}
+		in := &TranscodeOptionsIn{Fname: name, Transmuxing: true}
+		ps := []TranscodeOptions{{
+			Oname:        out.Oname,
+			Profile:      VideoProfile{Format: FormatNone},
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+			Muxer:        out.Muxer,
+			Metadata:     out.Metadata,
+		}}
+		res, err := tc.Transcode(in, ps)
+		if err != nil {
+			return nil, err
+		}
+		spans[i] = res.written
+	}
+	return spans, nil
+}
+
+// Concat stitches the inputs together into a single output, in order.
+//
+// The first input sets the codec parameters of the output. Later inputs that
+// differ from it are re-encoded to match, while the rest are stream copied.
+// Outputs other than MPEG-TS can't change parameter sets midway, so there
+// every input is re-encoded once one of them has to be. Timestamps are
+// rebased so each input starts where the previous one ended, closing any gaps
+// between inputs. All inputs must have the same kinds of streams. Inputs
+// may be longer than the MaxDuration of DefaultLimits.
+//
+// Only the Oname, Muxer, Metadata, Accel and Device fields of `out` are used.
+func Concat(inputs []string, out TranscodeOptions) (*ConcatResults, error) {
+	if len(inputs) == 0 {
+		return nil, ErrTranscoderInp
+	}
+	infos := make([]ProbeInfo, len(inputs))
+	for i, fname := range inputs {
+		info, err := ProbeMedia(fname)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+	}
+
+	ref := infos[0]
+	inBand := isMPEGTSOutput(out)
+	hasVideo, hasAudio := len(ref.VideoStreams()) > 0, len(ref.AudioStreams()) > 0
+	reVideo := make([]bool, len(inputs))
+	reAudio := make([]bool, len(inputs))
+	remux := make([]bool, len(inputs))
+	anyVideo, anyAudio, mixedFormats := false, false, false
+	for i, info := range infos {
+		v, a := info.VideoStreams(), info.AudioStreams()
+		if (len(v) > 0) != hasVideo || (len(a) > 0) != hasAudio {
+			glog.Warningf("Concat input %s has different streams than %s", inputs[i], inputs[0])
+			return nil, ErrConcatStreams
+		}
+		reVideo[i] = hasVideo && !videoCompatible(ref.VideoStreams()[0], v[0], inBand)
+		reAudio[i] = hasAudio && !audioCompatible(ref.AudioStreams()[0], a[0])
+		anyVideo = anyVideo || reVideo[i]
+		anyAudio = anyAudio || reAudio[i]
+		mixedFormats = mixedFormats || info.Format != ref.Format
+	}
+	if anyAudio && !matchesEncodedAudio(ref.AudioStreams()[0]) {
+		// re-encoded audio won't match the first input, so make everything match
+		for i := range reAudio {
+			reAudio[i] = true
+		}
+	}
+	if anyVideo && !inBand {
+		// the encoder won't reproduce the parameter sets of the first input
+		for i := range reVideo {
+			reVideo[i] = true
+		}
+	}
+	var profile VideoProfile
+	var encoder ComponentOptions
+	if anyVideo {
+		var err error
+		if profile, encoder, err = matchingEncoder(inputs[0], ref, GOPInfo{}); err != nil {
+			return nil, err
+		}
+	}
+	if mixedFormats || anyVideo || anyAudio {
+		// Packets from different containers may use different bitstream
+		// formats, so bring everything into mpegts first.
+		for i, info := range infos {
+			remux[i] = info.Format != "mpegts"
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "lpms-concat")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	names := make([]string, len(inputs))
+	firstEncoded := -1
+	for i, fname := range inputs {
+		names[i] = fname
+		if !reVideo[i] && !reAudio[i] && !remux[i] {
+			continue
+		}
+		names[i] = filepath.Join(dir, fmt.Sprintf("%d.ts", i))
+		o := TranscodeOptions{
+			Oname:        names[i],
+			Profile:      profile,
+			Accel:        out.Accel,
+			Device:       out.Device,
+			Muxer:        ComponentOptions{Name: "mpegts"},
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}
+		in := &TranscodeOptionsIn{Fname: fname}
+		if reVideo[i] {
+			o.VideoEncoder = encoder
+			in.Accel, in.Device = out.Accel, out.Device
+		}
+		if reAudio[i] {
+			o.AudioEncoder = ComponentOptions{Name: "aac"}
+		}
+		if !hasVideo {
+			o.VideoEncoder = ComponentOptions{Name: "drop"}
+		}
+		if !hasAudio {
+			o.AudioEncoder = ComponentOptions{Name: "drop"}
+		}
+		if _, err := transcodeWithLimits(concatLimits(), in, []TranscodeOptions{o}); err != nil {
+			return nil, err
+		}
+		if !reVideo[i] || inBand {
+			continue
+		}
+		if firstEncoded < 0 {
+			firstEncoded = i
+		} else if err := sameEncodedVideo(names[firstEncoded], names[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	spans, err := joinSegments(names, out)
+	if err != nil {
+		return nil, err
+	}
+	res := &ConcatResults{Inputs: make([]ConcatInput, len(inputs))}
+	var start, end time.Duration
+	started := false
+	for i, span := range spans {
+		if !span.Valid {
+			// nothing written, so the input takes no time
+			span.Start, span.End = end, end
+		} else if !started {
+			start, end, started = span.Start, span.Start, true
+		}
+		res.Inputs[i] = ConcatInput{
+			Fname:     inputs[i],
+			Offset:    span.Start - start,
+			Duration:  span.End - span.Start,
+			Reencoded: reVideo[i] || reAudio[i],
+		}
+		if span.End > end {
+			end = span.End
+		}
+	}
+	res.Duration = end - start
+	return res, nil
+}
+
+// Whether re-encoded inputs came out with the same parameter sets
+func sameEncodedVideo(a, b string) error {
+	x, err := ProbeMedia(a)
+	if err != nil {
+		return err
+	}
+	y, err := ProbeMedia(b)
+	if err != nil {
+		return err
+	}
+	if len(x.VideoStreams()) == 0 || len(y.VideoStreams()) == 0 ||
+		!videoCompatible(x.VideoStreams()[0], y.VideoStreams()[0], false) {
+		glog.Warningf("Concat could not encode %s with the parameter sets of %s", b, a)
+		return ErrConcatStreams
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcat_Segments(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	run(`
+		# 2s segments, the second one at a different resolution
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 6 -c copy -f hls -hls_time 2 seg.m3u8
+		ffmpeg -loglevel warning -i seg1.ts -c:v libx264 -s 320x180 -c:a copy -copyts seg1-small.ts
+		# and the third as mp4
+		ffmpeg -loglevel warning -i seg2.ts -c copy seg2.mp4
+		ffprobe -loglevel warning -select_streams v -count_frames -show_streams seg0.ts | grep nb_read_frames=120
+	`)
+
+	inputs := []string{
+		filepath.Join(dir, "seg0.ts"),
+		filepath.Join(dir, "seg1-small.ts"),
+		filepath.Join(dir, "seg2.mp4"),
+	}
+	tests := []struct {
+		oname     string
+		reencoded []bool
+	}{
+		// parameter sets change in band
+		{"out.ts", []bool{false, true, false}},
+		// mp4 keeps the parameter sets of a single encoder
+		{"out.mp4", []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.oname, func(t *testing.T) {
+			oname := filepath.Join(dir, tt.oname)
+			res, err := Concat(inputs, TranscodeOptions{Oname: oname})
+			require.NoError(t, err)
+			require.Len(t, res.Inputs, 3)
+			assert.Equal(t, time.Duration(0), res.Inputs[0].Offset)
+			for i, in := range res.Inputs {
+				assert.Equal(t, inputs[i], in.Fname)
+				assert.Equal(t, tt.reencoded[i], in.Reencoded)
+				assert.InDelta(t, 2*time.Second, in.Duration, float64(100*time.Millisecond))
+				if i > 0 {
+					// within a frame of where the previous input ended
+					assert.InDelta(t, res.Inputs[i-1].Offset+res.Inputs[i-1].Duration, in.Offset, float64(40*time.Millisecond))
+				}
+			}
+
+			info, err := ProbeMedia(oname)
+			require.NoError(t, err)
+			require.Len(t, info.VideoStreams(), 1)
+			require.Len(t, info.AudioStreams(), 1)
+			// re-encoded input is scaled back up to match the first
+			assert.Equal(t, 1280, info.VideoStreams()[0].Width)
+			assert.InDelta(t, res.Duration, info.Duration, float64(200*time.Millisecond))
+			run(`ffprobe -loglevel warning -select_streams v -count_frames -show_streams ` + tt.oname + ` | grep nb_read_frames=360`)
+			run(`ffmpeg -loglevel error -xerror -i ` + tt.oname + ` -f null -`)
+		})
+	}
+}
+
+func TestConcat_ParameterSets(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	run(`
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 4 -c copy -f hls -hls_time 2 seg.m3u8
+		# same resolution, profile and level but other parameter sets
+		ffmpeg -loglevel warning -i seg0.ts -c:v libx264 -profile:v high -level 4.0 -c:a copy -copyts a.ts
+		ffmpeg -loglevel warning -i seg1.ts -c:v libx264 -profile:v high -level 4.0 -x264opts cabac=0 -c:a copy -copyts b.ts
+	`)
+	inputs := []string{filepath.Join(dir, "a.ts"), filepath.Join(dir, "b.ts")}
+	info, err := ProbeMedia(inputs[1])
+	require.NoError(t, err)
+	require.NotEmpty(t, info.VideoStreams()[0].Extradata)
+
+	res, err := Concat(inputs, TranscodeOptions{Oname: filepath.Join(dir, "out.ts")})
+	require.NoError(t, err)
+	assert.False(t, res.Inputs[1].Reencoded)
+
+	res, err = Concat(inputs, TranscodeOptions{Oname: filepath.Join(dir, "out.mp4")})
+	require.NoError(t, err)
+	assert.True(t, res.Inputs[0].Reencoded)
+	assert.True(t, res.Inputs[1].Reencoded)
+	run(`ffmpeg -loglevel error -xerror -i out.mp4 -f null -`)
+}
+
+func TestConcat_Long(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// recordings past the duration limit of transcoders, one of them remuxed
+	run(`
+		ffmpeg -loglevel warning -f lavfi -i testsrc=size=64x36:rate=1 -f lavfi -i sine -t 310 -c:v libx264 -g 10 -c:a aac long.ts
+		ffmpeg -loglevel warning -i long.ts -c copy long.mp4
+	`)
+	inputs := []string{filepath.Join(dir, "long.ts"), filepath.Join(dir, "long.mp4")}
+	res, err := Concat(inputs, TranscodeOptions{Oname: filepath.Join(dir, "out.mp4")})
+	require.NoError(t, err)
+	require.Len(t, res.Inputs, 2)
+	assert.True(t, res.Duration > 600*time.Second, "duration %v", res.Duration)
+}
+
+func TestConcat_Errors(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	_, err := Concat(nil, TranscodeOptions{Oname: filepath.Join(dir, "out.ts")})
+	assert.Equal(t, ErrTranscoderInp, err)
+
+	run(`
+		cp "$1"/../transcoder/test.ts .
+		ffmpeg -loglevel warning -i test.ts -an -c:v copy noaudio.ts
+	`)
+	_, err = Concat([]string{filepath.Join(dir, "test.ts"), filepath.Join(dir, "noaudio.ts")},
+		TranscodeOptions{Oname: filepath.Join(dir, "out.ts")})
+	assert.Equal(t, ErrConcatStreams, err)
+}
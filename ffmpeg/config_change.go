@@ -0,0 +1,99 @@
+package ffmpeg
+
+import "strings"
+
+// ConfigChange lists how the configuration of an input differs from the
+// previous input of the session.
+type ConfigChange int
+
+const (
+	ConfigChangeResolution ConfigChange = 1 << iota
+	ConfigChangePixelFormat
+	// Includes video showing up in a stream that had none
+	ConfigChangeVideoCodec
+	// Includes audio showing up in a stream that had none
+	ConfigChangeAudioCodec
+	// Sample rate or number of channels
+	ConfigChangeAudioFormat
+)
+
+var configChangeNames = []struct {
+	change ConfigChange
+	name   string
+}{
+	{ConfigChangeResolution, "resolution"},
+	{ConfigChangePixelFormat, "pixel format"},
+	{ConfigChangeVideoCodec, "video codec"},
+	{ConfigChangeAudioCodec, "audio codec"},
+	{ConfigChangeAudioFormat, "audio format"},
+}
+
+func (c ConfigChange) String() string {
+	var names []string
+	for _, n := range configChangeNames {
+		if c&n.change != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Compares the probed configuration of an input with the previous one.
+// Streams missing from the input, and values the probe couldn't find, don't
+// count as changes, while streams showing up do. Audio is only compared if it
+// is decoded.
+func classifyConfigChange(prev, cur MediaFormatInfo, audio bool) ConfigChange {
+	var c ConfigChange
+	if prev.Vcodec == "" && cur.Vcodec != "" {
+		c |= ConfigChangeVideoCodec
+	} else if prev.Vcodec != "" && cur.Vcodec != "" {
+		if prev.Vcodec != cur.Vcodec {
+			c |= ConfigChangeVideoCodec
+		}
+		if cur.Width > 0 && cur.Height > 0 && (prev.Width != cur.Width || prev.Height != cur.Height) {
+			c |= ConfigChangeResolution
+		}
+		if cur.PixFormat.RawValue != PixelFormatNone && prev.PixFormat != cur.PixFormat {
+			c |= ConfigChangePixelFormat
+		}
+	}
+	if audio && cur.Acodec != "" {
+		if prev.Acodec != cur.Acodec {
+			c |= ConfigChangeAudioCodec
+		} else if cur.SampleRate > 0 && (prev.SampleRate != cur.SampleRate || prev.Channels != cur.Channels) {
+			c |= ConfigChangeAudioFormat
+		}
+	}
+	return c
+}
+
+// Configuration to compare the next input with. Streams missing from the
+// input keep their previous configuration, so a stream dropping audio for a
+// while doesn't count as a change once audio returns.
+func nextConfig(prev, cur MediaFormatInfo, audio bool) MediaFormatInfo {
+	next := prev
+	if cur.Vcodec != "" {
+		next.Vcodec = cur.Vcodec
+		next.Width, next.Height = cur.Width, cur.Height
+		next.PixFormat = cur.PixFormat
+	}
+	if audio && cur.Acodec != "" {
+		next.Acodec = cur.Acodec
+		next.SampleRate, next.Channels = cur.SampleRate, cur.Channels
+	}
+	return next
+}
+
+// Whether the change needs the demuxer and decoders reopened. Codec changes
+// always do, as do pixel format changes for hardware decoders that are kept
+// across inputs. Filters follow resolution and audio format changes, and
+// pixel format changes of software decoders, by themselves.
+func (c ConfigChange) needsReopen(accel Acceleration) bool {
+	if c&(ConfigChangeVideoCodec|ConfigChangeAudioCodec) != 0 {
+		return true
+	}
+	return accel != Software && c&ConfigChangePixelFormat != 0
+}
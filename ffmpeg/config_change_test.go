@@ -0,0 +1,105 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigChange_Classify(t *testing.T) {
+	yuv420p := PixelFormat{PixelFormatYUV420P}
+	base := MediaFormatInfo{
+		Vcodec: "h264", Width: 1280, Height: 720, PixFormat: yuv420p,
+		Acodec: "aac", SampleRate: 44100, Channels: 2,
+	}
+	with := func(f func(*MediaFormatInfo)) MediaFormatInfo {
+		m := base
+		f(&m)
+		return m
+	}
+	tests := []struct {
+		name   string
+		cur    MediaFormatInfo
+		audio  bool
+		change ConfigChange
+	}{
+		{"same", base, true, 0},
+		{"resolution", with(func(m *MediaFormatInfo) { m.Height = 360 }), true, ConfigChangeResolution},
+		{"pixel format", with(func(m *MediaFormatInfo) { m.PixFormat = PixelFormat{PixelFormatYUV444P} }), true, ConfigChangePixelFormat},
+		{"unknown pixel format", with(func(m *MediaFormatInfo) { m.PixFormat = PixelFormat{PixelFormatNone} }), true, 0},
+		{"video codec", with(func(m *MediaFormatInfo) { m.Vcodec = "hevc"; m.Width = 640 }), true, ConfigChangeVideoCodec | ConfigChangeResolution},
+		{"no video", with(func(m *MediaFormatInfo) { m.Vcodec = ""; m.Width = 0 }), true, 0},
+		{"audio codec", with(func(m *MediaFormatInfo) { m.Acodec = "opus"; m.SampleRate = 48000 }), true, ConfigChangeAudioCodec},
+		{"sample rate", with(func(m *MediaFormatInfo) { m.SampleRate = 22050 }), true, ConfigChangeAudioFormat},
+		{"channels", with(func(m *MediaFormatInfo) { m.Channels = 1 }), true, ConfigChangeAudioFormat},
+		{"dropped audio", with(func(m *MediaFormatInfo) { m.Acodec = "opus" }), false, 0},
+		{"no audio", with(func(m *MediaFormatInfo) { m.Acodec = "" }), true, 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.change, classifyConfigChange(base, tt.cur, tt.audio), tt.name)
+	}
+
+	// audio showing up in a video only stream
+	noAudio := with(func(m *MediaFormatInfo) { m.Acodec = ""; m.SampleRate = 0; m.Channels = 0 })
+	assert.Equal(t, ConfigChangeAudioCodec, classifyConfigChange(noAudio, base, true))
+	// and coming back after a gap isn't a change
+	next := nextConfig(base, noAudio, true)
+	assert.Equal(t, ConfigChange(0), classifyConfigChange(next, base, true))
+	// as does video in an audio-only stream, unlike video coming back
+	noVideo := with(func(m *MediaFormatInfo) { m.Vcodec = ""; m.Width = 0; m.Height = 0 })
+	assert.Equal(t, ConfigChangeVideoCodec, classifyConfigChange(noVideo, base, true))
+	next = nextConfig(base, noVideo, true)
+	assert.Equal(t, ConfigChange(0), classifyConfigChange(next, base, true))
+
+	assert.True(t, ConfigChangeAudioCodec.needsReopen(Software))
+	assert.True(t, ConfigChangeVideoCodec.needsReopen(Software))
+	assert.False(t, ConfigChangePixelFormat.needsReopen(Software))
+	assert.True(t, ConfigChangePixelFormat.needsReopen(Nvidia))
+	assert.False(t, (ConfigChangeResolution | ConfigChangeAudioFormat).needsReopen(Nvidia))
+
+	assert.Equal(t, "none", ConfigChange(0).String())
+	assert.Equal(t, "resolution, audio format", (ConfigChangeResolution | ConfigChangeAudioFormat).String())
+}
+
+func TestTranscoder_ConfigChange(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// consecutive segments, each changing part of the configuration
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -t 2 -c:v libx264 -c:a aac -ar 44100 -ac 2 seg0.ts
+		ffmpeg -ss 2 -t 2 -i "$1"/../transcoder/test.ts -copyts -vf scale=640:360 -c:v libx264 -c:a aac -ar 44100 -ac 2 seg1.ts
+		ffmpeg -ss 4 -t 2 -i "$1"/../transcoder/test.ts -copyts -c:v libx264 -pix_fmt yuv444p -c:a aac -ar 44100 -ac 2 seg2.ts
+		ffmpeg -ss 6 -t 2 -i "$1"/../transcoder/test.ts -copyts -c:v libx264 -c:a aac -ar 22050 -ac 1 seg3.ts
+	`
+	run(cmd)
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	changes := []ConfigChange{
+		0,
+		ConfigChangeResolution,
+		ConfigChangeResolution | ConfigChangePixelFormat,
+		ConfigChangePixelFormat | ConfigChangeAudioFormat,
+	}
+	for i, change := range changes {
+		in := &TranscodeOptionsIn{Fname: filepath.Join(dir, fmt.Sprintf("seg%d.ts", i))}
+		oname := filepath.Join(dir, fmt.Sprintf("out%d.ts", i))
+		res, err := tc.Transcode(in, []TranscodeOptions{{Oname: oname, Profile: P144p30fps16x9}})
+		require.NoError(t, err, i)
+		assert.Equal(t, change, res.ConfigChange, i)
+		assert.NotZero(t, res.Encoded[0].Frames, i)
+
+		// outputs keep their configuration
+		_, format, err := GetCodecInfo(oname)
+		require.NoError(t, err, i)
+		assert.Equal(t, "h264", format.Vcodec, i)
+		assert.Equal(t, 256, format.Width, i)
+		assert.Equal(t, 144, format.Height, i)
+		assert.Equal(t, "aac", format.Acodec, i)
+	}
+}
@@ -88,7 +88,9 @@ int decode_in(struct input_ctx *ictx, AVPacket *pkt, AVFrame *frame, int *stream
   } else if (ist->index == ictx->ai && ictx->ac) {
     // this is audio packet to decode
     decoder = ictx->ac;
-  } else if (pkt->stream_index == ictx->vi || pkt->stream_index == ictx->ai || ictx->transmuxing) {
+  } else if (pkt->stream_index == ictx->vi || pkt->stream_index == ictx->ai ||
+             pkt->stream_index == ictx->id3i || pkt->stream_index == ictx->scte35i ||
+             ictx->transmuxing) {
     // MA: this is original code. I think the intention was
     // if (audio or video) AND transmuxing
     // so it is buggy, but nevermind, refactored code will handle things in
@@ -235,6 +237,64 @@ static enum AVPixelFormat get_hw_format(AVCodecContext *ctx,
 }
 
 
+int find_data_stream(AVFormatContext *ic, enum AVCodecID id)
+{
+  for (int i = 0; i < ic->nb_streams; i++) {
+    if (id == ic->streams[i]->codecpar->codec_id) return i;
+  }
+  return -1;
+}
+
+// Keeps a packet of the SCTE-35 stream for the caller, which carries it into
+// the outputs after the transcode
+int add_scte35_cue(struct input_ctx *ictx, AVPacket *pkt)
+{
+  AVStream *ist = ictx->ic->streams[pkt->stream_index];
+  int64_t pts = pkt->pts != AV_NOPTS_VALUE ? pkt->pts : pkt->dts;
+  if (pts == AV_NOPTS_VALUE) {
+    LPMS_WARN("Dropping SCTE-35 cue without a timestamp");
+    return 0;
+  }
+  scte35_cue *cues = av_realloc_array(ictx->cues, ictx->nb_cues + 1, sizeof(*cues));
+  if (!cues) return AVERROR(ENOMEM);
+  ictx->cues = cues;
+  uint8_t *data = av_memdup(pkt->data, pkt->size);
+  if (!data) return AVERROR(ENOMEM);
+  cues[ictx->nb_cues++] = (scte35_cue) {
+    .pts = av_rescale_q(pts, ist->time_base, (AVRational){1, 90000}),
+    .data = data,
+    .size = pkt->size,
+  };
+  return 0;
+}
+
+void free_scte35_cues(scte35_cue **cues, int *nb_cues)
+{
+  for (int i = 0; i < *nb_cues; i++) av_free((*cues)[i].data);
+  av_freep(cues);
+  *nb_cues = 0;
+}
+
+static int find_audio_stream(input_params *params, AVFormatContext *ic, const AVCodec **codec)
+{
+  int track = 0;
+  if (!params->audio_lang && params->audio_track < 0) {
+    return av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, codec, 0);
+  }
+  for (int i = 0; i < ic->nb_streams; i++) {
+    AVStream *st = ic->streams[i];
+    if (AVMEDIA_TYPE_AUDIO != st->codecpar->codec_type) continue;
+    if (params->audio_lang) {
+      AVDictionaryEntry *lang = av_dict_get(st->metadata, "language", NULL, 0);
+      if (!lang || strcmp(lang->value, params->audio_lang)) continue;
+    } else if (track++ != params->audio_track) continue;
+    *codec = avcodec_find_decoder(st->codecpar->codec_id);
+    if (!*codec) return AVERROR_DECODER_NOT_FOUND;
+    return i;
+  }
+  return AVERROR_STREAM_NOT_FOUND;
+}
+
 int open_audio_decoder(input_params *params, struct input_ctx *ctx)
 {
   int ret = 0;
@@ -242,7 +302,11 @@ int open_audio_decoder(input_params *params, struct input_ctx *ctx)
   AVFormatContext *ic = ctx->ic;
 
   // open audio decoder
-  ctx->ai = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, &codec, 0);
+  ctx->ai = find_audio_stream(params, ic, &codec);
+  if (ctx->ai < 0 && (params->audio_lang || params->audio_track >= 0)) {
+    ret = ctx->ai;
+    LPMS_ERR(open_audio_err, "Selected audio track not found in input");
+  }
   if (ctx->da) ; // skip decoding audio
   else if (ctx->ai < 0) {
     LPMS_INFO("No audio stream found in input");
@@ -351,6 +415,8 @@ int open_input(input_params *params, struct input_ctx *ctx)
   ctx->ic = ic;
   ret = avformat_find_stream_info(ic, NULL);
   if (ret < 0) LPMS_ERR(open_input_err, "Unable to find input info");
+  ctx->id3i = find_data_stream(ic, AV_CODEC_ID_TIMED_ID3);
+  ctx->scte35i = find_data_stream(ic, AV_CODEC_ID_SCTE_35);
   if (params->transmuxing) return 0;
   ret = open_video_decoder(params, ctx);
   if (ret < 0) LPMS_ERR(open_input_err, "Unable to open video decoder")
@@ -382,5 +448,7 @@ void free_input(struct input_ctx *inctx)
   if (inctx->last_frame_v) av_frame_free(&inctx->last_frame_v);
   if (inctx->last_frame_a) av_frame_free(&inctx->last_frame_a);
   if (inctx->blocked_pkt) av_packet_free(&inctx->blocked_pkt);
+  free_scte35_cues(&inctx->cues, &inctx->nb_cues);
+  free_frame_hook(&inctx->hook);
 }
 
@@ -5,6 +5,7 @@
 #include <libavcodec/avcodec.h>
 #include <libavutil/opt.h>
 #include "transcoder.h"
+#include "hook.h"
 
 struct input_ctx {
   AVFormatContext *ic; // demuxer required
@@ -12,6 +13,12 @@ struct input_ctx {
   AVCodecContext  *ac; // audo  decoder optional
   int vi, ai; // video and audio stream indices
   int dv, da; // flags whether to drop video or audio
+  int id3i;   // timed ID3 stream index, -1 if none
+  int scte35i; // SCTE-35 stream index, -1 if none
+
+  // SCTE-35 cues demuxed during the current transcode call
+  scte35_cue *cues;
+  int nb_cues;
 
   // Decoded results for current transcode call (for early abort checks)
   output_results *decoded_res;
@@ -44,6 +51,35 @@ struct input_ctx {
   // Filter flush
   AVFrame *last_frame_v, *last_frame_a;
 
+  // Go frame hook run on decoded video
+  struct hook_ctx hook;
+
+  // Resource limits, zero is unlimited
+  int max_width, max_height;
+  int64_t max_pixels;
+  int max_frame_ratio;
+  int64_t max_input_bytes;
+  int64_t start_bytes; // bytes read from the input before this call
+  double max_framerate;
+  // Decoded video measured against max_framerate, per call
+  int64_t fps_first_pts, fps_last_pts;
+  int fps_frames;
+
+  // Discontinuity detection between calls, see transcoder.c.
+  // Timestamps are in AV_TIME_BASE units
+  int manual_discontinuity;
+  int discontinuity_flags;
+  int64_t discontinuity_gap;
+  // Per media type: video, then audio
+  int ts_checked[2];
+  int64_t ts_last[2], ts_end[2];
+  struct stream_params {
+    int valid;
+    enum AVCodecID vcodec, acodec;
+    int width, height, format;
+    int sample_rate, channels;
+  } last_params;
+
   // transmuxing specific fields:
   // last non-zero duration
   int64_t last_duration[MAX_OUTPUT_SIZE];
@@ -71,6 +107,9 @@ enum AVPixelFormat hw2pixfmt(AVCodecContext *ctx);
 int open_input(input_params *params, struct input_ctx *ctx);
 int open_video_decoder(input_params *params, struct input_ctx *ctx);
 int open_audio_decoder(input_params *params, struct input_ctx *ctx);
+int find_data_stream(AVFormatContext *ic, enum AVCodecID id);
+int add_scte35_cue(struct input_ctx *ictx, AVPacket *pkt);
+void free_scte35_cues(scte35_cue **cues, int *nb_cues);
 void free_input(struct input_ctx *inctx);
 
 // Utility functions
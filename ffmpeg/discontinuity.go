@@ -0,0 +1,40 @@
+package ffmpeg
+
+import "time"
+
+// #include "transcoder.h"
+import "C"
+
+// DiscontinuityInfo describes how the input of a Transcode call follows the
+// input of the previous call of the session. Detected discontinuities are
+// handled like calls to Transcoder.Discontinuity.
+type DiscontinuityInfo struct {
+	// Transcoder.Discontinuity was called before this input
+	Manual bool
+	// Timestamps jumped forward by more than a second
+	TimestampJump bool
+	// Timestamps went backwards, eg for segments out of order
+	Backwards bool
+	// Codec, resolution, pixel format, sample rate or channels changed
+	CodecChange bool
+	// Start of this input minus the end of the previous one, for timestamp
+	// jumps and backwards timestamps
+	Gap time.Duration
+}
+
+// Detected reports whether a discontinuity was detected, rather than only
+// signalled with Transcoder.Discontinuity.
+func (d DiscontinuityInfo) Detected() bool {
+	return d.TimestampJump || d.Backwards || d.CodecChange
+}
+
+func discontinuityInfo(r *C.output_results) DiscontinuityInfo {
+	flags := int(r.discontinuity)
+	return DiscontinuityInfo{
+		Manual:        flags&C.LPMS_DISCONT_MANUAL != 0,
+		TimestampJump: flags&C.LPMS_DISCONT_JUMP != 0,
+		Backwards:     flags&C.LPMS_DISCONT_BACKWARDS != 0,
+		CodecChange:   flags&C.LPMS_DISCONT_CODEC != 0,
+		Gap:           time.Duration(r.gap) * time.Microsecond,
+	}
+}
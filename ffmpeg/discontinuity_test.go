@@ -0,0 +1,103 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscoder_DetectDiscontinuity(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# three consecutive segments
+		ffmpeg -i "$1"/../transcoder/test.ts -t 6 -c:v libx264 -g 30 -c:a copy -f segment -segment_time 2 seg%d.ts
+		# the third segment at another resolution, timestamps unchanged
+		ffmpeg -i seg2.ts -copyts -vf scale=640:360 -c:v libx264 -c:a copy small.ts
+		# the second segment a hundred seconds later
+		ffmpeg -i seg1.ts -c copy -output_ts_offset 100 jump.ts
+	`
+	run(cmd)
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	transcode := func(name string) DiscontinuityInfo {
+		in := &TranscodeOptionsIn{Fname: filepath.Join(dir, name)}
+		out := []TranscodeOptions{{Oname: filepath.Join(dir, "out.ts"), Profile: P144p30fps16x9}}
+		res, err := tc.Transcode(in, out)
+		require.NoError(t, err)
+		return res.Discontinuity
+	}
+
+	assert.Equal(t, DiscontinuityInfo{}, transcode("seg0.ts"))
+	assert.Equal(t, DiscontinuityInfo{}, transcode("seg1.ts"))
+
+	d := transcode("small.ts")
+	assert.Equal(t, DiscontinuityInfo{CodecChange: true}, d)
+	assert.True(t, d.Detected())
+
+	d = transcode("jump.ts")
+	assert.True(t, d.TimestampJump)
+	assert.True(t, d.CodecChange)
+	assert.False(t, d.Backwards)
+	assert.True(t, d.Gap > 90*time.Second)
+
+	d = transcode("seg0.ts")
+	assert.True(t, d.Backwards)
+	assert.False(t, d.TimestampJump)
+	assert.True(t, d.Gap < -90*time.Second)
+
+	// manual discontinuities are reported too
+	tc.Discontinuity()
+	d = transcode("seg1.ts")
+	assert.Equal(t, DiscontinuityInfo{Manual: true}, d)
+	assert.False(t, d.Detected())
+}
+
+func TestTransmuxer_DetectDiscontinuityAudioFirst(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -t 4 -c copy -f segment -segment_time 2 seg%d.ts
+		# the second segment a hundred seconds later, audio half a second ahead
+		# so that audio packets are demuxed before the first video packet
+		ffmpeg -i seg1.ts -itsoffset -0.5 -i seg1.ts -map 0:v -map 1:a -c copy -output_ts_offset 100 lead.ts
+	`
+	run(cmd)
+
+	tc := NewTranscoder()
+	out := []TranscodeOptions{{
+		Oname:        filepath.Join(dir, "out.mp4"),
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		Profile:      VideoProfile{Format: FormatNone},
+		Muxer: ComponentOptions{
+			Name: "mp4",
+			Opts: map[string]string{"movflags": "frag_keyframe+negative_cts_offsets+omit_tfhd_offset+disable_chpl+default_base_moof"},
+		},
+	}}
+	var d DiscontinuityInfo
+	for _, name := range []string{"seg0.ts", "lead.ts"} {
+		res, err := tc.Transcode(&TranscodeOptionsIn{Fname: filepath.Join(dir, name), Transmuxing: true}, out)
+		require.NoError(t, err)
+		d = res.Discontinuity
+	}
+	tc.StopTranscoder()
+	assert.True(t, d.TimestampJump)
+	assert.True(t, d.Gap > 90*time.Second)
+
+	// every stream is rebased, including the audio ahead of the video
+	cmd = `
+		ffprobe -loglevel warning -select_streams a -show_entries packet=pts_time -of csv=p=0 out.mp4 > audio.out
+		ffprobe -loglevel warning -select_streams v -show_entries packet=pts_time -of csv=p=0 out.mp4 > video.out
+		awk 'max < $1 { max = $1 } END { exit !(NR > 0 && max < 10) }' audio.out
+		awk 'max < $1 { max = $1 } END { exit !(NR > 0 && max < 10) }' video.out
+	`
+	run(cmd)
+}
@@ -24,6 +24,14 @@ static int add_video_stream(struct output_ctx *octx, struct input_ctx *ictx)
     // Sometimes the codec tag is wonky for some reason, so correct it
     ret = av_codec_get_tag2(octx->oc->oformat->codec_tag, st->codecpar->codec_id, &st->codecpar->codec_tag);
     avformat_transfer_internal_stream_timing_info(octx->oc->oformat, st, ist, AVFMT_TBCF_DEMUXER);
+    // Clipping copied video works on packet timestamps in the input timebase
+    AVRational ms_tb = {1, 1000};
+    if (octx->clip_from) {
+      octx->clip_from_pts = av_rescale_q(octx->clip_from, ms_tb, ist->time_base);
+    }
+    if (octx->clip_to) {
+      octx->clip_to_pts = av_rescale_q(octx->clip_to, ms_tb, ist->time_base);
+    }
   } else if (octx->vc) {
     st->time_base = octx->vc->time_base;
     ret = avcodec_parameters_from_context(st->codecpar, octx->vc);
@@ -89,6 +97,10 @@ static int add_audio_stream(struct input_ctx *ictx, struct output_ctx *octx)
   }
   octx->ai = st->index;
 
+  // keep the language so players can tell tracks apart
+  AVDictionaryEntry *lang = av_dict_get(ictx->ic->streams[ictx->ai]->metadata, "language", NULL, 0);
+  if (lang) av_dict_set(&st->metadata, "language", lang->value, 0);
+
   AVRational ms_tb = {1, 1000};
   AVRational dest_tb = ictx->ic->streams[ictx->ai]->time_base;
   if (octx->clip_from) {
@@ -121,7 +133,7 @@ static int open_audio_output(struct input_ctx *ictx, struct output_ctx *octx,
   if (ictx->ac && needs_decoder(octx->audio->name)) {
 
     // initialize audio filters
-    ret = init_audio_filters(ictx, octx);
+    ret = init_audio_filters(ictx, octx, NULL);
     if (ret < 0) LPMS_ERR(audio_output_err, "Unable to open audio filter")
 
     // open encoder
@@ -150,6 +162,58 @@ audio_output_err:
   return ret;
 }
 
+// Adds a timed ID3 stream to mpegts outputs with tags to write, or whose
+// input carries timed ID3
+static int add_id3_stream(struct input_ctx *ictx, struct output_ctx *octx)
+{
+  int ret = 0;
+  octx->id3i = -1;
+  if (strcmp("mpegts", octx->oc->oformat->name)) return 0;
+  if (!octx->nb_id3_tags && ictx->id3i < 0) return 0;
+  AVStream *st = avformat_new_stream(octx->oc, NULL);
+  if (!st) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR_RETURN("Unable to alloc timed ID3 stream");
+  }
+  st->codecpar->codec_type = AVMEDIA_TYPE_DATA;
+  st->codecpar->codec_id = AV_CODEC_ID_TIMED_ID3;
+  st->time_base = (AVRational){1, 90000};
+  octx->id3i = st->index;
+  octx->last_id3_dts = AV_NOPTS_VALUE;
+  return 0;
+}
+
+// Writes the tags due by `until`, in AV_TIME_BASE units
+int write_id3_tags(struct output_ctx *octx, int64_t until)
+{
+  int ret = 0;
+  if (octx->id3i < 0) return 0;
+  AVStream *st = octx->oc->streams[octx->id3i];
+  while (octx->next_id3_tag < octx->nb_id3_tags) {
+    id3_tag *tag = &octx->id3_tags[octx->next_id3_tag];
+    int64_t pts = octx->id3_start + tag->pts;
+    if (pts > until) break;
+    octx->next_id3_tag++;
+    AVPacket *pkt = av_packet_alloc();
+    if (!pkt) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR_RETURN("Unable to alloc timed ID3 packet");
+    }
+    ret = av_new_packet(pkt, tag->size);
+    if (ret < 0) {
+      av_packet_free(&pkt);
+      LPMS_ERR_RETURN("Unable to alloc timed ID3 data");
+    }
+    memcpy(pkt->data, tag->data, tag->size);
+    pkt->pts = pkt->dts = pts;
+    pkt->flags |= AV_PKT_FLAG_KEY;
+    ret = mux(pkt, AV_TIME_BASE_Q, octx, st);
+    av_packet_free(&pkt);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to write timed ID3 tag");
+  }
+  return 0;
+}
+
 void close_output(struct output_ctx *octx)
 {
   if (octx->oc) {
@@ -201,6 +265,14 @@ int open_remux_output(struct input_ctx *ictx, struct output_ctx *octx)
                                                   AVFMT_TBCF_DEMUXER);
 
   }
+  if (ictx->id3i >= 0 && !strcmp("mpegts", octx->oc->oformat->name)) {
+    // tags go into the copy of the timed ID3 stream of the input
+    octx->id3i = ictx->id3i;
+    octx->last_id3_dts = AV_NOPTS_VALUE;
+  } else {
+    ret = add_id3_stream(ictx, octx);
+    if (ret < 0) LPMS_ERR(open_output_err, "Error adding timed ID3 stream");
+  }
   return 0;
 open_output_err:
   return ret;
@@ -215,6 +287,8 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
   AVFormatContext *oc = NULL;
   AVCodecContext *vc  = NULL;
 
+  octx->id3i = -1;
+
   // open muxer
   fmt = av_guess_format(octx->muxer->name, octx->fname, NULL);
   if (!fmt) LPMS_ERR(open_output_err, "Unable to guess output format");
@@ -244,7 +318,10 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
     else if (ictx->vc->framerate.num && ictx->vc->framerate.den) vc->time_base = av_inv_q(ictx->vc->framerate);
     else vc->time_base = ictx->ic->streams[ictx->vi]->time_base;
     vc->flags |= AV_CODEC_FLAG_COPY_OPAQUE;
-    if (octx->bitrate) vc->rc_min_rate = vc->bit_rate = vc->rc_max_rate = vc->rc_buffer_size = octx->bitrate;
+    if (octx->bitrate) vc->bit_rate = octx->bitrate;
+    if (octx->minrate) vc->rc_min_rate = octx->minrate;
+    if (octx->maxrate) vc->rc_max_rate = octx->maxrate;
+    if (octx->bufsize) vc->rc_buffer_size = octx->bufsize;
     if (av_buffersink_get_hw_frames_ctx(octx->vf.sink_ctx)) {
       vc->hw_frames_ctx =
         av_buffer_ref(av_buffersink_get_hw_frames_ctx(octx->vf.sink_ctx));
@@ -274,6 +351,9 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
 
     ret = open_audio_output(ictx, octx, fmt);
     if (ret < 0) LPMS_ERR(open_output_err, "Error opening audio output");
+
+    ret = add_id3_stream(ictx, octx);
+    if (ret < 0) LPMS_ERR(open_output_err, "Error adding timed ID3 stream");
   } else {
     ret = open_remux_output(ictx, octx);
     if (ret < 0) {
@@ -314,8 +394,8 @@ int reopen_output(struct output_ctx *octx, struct input_ctx *ictx)
   ret = avformat_alloc_output_context2(&octx->oc, fmt, NULL, octx->fname);
   if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to alloc reopened out context");
 
-  // re-attach video encoder
-  if (octx->vc) {
+  // re-attach video encoder, unless this input has no video for it
+  if (octx->vc && !octx->dv) {
     ret = add_video_stream(octx, ictx);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add video stream");
   } else LPMS_INFO("No video stream!?");
@@ -324,6 +404,9 @@ int reopen_output(struct output_ctx *octx, struct input_ctx *ictx)
   ret = open_audio_output(ictx, octx, fmt);
   if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add audio stream");
 
+  ret = add_id3_stream(ictx, octx);
+  if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add timed ID3 stream");
+
   if (!(fmt->flags & AVFMT_NOFILE)) {
     ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Error re-opening output file");
@@ -485,6 +568,21 @@ int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost)
   }
   */
 
+  if (octx->id3i >= 0 && ost->index == octx->id3i) {
+    // tags written here and those of the input share the stream, so keep
+    // its timestamps increasing
+    if (pkt->dts != AV_NOPTS_VALUE && octx->last_id3_dts != AV_NOPTS_VALUE &&
+        pkt->dts <= octx->last_id3_dts) {
+      pkt->dts = octx->last_id3_dts + 1;
+      if (pkt->pts != AV_NOPTS_VALUE && pkt->pts < pkt->dts) pkt->pts = pkt->dts;
+    }
+    if (pkt->dts != AV_NOPTS_VALUE) octx->last_id3_dts = pkt->dts;
+  } else if (octx->id3i >= 0 && pkt->dts != AV_NOPTS_VALUE) {
+    // tags due by now go first
+    int ret = write_id3_tags(octx, av_rescale_q(pkt->dts, ost->time_base, AV_TIME_BASE_Q));
+    if (ret < 0) return ret;
+  }
+
   // drop any preroll audio. may need to drop multiple packets for multichannel
   // XXX this breaks if preroll isn't exactly one AVPacket or drop_ts == 0
   //     hasn't been a problem in practice (so far)
@@ -594,18 +692,20 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
       frame = NULL;
     } else if (ret < 0) goto proc_cleanup;
 
+    // audio trimmed by the filters is already clipped
+    int clip_audio = is_audio && !octx->trim_audio;
     if (is_video && !octx->clip_start_pts_found && frame) {
       octx->clip_start_pts = frame->pts;
       octx->clip_start_pts_found = 1;
     }
-    if (is_audio && !octx->clip_audio_start_pts_found && frame) {
+    if (clip_audio && !octx->clip_audio_start_pts_found && frame) {
       octx->clip_audio_start_pts = frame->pts;
       octx->clip_audio_start_pts_found = 1;
     }
 
 
     if (is_video && octx->clip_to && octx->clip_start_pts_found && frame && frame->pts > octx->clip_to_pts + octx->clip_start_pts) goto skip;
-    if (is_audio && octx->clip_to && octx->clip_audio_start_pts_found && frame && frame->pts > octx->clip_audio_to_pts + octx->clip_audio_start_pts) {
+    if (clip_audio && octx->clip_to && octx->clip_audio_start_pts_found && frame && frame->pts > octx->clip_audio_to_pts + octx->clip_audio_start_pts) {
       goto skip;
     }
 
@@ -623,14 +723,14 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
           frame->pts -= octx->clip_from_pts + octx->clip_start_pts;
         }
       }
-    } else if (octx->clip_from_pts && !octx->clip_started) {
+    } else if (clip_audio && octx->clip_from_pts && !octx->clip_started) {
       // we want first frame to be video frame
       goto skip;
     }
-    if (is_audio && octx->clip_from && frame && frame->pts < octx->clip_audio_from_pts + octx->clip_audio_start_pts) {
+    if (clip_audio && octx->clip_from && frame && frame->pts < octx->clip_audio_from_pts + octx->clip_audio_start_pts) {
       goto skip;
     }
-    if (is_audio && octx->clip_from && frame) {
+    if (clip_audio && octx->clip_from && frame) {
       frame->pts -= octx->clip_audio_from_pts + octx->clip_audio_start_pts;
     }
 
@@ -666,14 +766,15 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
 
     // Check for runaway encodes where the FPS filter produces too many frames
     // Unclear what causes these
-    if (is_video && frame && ictx->decoded_res && ictx->decoded_res->frames > 0) {
+    if (is_video && frame && ictx->max_frame_ratio &&
+        ictx->decoded_res && ictx->decoded_res->frames > 0) {
       if (ictx->ic && ictx->ic->iformat &&
           !strcmp(ictx->ic->iformat->name, "image2")) {
         // Image sequence input can legitimately expand frame counts.
         goto after_runaway_check;
       }
       int64_t decoded_frames = ictx->decoded_res->frames;
-      if ((int64_t)octx->res->frames + 1 > 25 * decoded_frames) {
+      if ((int64_t)octx->res->frames + 1 > ictx->max_frame_ratio * decoded_frames) {
         av_frame_unref(frame);
         ret = lpms_ERR_ENC_RUNAWAY;
         goto proc_cleanup;
@@ -3,8 +3,14 @@
 #include <libavfilter/avfilter.h>
 #include <stdbool.h>
 #include <libavutil/md5.h>
+#include <libavutil/display.h>
+#include <libavutil/pixdesc.h>
+#include <libavutil/avstring.h>
+#include <libswscale/swscale.h>
 #include "extras.h"
+#include "decoder.h"
 #include "logging.h"
+#include "logger.h"
 
 #define MAX_AMISMATCH 10
 #define INC_MD5_COUNT 300
@@ -31,7 +37,30 @@ struct buffer_data {
 // Segmenter
 //
 
-int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char *seg_start)
+// Whether the H.264 packet holds an IDR slice, in length prefixed NAL units
+// as described by the extradata, or in Annex B ones
+static int has_idr(AVCodecParameters *par, AVPacket *pkt)
+{
+  const uint8_t *p = pkt->data, *end = pkt->data + pkt->size;
+  if (par->extradata_size > 4 && par->extradata[0] == 1) {
+    int len_size = (par->extradata[4] & 3) + 1;
+    while (end - p > len_size) {
+      int64_t n = 0;
+      for (int i = 0; i < len_size; i++) n = n << 8 | p[i];
+      p += len_size;
+      if (n <= 0 || n > end - p) break;
+      if ((p[0] & 0x1f) == 5) return 1;
+      p += n;
+    }
+    return 0;
+  }
+  for (; end - p > 3; p++) {
+    if (!p[0] && !p[1] && p[2] == 1 && (p[3] & 0x1f) == 5) return 1;
+  }
+  return 0;
+}
+
+int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char *seg_start, int enforce_kf)
 {
 #define r2h_err(str) {\
   if (!ret) ret = 1; \
@@ -98,6 +127,10 @@ int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char
     else goto r2hloop_end;
     ist = ic->streams[stream_map[pkt->stream_index]];
     ost = oc->streams[pkt->stream_index];
+    // the hls muxer cuts at video keyframes, so only let it cut at IDR frames
+    if (enforce_kf && ost->codecpar->codec_id == AV_CODEC_ID_H264 &&
+        (pkt->flags & AV_PKT_FLAG_KEY) && !has_idr(ost->codecpar, pkt))
+      pkt->flags &= ~AV_PKT_FLAG_KEY;
     int64_t dts_next = pkt->dts, dts_prev = prev_ts[pkt->stream_index];
     if (oc->streams[pkt->stream_index]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO &&
         AV_NOPTS_VALUE == dts_prev &&
@@ -190,6 +223,8 @@ int lpms_get_codec_info(char *fname, pcodec_info out)
   if (audio_present && ac->name) {
       strncpy(out->audio_codec, ac->name, MIN(strlen(out->audio_codec), strlen(ac->name))+1);
       out->audio_bit_rate = ic->streams[astream]->codecpar->bit_rate;
+      out->audio_sample_rate = ic->streams[astream]->codecpar->sample_rate;
+      out->audio_channels = ic->streams[astream]->codecpar->ch_layout.nb_channels;
   } else {
       // Indicate failure to extract audio codec from given container
       out->audio_codec[0] = 0;
@@ -200,6 +235,371 @@ close_format_context:
   return ret;
 }
 
+static void probe_copy_str(char *dst, const char *src)
+{
+  if (!src) { dst[0] = 0; return; }
+  av_strlcpy(dst, src, PROBE_STR_LEN);
+}
+
+static double probe_ts_to_sec(int64_t ts, AVRational tb)
+{
+  if (ts == AV_NOPTS_VALUE) return -1;
+  return ts * av_q2d(tb);
+}
+
+static const char* probe_field_order(enum AVFieldOrder fo)
+{
+  switch (fo) {
+    case AV_FIELD_PROGRESSIVE: return "progressive";
+    case AV_FIELD_TT: return "tt";
+    case AV_FIELD_BB: return "bb";
+    case AV_FIELD_TB: return "tb";
+    case AV_FIELD_BT: return "bt";
+    default: return NULL;
+  }
+}
+
+// Fill in details for every stream in the container. Streams beyond
+// PROBE_MAX_STREAMS are counted in nb_streams but otherwise skipped.
+// returns: 0 on success, <0 on error
+int lpms_probe_media(char *fname, probe_info *out)
+{
+  AVFormatContext *ic = NULL;
+  int ret = 0;
+
+  ret = avformat_open_input(&ic, fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(probe_cleanup, "Unable to open input for probing");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(probe_cleanup, "Unable to find stream info for probing");
+
+  if (ic->iformat) probe_copy_str(out->format_name, ic->iformat->name);
+  out->bit_rate = ic->bit_rate;
+  out->start_time = probe_ts_to_sec(ic->start_time, AV_TIME_BASE_Q);
+  out->duration = probe_ts_to_sec(ic->duration, AV_TIME_BASE_Q);
+  out->nb_streams = ic->nb_streams;
+
+  for (int i = 0; i < ic->nb_streams && i < PROBE_MAX_STREAMS; i++) {
+    AVStream *st = ic->streams[i];
+    AVCodecParameters *par = st->codecpar;
+    probe_stream *ps = &out->streams[i];
+    AVDictionaryEntry *lang = av_dict_get(st->metadata, "language", NULL, 0);
+
+    ps->index = st->index;
+    ps->media_type = par->codec_type;
+    probe_copy_str(ps->codec, avcodec_get_name(par->codec_id));
+    probe_copy_str(ps->profile, avcodec_profile_name(par->codec_id, par->profile));
+    ps->level = par->level;
+    ps->bit_rate = par->bit_rate;
+    ps->tb_num = st->time_base.num;
+    ps->tb_den = st->time_base.den;
+    ps->start_time = probe_ts_to_sec(st->start_time, st->time_base);
+    ps->duration = probe_ts_to_sec(st->duration, st->time_base);
+    probe_copy_str(ps->language, lang ? lang->value : NULL);
+    if (par->extradata && par->extradata_size <= PROBE_EXTRADATA_LEN) {
+      memcpy(ps->extradata, par->extradata, par->extradata_size);
+      ps->extradata_size = par->extradata_size;
+    }
+
+    if (AVMEDIA_TYPE_VIDEO == par->codec_type) {
+      AVRational sar = av_guess_sample_aspect_ratio(ic, st, NULL);
+      const AVPacketSideData *sd = NULL;
+      ps->fr_num = st->r_frame_rate.num;
+      ps->fr_den = st->r_frame_rate.den;
+      ps->avg_fr_num = st->avg_frame_rate.num;
+      ps->avg_fr_den = st->avg_frame_rate.den;
+      ps->width = par->width;
+      ps->height = par->height;
+      ps->pixel_format = par->format;
+      if (sar.num && sar.den) {
+        AVRational dar;
+        av_reduce(&dar.num, &dar.den, (int64_t)par->width * sar.num,
+                  (int64_t)par->height * sar.den, 1024*1024);
+        ps->sar_num = sar.num;
+        ps->sar_den = sar.den;
+        ps->dar_num = dar.num;
+        ps->dar_den = dar.den;
+      }
+      sd = av_packet_side_data_get(par->coded_side_data, par->nb_coded_side_data,
+                                   AV_PKT_DATA_DISPLAYMATRIX);
+      if (sd && sd->size >= 9 * sizeof(int32_t)) {
+        double rot = av_display_rotation_get((const int32_t *)sd->data);
+        if (!isnan(rot)) ps->rotation = rot;
+      }
+      if (AVCOL_RANGE_UNSPECIFIED != par->color_range)
+        probe_copy_str(ps->color_range, av_color_range_name(par->color_range));
+      if (AVCOL_SPC_UNSPECIFIED != par->color_space)
+        probe_copy_str(ps->color_space, av_color_space_name(par->color_space));
+      if (AVCOL_TRC_UNSPECIFIED != par->color_trc)
+        probe_copy_str(ps->color_transfer, av_color_transfer_name(par->color_trc));
+      if (AVCOL_PRI_UNSPECIFIED != par->color_primaries)
+        probe_copy_str(ps->color_primaries, av_color_primaries_name(par->color_primaries));
+      probe_copy_str(ps->field_order, probe_field_order(par->field_order));
+    } else if (AVMEDIA_TYPE_AUDIO == par->codec_type) {
+      char layout[PROBE_STR_LEN] = {0};
+      if (av_channel_layout_describe(&par->ch_layout, layout, sizeof(layout)) >= 0) {
+        probe_copy_str(ps->channel_layout, layout);
+      }
+      ps->channels = par->ch_layout.nb_channels;
+      ps->sample_rate = par->sample_rate;
+    }
+  }
+  ret = 0;
+
+probe_cleanup:
+  if (ic) avformat_close_input(&ic);
+  return ret;
+}
+
+// Whether the packet holds an IDR picture. Packets are length prefixed if
+// the extradata is avcC / hvcC, and in Annex B otherwise. Codecs without IDR
+// pictures go by the keyframe flag.
+static int gop_packet_idr(AVCodecParameters *par, AVPacket *pkt)
+{
+  const uint8_t *p = pkt->data, *end = pkt->data + pkt->size;
+  int hevc = par->codec_id == AV_CODEC_ID_HEVC, len_size = 0;
+  if (par->codec_id != AV_CODEC_ID_H264 && !hevc) return !!(pkt->flags & AV_PKT_FLAG_KEY);
+  if (par->extradata_size > 0 && par->extradata[0] == 1) {
+    if (!hevc && par->extradata_size >= 7) len_size = (par->extradata[4] & 3) + 1;
+    else if (hevc && par->extradata_size >= 23) len_size = (par->extradata[21] & 3) + 1;
+  }
+  while (p < end) {
+    const uint8_t *nal = NULL;
+    if (len_size) {
+      uint32_t n = 0;
+      int i;
+      if (end - p < len_size) break;
+      for (i = 0; i < len_size; i++) n = (n << 8) | p[i];
+      nal = p + len_size;
+      if (n > end - nal) break;
+      p = nal + n;
+      if (!n) continue;
+    } else {
+      while (end - p >= 3 && (p[0] || p[1] || p[2] != 1)) p++;
+      if (end - p < 4) break;
+      nal = p = p + 3;
+    }
+    if (hevc) {
+      int type = (nal[0] >> 1) & 0x3f;
+      if (type == 19 || type == 20) return 1; // IDR_W_RADL, IDR_N_LP
+    } else if ((nal[0] & 0x1f) == 5) return 1;
+  }
+  return 0;
+}
+
+// Demux the first video stream and record timestamps, keyframe flags and
+// picture types of every packet. Picture types come from the bitstream
+// parser so no decoding is done.
+// returns: 0 on success, <0 on error
+int lpms_analyze_gop(char *fname, gop_info *out)
+{
+  AVFormatContext *ic = NULL;
+  AVCodecContext *avctx = NULL;
+  AVCodecParserContext *parser = NULL;
+  AVPacket *pkt = NULL;
+  AVStream *st = NULL;
+  int ret = 0, vstream = -1, allocated = 0;
+
+  ret = avformat_open_input(&ic, fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(gop_cleanup, "Unable to open input for GOP analysis");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(gop_cleanup, "Unable to find stream info for GOP analysis");
+  vstream = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, NULL, 0);
+  if (vstream < 0) {
+    ret = vstream;
+    LPMS_ERR(gop_cleanup, "No video stream for GOP analysis");
+  }
+  st = ic->streams[vstream];
+  probe_copy_str(out->codec, avcodec_get_name(st->codecpar->codec_id));
+  out->tb_num = st->time_base.num;
+  out->tb_den = st->time_base.den;
+
+  avctx = avcodec_alloc_context3(NULL);
+  if (!avctx) LPMS_ERR(gop_cleanup, "Unable to allocate codec context for GOP analysis");
+  ret = avcodec_parameters_to_context(avctx, st->codecpar);
+  if (ret < 0) LPMS_ERR(gop_cleanup, "Unable to copy codec parameters for GOP analysis");
+  // Not all codecs have parsers; picture types are reported as unknown then
+  parser = av_parser_init(st->codecpar->codec_id);
+  if (parser) parser->flags |= PARSER_FLAG_COMPLETE_FRAMES;
+
+  pkt = av_packet_alloc();
+  if (!pkt) LPMS_ERR(gop_cleanup, "Unable to allocate packet for GOP analysis");
+  while ((ret = av_read_frame(ic, pkt)) >= 0) {
+    gop_frame *f = NULL;
+    if (pkt->stream_index != vstream) {
+      av_packet_unref(pkt);
+      continue;
+    }
+    if (out->nb_frames >= allocated) {
+      int size = allocated ? allocated * 2 : 256;
+      gop_frame *frames = av_realloc_array(out->frames, size, sizeof(gop_frame));
+      if (!frames) {
+        av_packet_unref(pkt);
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(gop_cleanup, "Unable to allocate frames for GOP analysis");
+      }
+      out->frames = frames;
+      allocated = size;
+    }
+    f = &out->frames[out->nb_frames++];
+    // Fall back to whichever timestamp is available
+    f->pts = pkt->pts != AV_NOPTS_VALUE ? pkt->pts : pkt->dts;
+    f->dts = pkt->dts != AV_NOPTS_VALUE ? pkt->dts : pkt->pts;
+    f->duration = pkt->duration;
+    f->key = !!(pkt->flags & AV_PKT_FLAG_KEY);
+    f->idr = f->key && gop_packet_idr(st->codecpar, pkt);
+    f->pict_type = AV_PICTURE_TYPE_NONE;
+    if (parser) {
+      uint8_t *pout = NULL;
+      int pout_size = 0;
+      av_parser_parse2(parser, avctx, &pout, &pout_size, pkt->data, pkt->size,
+                       pkt->pts, pkt->dts, pkt->pos);
+      f->pict_type = parser->pict_type;
+    }
+    av_packet_unref(pkt);
+  }
+  if (ret == AVERROR_EOF) ret = 0;
+  if (ret < 0) LPMS_ERR(gop_cleanup, "Unable to read packets for GOP analysis");
+
+gop_cleanup:
+  if (ret < 0) lpms_gop_info_free(out);
+  if (pkt) av_packet_free(&pkt);
+  if (parser) av_parser_close(parser);
+  if (avctx) avcodec_free_context(&avctx);
+  if (ic) avformat_close_input(&ic);
+  return ret;
+}
+
+void lpms_gop_info_free(gop_info *info)
+{
+  if (!info) return;
+  av_freep(&info->frames);
+  info->nb_frames = 0;
+}
+
+int lpms_merge(char **inputs, int nb_inputs, char *oname, char *muxer)
+{
+  int ret = 0;
+  AVFormatContext **ics = NULL;
+  AVFormatContext *oc = NULL;
+  AVPacket *pkt = NULL;
+  int **maps = NULL, *nb_maps = NULL, *eof = NULL;
+  int64_t *cur = NULL;
+  int has_id3 = 0;
+
+  ics = av_calloc(nb_inputs, sizeof(*ics));
+  maps = av_calloc(nb_inputs, sizeof(*maps));
+  nb_maps = av_calloc(nb_inputs, sizeof(*nb_maps));
+  eof = av_calloc(nb_inputs, sizeof(*eof));
+  cur = av_calloc(nb_inputs, sizeof(*cur));
+  pkt = av_packet_alloc();
+  if (!ics || !maps || !nb_maps || !eof || !cur || !pkt) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(merge_cleanup, "Unable to allocate merge context");
+  }
+
+  ret = avformat_alloc_output_context2(&oc, NULL, muxer, oname);
+  if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to alloc merge output");
+
+  // Streams of each input are added in order, one after another. Every part
+  // carries the same timed ID3, so only the first of those is kept.
+  for (int i = 0; i < nb_inputs; i++) {
+    ret = avformat_open_input(&ics[i], inputs[i], NULL, NULL);
+    if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to open merge input");
+    ret = avformat_find_stream_info(ics[i], NULL);
+    if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to find merge input info");
+    maps[i] = av_calloc(ics[i]->nb_streams, sizeof(**maps));
+    if (!maps[i]) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(merge_cleanup, "Unable to allocate merge stream map");
+    }
+    // streams showing up while reading aren't mapped
+    nb_maps[i] = ics[i]->nb_streams;
+    cur[i] = INT64_MIN;
+    for (int j = 0; j < ics[i]->nb_streams; j++) {
+      AVStream *ist = ics[i]->streams[j];
+      maps[i][j] = -1;
+      if (AV_CODEC_ID_TIMED_ID3 == ist->codecpar->codec_id) {
+        if (has_id3) continue;
+        has_id3 = 1;
+      }
+      // the muxer can't write SCTE-35; it is carried over by the caller
+      if (AV_CODEC_ID_SCTE_35 == ist->codecpar->codec_id) continue;
+      AVStream *st = avformat_new_stream(oc, NULL);
+      if (!st) {
+        ret = AVERROR(ENOMEM);
+        LPMS_ERR(merge_cleanup, "Unable to alloc merge stream");
+      }
+      st->time_base = ist->time_base;
+      ret = avcodec_parameters_copy(st->codecpar, ist->codecpar);
+      if (ret < 0) LPMS_ERR(merge_cleanup, "Error copying merge stream params");
+      // Sometimes the codec tag is wonky for some reason, so correct it
+      ret = av_codec_get_tag2(oc->oformat->codec_tag, st->codecpar->codec_id, &st->codecpar->codec_tag);
+      av_dict_copy(&st->metadata, ist->metadata, 0);
+      st->disposition = ist->disposition;
+      maps[i][j] = st->index;
+    }
+  }
+  if (ics[0]->metadata) av_dict_copy(&oc->metadata, ics[0]->metadata, 0);
+
+  if (!(oc->oformat->flags & AVFMT_NOFILE)) {
+    ret = avio_open(&oc->pb, oname, AVIO_FLAG_WRITE);
+    if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to open merge output file");
+  }
+  ret = avformat_write_header(oc, NULL);
+  if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to write merge header");
+
+  while (1) {
+    // Read from whichever input is furthest behind to keep packets interleaved
+    int next = -1;
+    for (int i = 0; i < nb_inputs; i++) {
+      if (!eof[i] && (next < 0 || cur[i] < cur[next])) next = i;
+    }
+    if (next < 0) break;
+    ret = av_read_frame(ics[next], pkt);
+    if (AVERROR_EOF == ret) {
+      eof[next] = 1;
+      continue;
+    } else if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to read merge input");
+    AVStream *ist = ics[next]->streams[pkt->stream_index];
+    if (pkt->dts != AV_NOPTS_VALUE) {
+      cur[next] = av_rescale_q(pkt->dts, ist->time_base, AV_TIME_BASE_Q);
+    }
+    if (pkt->stream_index >= nb_maps[next] || maps[next][pkt->stream_index] < 0) {
+      av_packet_unref(pkt);
+      continue;
+    }
+    AVStream *ost = oc->streams[maps[next][pkt->stream_index]];
+    av_packet_rescale_ts(pkt, ist->time_base, ost->time_base);
+    pkt->stream_index = ost->index;
+    pkt->pos = -1;
+    ret = av_interleaved_write_frame(oc, pkt);
+    if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to write merged packet");
+  }
+  ret = av_write_trailer(oc);
+  if (ret < 0) LPMS_ERR(merge_cleanup, "Unable to write merge trailer");
+
+merge_cleanup:
+  if (ics) {
+    for (int i = 0; i < nb_inputs; i++) {
+      if (ics[i]) avformat_close_input(&ics[i]);
+    }
+  }
+  if (oc) {
+    if (!(oc->oformat->flags & AVFMT_NOFILE) && oc->pb) avio_closep(&oc->pb);
+    avformat_free_context(oc);
+  }
+  av_packet_free(&pkt);
+  if (maps) {
+    for (int i = 0; i < nb_inputs; i++) av_free(maps[i]);
+  }
+  av_free(ics);
+  av_free(maps);
+  av_free(nb_maps);
+  av_free(eof);
+  av_free(cur);
+  return ret;
+}
+
 //// compare two signature files whether those matches or not.
 //// @param signpath1        full path of the first signature file.
 //// @param signpath2        full path of the second signature file.
@@ -222,6 +622,34 @@ int lpms_compare_sign_bybuffer(void *buffer1, int len1, void *buffer2, int len2)
   return ret;
 }
 
+// Picks the match out of the lines the signature filter logs, eg
+// "matching of video 0 at 1.000000 and 1 at 0.000000, 30 frames matching"
+static void sign_match_line(void *opaque, const char *line)
+{
+  sign_match *match = opaque;
+  int v1, v2, frames;
+  double first, second;
+  if (sscanf(line, "matching of video %d at %lf and %d at %lf, %d frames matching",
+             &v1, &first, &v2, &second, &frames) == 5) {
+    match->first = first;
+    match->second = second;
+    match->frames = frames;
+  }
+}
+
+// compare two signature buffers like lpms_compare_sign_bybuffer, also
+// reporting the match found by the signature filter.
+// @return  <0: error =0: no matchiing 1: partial matching 2: whole matching.
+int lpms_compare_sign_detailed(void *buffer1, int len1, void *buffer2, int len2, sign_match *match)
+{
+  memset(match, 0, sizeof *match);
+  lpms_log_capture(sign_match_line, match);
+  int ret = avfilter_compare_sign_bybuff(buffer1, len1, buffer2, len2);
+  lpms_log_capture(NULL, NULL);
+  if (ret <= 0) match->frames = 0;
+  return ret;
+}
+
 static int get_filesize(const char *filename)
 {
     int fileLength = 0;
@@ -464,3 +892,322 @@ int lpms_compare_video_bypath(char *vpath1, char *vpath2)
 
   return ret;
 }
+
+static int add_fingerprint(video_fingerprint *out, int *allocated, struct SwsContext **sws,
+                           AVFrame *frame, AVRational tb)
+{
+  int ret = 0;
+  int fp_size = FINGERPRINT_SIZE * FINGERPRINT_SIZE;
+  int64_t pts = frame->best_effort_timestamp;
+  if (pts == AV_NOPTS_VALUE) {
+    LPMS_WARN("Skipping frame without timestamp for fingerprint");
+    return 0;
+  }
+  if (out->nb_frames >= *allocated) {
+    int size = *allocated ? *allocated * 2 : 256;
+    double *times = av_realloc_array(out->times, size, sizeof(double));
+    if (!times) return AVERROR(ENOMEM);
+    out->times = times;
+    uint8_t *luma = av_realloc_array(out->luma, size, fp_size);
+    if (!luma) return AVERROR(ENOMEM);
+    out->luma = luma;
+    *allocated = size;
+  }
+  // Area averaging keeps the fingerprint insensitive to coding noise
+  *sws = sws_getCachedContext(*sws, frame->width, frame->height, frame->format,
+                              FINGERPRINT_SIZE, FINGERPRINT_SIZE, AV_PIX_FMT_GRAY8,
+                              SWS_AREA, NULL, NULL, NULL);
+  if (!*sws) return AVERROR(EINVAL);
+  uint8_t *dst[4] = { out->luma + (size_t)out->nb_frames * fp_size };
+  int dst_stride[4] = { FINGERPRINT_SIZE };
+  ret = sws_scale(*sws, (const uint8_t * const *)frame->data, frame->linesize,
+                  0, frame->height, dst, dst_stride);
+  if (ret < 0) return ret;
+  out->times[out->nb_frames++] = pts * av_q2d(tb);
+  return 0;
+}
+
+// Decode the video of a file, or of a buffer if one is given, into
+// downscaled luma fingerprints of every frame.
+// @return  <0: error, 0: success. Free the output with lpms_video_fingerprint_free.
+int lpms_video_fingerprint(char *fname, void *buffer, int len, video_fingerprint *out)
+{
+  int ret = 0, vstream = -1, allocated = 0, eof = 0;
+  struct buffer_data bd = { .ptr = buffer, .size = len };
+  AVFormatContext *ic = NULL;
+  AVIOContext *avio_in = NULL;
+  const AVCodec *codec = NULL;
+  AVCodecContext *dc = NULL;
+  struct SwsContext *sws = NULL;
+  AVPacket *pkt = NULL;
+  AVFrame *frame = NULL;
+  AVRational tb;
+
+  if (buffer) {
+    size_t avio_ctx_buffer_size = 4096;
+    uint8_t *avio_ctx_buffer = av_malloc(avio_ctx_buffer_size);
+    if (!avio_ctx_buffer) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(fp_cleanup, "Error allocating buffer for fingerprint");
+    }
+    avio_in = avio_alloc_context(avio_ctx_buffer, avio_ctx_buffer_size, 0, &bd, &read_packet, NULL, NULL);
+    if (!avio_in) {
+      av_free(avio_ctx_buffer);
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(fp_cleanup, "Error allocating context for fingerprint");
+    }
+    ic = avformat_alloc_context();
+    if (!ic) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(fp_cleanup, "Error allocating avformat context for fingerprint");
+    }
+    ic->pb = avio_in;
+    ic->flags = AVFMT_FLAG_CUSTOM_IO;
+    fname = "";
+  }
+  ret = avformat_open_input(&ic, fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to open input for fingerprint");
+  ret = avformat_find_stream_info(ic, NULL);
+  if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to find stream info for fingerprint");
+  vstream = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
+  if (vstream < 0) {
+    ret = vstream;
+    LPMS_ERR(fp_cleanup, "No video stream for fingerprint");
+  }
+  tb = ic->streams[vstream]->time_base;
+
+  dc = avcodec_alloc_context3(codec);
+  if (!dc) LPMS_ERR(fp_cleanup, "Unable to allocate decoder for fingerprint");
+  ret = avcodec_parameters_to_context(dc, ic->streams[vstream]->codecpar);
+  if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to copy codec parameters for fingerprint");
+  ret = avcodec_open2(dc, codec, NULL);
+  if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to open decoder for fingerprint");
+
+  pkt = av_packet_alloc();
+  frame = av_frame_alloc();
+  if (!pkt || !frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(fp_cleanup, "Unable to allocate frames for fingerprint");
+  }
+  while (!eof) {
+    ret = av_read_frame(ic, pkt);
+    if (ret == AVERROR_EOF) {
+      eof = 1;
+      ret = avcodec_send_packet(dc, NULL); // flush the decoder
+    } else if (ret < 0) {
+      LPMS_ERR(fp_cleanup, "Unable to read input for fingerprint");
+    } else if (pkt->stream_index != vstream) {
+      av_packet_unref(pkt);
+      continue;
+    } else {
+      ret = avcodec_send_packet(dc, pkt);
+      av_packet_unref(pkt);
+      // Leading packets may reference frames before the start of the input
+      if (ret == AVERROR_INVALIDDATA) continue;
+    }
+    if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to decode for fingerprint");
+    while ((ret = avcodec_receive_frame(dc, frame)) >= 0) {
+      ret = add_fingerprint(out, &allocated, &sws, frame, tb);
+      av_frame_unref(frame);
+      if (ret < 0) LPMS_ERR(fp_cleanup, "Unable to fingerprint frame");
+    }
+    if (ret != AVERROR(EAGAIN) && ret != AVERROR_EOF) LPMS_ERR(fp_cleanup, "Unable to receive frame for fingerprint");
+  }
+  ret = 0;
+
+fp_cleanup:
+  if (ret < 0) lpms_video_fingerprint_free(out);
+  if (sws) sws_freeContext(sws);
+  if (frame) av_frame_free(&frame);
+  if (pkt) av_packet_free(&pkt);
+  if (dc) avcodec_free_context(&dc);
+  if (ic) avformat_close_input(&ic);
+  /* note: the internal buffer could have changed, and be != avio_ctx_buffer */
+  if (avio_in) av_freep(&avio_in->buffer);
+  avio_context_free(&avio_in);
+  return ret;
+}
+
+void lpms_video_fingerprint_free(video_fingerprint *fp)
+{
+  if (!fp) return;
+  av_freep(&fp->times);
+  av_freep(&fp->luma);
+  fp->nb_frames = 0;
+}
+
+// Decode the frame shown at target, in stream timebase, into shown: the last
+// frame presented at or before target, or the first frame if target precedes it
+static int decode_shown_frame(struct input_ctx *ictx, int64_t target, AVPacket *pkt,
+                              AVFrame *frame, AVFrame *shown)
+{
+  int ret = 0, eof = 0, has_shown = 0;
+  AVCodecContext *vc = ictx->vc;
+
+  ret = av_seek_frame(ictx->ic, ictx->vi, target, AVSEEK_FLAG_BACKWARD);
+  if (ret < 0) LPMS_ERR_RETURN("Unable to seek for frame extraction");
+  avcodec_flush_buffers(vc);
+  av_frame_unref(shown);
+  while (!eof) {
+    ret = av_read_frame(ictx->ic, pkt);
+    if (ret == AVERROR_EOF) {
+      eof = 1;
+      ret = avcodec_send_packet(vc, NULL); // flush the decoder
+    } else if (ret < 0) {
+      LPMS_ERR_RETURN("Unable to read input for frame extraction");
+    } else if (pkt->stream_index != ictx->vi) {
+      av_packet_unref(pkt);
+      continue;
+    } else {
+      ret = avcodec_send_packet(vc, pkt);
+      av_packet_unref(pkt);
+      // Leading packets may reference frames before the seek point
+      if (ret == AVERROR_INVALIDDATA) continue;
+    }
+    if (ret < 0) LPMS_ERR_RETURN("Unable to decode for frame extraction");
+    while ((ret = avcodec_receive_frame(vc, frame)) >= 0) {
+      int64_t pts = frame->best_effort_timestamp;
+      if (has_shown && pts != AV_NOPTS_VALUE && pts > target) {
+        av_frame_unref(frame);
+        return 0;
+      }
+      av_frame_unref(shown);
+      av_frame_move_ref(shown, frame);
+      shown->pts = pts;
+      has_shown = 1;
+      if (pts != AV_NOPTS_VALUE && pts >= target) return 0;
+    }
+    if (ret != AVERROR(EAGAIN) && ret != AVERROR_EOF) LPMS_ERR_RETURN("Unable to receive frame for frame extraction");
+  }
+  if (!has_shown) {
+    ret = AVERROR_EOF;
+    LPMS_ERR_RETURN("No frame decoded for frame extraction");
+  }
+  return 0;
+}
+
+static int convert_frame(AVFrame *frame, AVFrame *sw_frame, struct SwsContext **sws,
+                         int width, int height, int ycbcr, extracted_frame *out)
+{
+  int ret = 0;
+  if (frame->hw_frames_ctx) {
+    // hwdownload
+    av_frame_unref(sw_frame);
+    ret = av_hwframe_transfer_data(sw_frame, frame, 0);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to download frame for frame extraction");
+    ret = av_frame_copy_props(sw_frame, frame);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to copy frame properties for frame extraction");
+    frame = sw_frame;
+  }
+  // A single dimension keeps the aspect ratio of the picture
+  if (!width && !height) {
+    width = frame->width;
+    height = frame->height;
+  } else if (!width) {
+    width = FFMAX(1, av_rescale(height, frame->width, frame->height));
+  } else if (!height) {
+    height = FFMAX(1, av_rescale(width, frame->height, frame->width));
+  }
+  *sws = sws_getCachedContext(*sws, frame->width, frame->height, frame->format,
+                              width, height, ycbcr ? AV_PIX_FMT_YUV420P : AV_PIX_FMT_RGBA,
+                              SWS_BICUBIC, NULL, NULL, NULL);
+  if (!*sws) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR_RETURN("Unable to scale for frame extraction");
+  }
+  // Take the matrix and range of the source into account. YCbCr comes out
+  // like JPEG, which is what Go's image.YCbCr expects.
+  sws_setColorspaceDetails(*sws, sws_getCoefficients(frame->colorspace),
+                           frame->color_range == AVCOL_RANGE_JPEG,
+                           sws_getCoefficients(ycbcr ? SWS_CS_ITU601 : SWS_CS_DEFAULT),
+                           1, 0, 1 << 16, 1 << 16);
+  int chroma_w = (width + 1) / 2, chroma_h = (height + 1) / 2;
+  int dst_stride[4] = { width * 4 };
+  size_t sizes[3] = { (size_t)width * height * 4 };
+  if (ycbcr) {
+    dst_stride[0] = width;
+    dst_stride[1] = dst_stride[2] = chroma_w;
+    sizes[0] = (size_t)width * height;
+    sizes[1] = sizes[2] = (size_t)chroma_w * chroma_h;
+  }
+  uint8_t *dst[4] = { NULL };
+  for (int i = 0; i < 3 && sizes[i]; i++) {
+    out->planes[i] = av_malloc(sizes[i]);
+    if (!out->planes[i]) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR_RETURN("Unable to allocate frame extraction output");
+    }
+    dst[i] = out->planes[i];
+  }
+  ret = sws_scale(*sws, (const uint8_t * const *)frame->data, frame->linesize,
+                  0, frame->height, dst, dst_stride);
+  if (ret < 0) LPMS_ERR_RETURN("Unable to convert frame for frame extraction");
+  out->width = width;
+  out->height = height;
+  return 0;
+}
+
+// Decode the frames shown at the given times and convert them to RGBA, or
+// YCbCr if asked for.
+// @param timestamps     times in AV_TIME_BASE units, relative to the input start
+// @param width, height  output size; zero keeps the input size or aspect ratio
+// @return  <0: error, 0: success. Free the output with lpms_extracted_frames_free.
+int lpms_extract_frames(input_params *params, int64_t *timestamps, int nb_timestamps,
+                        int width, int height, int ycbcr, extracted_frame *out)
+{
+  int ret = 0;
+  struct input_ctx ictx = { 0 };
+  struct SwsContext *sws = NULL;
+  AVPacket *pkt = NULL;
+  AVFrame *frame = NULL, *shown = NULL, *sw_frame = NULL;
+  AVStream *st = NULL;
+  int64_t start = 0;
+
+  memset(out, 0, nb_timestamps * sizeof(extracted_frame));
+  ictx.da = 1; // no audio needed
+  ret = open_input(params, &ictx);
+  if (ret < 0) LPMS_ERR(extract_cleanup, "Unable to open input for frame extraction");
+  if (!ictx.vc) {
+    ret = AVERROR_STREAM_NOT_FOUND;
+    LPMS_ERR(extract_cleanup, "No video stream for frame extraction");
+  }
+  st = ictx.ic->streams[ictx.vi];
+  if (st->start_time != AV_NOPTS_VALUE) start = st->start_time;
+
+  pkt = av_packet_alloc();
+  frame = av_frame_alloc();
+  shown = av_frame_alloc();
+  sw_frame = av_frame_alloc();
+  if (!pkt || !frame || !shown || !sw_frame) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(extract_cleanup, "Unable to allocate frames for frame extraction");
+  }
+  for (int i = 0; i < nb_timestamps; i++) {
+    int64_t target = start + av_rescale_q(timestamps[i], AV_TIME_BASE_Q, st->time_base);
+    ret = decode_shown_frame(&ictx, target, pkt, frame, shown);
+    if (ret < 0) goto extract_cleanup;
+    ret = convert_frame(shown, sw_frame, &sws, width, height, ycbcr, &out[i]);
+    if (ret < 0) goto extract_cleanup;
+    if (shown->pts != AV_NOPTS_VALUE) {
+      out[i].pts = av_rescale_q(shown->pts - start, st->time_base, AV_TIME_BASE_Q);
+    }
+  }
+
+extract_cleanup:
+  if (ret < 0) lpms_extracted_frames_free(out, nb_timestamps);
+  if (sws) sws_freeContext(sws);
+  if (sw_frame) av_frame_free(&sw_frame);
+  if (shown) av_frame_free(&shown);
+  if (frame) av_frame_free(&frame);
+  if (pkt) av_packet_free(&pkt);
+  free_input(&ictx);
+  return ret;
+}
+
+void lpms_extracted_frames_free(extracted_frame *frames, int nb_frames)
+{
+  if (!frames) return;
+  for (int i = 0; i < nb_frames; i++) {
+    for (int j = 0; j < 3; j++) av_freep(&frames[i].planes[j]);
+  }
+}
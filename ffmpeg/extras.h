@@ -1,11 +1,16 @@
 #ifndef _LPMS_EXTRAS_H_
 #define _LPMS_EXTRAS_H_
 
+#include <stdint.h>
+#include "transcoder.h"
+
 typedef struct s_codec_info {
   char * format_name;
   char * video_codec;
   char * audio_codec;
   int    audio_bit_rate;
+  int    audio_sample_rate;
+  int    audio_channels;
   int    pixel_format;
   int    width;
   int    height;
@@ -13,11 +18,103 @@ typedef struct s_codec_info {
   double dur;
 } codec_info, *pcodec_info;
 
-int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char *seg_time, char *seg_start);
+#define PROBE_MAX_STREAMS 32
+#define PROBE_STR_LEN 64
+#define PROBE_EXTRADATA_LEN 1024
+
+typedef struct s_probe_stream {
+  int     index;
+  int     media_type;       // AVMediaType
+  char    codec[PROBE_STR_LEN];
+  char    profile[PROBE_STR_LEN];
+  int     level;
+  int64_t bit_rate;
+  int     fr_num, fr_den;   // r_frame_rate
+  int     avg_fr_num, avg_fr_den;
+  int     tb_num, tb_den;
+  int     width, height;
+  int     pixel_format;
+  int     sar_num, sar_den;
+  int     dar_num, dar_den;
+  double  rotation;         // degrees, counter-clockwise
+  char    color_range[PROBE_STR_LEN];
+  char    color_space[PROBE_STR_LEN];
+  char    color_transfer[PROBE_STR_LEN];
+  char    color_primaries[PROBE_STR_LEN];
+  char    field_order[PROBE_STR_LEN];
+  char    channel_layout[PROBE_STR_LEN];
+  int     channels;
+  int     sample_rate;
+  char    language[PROBE_STR_LEN];
+  double  start_time;       // seconds, negative if unknown
+  double  duration;         // seconds, negative if unknown
+  uint8_t extradata[PROBE_EXTRADATA_LEN];
+  int     extradata_size;   // zero if none or too large to keep
+} probe_stream;
+
+typedef struct s_probe_info {
+  char    format_name[PROBE_STR_LEN];
+  int64_t bit_rate;
+  double  start_time;
+  double  duration;
+  int     nb_streams;       // total streams in the container
+  probe_stream streams[PROBE_MAX_STREAMS];
+} probe_info;
+
+typedef struct s_gop_frame {
+  int64_t pts;
+  int64_t dts;
+  int64_t duration;
+  int     key;
+  int     idr;              // IDR picture, or keyframe for codecs without them
+  int     pict_type;        // AVPictureType as reported by the parser
+} gop_frame;
+
+typedef struct s_gop_info {
+  char       codec[PROBE_STR_LEN];
+  int        tb_num, tb_den;
+  int        nb_frames;
+  gop_frame *frames;        // allocated by lpms_analyze_gop
+} gop_info;
+
+// Fingerprints are FINGERPRINT_SIZE x FINGERPRINT_SIZE downscaled luma planes
+#define FINGERPRINT_SIZE 32
+
+typedef struct s_video_fingerprint {
+  int      nb_frames;
+  double   *times;          // presentation time of each frame in seconds
+  uint8_t  *luma;           // nb_frames fingerprints, one after the other
+} video_fingerprint;
+
+typedef struct s_extracted_frame {
+  int64_t  pts;             // AV_TIME_BASE units, relative to the input start
+  int      width, height;
+  // RGBA: plane 0 of width * height * 4 bytes. YCbCr: 4:2:0 planes in full
+  // range BT.601, luma width bytes wide and chroma (width + 1) / 2.
+  uint8_t  *planes[3];
+} extracted_frame;
+
+// Match the signature filter logs when comparing signatures
+typedef struct {
+  int frames;           // matching frames, zero if nothing matched
+  double first, second; // media time of the first matching frame, in seconds
+} sign_match;
+
+int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char *seg_time, char *seg_start, int enforce_kf);
 int lpms_get_codec_info(char *fname, pcodec_info out);
+int lpms_probe_media(char *fname, probe_info *out);
+int lpms_analyze_gop(char *fname, gop_info *out);
+void lpms_gop_info_free(gop_info *info);
+int lpms_merge(char **inputs, int nb_inputs, char *oname, char *muxer);
 int lpms_compare_sign_bypath(char *signpath1, char *signpath2);
 int lpms_compare_sign_bybuffer(void *buffer1, int len1, void *buffer2, int len2);
+int lpms_compare_sign_detailed(void *buffer1, int len1, void *buffer2, int len2, sign_match *match);
 int lpms_compare_video_bypath(char *vpath1, char *vpath2);
 int lpms_compare_video_bybuffer(void *buffer1, int len1, void *buffer2, int len2);
+int lpms_video_fingerprint(char *fname, void *buffer, int len, video_fingerprint *out);
+void lpms_video_fingerprint_free(video_fingerprint *fp);
+int lpms_extract_frames(input_params *params, int64_t *timestamps, int nb_timestamps,
+                        int width, int height, int ycbcr, extracted_frame *out);
+void lpms_extracted_frames_free(extracted_frame *frames, int nb_frames);
 
 #endif // _LPMS_EXTRAS_H_
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,7 +19,9 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
+	"github.com/livepeer/lpms/encryption"
 	pb "github.com/livepeer/lpms/ffmpeg/proto"
+	"github.com/livepeer/lpms/scte35"
 )
 
 // #cgo pkg-config: libavformat libavfilter libavcodec libavutil libswscale
@@ -43,6 +46,8 @@ var ErrEmptyData = errors.New("EmptyData")
 var ErrSignCompare = errors.New("InvalidSignData")
 var ErrTranscoderPixelformat = errors.New("TranscoderInvalidPixelformat")
 var ErrVideoCompare = errors.New("InvalidVideoData")
+var ErrTranscoderRateControl = errors.New("TranscoderInvalidRateControl")
+var ErrTranscoderAudioTrack = errors.New("TranscoderInvalidAudioTrack")
 
 // Switch to turn off logging transcoding errors, when doing test transcoding
 var LogTranscodeErrors = true
@@ -89,8 +94,16 @@ type Transcoder struct {
 	handle     *C.struct_transcode_thread
 	stopped    bool
 	started    bool
-	lastacodec string
+	lastFormat MediaFormatInfo
 	mu         *sync.Mutex
+	logSession uint64
+	// Session whose ID tags the logs instead, for sessions run on behalf of
+	// another transcoder
+	logAs  uint64
+	limits Limits
+
+	// Sessions decoding additional audio tracks, by track position
+	tracks map[int]*Transcoder
 }
 
 type TranscodeOptionsIn struct {
@@ -100,8 +113,18 @@ type TranscodeOptionsIn struct {
 	Transmuxing bool
 	Profile     VideoProfile
 	Demuxer     ComponentOptions
+	// Audio track to transcode; nil picks the best one
+	AudioTrack *AudioTrack
+	// Optional Go code to run on decoded video frames
+	FrameHook *FrameHook
 }
 
+// TranscodeOptions describes an output of a transcode.
+//
+// SCTE-35 cues of the input are carried into MPEG-TS outputs by rewriting
+// the output files after the transcode, see SpliceEvent. Outputs that can't
+// be rewritten, pipes and the outputs of transmuxing, go without cues, as do
+// clipped outputs. The cues are still reported in the results.
 type TranscodeOptions struct {
 	Oname    string
 	Profile  VideoProfile
@@ -110,11 +133,33 @@ type TranscodeOptions struct {
 	CalcSign bool
 	From     time.Duration
 	To       time.Duration
+	ClipMode ClipMode
 
 	Muxer        ComponentOptions
 	VideoEncoder ComponentOptions
 	AudioEncoder ComponentOptions
 	Metadata     map[string]string
+
+	// Audio tracks of the input to carry in this output, in order. If empty,
+	// the output carries the audio track selected on the input.
+	AudioTracks []AudioTrack
+
+	// Timed ID3 tags to write into the output, which has to be MPEG-TS, when
+	// transcoding and transmuxing alike. Timed ID3 of the input is carried
+	// into MPEG-TS outputs as well.
+	ID3 []ID3Tag
+
+	// Common Encryption of the output, which has to be MP4
+	Encryption *CommonEncryption
+
+	// Return the signature in TranscodeResults.Signatures instead of
+	// writing it next to the output. Needs CalcSign.
+	//
+	// Media times in signatures are those of the encoded frames. Older
+	// versions stamped the frames of outputs with a framerate in the muxer's
+	// timebase instead. The signature filter matches frames rather than
+	// media times, so signatures of either kind still compare.
+	SignInMemory bool
 }
 
 type MediaInfo struct {
@@ -125,6 +170,38 @@ type MediaInfo struct {
 type TranscodeResults struct {
 	Decoded MediaInfo
 	Encoded []MediaInfo
+	// MPEG-7 signatures of outputs with SignInMemory set, indexed like
+	// Encoded. Nil if no output keeps its signature in memory.
+	Signatures [][]byte
+	// How the input follows the previous input of the session
+	Discontinuity DiscontinuityInfo
+	// Configuration changes since the previous input of the session, for
+	// inputs that can be probed
+	ConfigChange ConfigChange
+	// SCTE-35 splice events of the input, in the order they were carried
+	SpliceEvents []SpliceEvent
+
+	// Cues of SpliceEvents as demuxed, for outputs put together afterwards
+	cues     []scte35.Cue
+	cueStart int64
+	// Timestamps written when transmuxing, after rebasing
+	written writtenSpan
+}
+
+type writtenSpan struct {
+	Start, End time.Duration
+	Valid      bool
+}
+
+func transmuxedSpan(decoded *C.output_results) writtenSpan {
+	if int64(decoded.written_start) == math.MinInt64 || int64(decoded.written_end) == math.MinInt64 { // AV_NOPTS_VALUE
+		return writtenSpan{}
+	}
+	return writtenSpan{
+		Start: time.Duration(decoded.written_start) * time.Microsecond,
+		End:   time.Duration(decoded.written_end) * time.Microsecond,
+		Valid: true,
+	}
 }
 
 type PixelFormat struct {
@@ -252,6 +329,8 @@ type MediaFormatInfo struct {
 	FPS            float32
 	DurSecs        int64
 	AudioBitrate   int
+	SampleRate     int
+	Channels       int
 }
 
 func (f *MediaFormatInfo) ScaledHeight(width int) int {
@@ -293,6 +372,8 @@ func GetCodecInfo(fname string) (CodecStatus, MediaFormatInfo, error) {
 	format.FPS = float32(params_c.fps)
 	format.DurSecs = int64(params_c.dur)
 	format.AudioBitrate = int(params_c.audio_bit_rate)
+	format.SampleRate = int(params_c.audio_sample_rate)
+	format.Channels = int(params_c.audio_channels)
 	return status, format, nil
 }
 
@@ -371,19 +452,58 @@ func CompareSignatureByPath(fname1 string, fname2 string) (bool, error) {
 
 // compare two signature buffers whether those matches or not
 func CompareSignatureByBuffer(data1 []byte, data2 []byte) (bool, error) {
+	res, err := compareSignatureBuffers(data1, data2)
+	return res > 0, err
+}
+
+// compare two signature buffers, reporting how well those match
+func CompareSignatureDetailed(data1 []byte, data2 []byte) (*SignatureMatch, error) {
+	if len(data1) <= 0 || len(data2) <= 0 {
+		return nil, ErrSignCompare
+	}
+	s1, err := parseSignature(data1)
+	if err != nil {
+		return nil, err
+	}
+	s2, err := parseSignature(data2)
+	if err != nil {
+		return nil, err
+	}
+	var match C.sign_match
+	res := int(C.lpms_compare_sign_detailed(unsafe.Pointer(&data1[0]), C.int(len(data1)),
+		unsafe.Pointer(&data2[0]), C.int(len(data2)), &match))
+	if res < 0 {
+		return nil, ErrSignCompare
+	}
+	m := &SignatureMatch{Match: res > 0, Whole: res == 2}
+	if match.frames <= 0 {
+		return m, nil
+	}
+	frames := int(match.frames)
+	shorter := len(s1.pts)
+	if len(s2.pts) < shorter {
+		shorter = len(s2.pts)
+	}
+	m.Score = math.Min(1, float64(frames)/float64(shorter))
+	first, second := float64(match.first), float64(match.second)
+	m.Offset = time.Duration((second - first) * float64(time.Second))
+	m.Ranges = []SignatureRange{{First: s1.frameAt(first), Second: s2.frameAt(second), Frames: frames}}
+	return m, nil
+}
 
+// 0 if the signatures don't match, 1 on a partial and 2 on a whole match
+func compareSignatureBuffers(data1 []byte, data2 []byte) (int, error) {
+	if len(data1) <= 0 || len(data2) <= 0 {
+		return 0, ErrSignCompare
+	}
 	pdata1 := unsafe.Pointer(&data1[0])
 	pdata2 := unsafe.Pointer(&data2[0])
 
 	res := int(C.lpms_compare_sign_bybuffer(pdata1, C.int(len(data1)), pdata2, C.int(len(data2))))
-
-	if res > 0 {
-		return true, nil
-	} else if res == 0 {
-		return false, nil
-	} else {
-		return false, ErrSignCompare
+	if res < 0 {
+		return 0, ErrSignCompare
 	}
+	return res, nil
 }
 
 // compare two vidoe files whether those matches or not
@@ -425,12 +545,26 @@ func CompareVideoByBuffer(data1 []byte, data2 []byte) (bool, error) {
 }
 
 func RTMPToHLS(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs string, seg_start int) error {
+	return rtmpToHLS(localRTMPUrl, outM3U8, tmpl, seglen_secs, seg_start, false)
+}
+
+// RTMPToHLSEnforceKeyframe is RTMPToHLS cutting H.264 segments only at IDR
+// frames, rather than at any packet the input flags as a keyframe.
+func RTMPToHLSEnforceKeyframe(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs string, seg_start int) error {
+	return rtmpToHLS(localRTMPUrl, outM3U8, tmpl, seglen_secs, seg_start, true)
+}
+
+func rtmpToHLS(localRTMPUrl string, outM3U8 string, tmpl string, seglen_secs string, seg_start int, enforceKeyframe bool) error {
 	inp := C.CString(localRTMPUrl)
 	outp := C.CString(outM3U8)
 	ts_tmpl := C.CString(tmpl)
 	seglen := C.CString(seglen_secs)
 	segstart := C.CString(fmt.Sprintf("%v", seg_start))
-	ret := int(C.lpms_rtmp2hls(inp, outp, ts_tmpl, seglen, segstart))
+	enforceKf := 0
+	if enforceKeyframe {
+		enforceKf = 1
+	}
+	ret := int(C.lpms_rtmp2hls(inp, outp, ts_tmpl, seglen, segstart, C.int(enforceKf)))
 	C.free(unsafe.Pointer(inp))
 	C.free(unsafe.Pointer(outp))
 	C.free(unsafe.Pointer(ts_tmpl))
@@ -568,7 +702,7 @@ func isAudioAllDrop(ps []TranscodeOptions) bool {
 
 // create C output params array and return it along with corresponding finalizer
 // function that makes sure there are no C memory leaks
-func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.output_params, func(), error) {
+func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions, signs []string, keys []*encryption.ContentKey) ([]C.output_params, func(), error) {
 	params := make([]C.output_params, len(ps))
 	finalizer := func() { destroyCOutputParams(params) }
 	for i, p := range ps {
@@ -579,13 +713,19 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 				return params, finalizer, err
 			}
 		}
-		br := strings.Replace(param.Bitrate, "k", "000", 1)
-		bitrate, err := strconv.Atoi(br)
-		if err != nil {
+		bitrate, err := parseBitrate(param.Bitrate)
+		if err != nil && !(param.Bitrate == "" && param.RateControl.qualityBased()) {
 			if p.VideoEncoder.Name != "drop" && p.VideoEncoder.Name != "copy" {
 				return params, finalizer, err
 			}
 		}
+		var rc rateControlParams
+		if p.VideoEncoder.Name != "drop" && p.VideoEncoder.Name != "copy" {
+			rc, err = rateControlLimits(param, bitrate)
+			if err != nil {
+				return params, finalizer, err
+			}
+		}
 		encoder, scale_filter := p.VideoEncoder.Name, "scale"
 		var interpAlgo string
 		if encoder == "" {
@@ -676,7 +816,7 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 				"preset":     "medium",
 				"tier":       "high",
 			}
-			if p.Profile.Quality != 0 {
+			if p.Profile.Quality != 0 && p.Profile.RateControl == RateControlDefault {
 				if p.Profile.Quality <= 63 {
 					p.VideoEncoder.Opts["crf"] = strconv.Itoa(int(p.Profile.Quality))
 				} else {
@@ -726,6 +866,24 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 				}
 			}
 		}
+		if p.VideoEncoder.Name != "drop" && p.VideoEncoder.Name != "copy" {
+			// the rate control mode applies to custom encoder options too
+			rcOpts := map[string]string{}
+			rcParams, err := rateControlOpts(p.Profile, p.Accel, rc, rcOpts)
+			if err != nil {
+				return params, finalizer, err
+			}
+			p.VideoEncoder.Opts, err = mergeRateControlOpts(p.VideoEncoder.Opts, rcOpts)
+			if err != nil {
+				return params, finalizer, err
+			}
+			if rcParams != "" {
+				if xcoderOutParamsStr != "" {
+					xcoderOutParamsStr += ":"
+				}
+				xcoderOutParamsStr += rcParams
+			}
+		}
 
 		gopMs := 0
 		if param.GOP != 0 {
@@ -746,13 +904,17 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 			}
 		}
 
+		var key *encryption.ContentKey
+		if keys != nil {
+			key = keys[i]
+		}
 		var muxOpts C.component_opts
 		var muxName string
 		switch p.Profile.Format {
 		case FormatNone:
 			muxOpts = C.component_opts{
 				// don't free this bc of avformat_write_header API
-				opts: newAVOpts(p.Muxer.Opts),
+				opts: newAVOpts(cencOpts(p.Muxer.Opts, key)),
 			}
 			muxName = p.Muxer.Name
 		case FormatMPEGTS:
@@ -760,7 +922,7 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 		case FormatMP4:
 			muxName = "mp4"
 			muxOpts = C.component_opts{
-				opts: newAVOpts(map[string]string{"movflags": "faststart"}),
+				opts: newAVOpts(cencOpts(map[string]string{"movflags": "faststart"}, key)),
 			}
 		default:
 			return params, finalizer, ErrTranscoderFmt
@@ -788,21 +950,29 @@ func createCOutputParams(input *TranscodeOptionsIn, ps []TranscodeOptions) ([]C.
 		oname := C.CString(p.Oname)
 		xcoderOutParams := C.CString(xcoderOutParamsStr)
 		params[i] = C.output_params{fname: oname, fps: fps,
-			w: C.int(w), h: C.int(h), bitrate: C.int(bitrate),
+			w: C.int(w), h: C.int(h), bitrate: C.int(rc.bitrate),
+			minrate: C.int(rc.minrate), maxrate: C.int(rc.maxrate), bufsize: C.int(rc.bufsize),
 			gop_time: C.int(gopMs), from: C.int(fromMs), to: C.int(toMs),
 			muxer: muxOpts, audio: audioOpts, video: vidOpts, metadata: metadata,
 			vfilters: vfilt, sfilters: nil, xcoderParams: xcoderOutParams}
 		if p.CalcSign {
 			//signfilter string
-			escapedOname := ffmpegStrEscape(p.Oname)
-			signfilter := fmt.Sprintf("signature=filename='%s.bin'", escapedOname)
+			escapedSign := ffmpegStrEscape(signs[i])
+			signfilter := fmt.Sprintf("signature=filename='%s'", escapedSign)
 			if p.Accel == Nvidia {
 				//hw frame -> cuda signature -> sign.bin
-				signfilter = fmt.Sprintf("signature_cuda=filename='%s.bin'", escapedOname)
+				signfilter = fmt.Sprintf("signature_cuda=filename='%s'", escapedSign)
 			}
 			sfilt := C.CString(signfilter)
 			params[i].sfilters = sfilt
 		}
+		if p.ClipMode == clipModeAudio {
+			params[i].trim_audio = 1
+		}
+		params[i].id3_tags, params[i].nb_id3_tags, err = newID3Tags(p)
+		if err != nil {
+			return params, finalizer, err
+		}
 	}
 
 	return params, finalizer, nil
@@ -848,6 +1018,7 @@ func destroyCOutputParams(params []C.output_params) {
 		if p.metadata != nil {
 			C.av_dict_free(&p.metadata)
 		}
+		freeID3Tags(p.id3_tags, p.nb_id3_tags)
 	}
 }
 
@@ -864,6 +1035,17 @@ func hasVideoMetadata(fname string) bool {
 	return !fileInfo.IsDir()
 }
 
+// Audio-only inputs skip video outputs entirely, so the video parameters of
+// each output don't need to be valid. Only the audio is encoded.
+func audioOnlyOutputs(ps []TranscodeOptions) []TranscodeOptions {
+	out := make([]TranscodeOptions, len(ps))
+	for i, p := range ps {
+		p.VideoEncoder = ComponentOptions{Name: "drop"}
+		out[i] = p
+	}
+	return out
+}
+
 func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -873,75 +1055,101 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 	if input == nil {
 		return nil, ErrTranscoderInp
 	}
+	if len(ps) > 0 && ps[0].ClipMode == ClipModeSmartCut {
+		// Smart cuts run their own sessions; this one is left untouched
+		if err := validateClip(input, ps[0], len(ps)); err != nil {
+			return nil, err
+		}
+		return smartCut(input, ps[0], t.limits)
+	}
+	if hasAudioTracks(ps) {
+		return t.transcodeAudioTracks(input, ps)
+	}
+	return t.transcode(input, ps)
+}
+
+func (t *Transcoder) transcode(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
 	var reopendemux bool
 	reopendemux = false
+	var changes ConfigChange
+	audioOnly := false
 	// don't read metadata for inputs without video metadata, because it can't seek back and av_find_input_format in the decoder will fail
 	if hasVideoMetadata(input.Fname) {
 		status, format, err := GetCodecInfo(input.Fname)
 		if err != nil {
 			return nil, err
 		}
-		if format.DurSecs > 300 {
-			glog.Errorf("Input file %s has duration of %d seconds, which is more than 5 minutes. This is not supported by the transcoder.", input.Fname, format.DurSecs)
-			return nil, ErrTranscoderDuration
+		if err := t.limits.checkInput(input.Fname, format); err != nil {
+			return nil, err
 		}
+		// Inputs without any video stream, such as mp3 or ogg files or the
+		// audio-only segments of a stream, only encode audio. This is decided
+		// for every input, so a session can switch back and forth.
+		audioOnly = format.Vcodec == ""
 		// TODO hoist the rest of this into C so we don't have to invoke GetCodecInfo
 		if !t.started {
 			// NeedsBypass is state where video is present in container & without any frames
-			videoMissing := status == CodecStatusNeedsBypass || format.Vcodec == ""
+			videoMissing := status == CodecStatusNeedsBypass || format.Vcodec == "" && format.Acodec == ""
 			if videoMissing {
-				// Audio-only segment, fail fast right here as we cannot handle them nicely
+				// Zero-frame segment, fail fast right here as we cannot handle them nicely
 				return nil, ErrTranscoderVid
 			}
-			// keep last audio codec
-			t.lastacodec = format.Acodec
+			// keep the configuration to compare the next inputs with
+			t.lastFormat = format
 			// Stream is either OK or completely broken, let the transcoder handle it
 			t.started = true
 		} else {
-			// check if we need to reopen demuxer because added audio in video
-			// TODO: fixes like that are needed because handling of cfg change in
-			// LPMS is a joke. We need to decide whether LPMS should support full
-			// dynamic config one day and either implement it there, or implement
-			// some generic workaround for the problem in Go code, such as marking
-			// config changes as significant/insignificant and re-creating the instance
-			// if the former type change happens
-			if format.Acodec != "" && !isAudioAllDrop(ps) {
-				if (t.lastacodec == "") || (t.lastacodec != "" && t.lastacodec != format.Acodec) {
-					reopendemux = true
-					t.lastacodec = format.Acodec
-				}
-			}
+			// The demuxer and decoders are kept between inputs, so they need to
+			// be reopened for changes they can't follow, such as audio being added
+			// to a video only stream. Other changes are picked up in C by
+			// reinitializing filters once frames with the new parameters arrive.
+			audio := !isAudioAllDrop(ps)
+			changes = classifyConfigChange(t.lastFormat, format, audio)
+			reopendemux = changes.needsReopen(input.Accel)
+			t.lastFormat = nextConfig(t.lastFormat, format, audio)
 		}
-		if format.Format == "mpegts" && format.Vcodec == "h264" {
-			if fixedPath, fixErr := FixMisplacedSEI(input.Fname); fixErr != nil {
+		if format.Format == "mpegts" && (format.Vcodec == "h264" || format.Vcodec == "hevc") {
+			if fixedPath, report, fixErr := FixMisplacedSEIWithReport(input.Fname); fixErr != nil {
 				glog.Warningf("SEI fix-up check failed for %s: %v", input.Fname, fixErr)
 			} else if fixedPath != input.Fname {
+				glog.Infof("SEI fix-up of %s: %+v", input.Fname, report)
 				defer os.Remove(fixedPath)
 				input.Fname = fixedPath
 			}
 		}
 	}
+	if audioOnly {
+		ps = audioOnlyOutputs(ps)
+	}
 	hw_type, err := accelDeviceType(input.Accel)
 	if err != nil {
 		return nil, err
 	}
 	for _, p := range ps {
-		if p.From != 0 || p.To != 0 {
-			if p.VideoEncoder.Name == "drop" || p.VideoEncoder.Name == "copy" {
-				glog.Warning("Could clip only when transcoding video")
-				return nil, ErrTranscoderClipConfig
-			}
-			if p.From < 0 || p.To > 0 && p.From > 0 && p.To < p.From {
-				glog.Warning("'To' should be after 'From'")
-				return nil, ErrTranscoderClipConfig
-			}
+		if err := validateClip(input, p, len(ps)); err != nil {
+			return nil, err
 		}
 	}
+	if err := validateFrameHook(input); err != nil {
+		return nil, err
+	}
+	if err := t.limits.checkOutputs(ps); err != nil {
+		return nil, err
+	}
 	if input.Transmuxing {
 		t.started = true
 	}
+	signs, collectSigns, err := signatureFiles(ps)
+	if err != nil {
+		return nil, err
+	}
+	defer collectSigns()
+	keys, err := contentKeys(ps)
+	if err != nil {
+		return nil, err
+	}
 	// Output configuration
-	params, finalizer, err := createCOutputParams(input, ps)
+	params, finalizer, err := createCOutputParams(input, ps, signs, keys)
 	// This prevents C memory leaks
 	defer finalizer()
 	// Only now can we do this
@@ -998,10 +1206,24 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 	}
 
 	inp := &C.input_params{fname: fname, hw_type: hw_type, device: device, xcoderParams: xcoderParams,
-		handle: t.handle, demuxer: demuxerOpts}
+		handle: t.handle, demuxer: demuxerOpts, audio_track: -1, log_session: C.uint64_t(t.logSession)}
+	if t.logAs != 0 {
+		inp.log_session = C.uint64_t(t.logAs)
+	}
 	if input.Transmuxing {
 		inp.transmuxing = 1
 	}
+	if input.AudioTrack != nil {
+		if input.AudioTrack.Language != "" {
+			inp.audio_lang = C.CString(input.AudioTrack.Language)
+			defer C.free(unsafe.Pointer(inp.audio_lang))
+		} else {
+			inp.audio_track = C.int(input.AudioTrack.Index)
+		}
+	}
+	t.limits.setInputParams(inp)
+	releaseHook := setFrameHook(input, inp)
+	defer releaseHook()
 	results := make([]C.output_results, len(ps))
 	decoded := &C.output_results{}
 	var (
@@ -1024,6 +1246,7 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 	}
 
 	ret := int(C.lpms_transcode(inp, paramsPointer, resultsPointer, C.int(len(params)), decoded))
+	cues, cueStart := spliceCues(decoded)
 	if ret != 0 {
 		if LogTranscodeErrors {
 			glog.Error("Transcoder Return : ", ErrorMap[ret])
@@ -1044,19 +1267,45 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 		Frames: int(decoded.frames),
 		Pixels: int64(decoded.pixels),
 	}
-	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
+	sigs := collectSigns()
+	cues, events := spliceEvents(cues, cueStart)
+	if err := insertSpliceCues(ps, cues, cueStart, input.Transmuxing); err != nil {
+		return nil, err
+	}
+	if err := finishEncryption(ps, keys); err != nil {
+		return nil, err
+	}
+	return &TranscodeResults{
+		Encoded:       tr,
+		Decoded:       dec,
+		Signatures:    sigs,
+		Discontinuity: discontinuityInfo(decoded),
+		ConfigChange:  changes,
+		SpliceEvents:  events,
+		cues:          cues,
+		cueStart:      cueStart,
+		written:       transmuxedSpan(decoded),
+	}, nil
 }
 
+// Discontinuity marks the next input as not following the previous one, eg
+// after a stream restart. Timestamp jumps and codec changes are also detected
+// without it, see DiscontinuityInfo.
 func (t *Transcoder) Discontinuity() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	C.lpms_transcode_discontinuity(t.handle)
+	for _, tc := range t.tracks {
+		tc.Discontinuity()
+	}
 }
 
 func NewTranscoder() *Transcoder {
 	return &Transcoder{
-		handle: C.lpms_transcode_new(),
-		mu:     &sync.Mutex{},
+		handle:     C.lpms_transcode_new(),
+		mu:         &sync.Mutex{},
+		logSession: registerLogSession(),
+		limits:     DefaultLimits,
 	}
 }
 
@@ -1069,6 +1318,10 @@ func (t *Transcoder) StopTranscoder() {
 	C.lpms_transcode_stop(t.handle)
 	t.handle = nil // prevent accidental reuse
 	t.stopped = true
+	unregisterLogSession(t.logSession)
+	for _, tc := range t.tracks {
+		tc.StopTranscoder()
+	}
 }
 
 type LogLevel C.enum_LPMSLogLevel
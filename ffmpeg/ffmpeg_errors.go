@@ -45,6 +45,9 @@ func error_map() map[int]error {
 	for _, v := range lpmsErrors {
 		m[int(v.Code)] = errors.New(v.Desc)
 	}
+	for code, err := range limitErrors() {
+		m[code] = err
+	}
 
 	return m
 }
@@ -68,6 +71,8 @@ func non_retryable_errs() []string {
 	transcoderErrors := []error{
 		ErrTranscoderRes, ErrTranscoderVid, ErrTranscoderFmt,
 		ErrTranscoderPrf, ErrTranscoderGOP, ErrTranscoderDev,
+		ErrTranscoderRateControl, ErrTranscoderAudioTrack,
+		ErrTranscoderInputRes, ErrTranscoderInputSize, ErrTranscoderFramerate,
 	}
 	for _, v := range transcoderErrors {
 		errs = append(errs, v.Error())
@@ -134,11 +134,36 @@ vf_init_cleanup:
 }
 
 
-int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
+// Prefer fltp at 44.1kHz, otherwise fall back to whatever the encoder takes.
+// Opus for example only encodes at 48kHz and below.
+static enum AVSampleFormat audio_encoder_sample_fmt(const AVCodec *codec)
+{
+  const enum AVSampleFormat *f;
+  if (!codec || !codec->sample_fmts) return AV_SAMPLE_FMT_FLTP;
+  for (f = codec->sample_fmts; *f != AV_SAMPLE_FMT_NONE; f++) {
+    if (*f == AV_SAMPLE_FMT_FLTP) return AV_SAMPLE_FMT_FLTP;
+  }
+  return codec->sample_fmts[0];
+}
+
+static int audio_encoder_sample_rate(const AVCodec *codec)
+{
+  const int *r;
+  int best = 0;
+  if (!codec || !codec->supported_samplerates) return 44100;
+  for (r = codec->supported_samplerates; *r; r++) {
+    if (*r == 44100) return 44100;
+    if (*r > best) best = *r;
+  }
+  return best ? best : 44100;
+}
+
+int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx, AVFrame *inf)
 {
   int ret = 0;
   char args[512];
-  char filters_descr[256];
+  char filters_descr[512];
+  char trim[256] = "";
   char channel_layout[256];
   const AVFilter *buffersrc  = avfilter_get_by_name("abuffer");
   const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
@@ -146,11 +171,14 @@ int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
   AVFilterInOut *inputs  = NULL;
   struct filter_ctx *af = &octx->af;
   AVRational time_base = ictx->ic->streams[ictx->ai]->time_base;
+  const AVCodec *encoder = NULL;
 
   // no need for filters with the following conditions
   if (af->active) goto af_init_cleanup; // already initialized
   if (!needs_decoder(octx->audio->name)) goto af_init_cleanup;
 
+  encoder = avcodec_find_encoder_by_name(octx->audio->name);
+
   outputs = avfilter_inout_alloc();
   inputs = avfilter_inout_alloc();
   af->graph = avfilter_graph_alloc();
@@ -161,18 +189,45 @@ int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
   }
 
   /* buffer audio source: the decoded frames from the decoder will be inserted here. */
-  ret = av_channel_layout_describe(&ictx->ac->ch_layout, channel_layout, sizeof(channel_layout));
+  // Take the parameters from the frame if there is one, as the decoder
+  // context may lag behind changes of the input
+  int sample_rate = inf ? inf->sample_rate : ictx->ac->sample_rate;
+  int sample_fmt = inf ? inf->format : ictx->ac->sample_fmt;
+  const AVChannelLayout *layout = inf ? &inf->ch_layout : &ictx->ac->ch_layout;
+  ret = av_channel_layout_describe(layout, channel_layout, sizeof(channel_layout));
   if (ret < 0) LPMS_ERR(af_init_cleanup, "Unable to describe audio channel layout");
   snprintf(args, sizeof args,
       "sample_rate=%d:sample_fmt=%d:channel_layout=%s:channels=%d:"
       "time_base=%d/%d",
-      ictx->ac->sample_rate, ictx->ac->sample_fmt, channel_layout,
-      ictx->ac->ch_layout.nb_channels, time_base.num, time_base.den);
+      sample_rate, sample_fmt, channel_layout,
+      layout->nb_channels, time_base.num, time_base.den);
+
+  // Trim to the sample before resampling, rather than dropping whole frames
+  // once encoding. Timestamps start over from the first sample kept, so the
+  // trim keeps its place if the filters are reinitialized.
+  if (octx->trim_audio && (octx->clip_from || octx->clip_to)) {
+    AVRational ms_tb = {1, 1000};
+    int64_t from = 0;
+    int n = 0;
+    if (!octx->audio_trim_found) {
+      int64_t start = ictx->ic->streams[ictx->ai]->start_time;
+      if (inf && AV_NOPTS_VALUE != inf->pts) start = inf->pts;
+      octx->audio_trim_start = AV_NOPTS_VALUE != start ? start : 0;
+      octx->audio_trim_found = 1;
+    }
+    from = octx->audio_trim_start + av_rescale_q(octx->clip_from, ms_tb, time_base);
+    n = snprintf(trim, sizeof trim, "atrim=start_pts=%" PRId64, from);
+    if (octx->clip_to) {
+      int64_t to = octx->audio_trim_start + av_rescale_q(octx->clip_to, ms_tb, time_base);
+      n += snprintf(trim + n, sizeof trim - n, ":end_pts=%" PRId64, to);
+    }
+    snprintf(trim + n, sizeof trim - n, ",asetpts=PTS-(%" PRId64 "),", from);
+  }
 
-  // TODO set sample format and rate based on encoder support,
-  //      rather than hardcoding
   snprintf(filters_descr, sizeof filters_descr,
-    "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100");
+    "%saformat=sample_fmts=%s:channel_layouts=stereo:sample_rates=%d", trim,
+    av_get_sample_fmt_name(audio_encoder_sample_fmt(encoder)),
+    audio_encoder_sample_rate(encoder));
 
   ret = avfilter_graph_create_filter(&af->src_ctx, buffersrc,
                                      "in", args, NULL, af->graph);
@@ -210,6 +265,9 @@ int init_signature_filters(struct output_ctx *octx, AVFrame *inf)
     AVFilterInOut *outputs = NULL;
     AVFilterInOut *inputs  = NULL;
     AVRational time_base = octx->oc->streams[0]->time_base;
+    // frames reach the signature filter straight from the video filtergraph,
+    // so stamp them with its timebase for the media times in the signature
+    if (octx->vf.sink_ctx) time_base = av_buffersink_get_time_base(octx->vf.sink_ctx);
     enum AVPixelFormat pix_fmts[] = { AV_PIX_FMT_YUV420P, AV_PIX_FMT_CUDA, AV_PIX_FMT_NONE }; // XXX ensure the encoder allows this
     struct filter_ctx *sf = &octx->sf;
     char *filters_descr = octx->sfilters;
@@ -281,19 +339,43 @@ sf_init_cleanup:
     return ret;
 }
 
+// Whether the frame differs from what the filter was configured for, eg
+// after the input changed resolution, pixel format or audio layout
+static int filter_params_changed(struct filter_ctx *filter, AVFrame *inf, int is_video)
+{
+  if (!inf || !filter->src_ctx || filter->src_ctx->nb_outputs <= 0) return 0;
+  AVFilterLink *link = filter->src_ctx->outputs[0];
+  if (is_video) {
+    if (inf->hw_frames_ctx && filter->hw_frames_ctx &&
+        inf->hw_frames_ctx->data != filter->hw_frames_ctx->data) return 1;
+    return link->w != inf->width || link->h != inf->height ||
+           link->format != inf->format;
+  }
+  return link->sample_rate != inf->sample_rate || link->format != inf->format ||
+         av_channel_layout_compare(&link->ch_layout, &inf->ch_layout);
+}
+
 int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video)
 {
   if (filter->closed) return 0;
   int ret = 0;
+  // Audio filters live across segments, so they follow changes of the input.
+  // The few samples buffered for the encoder are dropped, as flushing would
+  // hand it a short frame mid-stream.
+  if (!is_video && filter_params_changed(filter, inf, is_video)) {
+    LPMS_INFO("Audio parameters changed; reinitializing filters");
+    free_filter(&octx->af);
+    ret = init_audio_filters(ictx, octx, inf);
+    if (ret < 0) return lpms_ERR_FILTERS;
+    if (octx->ac) av_buffersink_set_frame_size(octx->af.sink_ctx, octx->ac->frame_size);
+  }
   // We have to reset the filter because we initially set the filter
-  // before the decoder is fully ready, and the decoder may change HW params
+  // before the decoder is fully ready, and the decoder may change HW params.
+  // The same goes for inputs changing resolution or pixel format, and for
+  // discontinuities, after which the fps filter starts over from the new
+  // timestamps.
   // XXX: Unclear if this path is hit on all devices
-  if (is_video && inf && (
-      (inf->hw_frames_ctx && filter->hw_frames_ctx &&
-        inf->hw_frames_ctx->data != filter->hw_frames_ctx->data) ||
-      (filter->src_ctx->nb_outputs > 0 &&
-        filter->src_ctx->outputs[0]->w != inf->width &&
-        filter->src_ctx->outputs[0]->h != inf->height))) {
+  if (is_video && inf && (filter->reset || filter_params_changed(filter, inf, is_video))) {
 
 
     // flush video filter
@@ -32,6 +32,9 @@ struct filter_ctx {
   int flushing;
 
   int closed;
+
+  // Restart the filtergraph at the next frame, eg after a discontinuity
+  int reset;
 };
 
 struct output_ctx {
@@ -40,6 +43,7 @@ struct output_ctx {
   char *vfilters;      // required output video filters
   char *sfilters;      // required output signature filters
   int width, height, bitrate; // w, h, br required
+  int minrate, maxrate, bufsize; // optional VBV settings
   AVRational fps;
   AVFormatContext *oc; // muxer required
   AVCodecContext  *vc; // video decoder optional
@@ -68,13 +72,25 @@ struct output_ctx {
 
   int64_t clip_from, clip_to, clip_from_pts, clip_to_pts, clip_started, clip_start_pts, clip_start_pts_found; // for clipping
   int64_t clip_audio_from_pts, clip_audio_to_pts, clip_audio_start_pts, clip_audio_start_pts_found; // for clipping
+  // Sample accurate clipping of encoded audio by the filters, which counts
+  // from the start of the audio stream at audio_trim_start
+  int trim_audio, audio_trim_found;
+  int64_t audio_trim_start;
 
   output_results  *res; // data to return for this output
   char *xcoderParams;
+
+  // Timed ID3 stream index, -1 if none, along with the tags to write into it
+  // and where the input starts, which tags are timed from
+  int id3i;
+  id3_tag *id3_tags;
+  int nb_id3_tags, next_id3_tag;
+  int64_t id3_start;
+  int64_t last_id3_dts; // dts of the last timed ID3 packet sent to the muxer
 };
 
 int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx, AVFrame *inf);
-int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx);
+int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx, AVFrame *inf);
 int init_signature_filters(struct output_ctx *octx, AVFrame *inf);
 int filtergraph_write(AVFrame *inf, struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
 int filtergraph_read(struct input_ctx *ictx, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
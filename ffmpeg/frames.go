@@ -0,0 +1,112 @@
+package ffmpeg
+
+import (
+	"errors"
+	"image"
+	"time"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include "extras.h"
+import "C"
+
+var ErrFrameExtract = errors.New("FrameExtractError")
+
+// ExtractedFrame is a decoded picture along with the time it is shown at.
+type ExtractedFrame struct {
+	Image image.Image
+	// Presentation time of the frame, relative to the start of the input
+	PTS time.Duration
+}
+
+// FrameFormat selects the kind of image frames are extracted to
+type FrameFormat int
+
+const (
+	// *image.RGBA
+	FrameFormatRGBA FrameFormat = iota
+	// *image.YCbCr with 4:2:0 subsampling, in the full range BT.601 of JPEG
+	// that the image package assumes
+	FrameFormatYCbCr
+)
+
+// ExtractFrames decodes the frames shown at the given times, relative to the
+// start of the input, and scales them to size. A zero size keeps the size of
+// the input, while a single zero dimension keeps its aspect ratio. Images are
+// *image.RGBA.
+func ExtractFrames(fname string, timestamps []time.Duration, size image.Point) ([]ExtractedFrame, error) {
+	return ExtractFramesAccel(fname, Software, "", timestamps, size)
+}
+
+// ExtractFramesAccel is ExtractFrames decoding on the given device. Hardware
+// decoded frames are downloaded before conversion.
+func ExtractFramesAccel(fname string, accel Acceleration, device string, timestamps []time.Duration, size image.Point) ([]ExtractedFrame, error) {
+	return ExtractFramesFormat(fname, accel, device, timestamps, size, FrameFormatRGBA)
+}
+
+// ExtractFramesFormat is ExtractFramesAccel producing images of the given
+// format.
+func ExtractFramesFormat(fname string, accel Acceleration, device string, timestamps []time.Duration, size image.Point, format FrameFormat) ([]ExtractedFrame, error) {
+	if len(timestamps) == 0 {
+		return nil, nil
+	}
+	if size.X < 0 || size.Y < 0 || format != FrameFormatRGBA && format != FrameFormatYCbCr {
+		return nil, ErrFrameExtract
+	}
+	hwType, err := accelDeviceType(accel)
+	if err != nil {
+		return nil, err
+	}
+	cfname := C.CString(fname)
+	defer C.free(unsafe.Pointer(cfname))
+	params := &C.input_params{fname: cfname, hw_type: hwType, audio_track: -1}
+	if device != "" {
+		params.device = C.CString(device)
+		defer C.free(unsafe.Pointer(params.device))
+	}
+
+	n := len(timestamps)
+	ts := make([]C.int64_t, n)
+	for i, t := range timestamps {
+		ts[i] = C.int64_t(t / time.Microsecond)
+	}
+	cframes := make([]C.extracted_frame, n)
+
+	ycbcr := 0
+	if format == FrameFormatYCbCr {
+		ycbcr = 1
+	}
+	ret := int(C.lpms_extract_frames(params, &ts[0], C.int(n), C.int(size.X), C.int(size.Y), C.int(ycbcr), &cframes[0]))
+	if ret < 0 {
+		return nil, ErrFrameExtract
+	}
+	defer C.lpms_extracted_frames_free(&cframes[0], C.int(n))
+
+	frames := make([]ExtractedFrame, n)
+	for i, f := range cframes {
+		rect := image.Rect(0, 0, int(f.width), int(f.height))
+		var img image.Image
+		if format == FrameFormatYCbCr {
+			ycc := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+			copyPlane(ycc.Y, f.planes[0])
+			copyPlane(ycc.Cb, f.planes[1])
+			copyPlane(ycc.Cr, f.planes[2])
+			img = ycc
+		} else {
+			rgba := image.NewRGBA(rect)
+			copyPlane(rgba.Pix, f.planes[0])
+			img = rgba
+		}
+		frames[i] = ExtractedFrame{
+			Image: img,
+			PTS:   time.Duration(f.pts) * time.Microsecond,
+		}
+	}
+	return frames, nil
+}
+
+// Fills dst from a plane of the same size allocated in C
+func copyPlane(dst []byte, plane *C.uint8_t) {
+	copy(dst, (*[1 << 30]byte)(unsafe.Pointer(plane))[:len(dst):len(dst)])
+}
@@ -0,0 +1,111 @@
+package ffmpeg
+
+import (
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Mean absolute difference of the RGB channels of two same sized images
+func rgbaDistance(a, b *image.RGBA) float64 {
+	sum := 0
+	for i := range a.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		d := int(a.Pix[i]) - int(b.Pix[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(a.Pix)/4*3)
+}
+
+func extractFramesTest(t *testing.T, accel Acceleration) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	fname := "../transcoder/test.ts"
+	frameTime := time.Second / 60
+	times := []time.Duration{time.Second, 0, 1500 * time.Millisecond}
+	frames, err := ExtractFramesAccel(fname, accel, "0", times, image.Point{})
+	require.NoError(t, err)
+	require.Len(t, frames, len(times))
+	for i, f := range frames {
+		assert.Equal(t, image.Rect(0, 0, 1280, 720), f.Image.Bounds())
+		assert.IsType(t, &image.RGBA{}, f.Image)
+		// the frame shown at the requested time
+		assert.True(t, f.PTS <= times[i] && f.PTS > times[i]-frameTime, "%v at %v", f.PTS, times[i])
+	}
+	assert.Equal(t, time.Duration(0), frames[1].PTS)
+
+	// aspect ratio is kept when a single dimension is given
+	scaled, err := ExtractFramesAccel(fname, accel, "0", times[:1], image.Point{X: 256})
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 256, 144), scaled[0].Image.Bounds())
+	assert.Equal(t, frames[0].PTS, scaled[0].PTS)
+	scaled, err = ExtractFramesAccel(fname, accel, "0", times[:1], image.Point{Y: 144})
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 256, 144), scaled[0].Image.Bounds())
+
+	// YCbCr holds the same picture
+	ycc, err := ExtractFramesFormat(fname, accel, "0", times[:1], image.Point{}, FrameFormatYCbCr)
+	require.NoError(t, err)
+	require.IsType(t, &image.YCbCr{}, ycc[0].Image)
+	assert.Equal(t, image.YCbCrSubsampleRatio420, ycc[0].Image.(*image.YCbCr).SubsampleRatio)
+	assert.Equal(t, frames[0].Image.Bounds(), ycc[0].Image.Bounds())
+	assert.Equal(t, frames[0].PTS, ycc[0].PTS)
+	converted := image.NewRGBA(ycc[0].Image.Bounds())
+	draw.Draw(converted, converted.Bounds(), ycc[0].Image, image.Point{}, draw.Src)
+	same := rgbaDistance(frames[0].Image.(*image.RGBA), converted)
+	assert.True(t, same < 5, "distance %v", same)
+
+	// picture content survives a transcode
+	oname := filepath.Join(dir, "out.ts")
+	_, err = Transcode3(&TranscodeOptionsIn{Fname: fname, Accel: accel}, []TranscodeOptions{{
+		Oname:   oname,
+		Profile: P144p30fps16x9,
+		Accel:   accel,
+	}})
+	require.NoError(t, err)
+	out, err := ExtractFramesAccel(oname, accel, "0", times[:1], image.Point{})
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 256, 144), out[0].Image.Bounds())
+	assert.True(t, out[0].PTS <= time.Second && out[0].PTS > time.Second-time.Second/30)
+	same = rgbaDistance(scaled[0].Image.(*image.RGBA), out[0].Image.(*image.RGBA))
+	assert.True(t, same < 10, "distance %v", same)
+}
+
+func TestExtractFrames(t *testing.T) {
+	extractFramesTest(t, Software)
+
+	// the first frame for times before it, the last one for times after the end
+	frames, err := ExtractFrames("../transcoder/test.ts", []time.Duration{-time.Second, time.Hour}, image.Point{X: 64, Y: 64})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), frames[0].PTS)
+	assert.True(t, frames[1].PTS > 0)
+	assert.Equal(t, image.Rect(0, 0, 64, 64), frames[1].Image.Bounds())
+
+	frames, err = ExtractFrames("../transcoder/test.ts", nil, image.Point{})
+	assert.NoError(t, err)
+	assert.Empty(t, frames)
+	_, err = ExtractFrames("../transcoder/test.ts", []time.Duration{0}, image.Point{X: -1})
+	assert.Equal(t, ErrFrameExtract, err)
+	_, err = ExtractFramesFormat("../transcoder/test.ts", Software, "", []time.Duration{0}, image.Point{}, FrameFormat(-1))
+	assert.Equal(t, ErrFrameExtract, err)
+	// odd sizes round chroma up
+	frames, err = ExtractFramesFormat("../transcoder/test.ts", Software, "", []time.Duration{0}, image.Point{X: 65, Y: 37}, FrameFormatYCbCr)
+	require.NoError(t, err)
+	assert.Len(t, frames[0].Image.(*image.YCbCr).Cb, 33*19)
+	_, err = ExtractFrames("../data/audio.mp3", []time.Duration{0}, image.Point{})
+	assert.Equal(t, ErrFrameExtract, err)
+	_, err = ExtractFrames("missing.ts", []time.Duration{0}, image.Point{})
+	assert.Equal(t, ErrFrameExtract, err)
+}
@@ -0,0 +1,211 @@
+package ffmpeg
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include <libavutil/avutil.h>
+// #include "extras.h"
+import "C"
+
+var ErrGOPAnalysis = errors.New("GOPAnalysisError")
+
+type FrameType int
+
+const (
+	FrameTypeUnknown FrameType = iota
+	FrameTypeI
+	FrameTypeP
+	FrameTypeB
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameTypeI:
+		return "I"
+	case FrameTypeP:
+		return "P"
+	case FrameTypeB:
+		return "B"
+	}
+	return "?"
+}
+
+// GOPFrame is a single video packet in decode order
+type GOPFrame struct {
+	PTS, DTS time.Duration
+	Duration time.Duration
+	// Keyframes are random access points. For H.264 and HEVC these include
+	// the intra frames starting open GOPs, which aren't IDR frames.
+	Keyframe bool
+	IDR      bool
+	Type     FrameType
+}
+
+// GOP describes the frames from one keyframe up to (excluding) the next,
+// which need not be an IDR frame.
+type GOP struct {
+	StartPTS time.Duration
+	Duration time.Duration
+	Frames   int
+	// Closed GOPs do not reference frames from the previous GOP. A GOP is
+	// considered open when frames following the keyframe in decode order
+	// are presented before it.
+	Closed bool
+}
+
+type GOPInfo struct {
+	Codec string
+	// Presentation timestamps of IDR frames, or of keyframes for codecs
+	// without IDR frames
+	Keyframes          []time.Duration
+	GOPs               []GOP
+	Frames             []GOPFrame
+	StartsWithKeyframe bool
+	// Frames preceding the first keyframe
+	LeadingFrames int
+	// Frame counts by type, from the bitstream
+	IFrames, PFrames, BFrames, UnknownFrames int
+	HasBFrames                               bool
+	OpenGOP                                  bool
+}
+
+// MaxGOPDuration returns the duration of the longest GOP
+func (g *GOPInfo) MaxGOPDuration() time.Duration {
+	var max time.Duration
+	for _, gop := range g.GOPs {
+		if gop.Duration > max {
+			max = gop.Duration
+		}
+	}
+	return max
+}
+
+func frameTypeFromC(t C.int) FrameType {
+	switch t {
+	case C.AV_PICTURE_TYPE_I, C.AV_PICTURE_TYPE_SI:
+		return FrameTypeI
+	case C.AV_PICTURE_TYPE_P, C.AV_PICTURE_TYPE_SP:
+		return FrameTypeP
+	case C.AV_PICTURE_TYPE_B, C.AV_PICTURE_TYPE_BI:
+		return FrameTypeB
+	}
+	return FrameTypeUnknown
+}
+
+// AnalyzeGOP demuxes the first video stream of the file without decoding
+// and returns its keyframe and GOP structure.
+func AnalyzeGOP(fname string) (GOPInfo, error) {
+	var cinfo C.gop_info
+	cfname := C.CString(fname)
+	defer C.free(unsafe.Pointer(cfname))
+	if ret := int(C.lpms_analyze_gop(cfname, &cinfo)); ret < 0 {
+		return GOPInfo{}, ErrGOPAnalysis
+	}
+	defer C.lpms_gop_info_free(&cinfo)
+
+	tb := float64(cinfo.tb_num) / float64(cinfo.tb_den)
+	ts := func(t C.int64_t) time.Duration {
+		return time.Duration(float64(t) * tb * float64(time.Second))
+	}
+	n := int(cinfo.nb_frames)
+	frames := make([]GOPFrame, n)
+	var cframes []C.gop_frame
+	if n > 0 {
+		cframes = (*[1 << 28]C.gop_frame)(unsafe.Pointer(cinfo.frames))[:n:n]
+	}
+	for i, f := range cframes {
+		frames[i] = GOPFrame{
+			PTS:      ts(f.pts),
+			DTS:      ts(f.dts),
+			Duration: ts(f.duration),
+			Keyframe: f.key != 0,
+			IDR:      f.idr != 0,
+			Type:     frameTypeFromC(f.pict_type),
+		}
+	}
+	info := analyzeGOPFrames(frames)
+	info.Codec = C.GoString(&cinfo.codec[0])
+	return info, nil
+}
+
+// AnalyzeGOPBytes is like AnalyzeGOP but reads the media from memory.
+func AnalyzeGOPBytes(data []byte) (GOPInfo, error) {
+	if len(data) == 0 {
+		return GOPInfo{}, ErrEmptyData
+	}
+	fname, done, err := pipeBytes(data)
+	if err != nil {
+		return GOPInfo{}, err
+	}
+	defer done()
+	return AnalyzeGOP(fname)
+}
+
+func analyzeGOPFrames(frames []GOPFrame) GOPInfo {
+	info := GOPInfo{Frames: frames}
+	var cur *GOP
+	var curEnd, maxPTS time.Duration
+	closeGOP := func() {
+		if cur == nil {
+			return
+		}
+		cur.Duration = curEnd - cur.StartPTS
+		info.GOPs = append(info.GOPs, *cur)
+		if !cur.Closed {
+			info.OpenGOP = true
+		}
+	}
+	for i, f := range frames {
+		switch f.Type {
+		case FrameTypeI:
+			info.IFrames++
+		case FrameTypeP:
+			info.PFrames++
+		case FrameTypeB:
+			info.BFrames++
+			info.HasBFrames = true
+		default:
+			info.UnknownFrames++
+		}
+		if f.Keyframe {
+			if cur != nil {
+				// keyframe pts marks the end of the previous GOP
+				curEnd = f.PTS
+			}
+			closeGOP()
+			cur = &GOP{StartPTS: f.PTS, Closed: true}
+			curEnd = f.PTS + f.Duration
+			if f.IDR {
+				info.Keyframes = append(info.Keyframes, f.PTS)
+			}
+			if i == 0 {
+				info.StartsWithKeyframe = true
+			}
+		}
+		if i > 0 && f.PTS < maxPTS && f.Type == FrameTypeUnknown {
+			// reordering without picture types from the parser still implies B-frames
+			info.HasBFrames = true
+		}
+		if i == 0 || f.PTS > maxPTS {
+			maxPTS = f.PTS
+		}
+		if cur == nil {
+			info.LeadingFrames++
+			continue
+		}
+		cur.Frames++
+		if f.PTS < cur.StartPTS {
+			// presented before the keyframe, so must reference the prior GOP
+			cur.Closed = false
+		}
+		if end := f.PTS + f.Duration; end > curEnd {
+			curEnd = end
+		}
+	}
+	closeGOP()
+	return info
+}
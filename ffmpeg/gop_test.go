@@ -0,0 +1,127 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeGOP_Frames(t *testing.T) {
+	ms := time.Millisecond
+	f := func(pts, dts int, key bool, typ FrameType) GOPFrame {
+		return GOPFrame{PTS: time.Duration(pts) * ms, DTS: time.Duration(dts) * ms, Duration: 10 * ms, Keyframe: key, IDR: key, Type: typ}
+	}
+
+	// Closed GOPs, no reordering
+	info := analyzeGOPFrames([]GOPFrame{
+		f(0, 0, true, FrameTypeI), f(10, 10, false, FrameTypeP), f(20, 20, false, FrameTypeP),
+		f(30, 30, true, FrameTypeI), f(40, 40, false, FrameTypeP),
+	})
+	assert.True(t, info.StartsWithKeyframe)
+	assert.Equal(t, []time.Duration{0, 30 * ms}, info.Keyframes)
+	assert.Equal(t, []GOP{
+		{StartPTS: 0, Duration: 30 * ms, Frames: 3, Closed: true},
+		{StartPTS: 30 * ms, Duration: 20 * ms, Frames: 2, Closed: true},
+	}, info.GOPs)
+	assert.Equal(t, 2, info.IFrames)
+	assert.Equal(t, 3, info.PFrames)
+	assert.False(t, info.HasBFrames)
+	assert.False(t, info.OpenGOP)
+	assert.Equal(t, 30*ms, info.MaxGOPDuration())
+
+	// Open GOP: the B-frames after the second keyframe are presented before it
+	info = analyzeGOPFrames([]GOPFrame{
+		f(10, 0, false, FrameTypeP), f(0, 0, false, FrameTypeB),
+		f(40, 20, true, FrameTypeI), f(20, 30, false, FrameTypeB), f(30, 40, false, FrameTypeB),
+		f(70, 50, false, FrameTypeP), f(50, 60, false, FrameTypeB), f(60, 70, false, FrameTypeB),
+	})
+	assert.False(t, info.StartsWithKeyframe)
+	assert.Equal(t, 2, info.LeadingFrames)
+	require.Len(t, info.GOPs, 1)
+	assert.False(t, info.GOPs[0].Closed)
+	assert.Equal(t, 6, info.GOPs[0].Frames)
+	assert.True(t, info.OpenGOP)
+	assert.True(t, info.HasBFrames)
+	assert.Equal(t, 5, info.BFrames)
+
+	// Only IDR frames are listed as keyframes, though every keyframe starts a GOP
+	recovery := f(30, 30, true, FrameTypeI)
+	recovery.IDR = false
+	info = analyzeGOPFrames([]GOPFrame{
+		f(0, 0, true, FrameTypeI), f(10, 10, false, FrameTypeP), f(20, 20, false, FrameTypeP),
+		recovery, f(40, 40, false, FrameTypeP),
+	})
+	assert.Equal(t, []time.Duration{0}, info.Keyframes)
+	assert.Len(t, info.GOPs, 2)
+
+	// Reordering is still reported as B-frames without picture types
+	info = analyzeGOPFrames([]GOPFrame{
+		f(0, 0, true, FrameTypeUnknown), f(20, 10, false, FrameTypeUnknown), f(10, 20, false, FrameTypeUnknown),
+	})
+	assert.True(t, info.HasBFrames)
+	assert.True(t, info.GOPs[0].Closed)
+	assert.Equal(t, 3, info.UnknownFrames)
+}
+
+func TestAnalyzeGOP_Files(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	run(`
+		cp "$1/../transcoder/test.ts" test.ts
+		# 1s closed GOPs without B-frames
+		ffmpeg -loglevel warning -i test.ts -an -t 4 -c:v libx264 -r 30 -g 30 -keyint_min 30 -sc_threshold 0 -bf 0 closed.ts
+		# open GOPs with B-frames
+		ffmpeg -loglevel warning -i test.ts -an -t 4 -c:v libx264 -r 30 -g 30 -keyint_min 30 -sc_threshold 0 -bf 3 -x264opts open_gop=1 open.ts
+		# cut in the middle of a GOP without re-encoding
+		ffmpeg -loglevel warning -i closed.ts -c copy -bsf:v noise=drop='lt(n\,15)' nokf.ts
+	`)
+
+	info, err := AnalyzeGOP(filepath.Join(dir, "closed.ts"))
+	require.NoError(t, err)
+	assert.Equal(t, "h264", info.Codec)
+	assert.True(t, info.StartsWithKeyframe)
+	assert.Len(t, info.Keyframes, 4)
+	assert.Equal(t, 4, info.IFrames)
+	assert.Equal(t, 116, info.PFrames)
+	assert.Equal(t, 0, info.BFrames)
+	assert.False(t, info.HasBFrames)
+	assert.False(t, info.OpenGOP)
+	for _, gop := range info.GOPs {
+		assert.Equal(t, 30, gop.Frames)
+		assert.InDelta(t, time.Second, gop.Duration, float64(time.Millisecond))
+	}
+
+	info, err = AnalyzeGOP(filepath.Join(dir, "open.ts"))
+	require.NoError(t, err)
+	assert.True(t, info.HasBFrames)
+	assert.NotZero(t, info.BFrames)
+	assert.True(t, info.OpenGOP)
+	// x264 starts open GOPs with recovery points rather than IDR frames
+	assert.Len(t, info.Keyframes, 1)
+	assert.Len(t, info.GOPs, 4)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "nokf.ts"))
+	require.NoError(t, err)
+	info, err = AnalyzeGOPBytes(data)
+	require.NoError(t, err)
+	assert.False(t, info.StartsWithKeyframe)
+	assert.Equal(t, 15, info.LeadingFrames)
+	assert.Len(t, info.Keyframes, 3)
+
+	_, err = AnalyzeGOP("/non/existent")
+	assert.Equal(t, ErrGOPAnalysis, err)
+	_, err = AnalyzeGOPBytes(nil)
+	assert.Equal(t, ErrEmptyData, err)
+	// the pipe writer doesn't outlive a failed analysis
+	before := runtime.NumGoroutine()
+	_, err = AnalyzeGOPBytes(make([]byte, 8<<20))
+	assert.Equal(t, ErrGOPAnalysis, err)
+	assert.Equal(t, before, runtime.NumGoroutine())
+}
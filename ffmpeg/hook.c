@@ -0,0 +1,104 @@
+#include "hook.h"
+#include "logging.h"
+#include "_cgo_export.h"
+
+#include <libavutil/hwcontext.h>
+#include <libavutil/pixdesc.h>
+#include <libswscale/swscale.h>
+
+static int hook_rgba(struct hook_ctx *hc, AVFrame *frame, hook_frame *hf)
+{
+  int ret = 0, w = hc->w, h = hc->h;
+  if (frame->hw_frames_ctx) {
+    // hwdownload
+    if (!hc->sw_frame) hc->sw_frame = av_frame_alloc();
+    if (!hc->sw_frame) LPMS_ERR_RETURN("Unable to allocate frame for hook");
+    av_frame_unref(hc->sw_frame);
+    ret = av_hwframe_transfer_data(hc->sw_frame, frame, 0);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to download frame for hook");
+    ret = av_frame_copy_props(hc->sw_frame, frame);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to copy frame properties for hook");
+    frame = hc->sw_frame;
+  }
+  // A single dimension keeps the aspect ratio of the picture
+  if (!w && !h) {
+    w = frame->width;
+    h = frame->height;
+  } else if (!w) {
+    w = FFMAX(1, av_rescale(h, frame->width, frame->height));
+  } else if (!h) {
+    h = FFMAX(1, av_rescale(w, frame->height, frame->width));
+  }
+  if (hc->buf_size < w * h * 4) {
+    av_freep(&hc->buf);
+    hc->buf = av_malloc(w * h * 4);
+    if (!hc->buf) {
+      hc->buf_size = 0;
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR_RETURN("Unable to allocate hook frame");
+    }
+    hc->buf_size = w * h * 4;
+  }
+  hc->sws = sws_getCachedContext(hc->sws, frame->width, frame->height, frame->format,
+                                 w, h, AV_PIX_FMT_RGBA, SWS_BILINEAR, NULL, NULL, NULL);
+  if (!hc->sws) {
+    ret = AVERROR(EINVAL);
+    LPMS_ERR_RETURN("Unable to scale for hook");
+  }
+  sws_setColorspaceDetails(hc->sws, sws_getCoefficients(frame->colorspace),
+                           frame->color_range == AVCOL_RANGE_JPEG,
+                           sws_getCoefficients(SWS_CS_DEFAULT), 1, 0, 1 << 16, 1 << 16);
+  uint8_t *dst[4] = { hc->buf };
+  int dst_stride[4] = { w * 4 };
+  ret = sws_scale(hc->sws, (const uint8_t * const *)frame->data, frame->linesize,
+                  0, frame->height, dst, dst_stride);
+  if (ret < 0) LPMS_ERR_RETURN("Unable to convert frame for hook");
+  hf->width = w;
+  hf->height = h;
+  hf->data[0] = hc->buf;
+  hf->linesize[0] = w * 4;
+  return 0;
+}
+
+// Hand a decoded video frame over to the Go frame hook, if there is one.
+// Writable hooks may change the frame before it reaches the encoders.
+int run_frame_hook(struct hook_ctx *hc, AVFrame *frame, AVRational tb)
+{
+  int ret = 0;
+  hook_frame hf = { 0 };
+  if (!hc->handle) return 0;
+  if (hc->count++ % hc->interval) return 0;
+
+  hf.pts = AV_NOPTS_VALUE;
+  if (frame->pts != AV_NOPTS_VALUE) hf.pts = av_rescale_q(frame->pts, tb, AV_TIME_BASE_Q);
+  if (hc->writable) {
+    if (frame->format != AV_PIX_FMT_YUV420P && frame->format != AV_PIX_FMT_YUVJ420P) {
+      LPMS_WARN("Writable frame hooks need 4:2:0 software frames; skipping frame");
+      return 0;
+    }
+    // decoders keep references to frames, so don't write into theirs
+    ret = av_frame_make_writable(frame);
+    if (ret < 0) LPMS_ERR_RETURN("Unable to make frame writable for hook");
+    hf.writable = 1;
+    hf.width = frame->width;
+    hf.height = frame->height;
+    for (int i = 0; i < 3; i++) {
+      hf.data[i] = frame->data[i];
+      hf.linesize[i] = frame->linesize[i];
+    }
+  } else {
+    ret = hook_rgba(hc, frame, &hf);
+    if (ret < 0) return ret;
+  }
+  lpmsFrameHook(hc->handle, &hf);
+  return 0;
+}
+
+void free_frame_hook(struct hook_ctx *hc)
+{
+  if (hc->sws) sws_freeContext(hc->sws);
+  hc->sws = NULL;
+  if (hc->sw_frame) av_frame_free(&hc->sw_frame);
+  av_freep(&hc->buf);
+  hc->buf_size = 0;
+}
@@ -0,0 +1,150 @@
+package ffmpeg
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// #include "hook.h"
+import "C"
+
+var ErrFrameHook = errors.New("FrameHookError")
+
+// FrameHook runs Go code on the decoded video frames of a transcode, without
+// decoding the input a second time.
+//
+// Func is called synchronously from the transcoding loop, on the goroutine
+// that called Transcode, after decoding and before any filtering or encoding.
+// The time it takes adds to the transcode, so heavy work should be handed off
+// to other goroutines, working on a copy of the image. Images are backed by
+// memory of the transcoder and only valid until Func returns. Func must not
+// call into the Transcoder running it. Panics in Func are recovered and
+// logged so they don't unwind through C.
+type FrameHook struct {
+	Func func(HookFrame)
+	// Size of the read-only images handed to Func. A zero size keeps the
+	// decoded size, while a single zero dimension keeps the aspect ratio.
+	// Smaller sizes are cheaper.
+	Size image.Point
+	// Run Func for every Interval-th decoded frame; zero runs it for all
+	Interval int
+	// Hand the decoded frame itself to Func as a writable *image.YCbCr rather
+	// than a scaled *image.RGBA copy. Changes reach every output. Only
+	// software decoded 4:2:0 video is supported; other frames are skipped.
+	Writable bool
+}
+
+// HookFrame is a decoded video frame handed to a FrameHook.
+type HookFrame struct {
+	// *image.RGBA, or *image.YCbCr for writable hooks
+	Image image.Image
+	// Presentation time of the frame in the input; zero if unknown
+	PTS time.Duration
+}
+
+// Hooks are handed to C as integer handles, as C may not keep Go pointers
+var frameHooks = struct {
+	sync.Mutex
+	next  uintptr
+	hooks map[uintptr]*FrameHook
+}{hooks: map[uintptr]*FrameHook{}}
+
+func registerFrameHook(h *FrameHook) uintptr {
+	frameHooks.Lock()
+	defer frameHooks.Unlock()
+	frameHooks.next++
+	frameHooks.hooks[frameHooks.next] = h
+	return frameHooks.next
+}
+
+func unregisterFrameHook(handle uintptr) {
+	frameHooks.Lock()
+	defer frameHooks.Unlock()
+	delete(frameHooks.hooks, handle)
+}
+
+func validateFrameHook(input *TranscodeOptionsIn) error {
+	h := input.FrameHook
+	if h == nil {
+		return nil
+	}
+	if h.Func == nil || h.Size.X < 0 || h.Size.Y < 0 || h.Interval < 0 {
+		glog.Warning("Invalid frame hook")
+		return ErrFrameHook
+	}
+	if h.Writable && (input.Accel != Software || input.Transmuxing) {
+		glog.Warning("Writable frame hooks need software decoding")
+		return ErrFrameHook
+	}
+	return nil
+}
+
+// Sets up the input params to run the hook of the input, returning a func
+// to release it once the transcode is done
+func setFrameHook(input *TranscodeOptionsIn, inp *C.input_params) func() {
+	h := input.FrameHook
+	if h == nil {
+		return func() {}
+	}
+	handle := registerFrameHook(h)
+	inp.frame_hook = C.uintptr_t(handle)
+	inp.hook_w = C.int(h.Size.X)
+	inp.hook_h = C.int(h.Size.Y)
+	inp.hook_interval = C.int(h.Interval)
+	if h.Writable {
+		inp.hook_writable = 1
+	}
+	return func() { unregisterFrameHook(handle) }
+}
+
+//export lpmsFrameHook
+func lpmsFrameHook(handle C.uintptr_t, f *C.hook_frame) {
+	frameHooks.Lock()
+	hook := frameHooks.hooks[uintptr(handle)]
+	frameHooks.Unlock()
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Frame hook panicked: %v", r)
+		}
+	}()
+
+	w, h := int(f.width), int(f.height)
+	frame := HookFrame{}
+	if int64(f.pts) != math.MinInt64 { // AV_NOPTS_VALUE
+		frame.PTS = time.Duration(f.pts) * time.Microsecond
+	}
+	if f.writable != 0 {
+		ys, cs := int(f.linesize[0]), int(f.linesize[1])
+		ch := (h + 1) / 2
+		frame.Image = &image.YCbCr{
+			Y:              cBytes(f.data[0], ys*h),
+			Cb:             cBytes(f.data[1], cs*ch),
+			Cr:             cBytes(f.data[2], int(f.linesize[2])*ch),
+			YStride:        ys,
+			CStride:        cs,
+			SubsampleRatio: image.YCbCrSubsampleRatio420,
+			Rect:           image.Rect(0, 0, w, h),
+		}
+	} else {
+		frame.Image = &image.RGBA{
+			Pix:    cBytes(f.data[0], int(f.linesize[0])*h),
+			Stride: int(f.linesize[0]),
+			Rect:   image.Rect(0, 0, w, h),
+		}
+	}
+	hook.Func(frame)
+}
+
+// Go slice over C memory, without copying
+func cBytes(p *C.uint8_t, n int) []byte {
+	return (*[1 << 30]byte)(unsafe.Pointer(p))[:n:n]
+}
@@ -0,0 +1,36 @@
+#ifndef _LPMS_HOOK_H_
+#define _LPMS_HOOK_H_
+
+#include <stdint.h>
+#include <libavutil/frame.h>
+#include <libavutil/rational.h>
+
+// Frame handed to the Go frame hook. Read-only frames are RGBA in data[0],
+// writable frames are the 4:2:0 planes of the decoded frame itself.
+typedef struct {
+  int      writable;
+  int      width, height;
+  int64_t  pts;             // AV_TIME_BASE units, AV_NOPTS_VALUE if unknown
+  uint8_t *data[3];
+  int      linesize[3];
+} hook_frame;
+
+struct SwsContext;
+
+struct hook_ctx {
+  uintptr_t handle;         // Go side hook; zero when there is no hook
+  int w, h;                 // size of read-only frames; zero keeps decoded size
+  int interval;             // run for every nth decoded frame
+  int writable;
+  int64_t count;
+
+  struct SwsContext *sws;
+  AVFrame *sw_frame;        // downloaded hardware frame
+  uint8_t *buf;
+  int buf_size;
+};
+
+int run_frame_hook(struct hook_ctx *hc, AVFrame *frame, AVRational tb);
+void free_frame_hook(struct hook_ctx *hc);
+
+#endif // _LPMS_HOOK_H_
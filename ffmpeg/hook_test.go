@@ -0,0 +1,130 @@
+package ffmpeg
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameHook_ReadOnly(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	var (
+		calls  int
+		last   time.Duration = -1
+		bounds image.Rectangle
+	)
+	hook := &FrameHook{
+		Size:     image.Point{X: 64},
+		Interval: 2,
+		Func: func(f HookFrame) {
+			calls++
+			assert.True(t, f.PTS > last, "pts %v after %v", f.PTS, last)
+			last = f.PTS
+			bounds = f.Image.Bounds()
+			assert.IsType(t, &image.RGBA{}, f.Image)
+		},
+	}
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts", FrameHook: hook}
+	res, err := Transcode3(in, []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: P144p30fps16x9,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, (res.Decoded.Frames+1)/2, calls)
+	assert.Equal(t, image.Rect(0, 0, 64, 36), bounds)
+
+	// panics stay within the hook
+	calls = 0
+	in.FrameHook = &FrameHook{Func: func(f HookFrame) {
+		calls++
+		panic("hook")
+	}}
+	res, err = Transcode3(in, []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "panic.ts"),
+		Profile: P144p30fps16x9,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, res.Decoded.Frames, calls)
+	assert.NotZero(t, res.Encoded[0].Frames)
+}
+
+func TestFrameHook_Writable(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// paint every frame black before it is encoded
+	hook := &FrameHook{
+		Writable: true,
+		Func: func(f HookFrame) {
+			// no require here, FailNow can't unwind through C
+			img, ok := f.Image.(*image.YCbCr)
+			if !assert.True(t, ok) {
+				return
+			}
+			assert.Equal(t, image.Rect(0, 0, 1280, 720), img.Bounds())
+			for i := range img.Y {
+				img.Y[i] = 16
+			}
+			for i := range img.Cb {
+				img.Cb[i], img.Cr[i] = 128, 128
+			}
+		},
+	}
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts", FrameHook: hook}
+	out := []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "black.ts"),
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   filepath.Join(dir, "black360.ts"),
+		Profile: P360p30fps16x9,
+	}}
+	_, err := Transcode3(in, out)
+	require.NoError(t, err)
+	for _, o := range out {
+		frames, err := ExtractFrames(o.Oname, []time.Duration{0, time.Second}, image.Point{X: 16, Y: 16})
+		require.NoError(t, err)
+		for _, f := range frames {
+			r, g, b, _ := color.RGBAModel.Convert(f.Image.At(8, 8)).RGBA()
+			assert.True(t, r>>8 < 8 && g>>8 < 8 && b>>8 < 8, "%s not black at %v", o.Oname, f.PTS)
+		}
+	}
+
+	// the input itself is untouched
+	frames, err := ExtractFrames(in.Fname, []time.Duration{time.Second}, image.Point{X: 16, Y: 16})
+	require.NoError(t, err)
+	assert.NotEqual(t, make([]byte, 16*16*4), frames[0].Image.(*image.RGBA).Pix)
+}
+
+func TestFrameHook_Invalid(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	out := []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: P144p30fps16x9,
+	}}
+	hooks := []*FrameHook{
+		{},
+		{Func: func(HookFrame) {}, Size: image.Point{X: -1}},
+		{Func: func(HookFrame) {}, Interval: -1},
+	}
+	for _, h := range hooks {
+		_, err := Transcode3(&TranscodeOptionsIn{Fname: "../transcoder/test.ts", FrameHook: h}, out)
+		assert.Equal(t, ErrFrameHook, err)
+	}
+	_, err := Transcode3(&TranscodeOptionsIn{
+		Fname:     "../transcoder/test.ts",
+		Accel:     Nvidia,
+		FrameHook: &FrameHook{Func: func(HookFrame) {}, Writable: true},
+	}, out)
+	assert.Equal(t, ErrFrameHook, err)
+	assert.Empty(t, frameHooks.hooks)
+}
@@ -0,0 +1,132 @@
+package ffmpeg
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include "transcoder.h"
+import "C"
+
+var ErrTranscoderID3 = errors.New("TranscoderInvalidID3")
+
+// ID3Frame is a frame of a timed ID3 tag. Frames with an ID starting with T
+// are text frames carrying Text; TXXX ones also take a Description. PRIV
+// frames carry Data, with Description as the owner identifier.
+type ID3Frame struct {
+	ID          string
+	Description string
+	Text        string
+	Data        []byte
+}
+
+// ID3Tag is a timed ID3 tag to write into an MPEG-TS output, for players
+// to raise as an event at its presentation time. PTS counts from the start
+// of the input.
+type ID3Tag struct {
+	PTS    time.Duration
+	Frames []ID3Frame
+}
+
+// Size as an ID3v2.4 syncsafe integer, which has 7 bits a byte
+func id3Size(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// Bytes returns the tag as ID3v2.4, with text in UTF-8.
+func (tag ID3Tag) Bytes() ([]byte, error) {
+	if tag.PTS < 0 || len(tag.Frames) == 0 {
+		return nil, ErrTranscoderID3
+	}
+	var frames []byte
+	for _, f := range tag.Frames {
+		if len(f.ID) != 4 {
+			return nil, ErrTranscoderID3
+		}
+		for _, c := range []byte(f.ID) {
+			if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+				return nil, ErrTranscoderID3
+			}
+		}
+		var body []byte
+		switch {
+		case f.ID == "PRIV":
+			if f.Description == "" {
+				return nil, ErrTranscoderID3
+			}
+			body = append([]byte(f.Description), 0)
+			body = append(body, f.Data...)
+		case f.ID == "TXXX":
+			body = append([]byte{3}, f.Description...)
+			body = append(body, 0)
+			body = append(body, f.Text...)
+		case f.ID[0] == 'T':
+			body = append([]byte{3}, f.Text...)
+		default:
+			return nil, ErrTranscoderID3
+		}
+		frames = append(frames, f.ID...)
+		frames = append(frames, id3Size(len(body))...)
+		frames = append(frames, 0, 0) // flags
+		frames = append(frames, body...)
+	}
+	if len(frames) >= 1<<28 {
+		return nil, ErrTranscoderID3
+	}
+	b := []byte{'I', 'D', '3', 4, 0, 0}
+	b = append(b, id3Size(len(frames))...)
+	return append(b, frames...), nil
+}
+
+// Whether the output is written as MPEG-TS, the only format carrying timed ID3
+func isMPEGTSOutput(p TranscodeOptions) bool {
+	muxer := outputMuxer(p)
+	return muxer == "mpegts" || muxer == "" && filepath.Ext(p.Oname) == ".ts"
+}
+
+// Tags of the output in order of their timestamps, allocated for the C code.
+// The array and the tag data are freed with freeID3Tags.
+func newID3Tags(p TranscodeOptions) (*C.id3_tag, C.int, error) {
+	if len(p.ID3) == 0 {
+		return nil, 0, nil
+	}
+	if !isMPEGTSOutput(p) {
+		return nil, 0, ErrTranscoderID3
+	}
+	tags := make([]ID3Tag, len(p.ID3))
+	copy(tags, p.ID3)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].PTS < tags[j].PTS })
+	bufs := make([][]byte, len(tags))
+	for i, tag := range tags {
+		b, err := tag.Bytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		bufs[i] = b
+	}
+	n := len(tags)
+	ctags := (*C.id3_tag)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.id3_tag{}))))
+	arr := (*[1 << 20]C.id3_tag)(unsafe.Pointer(ctags))[:n:n]
+	for i, b := range bufs {
+		arr[i] = C.id3_tag{
+			pts:  C.int64_t(tags[i].PTS / time.Microsecond),
+			data: (*C.uint8_t)(C.CBytes(b)),
+			size: C.int(len(b)),
+		}
+	}
+	return ctags, C.int(n), nil
+}
+
+func freeID3Tags(tags *C.id3_tag, n C.int) {
+	if tags == nil {
+		return
+	}
+	for _, tag := range (*[1 << 20]C.id3_tag)(unsafe.Pointer(tags))[:n:n] {
+		C.free(unsafe.Pointer(tag.data))
+	}
+	C.free(unsafe.Pointer(tags))
+}
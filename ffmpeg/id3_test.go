@@ -0,0 +1,143 @@
+package ffmpeg
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestID3_Bytes(t *testing.T) {
+	tag := ID3Tag{Frames: []ID3Frame{
+		{ID: "TIT2", Text: "poll"},
+		{ID: "TXXX", Description: "id", Text: "7"},
+		{ID: "PRIV", Description: "com.apple.streaming.transportStreamTimestamp", Data: []byte{0, 0, 0, 0, 0, 0, 0x1f, 0x40}},
+	}}
+	b, err := tag.Bytes()
+	require.NoError(t, err)
+	expected := []byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 93,
+		'T', 'I', 'T', '2', 0, 0, 0, 5, 0, 0, 3, 'p', 'o', 'l', 'l',
+		'T', 'X', 'X', 'X', 0, 0, 0, 5, 0, 0, 3, 'i', 'd', 0, '7',
+	}
+	expected = append(expected, 'P', 'R', 'I', 'V', 0, 0, 0, 53, 0, 0)
+	expected = append(expected, "com.apple.streaming.transportStreamTimestamp"...)
+	expected = append(expected, 0, 0, 0, 0, 0, 0, 0, 0x1f, 0x40)
+	assert.Equal(t, expected, b)
+
+	// sizes are syncsafe
+	b, err = ID3Tag{Frames: []ID3Frame{{ID: "PRIV", Description: "x", Data: make([]byte, 200)}}}.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 1, 0x54}, b[6:10])
+	assert.Equal(t, []byte{0, 0, 1, 0x4a}, b[14:18])
+
+	invalid := []ID3Tag{
+		{},
+		{PTS: -time.Second, Frames: []ID3Frame{{ID: "TIT2"}}},
+		{Frames: []ID3Frame{{ID: "TIT"}}},
+		{Frames: []ID3Frame{{ID: "tit2"}}},
+		{Frames: []ID3Frame{{ID: "APIC"}}},
+		{Frames: []ID3Frame{{ID: "PRIV", Data: []byte{1}}}},
+	}
+	for _, tag := range invalid {
+		_, err := tag.Bytes()
+		assert.Equal(t, ErrTranscoderID3, err)
+	}
+}
+
+func TestID3_Transcode(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -c copy -t 2 test.ts
+	`
+	require.True(t, run(cmd))
+
+	tags := []ID3Tag{
+		{PTS: 1500 * time.Millisecond, Frames: []ID3Frame{{ID: "TXXX", Description: "event", Text: "ad-end"}}},
+		{PTS: 500 * time.Millisecond, Frames: []ID3Frame{
+			{ID: "TXXX", Description: "event", Text: "poll"},
+			{ID: "PRIV", Description: "tv.livepeer.test", Data: []byte("owned")},
+		}},
+	}
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts"}
+	_, err := Transcode3(in, []TranscodeOptions{{
+		Oname:   dir + "/tagged.ts",
+		Profile: P144p30fps16x9,
+		ID3:     tags,
+	}})
+	require.NoError(t, err)
+
+	// mpegts only
+	_, err = Transcode3(in, []TranscodeOptions{{
+		Oname:   dir + "/tagged.mp4",
+		Profile: P144p30fps16x9,
+		ID3:     tags,
+	}})
+	assert.Equal(t, ErrTranscoderID3, err)
+
+	// tags of the input are passed through to every rendition
+	in = &TranscodeOptionsIn{Fname: dir + "/tagged.ts"}
+	_, err = Transcode3(in, []TranscodeOptions{
+		{Oname: dir + "/out_0.ts", Profile: P144p30fps16x9},
+		{Oname: dir + "/out_1.ts", Profile: P240p30fps16x9},
+		{Oname: dir + "/out_2.mp4", Profile: P144p30fps16x9},
+	})
+	require.NoError(t, err)
+
+	cmd = `
+		for f in tagged.ts out_0.ts out_1.ts; do
+			ffprobe -loglevel warning -show_streams -select_streams d $f | grep codec_name=timed_id3
+			ffprobe -loglevel warning -show_packets -select_streams d -show_entries packet=pts -of csv=p=0 $f > $f.pts
+			test $(wc -l < $f.pts) -eq 2
+
+			# a second apart, in order
+			test $(( $(sed -n 2p $f.pts) - $(sed -n 1p $f.pts) )) -eq 90000
+
+			ffmpeg -loglevel warning -i $f -map 0:d -c copy -f data $f.id3
+			grep -a poll $f.id3
+			grep -a ad-end $f.id3
+			grep -a tv.livepeer.test $f.id3
+		done
+
+		# the first tag is half a second into the input
+		start=$(ffprobe -loglevel warning -show_entries format=start_time -of csv=p=0 test.ts)
+		first=$(ffprobe -loglevel warning -show_packets -select_streams d -show_entries packet=pts_time -of csv=p=0 tagged.ts | head -1)
+		awk "BEGIN { d = $first - $start; exit !(d > 0.499 && d < 0.501) }"
+
+		# other formats go without
+		ffprobe -loglevel warning -show_streams out_2.mp4 | grep codec_type > mp4.out
+		tee expected-mp4.out <<-EOF
+			codec_type=video
+			codec_type=audio
+			EOF
+		diff -u expected-mp4.out mp4.out
+	`
+	assert.True(t, run(cmd))
+
+	// transmuxed outputs take tags too, alongside those of the input
+	tc := NewTranscoder()
+	_, err = tc.Transcode(&TranscodeOptionsIn{Fname: dir + "/tagged.ts", Transmuxing: true}, []TranscodeOptions{{
+		Oname:        dir + "/remux.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		Profile:      VideoProfile{Format: FormatNone},
+		ID3:          []ID3Tag{{PTS: time.Second, Frames: []ID3Frame{{ID: "TXXX", Description: "event", Text: "remuxed"}}}},
+	}})
+	require.NoError(t, err)
+	tc.StopTranscoder()
+
+	cmd = `
+		ffprobe -loglevel warning -show_streams -select_streams d remux.ts | grep -c codec_name=timed_id3 | grep -x 1
+		ffprobe -loglevel warning -show_packets -select_streams d -show_entries packet=pts -of csv=p=0 remux.ts > remux.pts
+		test $(wc -l < remux.pts) -eq 3
+		sort -n -c remux.pts
+		ffmpeg -loglevel warning -i remux.ts -map 0:d -c copy -f data remux.id3
+		grep -a poll remux.id3
+		grep -a remuxed remux.id3
+		grep -a ad-end remux.id3
+	`
+	assert.True(t, run(cmd))
+}
@@ -0,0 +1,139 @@
+package ffmpeg
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// #include "transcoder.h"
+import "C"
+
+var ErrTranscoderInputRes = errors.New("TranscoderInputResolutionLimit")
+var ErrTranscoderInputSize = errors.New("TranscoderInputSizeLimit")
+var ErrTranscoderFramerate = errors.New("TranscoderFramerateLimit")
+
+// Limits bounds the resources a transcoder spends on its inputs, so that
+// untrusted inputs can't tie it up. Zero fields are unlimited, except for
+// MaxFrameRatio.
+type Limits struct {
+	// Longest input, for inputs whose duration can be probed. Exceeding it
+	// fails with ErrTranscoderDuration.
+	MaxDuration time.Duration
+	// Largest decoded video, by dimensions and by pixel count. Exceeding it
+	// fails with ErrTranscoderInputRes.
+	MaxWidth, MaxHeight int
+	MaxPixels           int64
+	// Most frames encoded per decoded frame, for each output. This guards
+	// against the fps filter filling large timestamp gaps with duplicates.
+	// Exceeding it fails with "Encoded frames runaway". Zero keeps the
+	// default of 25, as this guard can't be turned off.
+	MaxFrameRatio int
+	// Highest frame rate of the outputs, and of the decoded input as measured
+	// from its timestamps. Exceeding it fails with ErrTranscoderFramerate.
+	MaxFramerate float64
+	// Most outputs of a transcode; never more than MAX_OUTPUT_SIZE. Exceeding
+	// it fails with "Too many outputs".
+	MaxOutputs int
+	// Most input bytes read by a transcode. Exceeding it fails with
+	// ErrTranscoderInputSize.
+	MaxInputBytes int64
+}
+
+// DefaultLimits are the limits of new transcoders.
+var DefaultLimits = Limits{
+	MaxDuration:   300 * time.Second,
+	MaxFrameRatio: defaultFrameRatio,
+}
+
+// Encoded frames per decoded frame of limits that don't set any
+const defaultFrameRatio = 25
+
+// Limit errors of the C code, so they compare equal to the Go ones
+func limitErrors() map[int]error {
+	return map[int]error{
+		int(C.lpms_ERR_INPUT_RES):  ErrTranscoderInputRes,
+		int(C.lpms_ERR_INPUT_SIZE): ErrTranscoderInputSize,
+		int(C.lpms_ERR_INPUT_FPS):  ErrTranscoderFramerate,
+	}
+}
+
+// SetLimits replaces the limits of the transcoder, DefaultLimits unless set.
+// Limits apply from the next call to Transcode.
+func (t *Transcoder) SetLimits(l Limits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = l
+	for _, tc := range t.tracks {
+		tc.limits = l
+	}
+}
+
+// Checks the probed input against the limits
+func (l *Limits) checkInput(fname string, format MediaFormatInfo) error {
+	if l.MaxDuration > 0 && time.Duration(format.DurSecs)*time.Second > l.MaxDuration {
+		glog.Errorf("Input file %s has duration of %d seconds, which is more than the limit of %v.", fname, format.DurSecs, l.MaxDuration)
+		return ErrTranscoderDuration
+	}
+	if l.exceedsResolution(format.Width, format.Height) {
+		glog.Errorf("Input file %s has resolution %dx%d, which is above the limit.", fname, format.Width, format.Height)
+		return ErrTranscoderInputRes
+	}
+	if l.MaxInputBytes > 0 {
+		if fi, err := os.Stat(fname); err == nil && fi.Size() > l.MaxInputBytes {
+			glog.Errorf("Input file %s has %d bytes, which is more than the limit of %d.", fname, fi.Size(), l.MaxInputBytes)
+			return ErrTranscoderInputSize
+		}
+	}
+	return nil
+}
+
+func (l *Limits) exceedsResolution(w, h int) bool {
+	return l.MaxWidth > 0 && w > l.MaxWidth ||
+		l.MaxHeight > 0 && h > l.MaxHeight ||
+		l.MaxPixels > 0 && int64(w)*int64(h) > l.MaxPixels
+}
+
+// Checks the requested outputs against the limits
+func (l *Limits) checkOutputs(ps []TranscodeOptions) error {
+	if l.MaxOutputs > 0 && len(ps) > l.MaxOutputs {
+		return ErrorMap[int(C.lpms_ERR_OUTPUTS)]
+	}
+	if l.MaxFramerate <= 0 {
+		return nil
+	}
+	for _, p := range ps {
+		den := p.Profile.FramerateDen
+		if den == 0 {
+			den = 1
+		}
+		if float64(p.Profile.Framerate)/float64(den) > l.MaxFramerate {
+			glog.Errorf("Output %s has frame rate %d/%d, which is more than the limit of %v.", p.Oname, p.Profile.Framerate, den, l.MaxFramerate)
+			return ErrTranscoderFramerate
+		}
+	}
+	return nil
+}
+
+// Hands the limits enforced while transcoding over to C
+func (l *Limits) setInputParams(inp *C.input_params) {
+	inp.max_width = C.int(l.MaxWidth)
+	inp.max_height = C.int(l.MaxHeight)
+	inp.max_pixels = C.int64_t(l.MaxPixels)
+	inp.max_frame_ratio = C.int(l.MaxFrameRatio)
+	if l.MaxFrameRatio <= 0 {
+		inp.max_frame_ratio = defaultFrameRatio
+	}
+	inp.max_input_bytes = C.int64_t(l.MaxInputBytes)
+	inp.max_framerate = C.double(l.MaxFramerate)
+}
+
+// Transcodes within the given limits on a transcoder of its own
+func transcodeWithLimits(l Limits, input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
+	t := NewTranscoder()
+	defer t.StopTranscoder()
+	t.limits = l
+	return t.Transcode(input, ps)
+}
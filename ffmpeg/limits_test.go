@@ -0,0 +1,155 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Transcodes fname through a pipe, so nothing can be probed up front
+func transcodePipe(t *testing.T, l Limits, fname string, ps []TranscodeOptions) error {
+	ir, iw, err := os.Pipe()
+	require.NoError(t, err)
+	defer ir.Close()
+	go func() {
+		defer iw.Close()
+		f, err := os.Open(fname)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		io.Copy(iw, f)
+	}()
+	in := &TranscodeOptionsIn{Fname: fmt.Sprintf("pipe:%d", ir.Fd())}
+	_, err = transcodeWithLimits(l, in, ps)
+	return err
+}
+
+func TestLimits_Transcode(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		# a 1fps sample longer than the default duration limit
+		ffmpeg -i "$1"/../transcoder/test.ts -c copy -bsf:v setts=ts=N/TB/1 -frames:v 301 -an -y long.ts
+		ffprobe -show_format long.ts | grep duration=301.00
+	`
+	run(cmd)
+	long := filepath.Join(dir, "long.ts")
+	copyOut := []TranscodeOptions{{
+		Oname:        filepath.Join(dir, "out.ts"),
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		Muxer:        ComponentOptions{Name: "md5"},
+	}}
+
+	tc := NewTranscoder()
+	_, err := tc.Transcode(&TranscodeOptionsIn{Fname: long}, copyOut)
+	assert.Equal(t, ErrTranscoderDuration, err)
+	tc.StopTranscoder()
+
+	// longer files are fine once the limit is raised
+	vod := DefaultLimits
+	vod.MaxDuration = 2 * time.Hour
+	tc = NewTranscoder()
+	tc.SetLimits(vod)
+	_, err = tc.Transcode(&TranscodeOptionsIn{Fname: long}, copyOut)
+	assert.NoError(t, err)
+	tc.StopTranscoder()
+
+	in := "../transcoder/test.ts"
+	out := []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: P144p30fps16x9,
+	}}
+
+	// the input is 1280x720, checked up front and while decoding pipes
+	for _, l := range []Limits{{MaxWidth: 1000}, {MaxHeight: 480}, {MaxPixels: 640 * 360}} {
+		_, err = transcodeWithLimits(l, &TranscodeOptionsIn{Fname: in}, out)
+		assert.Equal(t, ErrTranscoderInputRes, err)
+		assert.Equal(t, ErrTranscoderInputRes, transcodePipe(t, l, in, out))
+	}
+	_, err = transcodeWithLimits(Limits{MaxWidth: 1280, MaxHeight: 720, MaxPixels: 1280 * 720}, &TranscodeOptionsIn{Fname: in}, out)
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(in)
+	require.NoError(t, err)
+	l := Limits{MaxInputBytes: fi.Size() / 2}
+	_, err = transcodeWithLimits(l, &TranscodeOptionsIn{Fname: in}, out)
+	assert.Equal(t, ErrTranscoderInputSize, err)
+	assert.Equal(t, ErrTranscoderInputSize, transcodePipe(t, l, in, out))
+	l.MaxInputBytes = fi.Size()
+	_, err = transcodeWithLimits(l, &TranscodeOptionsIn{Fname: in}, out)
+	assert.NoError(t, err)
+
+	fast := P144p30fps16x9
+	fast.Framerate = 60
+	_, err = transcodeWithLimits(Limits{MaxFramerate: 30}, &TranscodeOptionsIn{Fname: in}, []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: fast,
+	}})
+	assert.Equal(t, ErrTranscoderFramerate, err)
+	fast.FramerateDen = 2
+	_, err = transcodeWithLimits(Limits{MaxFramerate: 30}, &TranscodeOptionsIn{Fname: in}, []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: fast,
+	}})
+	assert.NoError(t, err)
+
+	// inputs faster than the limit fail while decoding, whatever the output rate
+	run(`ffmpeg -i "$1"/../transcoder/test.ts -c copy -bsf:v setts=ts=N*1500 -an -y fast.ts`)
+	for _, l := range []Limits{{MaxFramerate: 30}, {MaxFramerate: 59}} {
+		_, err = transcodeWithLimits(l, &TranscodeOptionsIn{Fname: filepath.Join(dir, "fast.ts")}, out)
+		assert.Equal(t, ErrTranscoderFramerate, err)
+		assert.Equal(t, ErrTranscoderFramerate, transcodePipe(t, l, filepath.Join(dir, "fast.ts"), out))
+	}
+	_, err = transcodeWithLimits(Limits{MaxFramerate: 60}, &TranscodeOptionsIn{Fname: filepath.Join(dir, "fast.ts")}, out)
+	assert.NoError(t, err)
+	_, err = transcodeWithLimits(Limits{MaxFramerate: 30}, &TranscodeOptionsIn{Fname: in}, out)
+	assert.NoError(t, err)
+
+	drop := []TranscodeOptions{
+		{VideoEncoder: ComponentOptions{Name: "drop"}},
+		{VideoEncoder: ComponentOptions{Name: "drop"}},
+		{VideoEncoder: ComponentOptions{Name: "drop"}},
+	}
+	_, err = transcodeWithLimits(Limits{MaxOutputs: 2}, &TranscodeOptionsIn{Fname: in}, drop)
+	assert.EqualError(t, err, "Too many outputs")
+}
+
+func TestLimits_FrameRatio(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// 10 seconds between frames, encoded at 5 fps for 50 frames per frame
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -vf "setpts=N*10/TB" -frames:v 5 -c:v libx264 -bf 0 -fps_mode vfr -an lowfps.mp4
+	`
+	run(cmd)
+	profile := P144p30fps16x9
+	profile.Framerate = 5
+	in := &TranscodeOptionsIn{Fname: filepath.Join(dir, "lowfps.mp4")}
+	out := []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "out.ts"),
+		Profile: profile,
+	}}
+
+	_, err := transcodeWithLimits(Limits{MaxFrameRatio: 25}, in, out)
+	assert.EqualError(t, err, "Encoded frames runaway")
+	res, err := transcodeWithLimits(Limits{MaxFrameRatio: 100}, in, out)
+	require.NoError(t, err)
+	assert.True(t, res.Encoded[0].Frames > 25*res.Decoded.Frames)
+	// limits without a ratio keep the default one
+	_, err = transcodeWithLimits(Limits{MaxDuration: 2 * time.Hour}, in, out)
+	assert.EqualError(t, err, "Encoded frames runaway")
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	tc.SetLimits(Limits{})
+	_, err = tc.Transcode(in, out)
+	assert.EqualError(t, err, "Encoded frames runaway")
+}
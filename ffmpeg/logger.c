@@ -0,0 +1,75 @@
+#include "logger.h"
+#include "_cgo_export.h"
+
+#include <stdio.h>
+#include <libavutil/avstring.h>
+#include <libavutil/common.h>
+#include <libavutil/log.h>
+
+#define LOG_LINE_SIZE 1024
+
+// Transcodes run on a single thread, so messages logged on it can be tied to
+// the session. Codec worker threads have no session.
+static __thread uint64_t log_session;
+
+// FFmpeg logs lines in pieces; collect them until the newline
+static __thread char log_line[LOG_LINE_SIZE];
+static __thread int log_len;
+static __thread int log_level;
+static __thread char log_component[64];
+
+static __thread lpms_log_capture_fn log_capture;
+static __thread void *log_capture_opaque;
+// whether lines go to Go rather than to the default callback
+static volatile int log_forward;
+
+static void log_callback(void *avcl, int level, const char *fmt, va_list vl)
+{
+  int n;
+  if (!log_forward) {
+    va_list copy;
+    va_copy(copy, vl);
+    av_log_default_callback(avcl, level, fmt, copy);
+    va_end(copy);
+    if (!log_capture) return;
+  } else if (level > av_log_get_level() && !log_capture) return;
+  if (!log_len) {
+    const char *component = "lpms";
+    AVClass *avc = avcl ? *(AVClass **)avcl : NULL;
+    if (avc) component = avc->item_name ? avc->item_name(avcl) : avc->class_name;
+    av_strlcpy(log_component, component, sizeof log_component);
+    log_level = level;
+  }
+  n = vsnprintf(log_line + log_len, sizeof log_line - log_len, fmt, vl);
+  if (n < 0) return;
+  log_len = FFMIN(log_len + n, (int)sizeof log_line - 1);
+  // wait for the rest of the line unless the buffer is full
+  if (log_len < sizeof log_line - 1 && (!log_len || log_line[log_len - 1] != '\n')) return;
+  while (log_len && (log_line[log_len - 1] == '\n' || log_line[log_len - 1] == '\r')) {
+    log_line[--log_len] = 0;
+  }
+  if (log_len && log_capture) log_capture(log_capture_opaque, log_line);
+  if (log_len && log_forward && log_level <= av_log_get_level()) {
+    lpmsLog(log_level, log_session, log_component, log_line);
+  }
+  log_len = 0;
+}
+
+void lpms_log_forward(int enable)
+{
+  log_forward = enable;
+  // capturing needs the callback even when nothing is forwarded
+  av_log_set_callback(log_callback);
+}
+
+void lpms_log_capture(lpms_log_capture_fn fn, void *opaque)
+{
+  log_capture = fn;
+  log_capture_opaque = opaque;
+  if (fn) av_log_set_callback(log_callback);
+}
+
+void lpms_log_set_session(uint64_t session)
+{
+  log_session = session;
+}
@@ -0,0 +1,122 @@
+package ffmpeg
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// #include "logger.h"
+import "C"
+
+// LogEntry is a single line logged by FFmpeg or LPMS.
+type LogEntry struct {
+	Level LogLevel
+	// Name of the FFmpeg component logging it, eg the codec or muxer, or
+	// "lpms" for messages of LPMS itself
+	Component string
+	// Session ID of the transcoder the message came from, if known. Messages
+	// from codec worker threads and outside of transcodes have none.
+	Session string
+	// Text of the line, without the trailing newline
+	Message string
+}
+
+// Logger receives the messages logged by FFmpeg and LPMS. Log may be called
+// concurrently from any thread, including threads of FFmpeg, and must not
+// call back into FFmpeg.
+type Logger interface {
+	Log(LogEntry)
+}
+
+type loggerHolder struct{ Logger }
+
+var logger atomic.Value
+
+// SetLogger forwards FFmpeg and LPMS logs at or above the level set with
+// InitFFmpegWithLogLevel to l, rather than writing them to stderr. A nil
+// logger restores the default.
+func SetLogger(l Logger) {
+	logger.Store(loggerHolder{l})
+	if l != nil {
+		C.lpms_log_forward(1)
+	} else {
+		C.lpms_log_forward(0)
+	}
+}
+
+// GlogLogger writes FFmpeg and LPMS logs to glog.
+type GlogLogger struct{}
+
+func (GlogLogger) Log(e LogEntry) {
+	prefix := "[" + e.Component + "] "
+	if e.Session != "" {
+		prefix = "[" + e.Session + "] " + prefix
+	}
+	switch {
+	case e.Level <= FFLogError:
+		glog.Error(prefix, e.Message)
+	case e.Level <= FFLogWarning:
+		glog.Warning(prefix, e.Message)
+	case e.Level <= FFLogInfo:
+		glog.Info(prefix, e.Message)
+	default:
+		glog.V(6).Info(prefix, e.Message)
+	}
+}
+
+// Session IDs are handed to C as integer handles
+var logSessions = struct {
+	sync.RWMutex
+	next uint64
+	ids  map[uint64]string
+}{ids: map[uint64]string{}}
+
+func registerLogSession() uint64 {
+	logSessions.Lock()
+	defer logSessions.Unlock()
+	logSessions.next++
+	return logSessions.next
+}
+
+func unregisterLogSession(session uint64) {
+	logSessions.Lock()
+	defer logSessions.Unlock()
+	delete(logSessions.ids, session)
+}
+
+func logSessionID(session uint64) string {
+	if session == 0 {
+		return ""
+	}
+	logSessions.RLock()
+	defer logSessions.RUnlock()
+	return logSessions.ids[session]
+}
+
+// SetSessionID tags the messages logged while this transcoder runs, eg with
+// the ID of the stream it transcodes.
+func (t *Transcoder) SetSessionID(id string) {
+	logSessions.Lock()
+	defer logSessions.Unlock()
+	if id == "" {
+		delete(logSessions.ids, t.logSession)
+	} else {
+		logSessions.ids[t.logSession] = id
+	}
+}
+
+//export lpmsLog
+func lpmsLog(level C.int, session C.uint64_t, component *C.char, msg *C.char) {
+	l, _ := logger.Load().(loggerHolder)
+	if l.Logger == nil {
+		return
+	}
+	l.Log(LogEntry{
+		Level:     LogLevel(level),
+		Component: C.GoString(component),
+		Session:   logSessionID(uint64(session)),
+		Message:   C.GoString(msg),
+	})
+}
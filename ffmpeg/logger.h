@@ -0,0 +1,16 @@
+#ifndef _LPMS_LOGGER_H_
+#define _LPMS_LOGGER_H_
+
+#include <stdint.h>
+
+// Forward av_log messages to the Go logger, or restore the default callback
+void lpms_log_forward(int enable);
+// Receives the lines logged on the calling thread while set
+typedef void (*lpms_log_capture_fn)(void *opaque, const char *line);
+// Hands lines logged on the calling thread to fn as well, whether or not they
+// are forwarded or above the log level. NULL stops capturing.
+void lpms_log_capture(lpms_log_capture_fn fn, void *opaque);
+// Session that messages logged from the calling thread belong to; zero for none
+void lpms_log_set_session(uint64_t session);
+
+#endif // _LPMS_LOGGER_H_
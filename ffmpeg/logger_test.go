@@ -0,0 +1,83 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (l *recordingLogger) Log(e LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+}
+
+// First entry containing msg
+func (l *recordingLogger) find(msg string) *LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.entries {
+		if strings.Contains(e.Message, msg) {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func (l *recordingLogger) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
+
+func TestLogger_Sessions(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	l := &recordingLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	in := &TranscodeOptionsIn{Fname: filepath.Join(dir, "missing.ts")}
+	out := []TranscodeOptions{{Oname: filepath.Join(dir, "out.ts"), Profile: P144p30fps16x9}}
+
+	tc := NewTranscoder()
+	tc.SetSessionID("stream-1")
+	_, err := tc.Transcode(in, out)
+	assert.Error(t, err)
+	e := l.find("Unable to open input")
+	require.NotNil(t, e)
+	assert.Equal(t, "stream-1", e.Session)
+	assert.Equal(t, "lpms", e.Component)
+	assert.Equal(t, LogLevel(FFLogError), e.Level)
+	assert.False(t, strings.HasSuffix(e.Message, "\n"))
+
+	// the ID goes away with the session
+	tc.StopTranscoder()
+	assert.Equal(t, "", logSessionID(tc.logSession))
+
+	// transcoders without an ID log without a session
+	l.reset()
+	_, err = Transcode3(in, out)
+	assert.Error(t, err)
+	e = l.find("Unable to open input")
+	require.NotNil(t, e)
+	assert.Equal(t, "", e.Session)
+
+	// nothing is forwarded once the logger is removed
+	SetLogger(nil)
+	l.reset()
+	_, err = Transcode3(in, out)
+	assert.Error(t, err)
+	assert.Nil(t, l.find("Unable to open input"))
+}
@@ -856,3 +856,7 @@ func TestNvidia_H264Parser(t *testing.T) {
 	run(cmd)
 
 }
+
+func TestNvidia_ExtractFrames(t *testing.T) {
+	extractFramesTest(t, Nvidia)
+}
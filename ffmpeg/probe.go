@@ -0,0 +1,246 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include <libavutil/avutil.h>
+// #include "extras.h"
+import "C"
+
+var ErrProbe = errors.New("ProbeError")
+
+type MediaType int
+
+const (
+	MediaTypeUnknown MediaType = iota
+	MediaTypeVideo
+	MediaTypeAudio
+	MediaTypeData
+	MediaTypeSubtitle
+	MediaTypeAttachment
+)
+
+func (t MediaType) String() string {
+	switch t {
+	case MediaTypeVideo:
+		return "video"
+	case MediaTypeAudio:
+		return "audio"
+	case MediaTypeData:
+		return "data"
+	case MediaTypeSubtitle:
+		return "subtitle"
+	case MediaTypeAttachment:
+		return "attachment"
+	}
+	return "unknown"
+}
+
+type Rational struct {
+	Num, Den int
+}
+
+func (r Rational) Float64() float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+func (r Rational) String() string {
+	return fmt.Sprintf("%d/%d", r.Num, r.Den)
+}
+
+// StreamInfo holds the details of a single stream in a container.
+// Fields that are not applicable to the stream type are left empty.
+type StreamInfo struct {
+	Index    int
+	Type     MediaType
+	Codec    string
+	Profile  string
+	Level    int
+	Bitrate  int64
+	TimeBase Rational
+	Language string
+
+	// Negative if unknown
+	StartTime time.Duration
+	Duration  time.Duration
+	// Codec specific data, such as the parameter sets of H.264 in avcC or
+	// Annex B. Empty if the stream has none, or too much of it.
+	Extradata []byte
+
+	// Video
+	FrameRate      Rational // r_frame_rate; lowest rate that represents all timestamps
+	AvgFrameRate   Rational
+	Width, Height  int
+	PixFormat      PixelFormat
+	SAR, DAR       Rational
+	Rotation       float64 // degrees, counter-clockwise
+	ColorRange     string
+	ColorSpace     string
+	ColorTransfer  string
+	ColorPrimaries string
+	FieldOrder     string
+
+	// Audio
+	ChannelLayout string
+	Channels      int
+	SampleRate    int
+}
+
+// ProbeInfo describes a container and every stream within it.
+type ProbeInfo struct {
+	Format  string
+	Bitrate int64
+
+	// Negative if unknown
+	StartTime time.Duration
+	Duration  time.Duration
+
+	Streams []StreamInfo
+}
+
+// VideoStreams returns all video streams in container order
+func (m *ProbeInfo) VideoStreams() []StreamInfo {
+	return m.streamsOfType(MediaTypeVideo)
+}
+
+// AudioStreams returns all audio streams in container order
+func (m *ProbeInfo) AudioStreams() []StreamInfo {
+	return m.streamsOfType(MediaTypeAudio)
+}
+
+func (m *ProbeInfo) streamsOfType(t MediaType) []StreamInfo {
+	var streams []StreamInfo
+	for _, s := range m.Streams {
+		if s.Type == t {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+func mediaTypeFromC(t C.int) MediaType {
+	switch t {
+	case C.AVMEDIA_TYPE_VIDEO:
+		return MediaTypeVideo
+	case C.AVMEDIA_TYPE_AUDIO:
+		return MediaTypeAudio
+	case C.AVMEDIA_TYPE_DATA:
+		return MediaTypeData
+	case C.AVMEDIA_TYPE_SUBTITLE:
+		return MediaTypeSubtitle
+	case C.AVMEDIA_TYPE_ATTACHMENT:
+		return MediaTypeAttachment
+	}
+	return MediaTypeUnknown
+}
+
+func secsToDuration(s C.double) time.Duration {
+	if s < 0 {
+		return -1
+	}
+	return time.Duration(float64(s) * float64(time.Second))
+}
+
+// ProbeMedia opens the file and returns details on the container and all of
+// its streams.
+func ProbeMedia(fname string) (ProbeInfo, error) {
+	info := ProbeInfo{}
+	cfname := C.CString(fname)
+	defer C.free(unsafe.Pointer(cfname))
+	cinfo := (*C.probe_info)(C.calloc(1, C.sizeof_probe_info))
+	if cinfo == nil {
+		return info, ErrProbe
+	}
+	defer C.free(unsafe.Pointer(cinfo))
+	if ret := int(C.lpms_probe_media(cfname, cinfo)); ret < 0 {
+		return info, ErrProbe
+	}
+	info.Format = C.GoString(&cinfo.format_name[0])
+	info.Bitrate = int64(cinfo.bit_rate)
+	info.StartTime = secsToDuration(cinfo.start_time)
+	info.Duration = secsToDuration(cinfo.duration)
+	n := int(cinfo.nb_streams)
+	if n > C.PROBE_MAX_STREAMS {
+		n = C.PROBE_MAX_STREAMS
+	}
+	for i := 0; i < n; i++ {
+		s := &cinfo.streams[i]
+		info.Streams = append(info.Streams, StreamInfo{
+			Index:          int(s.index),
+			Type:           mediaTypeFromC(s.media_type),
+			Codec:          C.GoString(&s.codec[0]),
+			Profile:        C.GoString(&s.profile[0]),
+			Level:          int(s.level),
+			Bitrate:        int64(s.bit_rate),
+			TimeBase:       Rational{int(s.tb_num), int(s.tb_den)},
+			Language:       C.GoString(&s.language[0]),
+			StartTime:      secsToDuration(s.start_time),
+			Duration:       secsToDuration(s.duration),
+			Extradata:      C.GoBytes(unsafe.Pointer(&s.extradata[0]), s.extradata_size),
+			FrameRate:      Rational{int(s.fr_num), int(s.fr_den)},
+			AvgFrameRate:   Rational{int(s.avg_fr_num), int(s.avg_fr_den)},
+			Width:          int(s.width),
+			Height:         int(s.height),
+			PixFormat:      PixelFormat{int(s.pixel_format)},
+			SAR:            Rational{int(s.sar_num), int(s.sar_den)},
+			DAR:            Rational{int(s.dar_num), int(s.dar_den)},
+			Rotation:       float64(s.rotation),
+			ColorRange:     C.GoString(&s.color_range[0]),
+			ColorSpace:     C.GoString(&s.color_space[0]),
+			ColorTransfer:  C.GoString(&s.color_transfer[0]),
+			ColorPrimaries: C.GoString(&s.color_primaries[0]),
+			FieldOrder:     C.GoString(&s.field_order[0]),
+			ChannelLayout:  C.GoString(&s.channel_layout[0]),
+			Channels:       int(s.channels),
+			SampleRate:     int(s.sample_rate),
+		})
+	}
+	return info, nil
+}
+
+// ProbeMediaBytes is like ProbeMedia but reads the media from memory.
+// Note that durations may be unavailable for formats that rely on the
+// file size to estimate them.
+func ProbeMediaBytes(data []byte) (ProbeInfo, error) {
+	if len(data) == 0 {
+		return ProbeInfo{}, ErrEmptyData
+	}
+	fname, done, err := pipeBytes(data)
+	if err != nil {
+		return ProbeInfo{}, err
+	}
+	defer done()
+	return ProbeMedia(fname)
+}
+
+// Feeds data through a pipe, returning the name FFmpeg opens it by. The
+// returned function closes the read end, which also ends the write if FFmpeg
+// gave up before reading everything, and waits for the writer to be done.
+func pipeBytes(data []byte) (string, func(), error) {
+	or, ow, err := os.Pipe()
+	if err != nil {
+		return "", nil, err
+	}
+	written := make(chan struct{})
+	go func() {
+		io.Copy(ow, bytes.NewReader(data))
+		ow.Close()
+		close(written)
+	}()
+	fname := fmt.Sprintf("pipe:%d", or.Fd())
+	return fname, func() {
+		or.Close()
+		<-written
+	}, nil
+}
@@ -0,0 +1,133 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/livepeer/lpms/probe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeMedia_Streams(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Tag streams with languages and color info so we can check they show up
+	run(`
+		cp "$1/../transcoder/test.ts" test.ts
+		ffmpeg -loglevel warning -i test.ts -map 0:v -map 0:a -map 0:a -t 2 \
+			-c:v libx264 -profile:v main -r 30000/1001 -bsf:v h264_metadata=sample_aspect_ratio=4/3 \
+			-color_range tv -colorspace bt709 -color_trc bt709 -color_primaries bt709 \
+			-c:a aac -ar 48000 -ac 2 \
+			-metadata:s:a:0 language=eng -metadata:s:a:1 language=spa \
+			out.mp4
+	`)
+
+	fname := filepath.Join(dir, "out.mp4")
+	info, err := ProbeMedia(fname)
+	require.NoError(t, err)
+
+	check := func(t *testing.T, info ProbeInfo, bytes bool) {
+		assert.Equal(t, "mov,mp4,m4a,3gp,3g2,mj2", info.Format)
+		require.Len(t, info.Streams, 3)
+		if !bytes {
+			// mp4 needs to seek to determine duration
+			assert.InDelta(t, 2*time.Second, info.Duration, float64(100*time.Millisecond))
+		}
+
+		v := info.VideoStreams()
+		require.Len(t, v, 1)
+		assert.Equal(t, 0, v[0].Index)
+		assert.Equal(t, "h264", v[0].Codec)
+		assert.Equal(t, "Main", v[0].Profile)
+		assert.Equal(t, Rational{30000, 1001}, v[0].FrameRate)
+		assert.Equal(t, Rational{4, 3}, v[0].SAR)
+		assert.Equal(t, Rational{v[0].Width * 4, v[0].Height * 3}.Float64(), v[0].DAR.Float64())
+		assert.Equal(t, "tv", v[0].ColorRange)
+		assert.Equal(t, "bt709", v[0].ColorSpace)
+		assert.Equal(t, "bt709", v[0].ColorTransfer)
+		assert.Equal(t, "bt709", v[0].ColorPrimaries)
+		assert.Equal(t, "progressive", v[0].FieldOrder)
+		assert.NotZero(t, v[0].TimeBase.Den)
+		assert.NotZero(t, v[0].Bitrate)
+
+		a := info.AudioStreams()
+		require.Len(t, a, 2)
+		for i, lang := range []string{"eng", "spa"} {
+			assert.Equal(t, "aac", a[i].Codec)
+			assert.Equal(t, "LC", a[i].Profile)
+			assert.Equal(t, "stereo", a[i].ChannelLayout)
+			assert.Equal(t, 2, a[i].Channels)
+			assert.Equal(t, 48000, a[i].SampleRate)
+			assert.Equal(t, lang, a[i].Language)
+		}
+	}
+
+	t.Run("file", func(t *testing.T) { check(t, info, false) })
+
+	data, err := ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	info, err = ProbeMediaBytes(data)
+	require.NoError(t, err)
+	t.Run("bytes", func(t *testing.T) { check(t, info, true) })
+
+	// mpegts exposes start time and the legacy video FPS
+	info, err = ProbeMedia(filepath.Join("..", "transcoder", "test.ts"))
+	require.NoError(t, err)
+	assert.Equal(t, "mpegts", info.Format)
+	assert.True(t, info.StartTime >= 0)
+	_, format, err := GetCodecInfo(filepath.Join("..", "transcoder", "test.ts"))
+	require.NoError(t, err)
+	require.NotEmpty(t, info.VideoStreams())
+	assert.InDelta(t, format.FPS, info.VideoStreams()[0].FrameRate.Float64(), 0.001)
+}
+
+func TestProbeMedia_Errors(t *testing.T) {
+	_, err := ProbeMedia("/non/existent")
+	assert.Equal(t, ErrProbe, err)
+
+	_, err = ProbeMediaBytes(nil)
+	assert.Equal(t, ErrEmptyData, err)
+
+	_, err = ProbeMediaBytes([]byte("not a media file"))
+	assert.Equal(t, ErrProbe, err)
+
+	// more than the pipe holds, left unread once probing fails
+	before := runtime.NumGoroutine()
+	_, err = ProbeMediaBytes(make([]byte, 8<<20))
+	assert.Equal(t, ErrProbe, err)
+	assert.Equal(t, before, runtime.NumGoroutine())
+}
+
+func TestProbe_PureGoMatchesGetCodecInfo(t *testing.T) {
+	for _, name := range []string{
+		"bad-cuvid.ts", "duplicate-audio-dts.ts", "kryp-1.ts", "missing-dts.ts",
+		"portrait.ts", "transmux.ts", "vertical-sample.ts", "zero-frame.ts", "videotest.mp4",
+	} {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join("..", "data", name)
+			status, format, err := GetCodecInfo(fname)
+			require.NoError(t, err)
+			info, err := probe.ProbeFile(fname)
+			require.NoError(t, err)
+			assert.Equal(t, format.Format, info.Format)
+			assert.Equal(t, format.Acodec, info.Acodec)
+			assert.Equal(t, format.Vcodec, info.Vcodec)
+			assert.Equal(t, format.Width, info.Width)
+			assert.Equal(t, format.Height, info.Height)
+			assert.Equal(t, format.DurSecs, info.DurSecs)
+			assert.Equal(t, format.SampleRate, info.SampleRate)
+			assert.Equal(t, format.Channels, info.Channels)
+			assert.Equal(t, status == CodecStatusNeedsBypass, info.ZeroVideoFrame)
+			// the frame rate of variable rate video is anyone's guess
+			if info.Format == probe.FormatMPEGTS && info.VideoFrames > 1 {
+				assert.InDelta(t, format.FPS, info.FPS, 0.01)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bitrate values passed down to the encoder context. Zero means unset.
+type rateControlParams struct {
+	bitrate int
+	minrate int
+	maxrate int
+	bufsize int
+}
+
+func parseBitrate(br string) (int, error) {
+	return strconv.Atoi(strings.Replace(br, "k", "000", 1))
+}
+
+// Returns true for modes where the target bitrate is optional
+func (rc RateControl) qualityBased() bool {
+	return rc == RateControlCappedCRF || rc == RateControlCQP
+}
+
+// Compute the VBV parameters for the given profile. `bitrate` is the already
+// parsed VideoProfile.Bitrate, which may be zero for quality based modes.
+func rateControlLimits(p VideoProfile, bitrate int) (rateControlParams, error) {
+	var err error
+	maxrate, bufsize := 0, 0
+	if p.MaxBitrate != "" {
+		if maxrate, err = parseBitrate(p.MaxBitrate); err != nil || maxrate <= 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+	}
+	if p.BufferSize != "" {
+		if bufsize, err = parseBitrate(p.BufferSize); err != nil || bufsize <= 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+	}
+
+	switch p.RateControl {
+	case RateControlDefault:
+		// Keep legacy behaviour: Bitrate is min, avg and max
+		return rateControlParams{bitrate: bitrate, minrate: bitrate, maxrate: bitrate, bufsize: bitrate}, nil
+	case RateControlCBR:
+		if bitrate <= 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+		if bufsize == 0 {
+			bufsize = bitrate
+		}
+		return rateControlParams{bitrate: bitrate, minrate: bitrate, maxrate: bitrate, bufsize: bufsize}, nil
+	case RateControlVBR:
+		if bitrate <= 0 || (maxrate != 0 && maxrate < bitrate) {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+		if bufsize == 0 {
+			bufsize = maxrate
+		}
+		return rateControlParams{bitrate: bitrate, maxrate: maxrate, bufsize: bufsize}, nil
+	case RateControlCappedCRF:
+		if p.Quality == 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+		if maxrate == 0 {
+			maxrate = bitrate
+		}
+		if maxrate <= 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+		if bufsize == 0 {
+			bufsize = maxrate
+		}
+		return rateControlParams{maxrate: maxrate, bufsize: bufsize}, nil
+	case RateControlCQP:
+		if p.Quality == 0 {
+			return rateControlParams{}, ErrTranscoderRateControl
+		}
+		return rateControlParams{}, nil
+	}
+	return rateControlParams{}, ErrTranscoderRateControl
+}
+
+// Translate the rate control mode into encoder specific options. Options are
+// written into `opts`; for Netint the returned string is appended to the
+// xcoder-params of the output.
+func rateControlOpts(p VideoProfile, accel Acceleration, rc rateControlParams, opts map[string]string) (string, error) {
+	if p.RateControl == RateControlDefault {
+		// handled by the legacy Quality code path
+		return "", nil
+	}
+	q := int(p.Quality)
+	switch accel {
+	case Software:
+		switch p.Encoder {
+		case H264, H265:
+			if q > 51 {
+				return "", ErrTranscoderRateControl
+			}
+			switch p.RateControl {
+			case RateControlCBR:
+				if p.Encoder == H264 {
+					opts["nal-hrd"] = "cbr"
+				} else {
+					opts["x265-params"] = "strict-cbr=1"
+				}
+			case RateControlCappedCRF:
+				opts["crf"] = strconv.Itoa(q)
+			case RateControlCQP:
+				opts["qp"] = strconv.Itoa(q)
+			}
+		case VP8, VP9:
+			if q > 63 {
+				return "", ErrTranscoderRateControl
+			}
+			// libvpx is constant rate once min and max rate match the
+			// bitrate, so CBR needs no options
+			switch p.RateControl {
+			case RateControlCappedCRF:
+				opts["crf"] = strconv.Itoa(q)
+			case RateControlCQP:
+				opts["qmin"] = strconv.Itoa(q)
+				opts["qmax"] = strconv.Itoa(q)
+			}
+		}
+	case Nvidia:
+		switch p.RateControl {
+		case RateControlCBR:
+			opts["rc"] = "cbr"
+		case RateControlVBR:
+			opts["rc"] = "vbr"
+		case RateControlCappedCRF:
+			// Same CRF -> CQ mapping as the default mode
+			cq := q + 7
+			if cq > 51 {
+				return "", ErrTranscoderRateControl
+			}
+			opts["rc"] = "vbr"
+			opts["cq"] = strconv.Itoa(cq)
+		case RateControlCQP:
+			if q > 51 {
+				return "", ErrTranscoderRateControl
+			}
+			opts["rc"] = "constqp"
+			opts["qp"] = strconv.Itoa(q)
+		}
+	case Netint:
+		// Netint takes everything through xcoder-params. VBV size is in ms.
+		params := []string{}
+		switch p.RateControl {
+		case RateControlCBR, RateControlVBR:
+			cbr := 0
+			if p.RateControl == RateControlCBR {
+				cbr = 1
+			}
+			params = append(params, "RcEnable=1", fmt.Sprintf("cbr=%d", cbr), fmt.Sprintf("bitrate=%d", rc.bitrate))
+			if rc.bufsize > 0 {
+				params = append(params, fmt.Sprintf("vbvBufferSize=%d", rc.bufsize*1000/rc.bitrate))
+			}
+		case RateControlCappedCRF:
+			if q > 51 {
+				return "", ErrTranscoderRateControl
+			}
+			params = append(params, fmt.Sprintf("crf=%d", q), fmt.Sprintf("vbvMaxRate=%d", rc.maxrate))
+			if rc.bufsize > 0 {
+				params = append(params, fmt.Sprintf("vbvBufferSize=%d", rc.bufsize*1000/rc.maxrate))
+			}
+		case RateControlCQP:
+			if q > 51 {
+				return "", ErrTranscoderRateControl
+			}
+			params = append(params, "RcEnable=0", fmt.Sprintf("intraQP=%d", q))
+		}
+		return strings.Join(params, ":"), nil
+	}
+	return "", nil
+}
+
+// Adds the rate control options to the encoder options of the output, which
+// may be custom ones. Options set to something else by the caller conflict
+// with the rate control mode and are refused.
+func mergeRateControlOpts(opts, rcOpts map[string]string) (map[string]string, error) {
+	if len(rcOpts) == 0 {
+		return opts, nil
+	}
+	out := map[string]string{}
+	for k, v := range opts {
+		out[k] = v
+	}
+	for k, v := range rcOpts {
+		if cur, ok := out[k]; ok && cur != v {
+			return nil, ErrTranscoderRateControl
+		}
+		out[k] = v
+	}
+	return out, nil
+}
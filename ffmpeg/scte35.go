@@ -0,0 +1,101 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/lpms/scte35"
+)
+
+// #include "transcoder.h"
+import "C"
+
+// SpliceEvent is a SCTE-35 splice event of the input. The muxer can't write
+// SCTE-35, so events are carried into MPEG-TS outputs after the transcode,
+// with their splice times moved to the timeline of the output.
+type SpliceEvent struct {
+	*scte35.Event
+	// Where the event was carried, from the start of the input
+	Offset time.Duration
+}
+
+// Cues demuxed during the transcode along with the start of the input, in
+// 90kHz ticks. The cues of the results are freed.
+func spliceCues(res *C.output_results) ([]scte35.Cue, int64) {
+	defer C.lpms_scte35_free(res)
+	n := int(res.nb_cues)
+	if n == 0 {
+		return nil, 0
+	}
+	cues := make([]scte35.Cue, n)
+	for i, c := range (*[1 << 20]C.scte35_cue)(unsafe.Pointer(res.cues))[:n:n] {
+		cues[i] = scte35.Cue{PTS: int64(c.pts), Section: C.GoBytes(unsafe.Pointer(c.data), c.size)}
+	}
+	return cues, int64(res.start_pts)
+}
+
+// Events of the cues, leaving out the cues that can't be read
+func spliceEvents(cues []scte35.Cue, start int64) ([]scte35.Cue, []SpliceEvent) {
+	var valid []scte35.Cue
+	var events []SpliceEvent
+	for _, c := range cues {
+		e, err := scte35.Parse(c.Section)
+		if err != nil {
+			glog.Warningf("Dropping SCTE-35 cue at pts=%d err=%v", c.PTS, err)
+			continue
+		}
+		// the input may wrap around
+		ticks := (c.PTS - start) & (1<<33 - 1)
+		if ticks >= 1<<32 {
+			ticks -= 1 << 33
+		}
+		valid = append(valid, c)
+		events = append(events, SpliceEvent{Event: e, Offset: time.Duration(ticks) * time.Second / 90000})
+	}
+	return valid, events
+}
+
+// Writes the cues into the MPEG-TS outputs. Outputs still being written by
+// a transmuxing session, and pipes, can't be rewritten and go without.
+func insertSpliceCues(ps []TranscodeOptions, cues []scte35.Cue, start int64, transmuxing bool) error {
+	if len(cues) == 0 {
+		return nil
+	}
+	var files []TranscodeOptions
+	for _, p := range ps {
+		if !isMPEGTSOutput(p) {
+			continue
+		}
+		if p.From != 0 || p.To != 0 {
+			glog.Warningf("SCTE-35 is not carried into clipped output %s", p.Oname)
+			continue
+		}
+		if transmuxing || strings.HasPrefix(strings.ToLower(p.Oname), "pipe:") {
+			glog.Warningf("Dropping %d SCTE-35 cues that can't be carried into output %s", len(cues), p.Oname)
+			continue
+		}
+		files = append(files, p)
+	}
+	for _, p := range files {
+		info, err := os.Stat(p.Oname)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p.Oname)
+		if err != nil {
+			return err
+		}
+		out, err := scte35.InsertTS(data, cues, start)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p.Oname, out, info.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package ffmpeg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livepeer/lpms/scte35"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCTE35_Passthrough(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+		ffmpeg -i "$1"/../transcoder/test.ts -c copy -t 4 test.ts
+	`
+	require.True(t, run(cmd))
+
+	// a minute long break, splicing a second into the input
+	section, err := base64.StdEncoding.DecodeString("/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=")
+	require.NoError(t, err)
+	e, err := scte35.Parse(section)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(dir + "/test.ts")
+	require.NoError(t, err)
+	data, err = scte35.InsertTS(data, []scte35.Cue{{PTS: e.PTS - 45000, Section: section}}, e.PTS-90000)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dir+"/cued.ts", data, 0644))
+
+	res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/cued.ts"}, []TranscodeOptions{
+		{Oname: dir + "/out.ts", Profile: P144p30fps16x9},
+		{Oname: dir + "/out.mp4", Profile: P144p30fps16x9},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.SpliceEvents, 1)
+	ev := res.SpliceEvents[0]
+	assert.True(t, ev.Out())
+	assert.Equal(t, e.EventID, ev.EventID)
+	assert.Equal(t, e.BreakDuration, ev.Duration())
+	// carried with the packets around it, ahead of the splice
+	assert.True(t, ev.Offset >= 0 && ev.Offset <= time.Second, "offset %v", ev.Offset)
+
+	cmd = `
+		for f in cued.ts out.ts; do
+			ffprobe -loglevel warning -show_streams -select_streams d $f | grep codec_name=scte_35
+		done
+		ffmpeg -loglevel warning -i out.ts -map 0:d -c copy -f data out.scte35
+		ffprobe -loglevel warning -show_entries format=start_time -of csv=p=0 out.ts |
+			awk '{ printf "%d", $1 * 90000 + 0.5 }' > out.start
+
+		# other formats go without
+		ffprobe -loglevel warning -show_streams out.mp4 | grep codec_type > mp4.out
+		tee expected-mp4.out <<-EOF
+			codec_type=video
+			codec_type=audio
+			EOF
+		diff -u expected-mp4.out mp4.out
+	`
+	require.True(t, run(cmd))
+
+	// the splice is a second into the output too
+	data, err = ioutil.ReadFile(dir + "/out.scte35")
+	require.NoError(t, err)
+	out, err := scte35.Parse(data)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(dir + "/out.start")
+	require.NoError(t, err)
+	start, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, start+90000, out.PTS, 1)
+	assert.Equal(t, e.BreakDuration, out.Duration())
+
+	// outputs that can't be rewritten afterwards go without the cues
+	pr, pw, err := os.Pipe()
+	require.NoError(t, err)
+	go io.Copy(ioutil.Discard, pr)
+	res, err = Transcode3(&TranscodeOptionsIn{Fname: dir + "/cued.ts"}, []TranscodeOptions{{
+		Oname: fmt.Sprintf("pipe:%d", pw.Fd()), Profile: P144p30fps16x9, Muxer: ComponentOptions{Name: "mpegts"},
+	}})
+	pw.Close()
+	require.NoError(t, err)
+	assert.Len(t, res.SpliceEvents, 1)
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	res, err = tc.Transcode(&TranscodeOptionsIn{Fname: dir + "/cued.ts", Transmuxing: true}, []TranscodeOptions{{
+		Oname:        dir + "/remux.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		Profile:      VideoProfile{Format: FormatNone},
+	}})
+	require.NoError(t, err)
+	assert.Len(t, res.SpliceEvents, 1)
+	tc.StopTranscoder()
+	cmd = `
+		ffprobe -loglevel warning -show_entries stream=codec_type -of csv=p=0 remux.ts | sort | uniq > remux.out
+		tee expected-remux.out <<-EOF
+			audio
+			video
+			EOF
+		diff -u expected-remux.out remux.out
+	`
+	require.True(t, run(cmd))
+}
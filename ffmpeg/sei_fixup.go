@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/livepeer/joy4/format/ts/tsio"
 )
@@ -11,6 +12,8 @@ import (
 const (
 	tsPacketSize        = 188
 	invalidPID   uint16 = 0x1fff
+	// Not defined by joy4
+	elementaryStreamTypeHEVC = 0x24
 )
 
 type byteRange struct {
@@ -22,47 +25,173 @@ type nalInfo struct {
 	start int
 	end   int
 	typ   uint8
+	// VCL NAL unit holding the first slice of a picture
+	firstSlice bool
+}
+
+// SEIFixReport describes what the SEI fix-up changed in a segment.
+type SEIFixReport struct {
+	// Video codec of the segment, "h264" or "hevc". Empty if the segment has
+	// no video the fix-up understands.
+	Codec string
+	// Access units that were rewritten
+	AccessUnits int
+	// SEI NAL units moved ahead of the picture data of their access unit.
+	// For HEVC these are prefix SEI.
+	SEI int
+	// HEVC suffix SEI NAL units moved behind the picture data
+	SuffixSEI int
+	// HEVC VPS, SPS and PPS NAL units moved ahead of the picture data
+	ParameterSets int
+}
+
+// Changed is whether the fix-up rewrote anything.
+func (r SEIFixReport) Changed() bool {
+	return r.AccessUnits > 0
 }
 
 // FixMisplacedSEI rewrites a TS segment into a temp file when SEI NAL units are
 // found after VCL NAL units within an access unit. If no fix is needed, it
 // returns the original input path.
 func FixMisplacedSEI(inputPath string) (fixedPath string, err error) {
+	fixedPath, _, err = FixMisplacedSEIWithReport(inputPath)
+	return fixedPath, err
+}
+
+// FixMisplacedSEIWithReport is FixMisplacedSEI, also reporting what was
+// changed.
+func FixMisplacedSEIWithReport(inputPath string) (string, SEIFixReport, error) {
 	data, err := ioutil.ReadFile(inputPath)
 	if err != nil {
-		return "", err
+		return "", SEIFixReport{}, err
 	}
-	fixedData, changed := fixSEIOrder(data)
-	if !changed {
-		return inputPath, nil
+	fixedData, report := FixMisplacedSEIBytes(data)
+	if !report.Changed() {
+		return inputPath, report, nil
 	}
 
 	dir := filepath.Dir(inputPath)
 	tmp, err := ioutil.TempFile(dir, "sei-fixup-*.ts")
 	if err != nil {
-		return "", err
+		return "", report, err
 	}
 	tmpPath := tmp.Name()
 	if _, err := tmp.Write(fixedData); err != nil {
 		tmp.Close()
 		os.Remove(tmpPath)
-		return "", err
+		return "", report, err
 	}
 	if err := tmp.Close(); err != nil {
 		os.Remove(tmpPath)
-		return "", err
+		return "", report, err
+	}
+	return tmpPath, report, nil
+}
+
+// FixMisplacedSEIBytes is FixMisplacedSEI for a TS segment in memory. The
+// fixed segment is a copy of the same size; if no fix is needed, data itself
+// is returned.
+func FixMisplacedSEIBytes(data []byte) ([]byte, SEIFixReport) {
+	return fixSEIOrder(data)
+}
+
+// NAL unit syntax of the video codecs the fix-up understands
+type nalCodec int
+
+const (
+	nalCodecNone nalCodec = iota
+	nalCodecH264
+	nalCodecHEVC
+)
+
+func (c nalCodec) String() string {
+	switch c {
+	case nalCodecH264:
+		return "h264"
+	case nalCodecHEVC:
+		return "hevc"
+	}
+	return ""
+}
+
+func (c nalCodec) nalType(hdr byte) uint8 {
+	if c == nalCodecHEVC {
+		return (hdr >> 1) & 0x3f
+	}
+	return hdr & 0x1f
+}
+
+func (c nalCodec) headerLen() int {
+	if c == nalCodecHEVC {
+		return 2
+	}
+	return 1
+}
+
+func (c nalCodec) isAUD(typ uint8) bool {
+	if c == nalCodecHEVC {
+		return typ == 35
+	}
+	return typ == 9
+}
+
+func (c nalCodec) isVCL(typ uint8) bool {
+	if c == nalCodecHEVC {
+		return typ < 32
+	}
+	return typ >= 1 && typ <= 5
+}
+
+func (c nalCodec) isSEI(typ uint8) bool {
+	if c == nalCodecHEVC {
+		return typ == 39
+	}
+	return typ == 6
+}
+
+// Whether the slice header following the NAL header starts a new picture:
+// first_mb_in_slice of 0 for H.264, first_slice_segment_in_pic_flag for HEVC.
+// Both are the first bit of the slice header.
+func (c nalCodec) startsPicture(typ uint8, sliceHdr byte) bool {
+	if c == nalCodecHEVC {
+		return (typ <= 9 || typ >= 16 && typ <= 21) && sliceHdr&0x80 != 0
+	}
+	return (typ == 1 || typ == 5) && sliceHdr&0x80 != 0
+}
+
+// NAL units that belong ahead of the picture data of their access unit:
+// SEI for H.264; VPS, SPS, PPS and prefix SEI for HEVC.
+func (c nalCodec) isPrefix(typ uint8) bool {
+	if c == nalCodecHEVC {
+		return typ >= 32 && typ <= 34 || typ == 39
 	}
-	return tmpPath, nil
+	return typ == 6
 }
 
-func fixSEIOrder(data []byte) ([]byte, bool) {
+// HEVC suffix SEI, which belongs behind the picture data
+func (c nalCodec) isSuffix(typ uint8) bool {
+	return c == nalCodecHEVC && typ == 40
+}
+
+// Order of the NAL units ahead of the picture data of a rewritten access
+// unit. HEVC parameter sets go in VPS, SPS, PPS order ahead of prefix SEI,
+// which may refer to them. H.264 access units keep their order.
+func (c nalCodec) rank(typ uint8) int {
+	if c == nalCodecHEVC && c.isPrefix(typ) {
+		return int(typ) - 31
+	}
+	return 0
+}
+
+func fixSEIOrder(data []byte) ([]byte, SEIFixReport) {
 	if len(data) < tsPacketSize {
-		return data, false
+		return data, SEIFixReport{}
 	}
-	videoPID := findVideoPID(data)
+	videoPID, codec := findVideoPID(data)
 	if videoPID == invalidPID {
-		return data, false
+		return data, SEIFixReport{}
 	}
+	report := SEIFixReport{Codec: codec.String()}
 
 	result := make([]byte, len(data))
 	copy(result, data)
@@ -106,13 +235,14 @@ func fixSEIOrder(data []byte) ([]byte, bool) {
 			allPayload = append(allPayload, byteRange{start: payloadStart, end: payloadEnd})
 		}
 	}
-	if len(allPayload) == 0 {
-		return result, false
+	if len(allPayload) == 0 || !fixPES(result, result, allPayload, codec, &report) {
+		return data, SEIFixReport{Codec: report.Codec}
 	}
-	return result, fixPES(result, result, allPayload)
+	return result, report
 }
 
-func findVideoPID(data []byte) uint16 {
+// Finds the video PID, and the codec of its NAL units
+func findVideoPID(data []byte) (uint16, nalCodec) {
 	pmtPID := invalidPID
 	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
 		pkt := data[off : off+tsPacketSize]
@@ -168,8 +298,11 @@ func findVideoPID(data []byte) uint16 {
 				continue
 			}
 			for _, es := range pmt.ElementaryStreamInfos {
-				if es.StreamType == tsio.ElementaryStreamTypeH264 {
-					return es.ElementaryPID
+				switch es.StreamType {
+				case tsio.ElementaryStreamTypeH264:
+					return es.ElementaryPID, nalCodecH264
+				case elementaryStreamTypeHEVC:
+					return es.ElementaryPID, nalCodecHEVC
 				}
 			}
 		}
@@ -185,14 +318,36 @@ func findVideoPID(data []byte) uint16 {
 		payload := pkt[hdrlen:]
 		if len(payload) >= 4 && payload[0] == 0 && payload[1] == 0 && payload[2] == 1 {
 			if payload[3] >= 0xe0 && payload[3] <= 0xef {
-				return pid
+				return pid, sniffNALCodec(payload)
 			}
 		}
 	}
-	return invalidPID
+	return invalidPID, nalCodecNone
+}
+
+// Guesses the codec from the first NAL unit of a PES packet, for segments
+// without a PMT. HEVC access units start with an AUD or a VPS, with a two
+// byte header whose second byte is 1 for the base layer; anything else is
+// taken to be H.264.
+func sniffNALCodec(pes []byte) nalCodec {
+	hdrlen, _, _, _, _, err := tsio.ParsePESHeader(pes)
+	if err != nil || hdrlen >= len(pes) {
+		return nalCodecH264
+	}
+	es := pes[hdrlen:]
+	start, scLen := findStartCode(es, 0)
+	if start < 0 || start+scLen+1 >= len(es) {
+		return nalCodecH264
+	}
+	hdr := es[start+scLen : start+scLen+2]
+	typ := nalCodecHEVC.nalType(hdr[0])
+	if hdr[0]&0x81 == 0 && hdr[1] == 1 && (typ == 35 || typ == 32) {
+		return nalCodecHEVC
+	}
+	return nalCodecH264
 }
 
-func fixPES(orig, result []byte, ranges []byteRange) bool {
+func fixPES(orig, result []byte, ranges []byteRange, codec nalCodec, report *SEIFixReport) bool {
 	total := 0
 	for _, r := range ranges {
 		if r.end > r.start {
@@ -210,7 +365,7 @@ func fixPES(orig, result []byte, ranges []byteRange) bool {
 		}
 		es = append(es, orig[r.start:r.end]...)
 	}
-	nals := scanNALs(es)
+	nals := scanNALs(es, codec)
 	if len(nals) == 0 {
 		return false
 	}
@@ -219,67 +374,94 @@ func fixPES(orig, result []byte, ranges []byteRange) bool {
 	reordered := make([]byte, 0, len(es))
 	reordered = append(reordered, leading...)
 
-	var changed bool
-	appendSegment := func(seg []nalInfo) {
-		if len(seg) == 0 {
-			return
+	var fixed SEIFixReport
+	appendNALs := func(seg []nalInfo) {
+		for _, n := range seg {
+			reordered = append(reordered, es[n.start:n.end]...)
 		}
-		firstVCL := -1
+	}
+	appendSegment := func(seg []nalInfo) {
+		firstVCL, lastVCL := -1, -1
 		for i, n := range seg {
-			if n.typ >= 1 && n.typ <= 5 {
-				firstVCL = i
-				break
+			if codec.isVCL(n.typ) {
+				if firstVCL < 0 {
+					firstVCL = i
+				}
+				lastVCL = i
 			}
 		}
 		if firstVCL < 0 {
-			for _, n := range seg {
-				reordered = append(reordered, es[n.start:n.end]...)
-			}
+			appendNALs(seg)
 			return
 		}
-		misplacedSEI := false
-		for i := firstVCL + 1; i < len(seg); i++ {
-			if seg[i].typ == 6 {
-				misplacedSEI = true
-				break
-			}
-		}
-		if !misplacedSEI {
-			for _, n := range seg {
-				reordered = append(reordered, es[n.start:n.end]...)
+
+		// Split the access unit around its picture data, pulling out NAL
+		// units on the wrong side of it
+		var head, body, late []nalInfo
+		for i, n := range seg {
+			switch {
+			case i < firstVCL && codec.isSuffix(n.typ):
+				late = append(late, n)
+			case i < firstVCL:
+				head = append(head, n)
+			case i > firstVCL && codec.isPrefix(n.typ):
+				head = append(head, n)
+				if codec.isSEI(n.typ) {
+					fixed.SEI++
+				} else {
+					fixed.ParameterSets++
+				}
+			default:
+				body = append(body, n)
 			}
-			return
 		}
+		fixed.SuffixSEI += len(late)
+		sort.SliceStable(head, func(i, j int) bool {
+			return codec.rank(head[i].typ) < codec.rank(head[j].typ)
+		})
 
-		changed = true
-		for i := 0; i < firstVCL; i++ {
-			n := seg[i]
-			reordered = append(reordered, es[n.start:n.end]...)
+		moved := len(late) > 0
+		for i, n := range head {
+			moved = moved || n.start != seg[i].start
 		}
-		for i := firstVCL; i < len(seg); i++ {
-			n := seg[i]
-			if n.typ == 6 {
-				reordered = append(reordered, es[n.start:n.end]...)
-			}
+		if !moved {
+			appendNALs(seg)
+			return
 		}
-		for i := firstVCL; i < len(seg); i++ {
-			n := seg[i]
-			if n.typ != 6 {
-				reordered = append(reordered, es[n.start:n.end]...)
+		fixed.AccessUnits++
+		appendNALs(head)
+		for i, n := range body {
+			appendNALs(body[i : i+1])
+			if n.start == seg[lastVCL].start {
+				appendNALs(late)
 			}
 		}
 	}
 
-	segStart := 0
+	// Access units start at an AUD, or at the first slice of a new picture
+	// for streams without AUDs. In the latter case SEI and parameter sets
+	// ahead of the slice belong to the new picture, apart from HEVC suffix
+	// SEI directly behind the previous one.
+	segStart, lastVCL := 0, -1
 	for i := 0; i <= len(nals); i++ {
-		segmentBoundary := i == len(nals) || (i > segStart && nals[i].typ == 9)
-		if !segmentBoundary {
+		if i == len(nals) || (i > segStart && codec.isAUD(nals[i].typ)) {
+			appendSegment(nals[segStart:i])
+			segStart, lastVCL = i, -1
 			continue
 		}
-		appendSegment(nals[segStart:i])
-		segStart = i
+		if nals[i].firstSlice && lastVCL >= 0 {
+			end := lastVCL + 1
+			for end < i && codec.isSuffix(nals[end].typ) {
+				end++
+			}
+			appendSegment(nals[segStart:end])
+			segStart = end
+		}
+		if codec.isVCL(nals[i].typ) {
+			lastVCL = i
+		}
 	}
-	if !changed {
+	if fixed.AccessUnits == 0 {
 		return false
 	}
 	if len(reordered) != len(es) {
@@ -295,10 +477,17 @@ func fixPES(orig, result []byte, ranges []byteRange) bool {
 		copy(result[r.start:r.end], reordered[pos:pos+n])
 		pos += n
 	}
-	return pos == len(reordered)
+	if pos != len(reordered) {
+		return false
+	}
+	report.AccessUnits += fixed.AccessUnits
+	report.SEI += fixed.SEI
+	report.SuffixSEI += fixed.SuffixSEI
+	report.ParameterSets += fixed.ParameterSets
+	return true
 }
 
-func scanNALs(es []byte) []nalInfo {
+func scanNALs(es []byte, codec nalCodec) []nalInfo {
 	var nals []nalInfo
 	for pos := 0; pos < len(es); {
 		start, scLen := findStartCode(es, pos)
@@ -311,11 +500,15 @@ func scanNALs(es []byte) []nalInfo {
 			end = nextStart
 		}
 		if start+scLen < end {
-			nals = append(nals, nalInfo{
+			n := nalInfo{
 				start: start,
 				end:   end,
-				typ:   es[start+scLen] & 0x1f,
-			})
+				typ:   codec.nalType(es[start+scLen]),
+			}
+			if hdr := start + scLen + codec.headerLen(); hdr < end {
+				n.firstSlice = codec.startsPicture(n.typ, es[hdr])
+			}
+			nals = append(nals, n)
 		}
 		if nextStart < 0 {
 			break
@@ -1,12 +1,16 @@
 package ffmpeg
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
+	"time"
 
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,6 +71,14 @@ func TestFixMisplacedSEI_BrokenFiles(t *testing.T) {
 			fixedData, err := ioutil.ReadFile(fixedPath)
 			require.NoError(t, err)
 			require.Equal(t, len(inputData), len(fixedData), "fix-up must preserve byte size")
+
+			// fixing in memory gives the same result
+			memData, report := FixMisplacedSEIBytes(inputData)
+			assert.Equal(t, fixedData, memData)
+			assert.Equal(t, "h264", report.Codec)
+			assert.True(t, report.Changed())
+			assert.NotZero(t, report.SEI)
+			assert.Zero(t, report.ParameterSets+report.SuffixSEI)
 			if "missing-dts.ts" == name {
 				checkNALSequence(t, run, fixedPath, "fixed-leading-sei.out")
 			} else {
@@ -101,10 +113,108 @@ func TestFixMisplacedSEI_NoChanges(t *testing.T) {
 			fixedPath, err := FixMisplacedSEI(input)
 			require.NoError(t, err)
 			require.Equal(t, input, fixedPath, "known-good sample should pass through unchanged")
+
+			data, err := ioutil.ReadFile(input)
+			require.NoError(t, err)
+			memData, report := FixMisplacedSEIBytes(data)
+			require.False(t, report.Changed())
+			require.Equal(t, &data[0], &memData[0], "unchanged data shouldn't be copied")
 		})
 	}
 }
 
+// HEVC NAL unit; the tag keeps units apart. Slices start a new picture.
+func hevcNAL(typ uint8, tag byte) []byte {
+	nal := []byte{0, 0, 0, 1, typ << 1, 1}
+	if typ < 32 {
+		nal = append(nal, 0x80)
+	}
+	return append(nal, tag)
+}
+
+// Single program TS with a video stream of the given type, one PES per AU
+func videoTS(t *testing.T, streamType uint8, aus ...[][]byte) []byte {
+	const pmtPID, videoPID = 0x1000, 0x100
+	var buf bytes.Buffer
+	psi := make([]byte, tsPacketSize)
+	pat := tsio.PAT{Entries: []tsio.PATEntry{{ProgramNumber: 1, ProgramMapPID: pmtPID}}}
+	n := tsio.FillPSI(psi, tsio.TableIdPAT, tsio.TableExtPAT, pat.Marshal(psi[tsio.PSIHeaderLength:]))
+	require.NoError(t, tsio.NewTSWriter(tsio.PAT_PID).WritePackets(&buf, [][]byte{psi[:n]}, 0, false, true))
+	pmt := tsio.PMT{
+		PCRPID:                videoPID,
+		ElementaryStreamInfos: []tsio.ElementaryStreamInfo{{StreamType: streamType, ElementaryPID: videoPID}},
+	}
+	n = tsio.FillPSI(psi, tsio.TableIdPMT, tsio.TableExtPMT, pmt.Marshal(psi[tsio.PSIHeaderLength:]))
+	require.NoError(t, tsio.NewTSWriter(pmtPID).WritePackets(&buf, [][]byte{psi[:n]}, 0, false, true))
+
+	w := tsio.NewTSWriter(videoPID)
+	for i, au := range aus {
+		es := bytes.Join(au, nil)
+		pes := make([]byte, tsio.MaxPESHeaderLength)
+		pts := time.Duration(i+1) * time.Second
+		n := tsio.FillPESHeader(pes, tsio.StreamIdH264, len(es), pts, pts)
+		require.NoError(t, w.WritePackets(&buf, [][]byte{pes[:n], es}, 0, i == 0, false))
+	}
+	return buf.Bytes()
+}
+
+func TestFixMisplacedSEI_HEVC(t *testing.T) {
+	const (
+		trail     = 1
+		idr       = 19
+		vps       = 32
+		sps       = 33
+		pps       = 34
+		aud       = 35
+		prefixSEI = 39
+		suffixSEI = 40
+	)
+	nal := hevcNAL
+
+	// hardware encoders putting prefix SEI and parameter sets behind the
+	// picture, and suffix SEI ahead of it
+	broken := [][]byte{
+		nal(aud, 1), nal(suffixSEI, 2), nal(idr, 3), nal(prefixSEI, 4),
+		nal(pps, 5), nal(vps, 6), nal(sps, 7),
+	}
+	fixed := [][]byte{
+		nal(aud, 1), nal(vps, 6), nal(sps, 7), nal(pps, 5),
+		nal(prefixSEI, 4), nal(idr, 3), nal(suffixSEI, 2),
+	}
+	good := [][]byte{nal(aud, 8), nal(prefixSEI, 9), nal(trail, 10), nal(suffixSEI, 11)}
+
+	data := videoTS(t, elementaryStreamTypeHEVC, broken, good, broken)
+	out, report := FixMisplacedSEIBytes(data)
+	assert.Equal(t, videoTS(t, elementaryStreamTypeHEVC, fixed, good, fixed), out)
+	assert.Equal(t, SEIFixReport{Codec: "hevc", AccessUnits: 2, SEI: 2, SuffixSEI: 2, ParameterSets: 6}, report)
+
+	// without a PMT the codec is guessed from the stream
+	noPMT := videoTS(t, elementaryStreamTypeHEVC, broken)
+	out, report = FixMisplacedSEIBytes(noPMT[2*tsPacketSize:])
+	assert.Equal(t, videoTS(t, elementaryStreamTypeHEVC, fixed)[2*tsPacketSize:], out)
+	assert.Equal(t, "hevc", report.Codec)
+
+	// without AUDs, units between pictures belong to the next one, apart from
+	// suffix SEI
+	secondSlice := nal(trail, 6)
+	secondSlice[6] = 0
+	noAUD := [][]byte{
+		nal(vps, 1), nal(sps, 2), nal(pps, 3), nal(prefixSEI, 4), nal(idr, 5),
+		secondSlice, nal(suffixSEI, 7), nal(prefixSEI, 8), nal(trail, 9),
+	}
+	data = videoTS(t, elementaryStreamTypeHEVC, noAUD)
+	out, report = FixMisplacedSEIBytes(data)
+	assert.Equal(t, data, out)
+	assert.Equal(t, SEIFixReport{Codec: "hevc"}, report)
+
+	// H.264 parameter sets behind a slice start the next access unit
+	h264 := [][]byte{{0, 0, 0, 1, 0x09, 0xf0}, {0, 0, 0, 1, 0x65, 0x88}, {0, 0, 0, 1, 0x67, 0x42}}
+	data = videoTS(t, tsio.ElementaryStreamTypeH264, h264)
+	out, report = FixMisplacedSEIBytes(data)
+	assert.Equal(t, data, out)
+	assert.Equal(t, SEIFixReport{Codec: "h264"}, report)
+}
+
 func dataFilePath(t *testing.T, name string) string {
 	t.Helper()
 	wd, err := os.Getwd()
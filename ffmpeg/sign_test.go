@@ -169,3 +169,101 @@ func Test_SignDataCompare(t *testing.T) {
 		}
 	}
 }
+
+func Test_SignDataCompareDetailed(t *testing.T) {
+	data0, err := ioutil.ReadFile("../data/sign_sw1.bin")
+	assert.NoError(t, err)
+	data1, err := ioutil.ReadFile("../data/sign_sw2.bin")
+	assert.NoError(t, err)
+	data2, err := ioutil.ReadFile("../data/sign_nv1.bin")
+	assert.NoError(t, err)
+
+	// software and nvidia signatures of the same rendition
+	m, err := CompareSignatureDetailed(data0, data2)
+	assert.NoError(t, err)
+	assert.True(t, m.Match)
+	assert.True(t, m.Score > 0.9)
+	assert.InDelta(t, 0, m.Offset, float64(40*time.Millisecond))
+	if assert.Len(t, m.Ranges, 1) {
+		assert.Equal(t, m.Ranges[0].First, m.Ranges[0].Second)
+		assert.True(t, m.Ranges[0].Frames > 0)
+	}
+
+	// different segments
+	m, err = CompareSignatureDetailed(data0, data1)
+	assert.NoError(t, err)
+	assert.False(t, m.Match)
+	assert.Equal(t, 0.0, m.Score)
+	assert.Empty(t, m.Ranges)
+
+	// no FineSignature in file
+	_, err = CompareSignatureDetailed(data0[:279], data2)
+	assert.Equal(t, ErrSignCompare, err)
+	_, err = CompareSignatureDetailed(nil, data2)
+	assert.Equal(t, ErrSignCompare, err)
+
+	// frames are found by their media time
+	s, err := parseSignature(data0)
+	assert.NoError(t, err)
+	assert.Len(t, s.pts, 37)
+	last := len(s.pts) - 1
+	assert.Equal(t, last, s.frameAt(s.mediaTime(s.pts[last]).Seconds()))
+	assert.Equal(t, 0, s.frameAt(-1))
+}
+
+func Test_SignInMemory(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts"}
+	out := []TranscodeOptions{{
+		Oname:        dir + "/signmem1.ts",
+		Profile:      P360p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		CalcSign:     true,
+		SignInMemory: true,
+	}, {
+		Oname:        dir + "/signmem2.ts",
+		Profile:      P360p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		CalcSign:     true,
+	}, {
+		Oname:        dir + "/signmem3.ts",
+		Profile:      P144p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "copy"},
+		SignInMemory: true,
+	}}
+	res, err := Transcode3(in, out)
+	assert.NoError(t, err)
+	assert.Len(t, res.Signatures, len(out))
+	assert.NotEmpty(t, res.Signatures[0])
+	assert.Nil(t, res.Signatures[1])
+	assert.Nil(t, res.Signatures[2])
+	_, err = os.Stat(dir + "/signmem1.ts.bin")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/signmem3.ts.bin")
+	assert.True(t, os.IsNotExist(err))
+
+	// same rendition as the signature written to a file
+	data, err := ioutil.ReadFile(dir + "/signmem2.ts.bin")
+	assert.NoError(t, err)
+	m, err := CompareSignatureDetailed(res.Signatures[0], data)
+	assert.NoError(t, err)
+	assert.True(t, m.Match)
+	assert.Equal(t, 1.0, m.Score)
+	assert.Equal(t, time.Duration(0), m.Offset)
+
+	// media times are those of the encoded frames, so they span the output
+	sig, err := parseSignature(res.Signatures[0])
+	assert.NoError(t, err)
+	info, err := ProbeMedia(dir + "/signmem1.ts")
+	assert.NoError(t, err)
+	span := sig.mediaTime(sig.pts[len(sig.pts)-1]) - sig.mediaTime(sig.pts[0])
+	assert.InDelta(t, info.VideoStreams()[0].Duration, span, float64(100*time.Millisecond))
+
+	// no signatures unless asked for
+	out[0].SignInMemory = false
+	res, err = Transcode3(in, out[:2])
+	assert.NoError(t, err)
+	assert.Nil(t, res.Signatures)
+}
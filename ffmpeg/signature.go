@@ -0,0 +1,149 @@
+package ffmpeg
+
+import (
+	"math"
+	"time"
+)
+
+// SignatureMatch details how two MPEG-7 video signatures match each other,
+// as found by the matcher of the signature filter.
+type SignatureMatch struct {
+	// Verdict of the signature filter, as returned by CompareSignatureByBuffer
+	Match bool
+	// Whether the signature filter matched the whole of the signatures
+	Whole bool
+	// Fraction of the frames of the shorter signature that match, 0 to 1
+	Score float64
+	// Media time of matched content in the second signature minus its media
+	// time in the first one
+	Offset time.Duration
+	// Frames the signature filter matched; a single run, if any
+	Ranges []SignatureRange
+}
+
+// SignatureRange is a run of consecutive frames matching between two
+// signatures. Frames are counted from the start of each signature.
+type SignatureRange struct {
+	First  int
+	Second int
+	Frames int
+}
+
+// Number of ternary elements of a fine signature, packed five per byte
+const signatureFrameBytes = 76
+
+type videoSignature struct {
+	timeUnit uint32   // media time ticks per second
+	pts      []uint32 // media time of each frame
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) left() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.data[r.pos>>3]>>(7-uint(r.pos&7))&1)
+		r.pos++
+	}
+	return v
+}
+
+// Parses the binary export of the signature filter. Trailing frames cut
+// short are ignored, like the signature filter does.
+func parseSignature(data []byte) (*videoSignature, error) {
+	// spatial region, frame count, media time and segment count
+	const headerBits = 32 + 1 + 32 + 16 + 16 + 32 + 32 + 16 + 1 + 32 + 32 + 32
+	const segmentBits = 32 + 32 + 1 + 32 + 32 + 5*243
+	const frameBits = 1 + 32 + 8 + 5*8 + signatureFrameBytes*8
+	r := &bitReader{data: data}
+	if r.left() < headerBits {
+		return nil, ErrSignCompare
+	}
+	r.pos += 32 + 1 + 32 + 16 + 16 + 32
+	nbFrames := int(r.read(32))
+	s := &videoSignature{timeUnit: r.read(16)}
+	r.pos += 1 + 32 + 32
+	nbSegments := int(r.read(32))
+	if nbSegments > r.left()/segmentBits {
+		return nil, ErrSignCompare
+	}
+	r.pos += nbSegments * segmentBits
+	r.pos++ // compression flag
+	for i := 0; i < nbFrames && r.left() >= frameBits; i++ {
+		r.pos++ // media time flag
+		s.pts = append(s.pts, r.read(32))
+		r.pos += frameBits - 1 - 32 // confidence, words and the fine signature
+	}
+	if len(s.pts) == 0 {
+		return nil, ErrSignCompare
+	}
+	return s, nil
+}
+
+func (s *videoSignature) mediaTime(pts uint32) time.Duration {
+	if s.timeUnit == 0 {
+		return 0
+	}
+	return time.Duration(pts) * time.Second / time.Duration(s.timeUnit)
+}
+
+// Frame closest to the media time, in seconds
+func (s *videoSignature) frameAt(t float64) int {
+	best := 0
+	for i := range s.pts {
+		if math.Abs(s.mediaTime(s.pts[i]).Seconds()-t) < math.Abs(s.mediaTime(s.pts[best]).Seconds()-t) {
+			best = i
+		}
+	}
+	return best
+}
+
+func signatureInMemory(p TranscodeOptions) bool {
+	return p.CalcSign && p.SignInMemory
+}
+
+// Files the signature filter of each output writes to. Signatures kept in
+// memory are written to a sink instead, see signatureSink. The returned
+// function stops collecting them and returns what was written, indexed like
+// the outputs, or nil if no output keeps its signature in memory. It may be
+// called more than once.
+func signatureFiles(ps []TranscodeOptions) ([]string, func() [][]byte, error) {
+	files := make([]string, len(ps))
+	var sigs [][]byte
+	var sinks []func() []byte
+	collect := func() [][]byte {
+		for i, p := range ps {
+			if signatureInMemory(p) && len(sinks) > 0 {
+				sigs[i], sinks = sinks[0](), sinks[1:]
+			}
+		}
+		return sigs
+	}
+	for i, p := range ps {
+		if !p.CalcSign {
+			continue
+		}
+		if !signatureInMemory(p) {
+			files[i] = p.Oname + ".bin"
+			continue
+		}
+		fname, sink, err := signatureSink()
+		if err != nil {
+			collect()
+			return nil, nil, err
+		}
+		if sigs == nil {
+			sigs = make([][]byte, len(ps))
+		}
+		files[i] = fname
+		sinks = append(sinks, sink)
+	}
+	return files, collect, nil
+}
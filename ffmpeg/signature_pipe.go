@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Signatures kept in memory are written to a pipe, which the signature
+// filter opens like a file, and read back while transcoding. The returned
+// function closes the pipe and returns what was written, nil if nothing was.
+func signatureSink() (string, func() []byte, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", nil, err
+	}
+	var data []byte
+	read := make(chan struct{})
+	go func() {
+		data, _ = ioutil.ReadAll(r)
+		r.Close()
+		close(read)
+	}()
+	fname := fmt.Sprintf("/dev/fd/%d", w.Fd())
+	return fname, func() []byte {
+		w.Close()
+		<-read
+		if len(data) == 0 {
+			return nil
+		}
+		return data
+	}, nil
+}
@@ -0,0 +1,26 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Windows can't open pipes by name, so signatures kept in memory go through
+// a temporary file instead. The returned function reads and removes it,
+// returning nil if nothing was written.
+func signatureSink() (string, func() []byte, error) {
+	f, err := ioutil.TempFile("", "lpms-sign")
+	if err != nil {
+		return "", nil, err
+	}
+	fname := f.Name()
+	f.Close()
+	return fname, func() []byte {
+		data, _ := ioutil.ReadFile(fname)
+		os.Remove(fname)
+		if len(data) == 0 {
+			return nil
+		}
+		return data
+	}, nil
+}
@@ -0,0 +1,434 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ClipMode selects how From / To are applied to an output
+type ClipMode int
+
+const (
+	// Re-encode everything between From and To. Needs a video encoder.
+	ClipModeReencode ClipMode = iota
+	// Stream copy whole GOPs, starting on the first keyframe at or after
+	// From. Needs the video encoder to be "copy".
+	ClipModeKeyframe
+	// Frame accurate clipping which only re-encodes the partial GOPs at the
+	// clip boundaries and stream copies the GOPs in between. Copied GOPs
+	// start on IDR frames, so open GOPs are re-encoded. The boundaries are
+	// encoded with the profile, level and B-frames of the source, and the
+	// smart cut is refused if they still can't be spliced with it; outputs
+	// other than MPEG-TS need the very same parameter sets. Audio is kept
+	// unless dropped, re-encoded to AAC in one go and trimmed to the sample,
+	// so it can't be copied. Needs the video encoder to be "copy", the audio
+	// encoder to be "drop" or empty, a single output and a seekable input
+	// file.
+	ClipModeSmartCut
+)
+
+// Encoded audio clipped to the sample, for the audio of smart cuts. Video
+// has to be dropped.
+const clipModeAudio ClipMode = -1
+
+// A section of the source that is either re-encoded or copied
+type clipPiece struct {
+	from, to time.Duration
+	copy     bool
+}
+
+func validateClip(input *TranscodeOptionsIn, p TranscodeOptions, nbOutputs int) error {
+	if p.ClipMode == ClipModeSmartCut {
+		if nbOutputs != 1 || input.Transmuxing || !hasVideoMetadata(input.Fname) || p.VideoEncoder.Name != "copy" {
+			glog.Warning("Smart cut needs a single output copying video from a file")
+			return ErrTranscoderClipConfig
+		}
+		switch p.AudioEncoder.Name {
+		case "", "drop":
+		default:
+			glog.Warning("Smart cut can only re-encode audio to AAC or drop it")
+			return ErrTranscoderClipConfig
+		}
+		if p.Encryption != nil {
+			glog.Warning("Smart cut can't encrypt its output")
+			return ErrTranscoderClipConfig
+		}
+	}
+	if p.From == 0 && p.To == 0 {
+		return nil
+	}
+	switch p.ClipMode {
+	case ClipModeReencode:
+		if p.VideoEncoder.Name == "drop" || p.VideoEncoder.Name == "copy" {
+			glog.Warning("Could clip only when transcoding video")
+			return ErrTranscoderClipConfig
+		}
+	case ClipModeKeyframe:
+		if p.VideoEncoder.Name != "copy" {
+			glog.Warning("Keyframe clipping needs video to be copied")
+			return ErrTranscoderClipConfig
+		}
+	case ClipModeSmartCut:
+	case clipModeAudio:
+		switch {
+		case p.VideoEncoder.Name != "drop", p.AudioEncoder.Name == "copy", p.AudioEncoder.Name == "drop":
+			return ErrTranscoderClipConfig
+		}
+	default:
+		return ErrTranscoderClipConfig
+	}
+	if p.From < 0 || p.To > 0 && p.From > 0 && p.To < p.From {
+		glog.Warning("'To' should be after 'From'")
+		return ErrTranscoderClipConfig
+	}
+	return nil
+}
+
+// Split the clip into pieces along the given keyframes, which are relative to
+// the start of the stream. A zero `to` means the end of the stream.
+//
+// Clip boundaries are inclusive and work with millisecond precision, so copied
+// pieces end a millisecond before the next keyframe.
+func planSmartCut(keyframes []time.Duration, from, to time.Duration) []clipPiece {
+	k1 := -1
+	for i, k := range keyframes {
+		if k >= from {
+			k1 = i
+			break
+		}
+	}
+	if k1 < 0 || (to > 0 && keyframes[k1] > to) {
+		// No keyframe inside the clip; nothing to copy
+		return []clipPiece{{from: from, to: to}}
+	}
+	start := keyframes[k1]
+	var pieces []clipPiece
+	if from < start {
+		pieces = append(pieces, clipPiece{from: from, to: start - time.Millisecond})
+	}
+	if to == 0 {
+		return append(pieces, clipPiece{from: start, copy: true})
+	}
+	end := start
+	for _, k := range keyframes[k1:] {
+		if k <= to {
+			end = k
+		}
+	}
+	if end > start {
+		pieces = append(pieces, clipPiece{from: start, to: end - time.Millisecond, copy: true})
+	}
+	return append(pieces, clipPiece{from: end, to: to})
+}
+
+// Build an encoding profile and encoder options that match the source video
+// closely enough to be spliced together with stream copied video. Whether
+// they did is checked on the encoded pieces, see checkSplice.
+func matchingEncoder(fname string, info ProbeInfo, gop GOPInfo) (VideoProfile, ComponentOptions, error) {
+	v := info.VideoStreams()[0]
+	codec, ok := FfmpegNameToVideoCodec[v.Codec]
+	if !ok || codec == VP8 || codec == VP9 {
+		// boundaries are joined in mpegts which does not carry VPx
+		glog.Warningf("Cannot match %s video", v.Codec)
+		return VideoProfile{}, ComponentOptions{}, ErrTranscoderClipConfig
+	}
+	bitrate := v.Bitrate
+	if bitrate <= 0 {
+		bitrate = info.Bitrate
+	}
+	if bitrate <= 0 && info.Duration > 0 {
+		// estimate from the file size
+		if fi, err := os.Stat(fname); err == nil {
+			bitrate = int64(float64(fi.Size()*8) / info.Duration.Seconds())
+		}
+	}
+	if bitrate <= 0 {
+		glog.Warning("Could not determine the source bitrate")
+		return VideoProfile{}, ComponentOptions{}, ErrTranscoderClipConfig
+	}
+	profile := ProfileNone
+	if codec == H264 {
+		switch v.Profile {
+		case "Baseline", "Constrained Baseline":
+			profile = ProfileH264Baseline
+		case "Main":
+			profile = ProfileH264Main
+		case "High":
+			profile = ProfileH264High
+		}
+	}
+	// The defaults of the encoder, see createCOutputParams, along with
+	// what the SPS of the source says
+	opts := map[string]string{
+		"forced-idr": "1",
+		"preset":     "medium",
+		"tier":       "high",
+		"bf":         "0",
+	}
+	if gop.HasBFrames {
+		opts["bf"] = "3"
+	}
+	if profile != ProfileNone {
+		opts["profile"] = ProfileParameters[profile]
+	}
+	if codec == H264 && v.Level > 0 {
+		opts["level"] = fmt.Sprintf("%d.%d", v.Level/10, v.Level%10)
+	}
+	// Framerate is deliberately left unset to keep source timestamps, which
+	// clipping and joining rely on.
+	return VideoProfile{
+		Name:       "matched",
+		Bitrate:    strconv.FormatInt(bitrate, 10),
+		Resolution: fmt.Sprintf("%dx%d", v.Width, v.Height),
+		Format:     FormatMPEGTS,
+		Profile:    profile,
+		Encoder:    codec,
+	}, ComponentOptions{Opts: opts}, nil
+}
+
+// Checks that the encoded piece can be spliced with the copied video of the
+// source. MPEG-TS carries parameter sets in band, so only the properties of
+// the streams need to match there. Other outputs keep one set of parameter
+// sets for the whole stream, which have to be the same.
+func checkSplice(src StreamInfo, fname string, inBand bool) error {
+	info, err := ProbeMedia(fname)
+	if err != nil {
+		return err
+	}
+	if len(info.VideoStreams()) == 0 {
+		return ErrTranscoderVid
+	}
+	enc := info.VideoStreams()[0]
+	if enc.Codec != src.Codec || enc.Profile != src.Profile || enc.Level != src.Level ||
+		enc.Width != src.Width || enc.Height != src.Height || enc.PixFormat != src.PixFormat ||
+		enc.FieldOrder != src.FieldOrder || enc.FrameRate != src.FrameRate {
+		glog.Warningf("Smart cut could not match the source video: %s %s level %d %dx%d %v at %v, encoded %s %s level %d %dx%d %v at %v",
+			src.Codec, src.Profile, src.Level, src.Width, src.Height, src.PixFormat, src.FrameRate,
+			enc.Codec, enc.Profile, enc.Level, enc.Width, enc.Height, enc.PixFormat, enc.FrameRate)
+		return ErrTranscoderClipConfig
+	}
+	if !inBand && !sameParameterSets(src, enc) {
+		glog.Warning("Smart cut could not match the parameter sets of the source")
+		return ErrTranscoderClipConfig
+	}
+	return nil
+}
+
+// Whether both streams carry the same parameter sets in their extradata
+func sameParameterSets(a, b StreamInfo) bool {
+	codec := nalCodecH264
+	if a.Codec == "hevc" {
+		codec = nalCodecHEVC
+	}
+	x, y := parameterSets(codec, a.Extradata), parameterSets(codec, b.Extradata)
+	if len(x) == 0 || len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !bytes.Equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameter sets in extradata, which is either a decoder configuration record
+// (avcC / hvcC) or in Annex B, in a canonical order
+func parameterSets(codec nalCodec, extradata []byte) [][]byte {
+	var nals [][]byte
+	if len(extradata) > 0 && extradata[0] == 1 {
+		nals = configRecordNALs(codec, extradata)
+	} else {
+		for _, n := range scanNALs(extradata, codec) {
+			_, sc := findStartCode(extradata, n.start)
+			nals = append(nals, bytes.TrimRight(extradata[n.start+sc:n.end], "\x00"))
+		}
+	}
+	var sets [][]byte
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		typ := codec.nalType(nal[0])
+		if codec == nalCodecHEVC && typ >= 32 && typ <= 34 || codec == nalCodecH264 && (typ == 7 || typ == 8) {
+			sets = append(sets, nal)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return bytes.Compare(sets[i], sets[j]) < 0 })
+	return sets
+}
+
+// NAL units of an avcC or hvcC record, nil if it is cut short
+func configRecordNALs(codec nalCodec, b []byte) [][]byte {
+	var nals [][]byte
+	// reads count NAL units with 16 bit lengths from the offset
+	read := func(off, count int) int {
+		for i := 0; i < count; i++ {
+			if off+2 > len(b) {
+				return -1
+			}
+			n := int(b[off])<<8 | int(b[off+1])
+			if off+2+n > len(b) {
+				return -1
+			}
+			nals = append(nals, b[off+2:off+2+n])
+			off += 2 + n
+		}
+		return off
+	}
+	if codec == nalCodecHEVC {
+		if len(b) < 23 {
+			return nil
+		}
+		off := 23
+		for i := 0; i < int(b[22]); i++ {
+			if off+3 > len(b) {
+				return nil
+			}
+			if off = read(off+3, int(b[off+1])<<8|int(b[off+2])); off < 0 {
+				return nil
+			}
+		}
+		return nals
+	}
+	if len(b) < 6 {
+		return nil
+	}
+	off := read(6, int(b[5]&0x1f))
+	if off < 0 || off >= len(b) {
+		return nil
+	}
+	if read(off+1, int(b[off])) < 0 {
+		return nil
+	}
+	return nals
+}
+
+// Audio is always encoded as 44.1kHz stereo AAC; see filter.c
+func matchesEncodedAudio(a StreamInfo) bool {
+	return a.Codec == "aac" && a.SampleRate == 44100 && a.Channels == 2
+}
+
+func smartCut(input *TranscodeOptionsIn, p TranscodeOptions, limits Limits) (*TranscodeResults, error) {
+	info, err := ProbeMedia(input.Fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.VideoStreams()) == 0 {
+		return nil, ErrTranscoderVid
+	}
+	gop, err := AnalyzeGOP(input.Fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(gop.Frames) == 0 {
+		return nil, ErrTranscoderVid
+	}
+	// Clipping is relative to the first video frame. Copied pieces start on
+	// IDR frames leading closed GOPs, which decode without what came before.
+	base := gop.Frames[0].PTS
+	closed := map[time.Duration]bool{}
+	for _, g := range gop.GOPs {
+		if g.Closed {
+			closed[g.StartPTS] = true
+		}
+	}
+	var keyframes []time.Duration
+	for _, k := range gop.Keyframes {
+		if closed[k] {
+			keyframes = append(keyframes, k-base)
+		}
+	}
+
+	profile, encoder, err := matchingEncoder(input.Fname, info, gop)
+	if err != nil {
+		return nil, err
+	}
+	audio := p.AudioEncoder.Name != "drop" && len(info.AudioStreams()) > 0
+
+	dir, err := ioutil.TempDir("", "lpms-smartcut")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Video goes piece by piece, without audio
+	pieces := planSmartCut(keyframes, p.From, p.To)
+	names := make([]string, len(pieces))
+	res := &TranscodeResults{Encoded: make([]MediaInfo, 1)}
+	for i, pc := range pieces {
+		names[i] = filepath.Join(dir, fmt.Sprintf("%d.ts", i))
+		out := TranscodeOptions{
+			Oname:        names[i],
+			Profile:      profile,
+			Accel:        p.Accel,
+			Device:       p.Device,
+			From:         pc.from,
+			To:           pc.to,
+			Muxer:        ComponentOptions{Name: "mpegts"},
+			VideoEncoder: encoder,
+			AudioEncoder: ComponentOptions{Name: "drop"},
+		}
+		in := &TranscodeOptionsIn{Fname: input.Fname, Accel: input.Accel, Device: input.Device, Demuxer: input.Demuxer}
+		if pc.copy {
+			out.ClipMode = ClipModeKeyframe
+			out.VideoEncoder = ComponentOptions{Name: "copy"}
+			in.Accel = Software
+		}
+		r, err := transcodeWithLimits(limits, in, []TranscodeOptions{out})
+		if err != nil {
+			return nil, err
+		}
+		if !pc.copy {
+			if err := checkSplice(info.VideoStreams()[0], names[i], isMPEGTSOutput(p)); err != nil {
+				return nil, err
+			}
+		}
+		res.Decoded.Frames += r.Decoded.Frames
+		res.Decoded.Pixels += r.Decoded.Pixels
+		res.Encoded[0].Frames += r.Encoded[0].Frames
+		res.Encoded[0].Pixels += r.Encoded[0].Pixels
+	}
+	if !audio {
+		if _, err := joinSegments(names, p); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	// Audio is encoded in one go, so there are no priming gaps between
+	// pieces, and trimmed to the sample
+	video := filepath.Join(dir, "video.ts")
+	if _, err := joinSegments(names, TranscodeOptions{Oname: video, Muxer: ComponentOptions{Name: "mpegts"}}); err != nil {
+		return nil, err
+	}
+	audioName := filepath.Join(dir, "audio.ts")
+	_, err = transcodeWithLimits(limits, &TranscodeOptionsIn{Fname: input.Fname, Demuxer: input.Demuxer}, []TranscodeOptions{{
+		Oname:        audioName,
+		From:         p.From,
+		To:           p.To,
+		ClipMode:     clipModeAudio,
+		Muxer:        ComponentOptions{Name: "mpegts"},
+		VideoEncoder: ComponentOptions{Name: "drop"},
+		AudioEncoder: ComponentOptions{Name: "aac"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	merged := filepath.Join(dir, "merged.ts")
+	if err := mergeStreams([]string{video, audioName}, merged, "mpegts"); err != nil {
+		return nil, err
+	}
+	if _, err := joinSegments([]string{merged}, p); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
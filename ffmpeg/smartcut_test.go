@@ -0,0 +1,214 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmartCut_Plan(t *testing.T) {
+	s := time.Second
+	ms := time.Millisecond
+	kfs := []time.Duration{0, 1 * s, 2 * s, 3 * s, 4 * s}
+	tests := []struct {
+		name     string
+		from, to time.Duration
+		pieces   []clipPiece
+	}{{
+		name: "whole stream",
+		pieces: []clipPiece{
+			{from: 0, copy: true},
+		},
+	}, {
+		name: "both boundaries mid-GOP",
+		from: 1500 * ms, to: 3500 * ms,
+		pieces: []clipPiece{
+			{from: 1500 * ms, to: 2*s - ms},
+			{from: 2 * s, to: 3*s - ms, copy: true},
+			{from: 3 * s, to: 3500 * ms},
+		},
+	}, {
+		name: "start on keyframe, open end",
+		from: 2 * s,
+		pieces: []clipPiece{
+			{from: 2 * s, copy: true},
+		},
+	}, {
+		name: "within one GOP",
+		from: 1200 * ms, to: 1800 * ms,
+		pieces: []clipPiece{
+			{from: 1200 * ms, to: 1800 * ms},
+		},
+	}, {
+		name: "straddling one keyframe",
+		from: 1500 * ms, to: 2500 * ms,
+		pieces: []clipPiece{
+			{from: 1500 * ms, to: 2*s - ms},
+			{from: 2 * s, to: 2500 * ms},
+		},
+	}, {
+		name: "past the last keyframe",
+		from: 4500 * ms,
+		pieces: []clipPiece{
+			{from: 4500 * ms},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.pieces, planSmartCut(kfs, tt.from, tt.to))
+		})
+	}
+}
+
+func TestSmartCut_InvalidConfig(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	run(`cp "$1"/../transcoder/test.ts .`)
+	in := &TranscodeOptionsIn{Fname: filepath.Join(dir, "test.ts")}
+	out := TranscodeOptions{
+		Oname:        filepath.Join(dir, "out.ts"),
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		ClipMode:     ClipModeSmartCut,
+		From:         time.Second,
+	}
+	// needs video copy
+	bad := out
+	bad.VideoEncoder.Name = ""
+	_, err := Transcode3(in, []TranscodeOptions{bad})
+	assert.Equal(t, ErrTranscoderClipConfig, err)
+	// single output only
+	_, err = Transcode3(in, []TranscodeOptions{out, out})
+	assert.Equal(t, ErrTranscoderClipConfig, err)
+	// audio can't be re-encoded with another encoder
+	bad = out
+	bad.AudioEncoder.Name = "opus"
+	_, err = Transcode3(in, []TranscodeOptions{bad})
+	assert.Equal(t, ErrTranscoderClipConfig, err)
+	// nor copied, as it is always re-encoded
+	bad = out
+	bad.AudioEncoder.Name = "copy"
+	_, err = Transcode3(in, []TranscodeOptions{bad})
+	assert.Equal(t, ErrTranscoderClipConfig, err)
+	// keyframe clipping needs video copy
+	bad = out
+	bad.ClipMode = ClipModeKeyframe
+	bad.VideoEncoder.Name = ""
+	_, err = Transcode3(in, []TranscodeOptions{bad})
+	assert.Equal(t, ErrTranscoderClipConfig, err)
+}
+
+func TestSmartCut_Transcode(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// 30fps source with one second GOPs
+	run(`
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 6 -c:v libx264 -r 30 \
+			-g 30 -keyint_min 30 -sc_threshold 0 -c:a aac in.ts
+	`)
+
+	for _, mode := range []ClipMode{ClipModeKeyframe, ClipModeSmartCut} {
+		t.Run(fmt.Sprintf("mode-%d", mode), func(t *testing.T) {
+			oname := filepath.Join(dir, fmt.Sprintf("out-%d.ts", mode))
+			in := &TranscodeOptionsIn{Fname: filepath.Join(dir, "in.ts")}
+			out := []TranscodeOptions{{
+				Oname:        oname,
+				VideoEncoder: ComponentOptions{Name: "copy"},
+				AudioEncoder: ComponentOptions{Name: "copy"},
+				ClipMode:     mode,
+				From:         1500 * time.Millisecond,
+				To:           3500 * time.Millisecond,
+			}}
+			if mode == ClipModeSmartCut {
+				// audio is re-encoded
+				out[0].AudioEncoder.Name = ""
+			}
+			_, err := Transcode3(in, out)
+			require.NoError(t, err)
+
+			gop, err := AnalyzeGOP(oname)
+			require.NoError(t, err)
+			assert.True(t, gop.StartsWithKeyframe)
+			if mode == ClipModeKeyframe {
+				// whole GOPs from 2s up to and including the 3.5s frame
+				assert.Len(t, gop.Frames, 46)
+				return
+			}
+			// frame accurate: 1.5s to 3.5s inclusive
+			assert.Len(t, gop.Frames, 61)
+			// re-encoded head, copied GOP, re-encoded tail
+			require.Len(t, gop.Keyframes, 3)
+			assert.InDelta(t, 500*time.Millisecond, gop.Keyframes[1]-gop.Keyframes[0], float64(time.Millisecond))
+			assert.InDelta(t, 1500*time.Millisecond, gop.Keyframes[2]-gop.Keyframes[0], float64(time.Millisecond))
+			assert.Equal(t, []int{15, 30, 16}, []int{gop.GOPs[0].Frames, gop.GOPs[1].Frames, gop.GOPs[2].Frames})
+
+			info, err := ProbeMedia(oname)
+			require.NoError(t, err)
+			require.Len(t, info.AudioStreams(), 1)
+			assert.InDelta(t, 2*time.Second, info.Duration, float64(100*time.Millisecond))
+			// audio is trimmed to the sample rather than to whole frames,
+			// leaving only the priming of the encoder
+			assert.InDelta(t, 2*time.Second, info.AudioStreams()[0].Duration, float64(30*time.Millisecond))
+		})
+	}
+}
+
+func TestSmartCut_OpenGOP(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Only the first frame is IDR; the other GOPs start on recovery points
+	// and lead with B-frames referencing the GOP before
+	run(`
+		ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 6 -c:v libx264 -r 30 \
+			-g 30 -keyint_min 30 -sc_threshold 0 -bf 3 -x264opts open_gop=1 -an in.ts
+	`)
+	oname := filepath.Join(dir, "out.ts")
+	_, err := Transcode3(&TranscodeOptionsIn{Fname: filepath.Join(dir, "in.ts")}, []TranscodeOptions{{
+		Oname:        oname,
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		ClipMode:     ClipModeSmartCut,
+		From:         1500 * time.Millisecond,
+		To:           3500 * time.Millisecond,
+	}})
+	require.NoError(t, err)
+
+	// nothing can be copied, so all of it is re-encoded and decodes
+	gop, err := AnalyzeGOP(oname)
+	require.NoError(t, err)
+	assert.True(t, gop.StartsWithKeyframe)
+	assert.Len(t, gop.Frames, 61)
+	assert.Len(t, gop.Keyframes, 1)
+	run(`ffmpeg -loglevel error -xerror -i out.ts -f null -`)
+}
+
+func TestSmartCut_ParameterSets(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb}
+	avcC := []byte{1, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0, byte(len(sps))}
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1, 0, byte(len(pps)))
+	avcC = append(avcC, pps...)
+	annexB := append(append([]byte{0, 0, 0, 1}, pps...), append([]byte{0, 0, 1}, sps...)...)
+
+	// the same parameter sets, whichever way they are stored
+	sets := parameterSets(nalCodecH264, avcC)
+	assert.Equal(t, [][]byte{sps, pps}, sets)
+	assert.Equal(t, sets, parameterSets(nalCodecH264, annexB))
+	assert.Empty(t, parameterSets(nalCodecH264, avcC[:10]))
+
+	vps := []byte{0x40, 0x01, 0x0c}
+	hevcSPS := []byte{0x42, 0x01, 0x01}
+	hvcC := make([]byte, 22)
+	hvcC[0] = 1
+	hvcC = append(hvcC, 2, 32, 0, 1, 0, byte(len(vps)))
+	hvcC = append(hvcC, vps...)
+	hvcC = append(hvcC, 33, 0, 1, 0, byte(len(hevcSPS)))
+	hvcC = append(hvcC, hevcSPS...)
+	assert.Equal(t, [][]byte{vps, hevcSPS}, parameterSets(nalCodecHEVC, hvcC))
+}
@@ -3,6 +3,7 @@
 #include "filter.h"
 #include "encoder.h"
 #include "logging.h"
+#include "logger.h"
 #include "queue.h"
 
 #include <libavcodec/avcodec.h>
@@ -21,6 +22,9 @@ const int lpms_ERR_FILTER_FLUSHED = FFERRTAG('F','L','F','L');
 const int lpms_ERR_OUTPUTS = FFERRTAG('O','U','T','P');
 const int lpms_ERR_UNRECOVERABLE = FFERRTAG('U', 'N', 'R', 'V');
 const int lpms_ERR_ENC_RUNAWAY = FFERRTAG('E', 'N', 'R', 'W');
+const int lpms_ERR_INPUT_RES = FFERRTAG('I', 'N', 'R', 'S');
+const int lpms_ERR_INPUT_SIZE = FFERRTAG('I', 'N', 'S', 'Z');
+const int lpms_ERR_INPUT_FPS = FFERRTAG('I', 'N', 'F', 'R');
 
 //
 //  Notes on transcoder internals:
@@ -110,6 +114,8 @@ static int flush_outputs(struct input_ctx *ictx, struct output_ctx *octx)
       ret = process_out(ictx, octx, octx->ac, octx->oc->streams[octx->dv ? 0 : 1], &octx->af, NULL);
     }
   }
+  ret = write_id3_tags(octx, INT64_MAX); // tags timed after the last packet
+  if (ret < 0) return ret;
   av_interleaved_write_frame(octx->oc, NULL); // flush muxer
   return av_write_trailer(octx->oc);
 }
@@ -150,12 +156,113 @@ int transcode_shutdown(struct transcode_thread *h, int ret)
 
 }
 
+// Rebases every stream from its next packet on, and restarts the video
+// filters so the fps filter doesn't fill the gap with duplicates.
+static void mark_discontinuity(struct transcode_thread *h)
+{
+  for (int i = 0; i < MAX_OUTPUT_SIZE; i++) {
+    h->ictx.discontinuity[i] = 1;
+  }
+  for (int i = 0; i < h->nb_outputs; i++) {
+    if (h->outputs[i].vf.active) h->outputs[i].vf.reset = 1;
+  }
+}
+
+// Compares the codec parameters of the input with those of the previous call
+static void check_codec_params(struct input_ctx *ictx)
+{
+  struct stream_params p = { .valid = 1 };
+  if (ictx->vi >= 0) {
+    AVCodecParameters *par = ictx->ic->streams[ictx->vi]->codecpar;
+    p.vcodec = par->codec_id;
+    p.width = par->width;
+    p.height = par->height;
+    p.format = par->format;
+  }
+  if (ictx->ai >= 0) {
+    AVCodecParameters *par = ictx->ic->streams[ictx->ai]->codecpar;
+    p.acodec = par->codec_id;
+    p.sample_rate = par->sample_rate;
+    p.channels = par->ch_layout.nb_channels;
+  }
+  if (ictx->last_params.valid && memcmp(&p, &ictx->last_params, sizeof p)) {
+    ictx->discontinuity_flags |= LPMS_DISCONT_CODEC;
+  }
+  ictx->last_params = p;
+}
+
+// Anything further than this from the end of the previous input is a jump
+#define MAX_TIMESTAMP_GAP AV_TIME_BASE
+
+// Compares the first timestamp of each of the video and audio streams with
+// where that stream left off in the previous call, and keeps track of where
+// it ends in this one. Every stream is checked before its first packet is
+// rebased, so whichever stream comes first detects the jump for all of them.
+// Returns whether a jump was detected.
+static int check_timestamps(struct input_ctx *ictx, AVPacket *pkt)
+{
+  int m = pkt->stream_index == ictx->vi ? 0 : pkt->stream_index == ictx->ai ? 1 : -1;
+  if (m < 0 || pkt->stream_index < 0 || pkt->pts == AV_NOPTS_VALUE) return 0;
+  AVRational tb = ictx->ic->streams[pkt->stream_index]->time_base;
+  int64_t pts = av_rescale_q(pkt->pts, tb, AV_TIME_BASE_Q);
+  int64_t end = pts + av_rescale_q(pkt->duration, tb, AV_TIME_BASE_Q);
+  if (ictx->ts_checked[m]) {
+    ictx->ts_last[m] = FFMAX(ictx->ts_last[m], pts);
+    ictx->ts_end[m] = FFMAX(ictx->ts_end[m], end);
+    return 0;
+  }
+  int flags = 0;
+  ictx->ts_checked[m] = 1;
+  if (ictx->ts_end[m] != AV_NOPTS_VALUE) {
+    if (pts < ictx->ts_last[m]) flags = LPMS_DISCONT_BACKWARDS;
+    else if (pts - ictx->ts_end[m] > MAX_TIMESTAMP_GAP) flags = LPMS_DISCONT_JUMP;
+  }
+  // the gap is the one seen by the first stream to detect it
+  if (flags && !(ictx->discontinuity_flags & (LPMS_DISCONT_BACKWARDS | LPMS_DISCONT_JUMP))) {
+    ictx->discontinuity_gap = pts - ictx->ts_end[m];
+  }
+  ictx->discontinuity_flags |= flags;
+  ictx->ts_last[m] = pts;
+  ictx->ts_end[m] = end;
+  return flags != 0;
+}
+
+// Measures the rate of the video decoded so far in this call, since the frame
+// rate declared by the input can't be trusted. The span is widened by a tick
+// so that timestamp rounding never pushes a compliant input over the limit.
+static int input_framerate_exceeded(struct input_ctx *ictx, AVFrame *frame, AVRational tb)
+{
+  int64_t pts = frame->best_effort_timestamp;
+  if (ictx->max_framerate <= 0 || pts == AV_NOPTS_VALUE) return 0;
+  if (ictx->fps_first_pts == AV_NOPTS_VALUE) ictx->fps_first_pts = pts;
+  ictx->fps_first_pts = FFMIN(ictx->fps_first_pts, pts);
+  ictx->fps_last_pts = FFMAX(ictx->fps_last_pts, pts);
+  ictx->fps_frames++;
+  int64_t span = ictx->fps_last_pts - ictx->fps_first_pts;
+  if (ictx->fps_frames < 2 || span <= 0) return 0;
+  double secs = (span + 1) * av_q2d(tb);
+  return (ictx->fps_frames - 1) / secs > ictx->max_framerate;
+}
+
 int transcode_init(struct transcode_thread *h, input_params *inp,
                    output_params *params, output_results *results)
 {
   int ret = 0;
   struct input_ctx *ictx = &h->ictx;
   ictx->xcoderParams = inp->xcoderParams;
+  ictx->hook.handle = inp->frame_hook;
+  ictx->hook.w = inp->hook_w;
+  ictx->hook.h = inp->hook_h;
+  ictx->hook.interval = FFMAX(1, inp->hook_interval);
+  ictx->hook.writable = inp->hook_writable;
+  ictx->max_width = inp->max_width;
+  ictx->max_height = inp->max_height;
+  ictx->max_pixels = inp->max_pixels;
+  ictx->max_frame_ratio = inp->max_frame_ratio;
+  ictx->max_input_bytes = inp->max_input_bytes;
+  ictx->max_framerate = inp->max_framerate;
+  ictx->fps_first_pts = ictx->fps_last_pts = AV_NOPTS_VALUE;
+  ictx->fps_frames = 0;
   int reopen_decoders = !ictx->transmuxing;
   struct output_ctx *outputs = h->outputs;
   int nb_outputs = h->nb_outputs;
@@ -185,6 +292,8 @@ int transcode_init(struct transcode_thread *h, input_params *inp,
     if (demuxer_opts) av_dict_free(demuxer_opts);
     ret = avformat_find_stream_info(ictx->ic, NULL);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to find info for reopened stream")
+    ictx->id3i = find_data_stream(ictx->ic, AV_CODEC_ID_TIMED_ID3);
+    ictx->scte35i = find_data_stream(ictx->ic, AV_CODEC_ID_SCTE_35);
   } else if (is_mpegts(ictx->ic) && !ictx->ic->pb) {
     // reopen input segment file IO context if needed
     // only necessary for mpegts
@@ -192,13 +301,16 @@ int transcode_init(struct transcode_thread *h, input_params *inp,
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen file");
   } else reopen_decoders = 0;
 
-  if (AV_HWDEVICE_TYPE_CUDA == ictx->hw_type && ictx->vi >= 0) {
-    if (ictx->last_format == AV_PIX_FMT_NONE) ictx->last_format = ictx->ic->streams[ictx->vi]->codecpar->format;
-    else if (ictx->ic->streams[ictx->vi]->codecpar->format != ictx->last_format) {
-      LPMS_WARN("Input pixel format has been changed in the middle.");
-      ictx->last_format = ictx->ic->streams[ictx->vi]->codecpar->format;
+  if (ictx->hw_type > AV_HWDEVICE_TYPE_NONE && ictx->vi >= 0) {
+    AVCodecParameters *par = ictx->ic->streams[ictx->vi]->codecpar;
+    int codec_changed = ictx->last_params.valid && ictx->last_params.vcodec != par->codec_id;
+    if (ictx->last_format == AV_PIX_FMT_NONE) ictx->last_format = par->format;
+    else if (par->format != ictx->last_format || codec_changed) {
+      LPMS_WARN("Input pixel format or codec has been changed in the middle.");
+      ictx->last_format = par->format;
       // if the decoder is not re-opened when the video pixel format is changed,
       // the decoder tries HW decoding with the video context initialized to a pixel format different from the input one.
+      // the same goes for a different codec.
       // to handle a change in the input pixel format,
       // we close the demuxer and re-open the decoder by calling open_input().
       free_input(&h->ictx);
@@ -208,6 +320,18 @@ int transcode_init(struct transcode_thread *h, input_params *inp,
     }
   }
 
+  // Detect discontinuities with the previous call. Changes are handled like
+  // manual discontinuities.
+  ictx->discontinuity_flags = 0;
+  ictx->discontinuity_gap = 0;
+  ictx->ts_checked[0] = ictx->ts_checked[1] = 0;
+  if (ictx->manual_discontinuity) {
+    ictx->discontinuity_flags |= LPMS_DISCONT_MANUAL;
+    ictx->manual_discontinuity = 0;
+  }
+  check_codec_params(ictx);
+  if (ictx->discontinuity_flags & LPMS_DISCONT_CODEC) mark_discontinuity(h);
+
   if (reopen_decoders) {
     // XXX check to see if we can also reuse decoder for sw decoding
     if (ictx->hw_type == AV_HWDEVICE_TYPE_NONE) {
@@ -228,18 +352,32 @@ int transcode_init(struct transcode_thread *h, input_params *inp,
     octx->audio = &params[i].audio;
     octx->video = &params[i].video;
     octx->metadata = params[i].metadata;
+    octx->id3_tags = params[i].id3_tags;
+    octx->nb_id3_tags = params[i].nb_id3_tags;
+    octx->next_id3_tag = 0;
+    octx->id3_start = ictx->ic->start_time != AV_NOPTS_VALUE ? ictx->ic->start_time : 0;
     octx->vfilters = params[i].vfilters;
     octx->sfilters = params[i].sfilters;
     octx->xcoderParams = params[i].xcoderParams;
     if (params[i].bitrate) octx->bitrate = params[i].bitrate;
+    octx->minrate = params[i].minrate;
+    octx->maxrate = params[i].maxrate;
+    octx->bufsize = params[i].bufsize;
     if (params[i].fps.den) octx->fps = params[i].fps;
     if (params[i].gop_time) octx->gop_time = params[i].gop_time;
     if (params[i].from) octx->clip_from = params[i].from;
     if (params[i].to) octx->clip_to = params[i].to;
+    octx->trim_audio = params[i].trim_audio;
     octx->dv = ictx->vi < 0 || is_drop(octx->video->name);
     octx->da = ictx->ai < 0 || is_drop(octx->audio->name);
     octx->res = &results[i];
     octx->initialized = h->initialized && (AV_HWDEVICE_TYPE_NONE != octx->hw_type || ictx->transmuxing);
+    if (octx->initialized && !ictx->transmuxing && !octx->vc && !octx->dv && ictx->vc) {
+      // a hardware session that started audio-only has no video encoder to
+      // re-attach, so the output is opened from scratch once video shows up
+      free_output(octx);
+      octx->initialized = 0;
+    }
 
     // either first segment of a GPU stream or a CPU stream
     // when transmuxing we're opening output with first segment, but closing it
@@ -327,8 +465,10 @@ int transcode(struct transcode_thread *h,
   struct output_ctx *outputs = h->outputs;
   int nb_outputs = h->nb_outputs;
   int outputs_ready = 0, hit_eof = 0;
+  int id3_rebased = 0; // whether tags follow the rebased timestamps, when transmuxing
 
   ictx->decoded_res = decoded_results;
+  decoded_results->written_start = decoded_results->written_end = AV_NOPTS_VALUE;
 
   ipkt = av_packet_alloc();
   if (!ipkt) LPMS_ERR(transcode_cleanup, "Unable to allocated packet");
@@ -336,6 +476,7 @@ int transcode(struct transcode_thread *h,
   if (!dframe) LPMS_ERR(transcode_cleanup, "Unable to allocate frame");
   frame_queue = queue_create();
   if (!frame_queue) LPMS_ERR(transcode_cleanup, "Unable to allocate audio queue");
+  ictx->start_bytes = ictx->ic->pb ? ictx->ic->pb->bytes_read : 0;
 
   while (1) {
     // DEMUXING & DECODING
@@ -365,6 +506,16 @@ int transcode(struct transcode_thread *h,
       LPMS_ERR(transcode_cleanup, "Could not decode; No keyframes in input");
     } else if (ret < 0) LPMS_ERR(transcode_cleanup, "Could not decode; stopping");
 
+    if (ret != AVERROR_EOF && !ictx->flushing && check_timestamps(ictx, ipkt)) {
+      mark_discontinuity(h);
+    }
+
+    if (ictx->max_input_bytes && ictx->ic->pb &&
+        ictx->ic->pb->bytes_read - ictx->start_bytes > ictx->max_input_bytes) {
+      ret = lpms_ERR_INPUT_SIZE;
+      LPMS_ERR(transcode_cleanup, "Input size above limit");
+    }
+
     // This is for the case when we _are_ decoding but frame is not complete yet
     // So for example multislice h.264 picture without all slices fed in.
     // IMPORTANT: this should also be false if we are transmuxing, and it is not
@@ -405,6 +556,9 @@ int transcode(struct transcode_thread *h,
         output_frame = has_frame && dframe->width && dframe->height;
       } else if (stream_index == ictx->ai) {
         output_frame = has_frame && dframe->nb_samples;
+      } else if ((ictx->id3i >= 0 && stream_index == ictx->id3i) ||
+                 (ictx->scte35i >= 0 && stream_index == ictx->scte35i)) {
+        output_frame = 0; // copied, never decoded
       }
       ret = queue_write(frame_queue, is_eof ? NULL : ipkt, output_frame ? dframe : NULL, packet_ret);
       if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to queue packet");
@@ -421,6 +575,15 @@ int transcode(struct transcode_thread *h,
 
     ist = ictx->ic->streams[stream_index];
 
+    // SCTE-35 is carried over by the caller, see scte35.go
+    if (ictx->scte35i >= 0 && stream_index == ictx->scte35i) {
+      if (ipkt->size > 0) {
+        ret = add_scte35_cue(ictx, ipkt);
+        if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to keep SCTE-35 cue");
+      }
+      goto whileloop_end;
+    }
+
     // Now apart from if (is_flush_frame(dframe)) goto whileloop_end; statement
     // this code just updates has_frame properly for video and audio, updates
     // statistics for video and ausio and sets last_frame
@@ -430,7 +593,22 @@ int transcode(struct transcode_thread *h,
       decoded_results->frames += dframe->width && dframe->height;
       decoded_results->pixels += dframe->width * dframe->height;
       has_frame = has_frame && dframe->width && dframe->height;
-      if (has_frame) last_frame = ictx->last_frame_v;
+      if (has_frame) {
+        int64_t pixels = (int64_t)dframe->width * dframe->height;
+        if ((ictx->max_width && dframe->width > ictx->max_width) ||
+            (ictx->max_height && dframe->height > ictx->max_height) ||
+            (ictx->max_pixels && pixels > ictx->max_pixels)) {
+          ret = lpms_ERR_INPUT_RES;
+          LPMS_ERR(transcode_cleanup, "Input resolution above limit");
+        }
+        if (input_framerate_exceeded(ictx, dframe, ist->time_base)) {
+          ret = lpms_ERR_INPUT_FPS;
+          LPMS_ERR(transcode_cleanup, "Input frame rate above limit");
+        }
+        ret = run_frame_hook(&ictx->hook, dframe, ist->time_base);
+        if (ret < 0) LPMS_ERR(transcode_cleanup, "Frame hook failed");
+        last_frame = ictx->last_frame_v;
+      }
     } else if (AVMEDIA_TYPE_AUDIO == ist->codecpar->codec_type) {
       has_frame = has_frame && dframe->nb_samples;
       if (has_frame) last_frame = ictx->last_frame_a;
@@ -477,6 +655,20 @@ int transcode(struct transcode_thread *h,
         if (ipkt->duration) {
           ictx->last_duration[stream_index] = ipkt->duration;
         }
+        // tags count from the start of the input, so they move along with it
+        if (!id3_rebased) {
+          int64_t shift = av_rescale_q(ictx->dts_diff[stream_index], ist->time_base, AV_TIME_BASE_Q);
+          for (int i = 0; i < nb_outputs; i++) outputs[i].id3_start += shift;
+          id3_rebased = 1;
+        }
+      }
+      if (stream_index == FFMAX(ictx->vi, 0) && AV_NOPTS_VALUE != ipkt->pts) {
+        int64_t start = av_rescale_q(ipkt->pts, ist->time_base, AV_TIME_BASE_Q);
+        int64_t end = av_rescale_q(ipkt->pts + ipkt->duration, ist->time_base, AV_TIME_BASE_Q);
+        if (AV_NOPTS_VALUE == decoded_results->written_start || start < decoded_results->written_start)
+          decoded_results->written_start = start;
+        if (AV_NOPTS_VALUE == decoded_results->written_end || end > decoded_results->written_end)
+          decoded_results->written_end = end;
       }
     }
 
@@ -504,6 +696,9 @@ int transcode(struct transcode_thread *h,
           encoder = octx->ac;
           filter = &octx->af;
         }
+      } else if (ictx->id3i >= 0 && ist->index == ictx->id3i) {
+        if (octx->id3i < 0) continue; // output can't carry timed ID3
+        ost = octx->oc->streams[octx->id3i];
       } else continue; // dropped or unrecognized stream
 
       if (!encoder && ost) {
@@ -514,6 +709,23 @@ int transcode(struct transcode_thread *h,
         // (we don't need decoded frames since this stream is doing a copy)
         if (ipkt->pts == AV_NOPTS_VALUE) continue;
 
+        if (ist->index == ictx->vi && !ictx->transmuxing) {
+          if (!octx->clip_start_pts_found) {
+            octx->clip_start_pts = ipkt->pts;
+            octx->clip_start_pts_found = 1;
+          }
+          if (octx->clip_to && ipkt->pts > octx->clip_to_pts + octx->clip_start_pts) {
+            continue;
+          }
+          if (octx->clip_from && !octx->clip_started) {
+            // copied video can only start on a keyframe
+            if (!(ipkt->flags & AV_PKT_FLAG_KEY) ||
+                ipkt->pts < octx->clip_from_pts + octx->clip_start_pts) {
+              continue;
+            }
+            octx->clip_started = 1;
+          }
+        }
         if (ist->index == ictx->ai) {
           if (!octx->clip_audio_start_pts_found) {
             octx->clip_audio_start_pts = ipkt->pts;
@@ -536,6 +748,11 @@ int transcode(struct transcode_thread *h,
         if (octx->clip_from && ist->index == ictx->ai) {
           pkt->pts -= octx->clip_audio_from_pts + octx->clip_audio_start_pts;
         }
+        if (octx->clip_from && ist->index == ictx->vi && !ictx->transmuxing) {
+          int64_t offset = octx->clip_from_pts + octx->clip_start_pts;
+          pkt->pts -= offset;
+          if (pkt->dts != AV_NOPTS_VALUE) pkt->dts -= offset;
+        }
         ret = mux(pkt, ist->time_base, octx, ost);
         av_packet_free(&pkt);
       } else if (has_frame) {
@@ -550,8 +767,19 @@ whileloop_end:
 
   if (ictx->transmuxing) {
     for (int i = 0; i < nb_outputs; i++) {
+      ret = write_id3_tags(&outputs[i], INT64_MAX); // tags timed after the last packet
+      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to write timed ID3 tags");
       av_interleaved_write_frame(outputs[i].oc, NULL); // flush muxer
     }
+    decoded_results->discontinuity = ictx->discontinuity_flags;
+    decoded_results->gap = ictx->discontinuity_gap;
+    decoded_results->cues = ictx->cues;
+    decoded_results->nb_cues = ictx->nb_cues;
+    ictx->cues = NULL;
+    ictx->nb_cues = 0;
+    if (ictx->ic && ictx->ic->start_time != AV_NOPTS_VALUE) {
+      decoded_results->start_pts = av_rescale(ictx->ic->start_time, 90000, AV_TIME_BASE);
+    }
     if (ictx->ic) {
         avformat_close_input(&ictx->ic);
         ictx->ic = NULL;
@@ -567,6 +795,15 @@ whileloop_end:
   }
 
 transcode_cleanup:
+  decoded_results->discontinuity = ictx->discontinuity_flags;
+  decoded_results->gap = ictx->discontinuity_gap;
+  decoded_results->cues = ictx->cues;
+  decoded_results->nb_cues = ictx->nb_cues;
+  ictx->cues = NULL;
+  ictx->nb_cues = 0;
+  if (ictx->ic && ictx->ic->start_time != AV_NOPTS_VALUE) {
+    decoded_results->start_pts = av_rescale(ictx->ic->start_time, 90000, AV_TIME_BASE);
+  }
   ictx->decoded_res = NULL;
   if (dframe) av_frame_free(&dframe);
   if (ipkt) av_packet_free(&ipkt);  // needed for early exits
@@ -576,7 +813,7 @@ transcode_cleanup:
 
 // MA: this should probably be merged with transcode_init, as it basically is a
 // part of initialization
-int lpms_transcode(input_params *inp, output_params *params,
+static int run_transcode(input_params *inp, output_params *params,
   output_results *results, int nb_outputs, output_results *decoded_results)
 {
   int ret = 0;
@@ -638,9 +875,25 @@ int lpms_transcode(input_params *inp, output_params *params,
   return ret;
 }
 
+int lpms_transcode(input_params *inp, output_params *params,
+  output_results *results, int nb_outputs, output_results *decoded_results)
+{
+  // tie messages logged while transcoding to the session
+  lpms_log_set_session(inp->log_session);
+  int ret = run_transcode(inp, params, results, nb_outputs, decoded_results);
+  lpms_log_set_session(0);
+  return ret;
+}
+
 int lpms_transcode_reopen_demux(input_params *inp) {
-  free_input(&inp->handle->ictx);
-  return open_input(inp, &inp->handle->ictx);
+  lpms_log_set_session(inp->log_session);
+  struct input_ctx *ictx = &inp->handle->ictx;
+  free_input(ictx);
+  int ret = open_input(inp, ictx);
+  // the decoder now matches the input
+  if (!ret && ictx->vi >= 0) ictx->last_format = ictx->ic->streams[ictx->vi]->codecpar->format;
+  lpms_log_set_session(0);
+  return ret;
 }
 
 struct transcode_thread* lpms_transcode_new() {
@@ -649,6 +902,9 @@ struct transcode_thread* lpms_transcode_new() {
   memset(h, 0, sizeof *h);
   // initialize video stream pixel format.
   h->ictx.last_format = AV_PIX_FMT_NONE;
+  h->ictx.id3i = -1;
+  h->ictx.scte35i = -1;
+  for (int i = 0; i < 2; i++) h->ictx.ts_last[i] = h->ictx.ts_end[i] = AV_NOPTS_VALUE;
   // keep track of last dts in each stream.
   // used while transmuxing, to skip packets with invalid dts.
   for (int i = 0; i < MAX_OUTPUT_SIZE; i++) {
@@ -678,7 +934,12 @@ void lpms_transcode_stop(struct transcode_thread *handle) {
 void lpms_transcode_discontinuity(struct transcode_thread *handle) {
   if (!handle)
     return;
-  for (int i = 0; i < MAX_OUTPUT_SIZE; i++) {
-    handle->ictx.discontinuity[i] = 1;
-  }
+  mark_discontinuity(handle);
+  handle->ictx.manual_discontinuity = 1;
+}
+
+void lpms_scte35_free(output_results *res) {
+  if (!res)
+    return;
+  free_scte35_cues(&res->cues, &res->nb_cues);
 }
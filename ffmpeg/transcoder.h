@@ -18,6 +18,9 @@ extern const int lpms_ERR_FILTER_FLUSHED;
 extern const int lpms_ERR_OUTPUTS;
 extern const int lpms_ERR_UNRECOVERABLE;
 extern const int lpms_ERR_ENC_RUNAWAY;
+extern const int lpms_ERR_INPUT_RES;
+extern const int lpms_ERR_INPUT_SIZE;
+extern const int lpms_ERR_INPUT_FPS;
 
 struct transcode_thread;
 
@@ -26,17 +29,35 @@ typedef struct {
     AVDictionary *opts;
 } component_opts;
 
+// Timed ID3 tag, at pts AV_TIME_BASE units from the start of the input
+typedef struct {
+  int64_t pts;
+  uint8_t *data;
+  int size;
+} id3_tag;
+
+// SCTE-35 splice_info_section demuxed from the input, at pts in 90kHz
+typedef struct {
+  int64_t pts;
+  uint8_t *data;
+  int size;
+} scte35_cue;
+
 typedef struct {
   char *fname;
   char *vfilters;
   char *sfilters;
   int w, h, bitrate, gop_time, from, to;
+  int minrate, maxrate, bufsize; // VBV settings; zero means unset
   AVRational fps;
   char *xcoderParams;
   component_opts muxer;
   component_opts audio;
   component_opts video;
   AVDictionary *metadata;
+  id3_tag *id3_tags;        // in order of pts; mpegts outputs only
+  int nb_id3_tags;
+  int trim_audio;           // clip encoded audio to the sample, see filter.c
 } output_params;
 
 typedef struct {
@@ -58,8 +79,30 @@ typedef struct {
   // Optional video decoder + opts
   component_opts video;
 
+  // Optional audio stream selection. Picks the first audio stream tagged
+  // with `audio_lang` if set, otherwise the `audio_track`th audio stream.
+  // A negative `audio_track` picks the best audio stream.
+  int audio_track;
+  char *audio_lang;
+
+  // Optional Go frame hook, see hook.go. Zero disables it.
+  uintptr_t frame_hook;
+  int hook_w, hook_h;       // size of read-only frames; zero keeps decoded size
+  int hook_interval;        // run for every nth decoded frame, at least 1
+  int hook_writable;        // hand over the decoded frame itself
+
   // concatenates multiple inputs into the same output
   int transmuxing;
+
+  // Session messages logged during the call belong to; zero for none
+  uint64_t log_session;
+
+  // Resource limits, see limits.go. Zero is unlimited.
+  int max_width, max_height;
+  int64_t max_pixels;
+  int max_frame_ratio;      // encoded frames per decoded frame, per output
+  int64_t max_input_bytes;  // bytes read from the input per call
+  double max_framerate;     // decoded video frames per second
 } input_params;
 
 #define MAX_CLASSIFY_SIZE 10
@@ -68,8 +111,29 @@ typedef struct {
 typedef struct {
     int frames;
     int64_t pixels;
+    // Decoded results only: discontinuities with the previous call of the
+    // session as LPMS_DISCONT_* flags, and the gap between the end of the
+    // previous input and the start of this one in AV_TIME_BASE units
+    int discontinuity;
+    int64_t gap;
+    // Decoded results only: SCTE-35 cues of the input in demuxing order,
+    // freed with lpms_scte35_free, and the start of the input in 90kHz
+    scte35_cue *cues;
+    int nb_cues;
+    int64_t start_pts;
+    // Decoded results only, when transmuxing: the span of the timestamps
+    // written for the video stream, or the first stream without video, after
+    // rebasing. AV_TIME_BASE units, AV_NOPTS_VALUE if nothing was written.
+    int64_t written_start, written_end;
 } output_results;
 
+enum LPMSDiscontinuity {
+  LPMS_DISCONT_MANUAL     = 1,  // lpms_transcode_discontinuity was called
+  LPMS_DISCONT_JUMP       = 2,  // timestamps jumped forward
+  LPMS_DISCONT_BACKWARDS  = 4,  // timestamps went backwards
+  LPMS_DISCONT_CODEC      = 8,  // codec parameters changed
+};
+
 enum LPMSLogLevel {
   LPMS_LOG_TRACE    = AV_LOG_TRACE,
   LPMS_LOG_DEBUG    = AV_LOG_DEBUG,
@@ -88,5 +152,6 @@ int lpms_transcode_reopen_demux(input_params *inp);
 struct transcode_thread* lpms_transcode_new();
 void lpms_transcode_stop(struct transcode_thread* handle);
 void lpms_transcode_discontinuity(struct transcode_thread *handle);
+void lpms_scte35_free(output_results *res);
 
 #endif // _LPMS_TRANSCODER_H_
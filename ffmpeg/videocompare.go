@@ -0,0 +1,216 @@
+package ffmpeg
+
+import (
+	"math"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include "extras.h"
+import "C"
+
+// DefaultVideoCompareTolerance is the mean luma difference, out of 255, up to
+// which frames are considered the same if no tolerance is given. Encodes of
+// the same rendition stay well below it, different pictures go well above.
+const DefaultVideoCompareTolerance = 8.0
+
+// VideoCompareOptions tunes the perceptual video comparison.
+type VideoCompareOptions struct {
+	// Largest mean luma difference, out of 255, for two frames to be
+	// considered the same. Zero uses DefaultVideoCompareTolerance.
+	Tolerance float64
+	// Fraction of frames that may differ or lack a counterpart in the other
+	// video while the videos still match. Zero requires every frame to match.
+	MaxMismatch float64
+}
+
+// FrameComparison is the distance of a frame of the first video to the frame
+// shown at the same time in the second one.
+type FrameComparison struct {
+	// Presentation time, relative to the first frame of the video
+	Time time.Duration
+	// Mean luma difference out of 255, or -1 if the second video has no
+	// frame at that time
+	Distance float64
+}
+
+// VideoComparison is the outcome of a perceptual video comparison.
+type VideoComparison struct {
+	// Overall verdict
+	Match bool
+	// Frames of the first video in presentation order
+	Frames []FrameComparison
+	// Mean and largest distance of frames with a counterpart
+	MeanDistance float64
+	MaxDistance  float64
+	// Frames above the tolerance
+	Mismatched int
+	// Frames of either video without a counterpart in the other
+	Unmatched int
+}
+
+type videoFingerprint struct {
+	times []float64 // seconds
+	luma  [][]byte
+}
+
+// compare two video files, decoding both and matching their frames by luma
+// fingerprints rather than by packet contents
+func CompareVideoPerceptualByPath(fname1 string, fname2 string, opts VideoCompareOptions) (*VideoComparison, error) {
+	fp1, err := fingerprintVideo(fname1, nil)
+	if err != nil {
+		return nil, err
+	}
+	fp2, err := fingerprintVideo(fname2, nil)
+	if err != nil {
+		return nil, err
+	}
+	return compareFingerprints(fp1, fp2, opts), nil
+}
+
+// compare two video buffers, decoding both and matching their frames by luma
+// fingerprints rather than by packet contents
+func CompareVideoPerceptualByBuffer(data1 []byte, data2 []byte, opts VideoCompareOptions) (*VideoComparison, error) {
+	fp1, err := fingerprintVideo("", data1)
+	if err != nil {
+		return nil, err
+	}
+	fp2, err := fingerprintVideo("", data2)
+	if err != nil {
+		return nil, err
+	}
+	return compareFingerprints(fp1, fp2, opts), nil
+}
+
+func fingerprintVideo(fname string, data []byte) (*videoFingerprint, error) {
+	var (
+		cfname  *C.char
+		pbuffer unsafe.Pointer
+		cfp     C.video_fingerprint
+	)
+	if data != nil {
+		if len(data) <= 0 {
+			return nil, ErrVideoCompare
+		}
+		// the buffer is only read during the call, so Go memory is fine
+		pbuffer = unsafe.Pointer(&data[0])
+	} else {
+		if len(fname) <= 0 {
+			return nil, ErrVideoCompare
+		}
+		cfname = C.CString(fname)
+		defer C.free(unsafe.Pointer(cfname))
+	}
+	ret := int(C.lpms_video_fingerprint(cfname, pbuffer, C.int(len(data)), &cfp))
+	if ret < 0 {
+		return nil, ErrVideoCompare
+	}
+	defer C.lpms_video_fingerprint_free(&cfp)
+
+	n := int(cfp.nb_frames)
+	size := C.FINGERPRINT_SIZE * C.FINGERPRINT_SIZE
+	fp := &videoFingerprint{times: make([]float64, n), luma: make([][]byte, n)}
+	if n == 0 {
+		return fp, nil
+	}
+	times := (*[1 << 28]C.double)(unsafe.Pointer(cfp.times))[:n:n]
+	luma := (*[1 << 30]byte)(unsafe.Pointer(cfp.luma))[: n*size : n*size]
+	for i := 0; i < n; i++ {
+		fp.times[i] = float64(times[i])
+		fp.luma[i] = append([]byte(nil), luma[i*size:(i+1)*size]...)
+	}
+	// decoders emit frames in presentation order, except around timestamp glitches
+	sort.Sort(fp)
+	return fp, nil
+}
+
+func (fp *videoFingerprint) Len() int           { return len(fp.times) }
+func (fp *videoFingerprint) Less(i, j int) bool { return fp.times[i] < fp.times[j] }
+func (fp *videoFingerprint) Swap(i, j int) {
+	fp.times[i], fp.times[j] = fp.times[j], fp.times[i]
+	fp.luma[i], fp.luma[j] = fp.luma[j], fp.luma[i]
+}
+
+// Mean time between frames, in seconds
+func (fp *videoFingerprint) interval() float64 {
+	n := len(fp.times)
+	if n < 2 {
+		return 0
+	}
+	return (fp.times[n-1] - fp.times[0]) / float64(n-1)
+}
+
+func lumaDistance(a, b []byte) float64 {
+	sum := 0
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(a))
+}
+
+// Pairs every frame of the first video with the frame of the second video
+// shown closest to the same time, counting from the first frame of each so
+// differing start times don't matter. Frames further apart than half a frame
+// interval have no counterpart.
+func compareFingerprints(fp1, fp2 *videoFingerprint, opts VideoCompareOptions) *VideoComparison {
+	tolerance := opts.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultVideoCompareTolerance
+	}
+	c := &VideoComparison{Frames: make([]FrameComparison, len(fp1.times))}
+	if len(fp1.times) == 0 || len(fp2.times) == 0 {
+		c.Unmatched = len(fp1.times) + len(fp2.times)
+		for i := range c.Frames {
+			c.Frames[i] = FrameComparison{Time: seconds(fp1.times[i] - fp1.times[0]), Distance: -1}
+		}
+		return c
+	}
+	window := math.Max(fp1.interval(), fp2.interval()) / 2
+	start1, start2 := fp1.times[0], fp2.times[0]
+	used := make([]bool, len(fp2.times))
+	paired, total := 0, 0.0
+	j := 0
+	for i, t := range fp1.times {
+		t -= start1
+		// move to the frame of the second video closest in time
+		for j+1 < len(fp2.times) && math.Abs(fp2.times[j+1]-start2-t) <= math.Abs(fp2.times[j]-start2-t) {
+			j++
+		}
+		c.Frames[i] = FrameComparison{Time: seconds(t), Distance: -1}
+		if used[j] || math.Abs(fp2.times[j]-start2-t) > window+1e-6 {
+			c.Unmatched++
+			continue
+		}
+		used[j] = true
+		d := lumaDistance(fp1.luma[i], fp2.luma[j])
+		c.Frames[i].Distance = d
+		paired++
+		total += d
+		if d > c.MaxDistance {
+			c.MaxDistance = d
+		}
+		if d > tolerance {
+			c.Mismatched++
+		}
+	}
+	c.Unmatched += len(fp2.times) - paired
+	if paired > 0 {
+		c.MeanDistance = total / float64(paired)
+	}
+	frames := len(fp1.times)
+	if len(fp2.times) > frames {
+		frames = len(fp2.times)
+	}
+	c.Match = paired > 0 && float64(c.Mismatched+c.Unmatched) <= opts.MaxMismatch*float64(frames)
+	return c
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
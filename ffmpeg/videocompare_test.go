@@ -0,0 +1,134 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVideoCompare_Perceptual(t *testing.T) {
+	_, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// The same rendition from differently configured encoders, a smaller
+	// rendition and the first second only
+	in := &TranscodeOptionsIn{Fname: "../transcoder/test.ts"}
+	lowrate := P360p30fps16x9
+	lowrate.Bitrate = "300k"
+	out := []TranscodeOptions{{
+		Oname:   filepath.Join(dir, "a.ts"),
+		Profile: P360p30fps16x9,
+	}, {
+		Oname:        filepath.Join(dir, "b.ts"),
+		Profile:      lowrate,
+		VideoEncoder: ComponentOptions{Opts: map[string]string{"preset": "ultrafast"}},
+	}, {
+		Oname:   filepath.Join(dir, "c.ts"),
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   filepath.Join(dir, "d.ts"),
+		Profile: P360p30fps16x9,
+		To:      time.Second,
+	}}
+	_, err := Transcode3(in, out)
+	require.NoError(t, err)
+	a, b, c, d := out[0].Oname, out[1].Oname, out[2].Oname, out[3].Oname
+
+	res, err := CompareVideoPerceptualByPath(a, b, VideoCompareOptions{})
+	require.NoError(t, err)
+	assert.True(t, res.Match)
+	assert.Zero(t, res.Unmatched)
+	assert.Zero(t, res.Mismatched)
+	assert.NotZero(t, res.MeanDistance)
+	assert.True(t, res.MaxDistance <= DefaultVideoCompareTolerance)
+	require.NotEmpty(t, res.Frames)
+	assert.Equal(t, time.Duration(0), res.Frames[0].Time)
+	for i, f := range res.Frames[1:] {
+		assert.True(t, f.Time > res.Frames[i].Time)
+		assert.True(t, f.Distance >= 0)
+	}
+	// the packet based comparison rejects a smaller rendition of the same video
+	data1, err := ioutil.ReadFile(a)
+	require.NoError(t, err)
+	data2, err := ioutil.ReadFile(c)
+	require.NoError(t, err)
+	match, err := CompareVideoByBuffer(data1, data2)
+	assert.NoError(t, err)
+	assert.False(t, match)
+	res, err = CompareVideoPerceptualByBuffer(data1, data2, VideoCompareOptions{})
+	require.NoError(t, err)
+	assert.True(t, res.Match)
+
+	// frames past the first second have no counterpart
+	res, err = CompareVideoPerceptualByPath(a, d, VideoCompareOptions{})
+	require.NoError(t, err)
+	assert.False(t, res.Match)
+	assert.NotZero(t, res.Unmatched)
+	assert.Zero(t, res.Mismatched)
+	assert.Equal(t, float64(-1), res.Frames[len(res.Frames)-1].Distance)
+	res, err = CompareVideoPerceptualByPath(a, d, VideoCompareOptions{MaxMismatch: 1})
+	require.NoError(t, err)
+	assert.True(t, res.Match)
+
+	// a tolerance below the coding noise rejects every frame
+	res, err = CompareVideoPerceptualByPath(a, b, VideoCompareOptions{Tolerance: 0.001})
+	require.NoError(t, err)
+	assert.False(t, res.Match)
+	assert.NotZero(t, res.Mismatched)
+
+	_, err = CompareVideoPerceptualByPath(a, filepath.Join(dir, "missing.ts"), VideoCompareOptions{})
+	assert.Equal(t, ErrVideoCompare, err)
+	_, err = CompareVideoPerceptualByBuffer(data1, []byte{}, VideoCompareOptions{})
+	assert.Equal(t, ErrVideoCompare, err)
+	_, err = CompareVideoPerceptualByPath(a, "../data/audio.mp3", VideoCompareOptions{})
+	assert.Equal(t, ErrVideoCompare, err)
+}
+
+func TestVideoCompare_Fingerprints(t *testing.T) {
+	frame := func(v byte) []byte {
+		b := make([]byte, 16)
+		for i := range b {
+			b[i] = v
+		}
+		return b
+	}
+	fp1 := &videoFingerprint{
+		times: []float64{10, 10.25, 10.5, 10.75},
+		luma:  [][]byte{frame(10), frame(20), frame(30), frame(40)},
+	}
+	// different start time, a little jitter, a different picture at 0.5s
+	// and a missing frame at 0.75s
+	fp2 := &videoFingerprint{
+		times: []float64{1.5, 1.7578125, 2},
+		luma:  [][]byte{frame(12), frame(20), frame(90)},
+	}
+	res := compareFingerprints(fp1, fp2, VideoCompareOptions{})
+	assert.False(t, res.Match)
+	assert.Equal(t, []FrameComparison{
+		{Time: 0, Distance: 2},
+		{Time: 250 * time.Millisecond, Distance: 0},
+		{Time: 500 * time.Millisecond, Distance: 60},
+		{Time: 750 * time.Millisecond, Distance: -1},
+	}, res.Frames)
+	assert.Equal(t, 1, res.Mismatched)
+	assert.Equal(t, 1, res.Unmatched)
+	assert.Equal(t, float64(60), res.MaxDistance)
+	assert.Equal(t, float64(62)/3, res.MeanDistance)
+
+	res = compareFingerprints(fp1, fp2, VideoCompareOptions{MaxMismatch: 0.5})
+	assert.True(t, res.Match)
+	res = compareFingerprints(fp1, fp2, VideoCompareOptions{Tolerance: 60, MaxMismatch: 0.25})
+	assert.True(t, res.Match)
+	res = compareFingerprints(fp1, fp2, VideoCompareOptions{Tolerance: 1, MaxMismatch: 0.25})
+	assert.False(t, res.Match)
+
+	// nothing decoded
+	res = compareFingerprints(fp1, &videoFingerprint{}, VideoCompareOptions{MaxMismatch: 1})
+	assert.False(t, res.Match)
+	assert.Equal(t, 4, res.Unmatched)
+}
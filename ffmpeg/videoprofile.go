@@ -15,6 +15,7 @@ import "C"
 
 var ErrProfName = fmt.Errorf("unknown VideoProfile profile name")
 var ErrCodecName = fmt.Errorf("unknown codec name")
+var ErrRateControlName = fmt.Errorf("unknown rate control name")
 
 type Format int
 
@@ -43,6 +44,35 @@ var EncoderProfileLookup = map[string]Profile{
 	"h264constrainedhigh": ProfileH264ConstrainedHigh,
 }
 
+// RateControl selects how the encoder distributes bits across the output.
+// Modes other than the default also apply on top of custom encoder options,
+// which must not set the options of the mode to something else.
+type RateControl int
+
+const (
+	// Legacy behaviour: Bitrate is used as min, avg and max bitrate and
+	// Quality (if set) toggles CRF / CQ.
+	RateControlDefault RateControl = iota
+	// Constant bitrate. Bitrate is the target; BufferSize sizes the VBV.
+	RateControlCBR
+	// Variable bitrate. Bitrate is the average, MaxBitrate caps the peak.
+	RateControlVBR
+	// Constant quality (CRF / CQ) taken from Quality, with the peak capped
+	// by MaxBitrate (or Bitrate if MaxBitrate is unset).
+	RateControlCappedCRF
+	// Constant quantizer taken from Quality; bitrates are ignored.
+	RateControlCQP
+)
+
+var RateControlLookup = map[string]RateControl{
+	"":          RateControlDefault,
+	"default":   RateControlDefault,
+	"cbr":       RateControlCBR,
+	"vbr":       RateControlVBR,
+	"cappedcrf": RateControlCappedCRF,
+	"cqp":       RateControlCQP,
+}
+
 // For additional "special" GOP values
 // enumerate backwards from here
 const (
@@ -102,6 +132,12 @@ type VideoProfile struct {
 	// If set, then constant rate factor is used instead of constant bitrate
 	// If both Quality and Bitrate are set, then Bitrate is used only as max bitrate
 	Quality uint
+	// RateControl selects the rate control mode; see the RateControl* consts.
+	// MaxBitrate and BufferSize use the same notation as Bitrate ("6000k")
+	// and set the VBV peak rate and buffer size respectively.
+	RateControl RateControl
+	MaxBitrate  string
+	BufferSize  string
 }
 
 // Some sample video profiles
@@ -176,7 +212,11 @@ func VideoProfileToVariantParams(p VideoProfile) m3u8.VariantParams {
 	r := p.Resolution
 	r = strings.Replace(r, ":", "x", 1)
 
+	// BANDWIDTH is the peak rate, so advertise the VBV cap when there is one
 	bw := p.Bitrate
+	if p.MaxBitrate != "" {
+		bw = p.MaxBitrate
+	}
 	bw = strings.Replace(bw, "k", "000", 1)
 	b, err := strconv.ParseUint(bw, 10, 32)
 	if err != nil {
@@ -185,6 +225,25 @@ func VideoProfileToVariantParams(p VideoProfile) m3u8.VariantParams {
 	return m3u8.VariantParams{Bandwidth: uint32(b), Resolution: r}
 }
 
+// AudioRenditionToAlternative describes an audio-only rendition as an
+// EXT-X-MEDIA entry within an HLS audio group. Variants reference the group
+// by setting VariantParams.Audio to the same group ID.
+func AudioRenditionToAlternative(groupID, name, lang, uri string, isDefault bool) *m3u8.Alternative {
+	autoselect := "NO"
+	if isDefault {
+		autoselect = "YES"
+	}
+	return &m3u8.Alternative{
+		GroupId:    groupID,
+		URI:        uri,
+		Type:       "AUDIO",
+		Language:   lang,
+		Name:       name,
+		Default:    isDefault,
+		Autoselect: autoselect,
+	}
+}
+
 type ByName []VideoProfile
 
 func (a ByName) Len() int      { return len(a) }
@@ -207,6 +266,14 @@ func EncoderProfileNameToValue(profile string) (Profile, error) {
 	return p, nil
 }
 
+func RateControlNameToValue(rc string) (RateControl, error) {
+	r, ok := RateControlLookup[strings.ToLower(rc)]
+	if !ok {
+		return -1, ErrRateControlName
+	}
+	return r, nil
+}
+
 func CodecNameToValue(encoder string) (VideoCodec, error) {
 	if encoder == "" {
 		return H264, nil
@@ -236,6 +303,9 @@ type JsonProfile struct {
 	ColorDepth   ColorDepthBits    `json:"colorDepth"`
 	ChromaFormat ChromaSubsampling `json:"chromaFormat"`
 	Quality      uint              `json:"quality"`
+	RateControl  string            `json:"rateControl"`
+	MaxBitrate   int               `json:"maxBitrate"`
+	BufferSize   int               `json:"bufferSize"`
 }
 
 func ParseProfilesFromJsonProfileArray(profiles []JsonProfile) ([]VideoProfile, error) {
@@ -269,6 +339,17 @@ func ParseProfilesFromJsonProfileArray(profiles []JsonProfile) ([]VideoProfile,
 		if err != nil {
 			return parsedProfiles, fmt.Errorf("Unable to parse encoder profile, unknown encoder: %s %w", profile.Encoder, err)
 		}
+		rateControl, err := RateControlNameToValue(profile.RateControl)
+		if err != nil {
+			return parsedProfiles, fmt.Errorf("unable to parse rate control mode %s: %w", profile.RateControl, err)
+		}
+		var maxBitrate, bufferSize string
+		if profile.MaxBitrate > 0 {
+			maxBitrate = fmt.Sprint(profile.MaxBitrate)
+		}
+		if profile.BufferSize > 0 {
+			bufferSize = fmt.Sprint(profile.BufferSize)
+		}
 		prof := VideoProfile{
 			Name:         name,
 			Bitrate:      fmt.Sprint(profile.Bitrate),
@@ -282,6 +363,9 @@ func ParseProfilesFromJsonProfileArray(profiles []JsonProfile) ([]VideoProfile,
 			// profile.ChromaFormat of 0 is default ChromaSubsampling420
 			ChromaFormat: profile.ChromaFormat,
 			Quality:      profile.Quality,
+			RateControl:  rateControl,
+			MaxBitrate:   maxBitrate,
+			BufferSize:   bufferSize,
 		}
 		parsedProfiles = append(parsedProfiles, prof)
 	}
@@ -0,0 +1,200 @@
+// Package mpegts has the MPEG-TS packet and PMT handling shared by the
+// packages that rewrite segments: tsrepair, encryption and scte35. Packets
+// are taken as byte slices of PacketSize bytes, starting with the sync byte.
+package mpegts
+
+import "github.com/livepeer/joy4/format/ts/tsio"
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+	NullPID    = 0x1fff
+)
+
+// PID of the packet
+func PID(b []byte) uint16 {
+	return uint16(b[1]&0x1f)<<8 | uint16(b[2])
+}
+
+// Start is whether the packet starts a PES packet or a section.
+func Start(b []byte) bool {
+	return b[1]&0x40 != 0
+}
+
+// HasPayload is whether the packet carries payload.
+func HasPayload(b []byte) bool {
+	return b[3]&0x10 != 0
+}
+
+// Payload of the packet, nil if it has none or its header is broken
+func Payload(b []byte) []byte {
+	_, _, _, hdrlen, err := tsio.ParseTSHeader(b)
+	if err != nil || !HasPayload(b) || hdrlen >= PacketSize {
+		return nil
+	}
+	return b[hdrlen:]
+}
+
+// AdaptationField of the packet without the stuffing bytes, from the flags
+// on. Nil if the packet has none.
+func AdaptationField(b []byte) []byte {
+	if b[3]&0x20 == 0 || b[4] == 0 {
+		return nil
+	}
+	af := b[5:]
+	if int(b[4]) < len(af) {
+		af = af[:b[4]]
+	}
+	flags := af[0]
+	n := 1
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(af) { // private data
+		n += 1 + int(af[n])
+	}
+	if flags&0x01 != 0 && n < len(af) { // extension
+		n += 1 + int(af[n])
+	}
+	if n > len(af) {
+		return af
+	}
+	return af[:n]
+}
+
+// Discontinuity is whether the adaptation field of the packet signals a
+// discontinuity.
+func Discontinuity(b []byte) bool {
+	af := AdaptationField(b)
+	return len(af) > 0 && af[0]&0x80 != 0
+}
+
+// NewPacket builds a packet carrying the adaptation field af, without
+// stuffing, and as much of payload as fits. Returns the packet and the
+// payload bytes it holds. The continuity counter is left at zero.
+func NewPacket(pid uint16, start bool, af, payload []byte) ([]byte, int) {
+	b := make([]byte, PacketSize)
+	b[0] = SyncByte
+	b[1] = byte(pid>>8) & 0x1f
+	b[2] = byte(pid)
+	if start {
+		b[1] |= 0x40
+	}
+	room := PacketSize - 4
+	if len(af) > 0 {
+		room -= 1 + len(af)
+	}
+	n := len(payload)
+	if n > room {
+		n = room
+	}
+	if n > 0 {
+		b[3] = 0x10
+	}
+	if len(af) == 0 && n == PacketSize-4 {
+		copy(b[4:], payload[:n])
+		return b, n
+	}
+	// adaptation field with stuffing up to the payload
+	b[3] |= 0x20
+	aflen := PacketSize - 5 - n
+	b[4] = byte(aflen)
+	if aflen > 0 {
+		copy(b[5:], af)
+		for i := 5 + len(af); i < 5+aflen; i++ {
+			b[i] = 0xff
+		}
+		if len(af) == 0 {
+			b[5] = 0
+		}
+	}
+	copy(b[5+aflen:], payload[:n])
+	return b, n
+}
+
+// Section starting in the payload of a packet that begins one, nil if the
+// packet doesn't or the section doesn't fit.
+func Section(b []byte) []byte {
+	p := Payload(b)
+	if !Start(b) || len(p) < 4 || 1+int(p[0])+3 > len(p) {
+		return nil
+	}
+	p = p[1+int(p[0]):]
+	n := 3 + (int(p[1]&0x0f)<<8 | int(p[2]))
+	if n > len(p) {
+		return nil
+	}
+	return p[:n]
+}
+
+// CRC32 is the MPEG-2 CRC-32 of b. Sections including their CRC come out
+// as zero.
+func CRC32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, c := range b {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Stream is an elementary stream entry of a PMT.
+type Stream struct {
+	Type byte
+	PID  uint16
+	// Descriptors of the stream
+	Info []byte
+}
+
+// ProgramInfo is the program descriptors of the PMT section.
+func ProgramInfo(sec []byte) []byte {
+	return sec[12 : 12+(int(sec[10]&0x0f)<<8|int(sec[11]))]
+}
+
+// Streams of the PMT section, up to the first broken entry
+func Streams(sec []byte) []Stream {
+	var streams []Stream
+	n := 12 + len(ProgramInfo(sec))
+	for n+5 <= len(sec)-4 {
+		l := int(sec[n+3]&0x0f)<<8 | int(sec[n+4])
+		if n+5+l > len(sec)-4 {
+			break
+		}
+		streams = append(streams, Stream{
+			Type: sec[n],
+			PID:  uint16(sec[n+1]&0x1f)<<8 | uint16(sec[n+2]),
+			Info: sec[n+5 : n+5+l],
+		})
+		n += 5 + l
+	}
+	return streams
+}
+
+// NewPMT builds a PMT section like sec with the program descriptors and
+// streams replaced, with its length and CRC updated to match.
+func NewPMT(sec, info []byte, streams []Stream) []byte {
+	out := append([]byte{}, sec[:10]...)
+	out = append(out, 0xf0|byte(len(info)>>8), byte(len(info)))
+	out = append(out, info...)
+	for _, s := range streams {
+		out = append(out, s.Type, 0xe0|byte(s.PID>>8), byte(s.PID), 0xf0|byte(len(s.Info)>>8), byte(len(s.Info)))
+		out = append(out, s.Info...)
+	}
+	n := len(out) + 4 - 3
+	out[1] = out[1]&0xf0 | byte(n>>8)
+	out[2] = byte(n)
+	crc := CRC32(out)
+	return append(out, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
@@ -0,0 +1,95 @@
+package mpegts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPacket(t *testing.T) {
+	assert := assert.New(t)
+
+	// payload filling the packet, no adaptation field
+	payload := make([]byte, 300)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	b, n := NewPacket(0x100, true, nil, payload)
+	assert.Len(b, PacketSize)
+	assert.Equal(PacketSize-4, n)
+	assert.Equal(uint16(0x100), PID(b))
+	assert.True(Start(b))
+	assert.Nil(AdaptationField(b))
+	assert.Equal(payload[:n], Payload(b))
+
+	// adaptation field with PCR and the discontinuity flag, stuffed up to a
+	// short payload
+	af := []byte{0x90, 1, 2, 3, 4, 5, 6}
+	b, n = NewPacket(0x1ffe, false, af, payload[:10])
+	assert.Equal(10, n)
+	assert.Equal(uint16(0x1ffe), PID(b))
+	assert.False(Start(b))
+	assert.Equal(af, AdaptationField(b))
+	assert.True(Discontinuity(b))
+	assert.Equal(payload[:10], Payload(b))
+
+	// no payload at all
+	b, n = NewPacket(0x101, false, af, nil)
+	assert.Equal(0, n)
+	assert.False(HasPayload(b))
+	assert.Nil(Payload(b))
+}
+
+func TestSection(t *testing.T) {
+	assert := assert.New(t)
+
+	// PAT of program 1 on PID 0x1000
+	sec := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}
+	crc := CRC32(sec)
+	sec = append(sec, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	assert.Equal(uint32(0x2ab104b2), crc)
+	assert.Equal(uint32(0), CRC32(sec))
+
+	b, _ := NewPacket(0, true, nil, append([]byte{0}, sec...))
+	assert.Equal(sec, Section(b))
+
+	// not starting a section
+	b, _ = NewPacket(0, false, nil, append([]byte{0}, sec...))
+	assert.Nil(Section(b))
+
+	// section longer than the packet
+	b, _ = NewPacket(0, true, nil, append([]byte{0}, sec[:8]...))
+	assert.Nil(Section(b))
+}
+
+func TestPMT(t *testing.T) {
+	assert := assert.New(t)
+
+	// program 1 with PCR on 0x100, an H.264 stream with a descriptor and an
+	// AAC stream
+	sec := NewPMT([]byte{0x02, 0xb0, 0, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00}, []byte{0x05, 4, 'C', 'U', 'E', 'I'}, []Stream{
+		{Type: 0x1b, PID: 0x100, Info: []byte{0x0f, 4, 'z', 'a', 'v', 'c'}},
+		{Type: 0x0f, PID: 0x101},
+	})
+	assert.Equal(uint32(0), CRC32(sec))
+	assert.Equal(len(sec)-3, int(sec[1]&0x0f)<<8|int(sec[2]))
+	assert.Equal([]byte{0x05, 4, 'C', 'U', 'E', 'I'}, ProgramInfo(sec))
+	streams := Streams(sec)
+	assert.Len(streams, 2)
+	assert.Equal(Stream{Type: 0x1b, PID: 0x100, Info: []byte{0x0f, 4, 'z', 'a', 'v', 'c'}}, streams[0])
+	assert.Equal(uint16(0x101), streams[1].PID)
+	assert.Empty(streams[1].Info)
+
+	sec = NewPMT(sec, ProgramInfo(sec), append(streams, Stream{Type: 0x86, PID: 0x1ff}))
+	assert.Equal(uint32(0), CRC32(sec))
+	assert.Equal(len(sec)-3, int(sec[1]&0x0f)<<8|int(sec[2]))
+	assert.Equal([]byte{0x05, 4, 'C', 'U', 'E', 'I'}, ProgramInfo(sec))
+	streams = Streams(sec)
+	assert.Len(streams, 3)
+	assert.Equal(byte(0x86), streams[2].Type)
+	assert.Equal(uint16(0x1ff), streams[2].PID)
+
+	// fits in a packet
+	b, _ := NewPacket(0x1000, true, nil, append([]byte{0}, sec...))
+	assert.Equal(sec, Section(b))
+}
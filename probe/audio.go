@@ -0,0 +1,110 @@
+package probe
+
+// Details of the header of an audio frame
+type audioHeader struct {
+	codec      string
+	sampleRate int
+	channels   int
+	// Bytes and samples in the frame
+	size, samples int
+}
+
+// Bitrates in kbit/s of MPEG-1 layers 1 to 3, and of MPEG-2 layer 1 and of
+// layers 2 and 3, by bitrate index
+var mpegAudioBitrates = [5][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegAudioSampleRates = [3]int{44100, 48000, 32000}
+
+// Parses the header of an MPEG audio frame
+func parseMPEGAudioHeader(b []byte) (audioHeader, bool) {
+	var h audioHeader
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	version := b[1] >> 3 & 0x03 // 3 for MPEG-1, 2 for MPEG-2, 0 for MPEG-2.5
+	layer := 4 - int(b[1]>>1&0x03)
+	bitrate := int(b[2] >> 4)
+	rate := int(b[2] >> 2 & 0x03)
+	if version == 1 || layer == 4 || bitrate == 0 || bitrate == 15 || rate == 3 {
+		return h, false
+	}
+	h.codec = []string{"", "mp1", "mp2", "mp3"}[layer]
+	h.sampleRate = mpegAudioSampleRates[rate]
+	table := layer - 1
+	switch version {
+	case 2:
+		h.sampleRate /= 2
+		table = 3
+	case 0:
+		h.sampleRate /= 4
+		table = 3
+	}
+	if version != 3 && layer > 1 {
+		table = 4
+	}
+	kbps := mpegAudioBitrates[table][bitrate]
+	padding := int(b[2] >> 1 & 0x01)
+	h.channels = 2
+	if b[3]>>6 == 3 {
+		h.channels = 1
+	}
+	switch {
+	case layer == 1:
+		h.samples = 384
+		h.size = (12*kbps*1000/h.sampleRate + padding) * 4
+	case layer == 3 && version != 3:
+		h.samples = 576
+		h.size = 72*kbps*1000/h.sampleRate + padding
+	default:
+		h.samples = 1152
+		h.size = 144*kbps*1000/h.sampleRate + padding
+	}
+	return h, true
+}
+
+// Bitrates in kbit/s of AC-3, by frame size code over two
+var ac3Bitrates = [19]int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+
+// Parses the header of an AC-3 frame
+func parseAC3Header(b []byte) (audioHeader, bool) {
+	h := audioHeader{codec: "ac3", samples: 1536}
+	if len(b) < 7 || b[0] != 0x0b || b[1] != 0x77 {
+		return h, false
+	}
+	fscod := b[4] >> 6
+	frmsizecod := int(b[4] & 0x3f)
+	if fscod == 3 || frmsizecod >= 2*len(ac3Bitrates) {
+		return h, false
+	}
+	kbps := ac3Bitrates[frmsizecod/2]
+	switch fscod {
+	case 0:
+		h.sampleRate, h.size = 48000, kbps*4
+	case 1:
+		h.sampleRate, h.size = 44100, (kbps*320/147+frmsizecod&1)*2
+	case 2:
+		h.sampleRate, h.size = 32000, kbps*6
+	}
+
+	// the channel mode is followed by the mix levels it has, then the LFE
+	acmod := b[6] >> 5
+	h.channels = []int{2, 1, 2, 3, 3, 4, 4, 5}[acmod]
+	shift := uint(4)
+	if acmod&1 != 0 && acmod != 1 {
+		shift -= 2
+	}
+	if acmod&4 != 0 {
+		shift -= 2
+	}
+	if acmod == 2 {
+		shift -= 2
+	}
+	h.channels += int(b[6] >> shift & 1)
+	return h, true
+}
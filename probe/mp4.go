@@ -0,0 +1,403 @@
+package probe
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/livepeer/joy4/codec/aacparser"
+)
+
+var be = binary.BigEndian
+
+// Calls fn with the type and body of each box in b
+func boxes(b []byte, fn func(typ string, body []byte)) {
+	for len(b) >= 8 {
+		size := uint64(be.Uint32(b))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return
+			}
+			size, hdr = be.Uint64(b[8:]), 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return
+		}
+		fn(typ, b[hdr:size])
+		b = b[size:]
+	}
+}
+
+// Body of the first box of the type in b, nil if there is none
+func findBox(b []byte, typ string) []byte {
+	var found []byte
+	boxes(b, func(t string, body []byte) {
+		if found == nil && t == typ {
+			found = body
+		}
+	})
+	return found
+}
+
+// Whether data starts with one of the boxes an MP4 file or fragment does
+func isMP4(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	switch string(data[4:8]) {
+	case "ftyp", "styp", "moov", "moof":
+		return true
+	}
+	return false
+}
+
+// Timescale and duration of a movie or media header, which version 1 has
+// 64 bit times for
+func mediaHeader(b []byte) (int64, int64) {
+	if len(b) >= 32 && b[0] == 1 {
+		return int64(be.Uint32(b[20:])), int64(be.Uint64(b[24:]))
+	}
+	if len(b) >= 20 {
+		return int64(be.Uint32(b[12:])), int64(be.Uint32(b[16:]))
+	}
+	return 0, 0
+}
+
+// Track of an MP4, along with what fragments need of it
+type mp4Track struct {
+	*track
+	id              uint32
+	duration        int64
+	defaultDuration uint32
+	// Decode time of the next sample
+	next int64
+}
+
+func probeMP4(data []byte) ([]*track, time.Duration) {
+	var tracks []*mp4Track
+	byID := map[uint32]*mp4Track{}
+	var movieScale, movieDuration int64
+	boxes(data, func(typ string, body []byte) {
+		switch typ {
+		case "moov":
+			movieScale, movieDuration = mediaHeader(findBox(body, "mvhd"))
+			boxes(body, func(typ string, trak []byte) {
+				if typ != "trak" {
+					return
+				}
+				if t := mp4Trak(trak); t != nil {
+					tracks = append(tracks, t)
+					byID[t.id] = t
+				}
+			})
+			boxes(findBox(body, "mvex"), func(typ string, trex []byte) {
+				if typ == "trex" && len(trex) >= 16 {
+					if t := byID[be.Uint32(trex[4:])]; t != nil {
+						t.defaultDuration = be.Uint32(trex[12:])
+					}
+				}
+			})
+		case "moof":
+			boxes(body, func(typ string, traf []byte) {
+				if typ == "traf" {
+					mp4Traf(traf, byID)
+				}
+			})
+		}
+	})
+
+	// the longest track, or the movie when none says
+	var duration time.Duration
+	var out []*track
+	for _, t := range tracks {
+		out = append(out, t.track)
+		d := t.duration
+		if d == 0 && t.timed {
+			d = t.end - t.start
+		}
+		if t.timescale > 0 && t.toDuration(d) > duration {
+			duration = t.toDuration(d)
+		}
+	}
+	if duration == 0 && movieScale > 0 {
+		duration = time.Duration(movieDuration) * time.Second / time.Duration(movieScale)
+	}
+	return out, duration
+}
+
+// Reads a track of the movie, nil if it isn't audio or video
+func mp4Trak(trak []byte) *mp4Track {
+	t := &mp4Track{track: &track{}}
+	if tkhd := findBox(trak, "tkhd"); len(tkhd) >= 24 {
+		if tkhd[0] == 1 {
+			t.id = be.Uint32(tkhd[20:])
+		} else {
+			t.id = be.Uint32(tkhd[12:])
+		}
+	}
+	mdia := findBox(trak, "mdia")
+	t.timescale, t.duration = mediaHeader(findBox(mdia, "mdhd"))
+	if hdlr := findBox(mdia, "hdlr"); len(hdlr) >= 12 {
+		switch string(hdlr[8:12]) {
+		case "vide":
+			t.video = true
+		case "soun":
+		default:
+			return nil
+		}
+	}
+	stbl := findBox(findBox(mdia, "minf"), "stbl")
+	stsd := findBox(stbl, "stsd")
+	if len(stsd) < 8 {
+		return nil
+	}
+	boxes(stsd[8:], func(typ string, entry []byte) {
+		if t.codec == "" {
+			mp4SampleEntry(t.track, typ, entry)
+		}
+	})
+	if t.codec == "" {
+		return nil
+	}
+
+	// samples with their durations, which give the decode times
+	stts := findBox(stbl, "stts")
+	if len(stts) >= 8 {
+		n := int(be.Uint32(stts[4:]))
+		for i := 0; i < n && 16+8*i <= len(stts); i++ {
+			count, delta := be.Uint32(stts[8+8*i:]), be.Uint32(stts[12+8*i:])
+			t.samples(int(count), int64(delta))
+		}
+	}
+	return t
+}
+
+// Adds count samples lasting delta each. Their presentation is taken to
+// span their decode times, which composition offsets don't change much.
+func (t *mp4Track) samples(count int, delta int64) {
+	if count == 0 {
+		return
+	}
+	t.frames += count
+	for i := 0; i < count && len(t.deltas) < maxDeltas; i++ {
+		t.deltas = append(t.deltas, delta)
+	}
+	t.span(t.next, t.next+int64(count)*delta)
+	t.next += int64(count) * delta
+}
+
+// Most sample durations kept for the frame rate
+const maxDeltas = 10000
+
+// Fills in the codec details of a sample entry
+func mp4SampleEntry(t *track, typ string, entry []byte) {
+	switch typ {
+	case "avc1", "avc3", "hvc1", "hev1", "vp09", "av01", "mp4v":
+		if len(entry) < 78 {
+			return
+		}
+		t.codec = map[string]string{
+			"avc1": "h264", "avc3": "h264", "hvc1": "hevc", "hev1": "hevc",
+			"vp09": "vp9", "av01": "av1", "mp4v": "mpeg4",
+		}[typ]
+		t.width, t.height = int(be.Uint16(entry[24:])), int(be.Uint16(entry[26:]))
+		var sps spsInfo
+		var err error
+		switch t.codec {
+		case "h264":
+			nal := avcCSPS(findBox(entry[78:], "avcC"))
+			if nal == nil {
+				return
+			}
+			sps, err = parseH264SPS(nal)
+		case "hevc":
+			nal := hvcCSPS(findBox(entry[78:], "hvcC"))
+			if nal == nil {
+				return
+			}
+			sps, err = parseHEVCSPS(nal)
+		default:
+			return
+		}
+		if err == nil {
+			t.width, t.height, t.pixFormat = sps.width, sps.height, sps.pixFormat
+		}
+	case "mp4a", "ac-3", "ec-3", "Opus", "fLaC", ".mp3":
+		if len(entry) < 28 {
+			return
+		}
+		t.codec = map[string]string{
+			"mp4a": "aac", "ac-3": "ac3", "ec-3": "eac3", "Opus": "opus",
+			"fLaC": "flac", ".mp3": "mp3",
+		}[typ]
+		t.channels = int(be.Uint16(entry[16:]))
+		t.sampleRate = int(be.Uint32(entry[24:]) >> 16)
+		if typ == "mp4a" {
+			mp4aConfig(t, findBox(entry[28:], "esds"))
+		}
+	}
+}
+
+// First SPS of an AVC decoder configuration record
+func avcCSPS(b []byte) []byte {
+	if len(b) < 8 || b[5]&0x1f == 0 {
+		return nil
+	}
+	n := int(be.Uint16(b[6:]))
+	if 8+n > len(b) {
+		return nil
+	}
+	return b[8 : 8+n]
+}
+
+// First SPS of an HEVC decoder configuration record
+func hvcCSPS(b []byte) []byte {
+	if len(b) < 23 {
+		return nil
+	}
+	arrays := int(b[22])
+	b = b[23:]
+	for i := 0; i < arrays && len(b) >= 3; i++ {
+		typ, n := b[0]&0x3f, int(be.Uint16(b[1:]))
+		b = b[3:]
+		for j := 0; j < n && len(b) >= 2; j++ {
+			size := int(be.Uint16(b))
+			if 2+size > len(b) {
+				return nil
+			}
+			if typ == 33 {
+				return b[2 : 2+size]
+			}
+			b = b[2+size:]
+		}
+	}
+	return nil
+}
+
+// Fills in the codec, sample rate and channels from the decoder config
+// descriptor of an elementary stream descriptor
+func mp4aConfig(t *track, esds []byte) {
+	if len(esds) < 4 {
+		return
+	}
+	// descriptors have a tag and a size of up to four bytes of 7 bits
+	desc := func(b []byte) (byte, []byte, []byte) {
+		if len(b) < 2 {
+			return 0, nil, nil
+		}
+		tag, size, i := b[0], 0, 1
+		for ; i < len(b) && i <= 4; i++ {
+			size = size<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		if i+size > len(b) {
+			return 0, nil, nil
+		}
+		return tag, b[i : i+size], b[i+size:]
+	}
+	tag, es, _ := desc(esds[4:])
+	if tag != 0x03 || len(es) < 3 {
+		return
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 && len(es) >= 2 { // stream dependence
+		es = es[2:]
+	}
+	if flags&0x40 != 0 && len(es) >= 1 { // URL
+		es = es[1+int(es[0]):]
+	}
+	if flags&0x20 != 0 && len(es) >= 2 { // OCR stream
+		es = es[2:]
+	}
+	tag, dc, _ := desc(es)
+	if tag != 0x04 || len(dc) < 13 {
+		return
+	}
+	switch dc[0] {
+	case 0x69, 0x6b:
+		t.codec = "mp3"
+		return
+	case 0x40, 0x66, 0x67, 0x68:
+	default:
+		return
+	}
+	if tag, info, _ := desc(dc[13:]); tag == 0x05 {
+		if config, err := aacparser.ParseMPEG4AudioConfigBytes(info); err == nil && config.SampleRate > 0 {
+			t.sampleRate = config.SampleRate
+			if n := config.ChannelLayout.Count(); n > 0 {
+				t.channels = n
+			}
+		}
+	}
+}
+
+// Adds the samples of a track fragment
+func mp4Traf(traf []byte, byID map[uint32]*mp4Track) {
+	tfhd := findBox(traf, "tfhd")
+	if len(tfhd) < 8 {
+		return
+	}
+	t := byID[be.Uint32(tfhd[4:])]
+	if t == nil {
+		return
+	}
+	flags := be.Uint32(tfhd) & 0xffffff
+	defaultDuration := t.defaultDuration
+	off := 8
+	if flags&0x01 != 0 { // base data offset
+		off += 8
+	}
+	if flags&0x02 != 0 { // sample description index
+		off += 4
+	}
+	if flags&0x08 != 0 && off+4 <= len(tfhd) {
+		defaultDuration = be.Uint32(tfhd[off:])
+	}
+	if tfdt := findBox(traf, "tfdt"); len(tfdt) >= 8 {
+		if tfdt[0] == 1 && len(tfdt) >= 12 {
+			t.next = int64(be.Uint64(tfdt[4:]))
+		} else {
+			t.next = int64(be.Uint32(tfdt[4:]))
+		}
+	}
+	boxes(traf, func(typ string, trun []byte) {
+		if typ != "trun" || len(trun) < 8 {
+			return
+		}
+		flags := be.Uint32(trun) & 0xffffff
+		count := int(be.Uint32(trun[4:]))
+		off := 8
+		if flags&0x01 != 0 { // data offset
+			off += 4
+		}
+		if flags&0x04 != 0 { // first sample flags
+			off += 4
+		}
+		size := 0
+		for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&f != 0 {
+				size += 4
+			}
+		}
+		if size == 0 {
+			t.samples(count, int64(defaultDuration))
+			return
+		}
+		for i := 0; i < count && off+size <= len(trun); i++ {
+			d := int64(defaultDuration)
+			if flags&0x100 != 0 {
+				d = int64(be.Uint32(trun[off:]))
+			}
+			t.samples(1, d)
+			off += size
+		}
+	})
+}
@@ -0,0 +1,245 @@
+// Package probe inspects MPEG-TS and MP4 segments without FFmpeg.
+//
+// It reports the same details as ffmpeg.GetCodecInfo, using the names FFmpeg
+// gives codecs and formats, along with frame counts. It is plain Go, so it
+// builds with CGO_ENABLED=0 for services that would rather not link FFmpeg:
+//
+//	info, err := probe.Probe(segment)
+//
+// Only the container and the parameter sets are parsed, so probing doesn't
+// check the frames decode.
+package probe
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+)
+
+var ErrEmptyData = errors.New("ProbeEmptyData")
+var ErrUnknownFormat = errors.New("ProbeUnknownFormat")
+
+// Format names, as FFmpeg gives them
+const (
+	FormatMPEGTS = "mpegts"
+	FormatMP4    = "mov,mp4,m4a,3gp,3g2,mj2"
+)
+
+// Info describes a segment. Codecs, resolution and frame rate are those of
+// the first video and audio streams.
+type Info struct {
+	Format         string
+	Acodec, Vcodec string
+	// FFmpeg name of the pixel format, empty if unknown
+	PixFormat     string
+	Width, Height int
+	FPS           float32
+	// Duration, and the same in whole seconds like GetCodecInfo reports it
+	Duration   time.Duration
+	DurSecs    int64
+	SampleRate int
+	Channels   int
+	// Frames in the segment. Audio frames are those of the codec, several
+	// of which may share a PES packet.
+	VideoFrames, AudioFrames int
+	// Whether the segment has audio and a video stream without any frame to
+	// tell its picture from, which GetCodecInfo reports as
+	// CodecStatusNeedsBypass
+	ZeroVideoFrame bool
+}
+
+// A stream found in the container
+type track struct {
+	codec string
+	video bool
+	// Video
+	width, height int
+	pixFormat     string
+	// Audio
+	sampleRate, channels int
+
+	frames int
+	// Ticks per second of the timestamps, and the gaps between decode
+	// timestamps, or the presentation timestamps to find them from
+	timescale int64
+	deltas    []int64
+	pts       []int64
+	// Presentation time span, in timescale units
+	start, end int64
+	timed      bool
+}
+
+// Adds the presentation timestamp of a frame, or run of frames lasting
+// duration. Reordered frames get in order by their timestamps, so that
+// streams missing decode timestamps have their frame durations found too.
+func (t *track) timestamp(pts, duration int64) {
+	t.pts = append(t.pts, pts)
+	t.span(pts, pts+duration)
+}
+
+// Extends the presentation time span of the track to cover [start, end)
+func (t *track) span(start, end int64) {
+	if !t.timed || start < t.start {
+		t.start = start
+	}
+	if !t.timed || end > t.end {
+		t.end = end
+	}
+	t.timed = true
+}
+
+// Typical gap between decode timestamps, zero if unknown
+func (t *track) frameDuration() int64 {
+	if len(t.pts) > 1 && len(t.deltas) == 0 {
+		sort.Slice(t.pts, func(i, j int) bool { return t.pts[i] < t.pts[j] })
+		for i := 1; i < len(t.pts); i++ {
+			t.deltas = append(t.deltas, t.pts[i]-t.pts[i-1])
+		}
+	}
+	var ds []int64
+	for _, d := range t.deltas {
+		if d > 0 {
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) == 0 {
+		return 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds[len(ds)/2]
+}
+
+// Frame rates FFmpeg settles on when the timestamps are close to them
+var standardRates = func() []float64 {
+	rates := []float64{24000.0 / 1001, 30000.0 / 1001, 48000.0 / 1001, 60000.0 / 1001, 120000.0 / 1001}
+	for i := 1; i <= 120; i++ {
+		rates = append(rates, float64(i))
+	}
+	return rates
+}()
+
+// Average frame rate, leaving out gaps far from the typical frame duration
+// such as those of dropped frames. Rates within 1.5% of a standard one are
+// taken to be that.
+func (t *track) frameRate() float64 {
+	d := t.frameDuration()
+	if d == 0 {
+		return 0
+	}
+	var sum, n int64
+	for _, delta := range t.deltas {
+		if 2*delta >= d && 2*delta <= 3*d {
+			sum += delta
+			n++
+		}
+	}
+	fps := float64(n*t.timescale) / float64(sum)
+	best, diff := fps, 0.015*fps
+	for _, r := range standardRates {
+		if math.Abs(fps-r) < diff {
+			best, diff = r, math.Abs(fps-r)
+		}
+	}
+	return best
+}
+
+// End of the presentation, counting the last video frame as lasting as
+// long as the typical one
+func (t *track) endTime() int64 {
+	if t.video {
+		return t.end + t.frameDuration()
+	}
+	return t.end
+}
+
+func (t *track) toDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / time.Duration(t.timescale)
+}
+
+// Probe returns details on the MPEG-TS or MP4 segment in data.
+func Probe(data []byte) (Info, error) {
+	if len(data) == 0 {
+		return Info{}, ErrEmptyData
+	}
+	var info Info
+	var tracks []*track
+	var duration time.Duration
+	switch {
+	case isTS(data):
+		info.Format = FormatMPEGTS
+		tracks = probeTS(data)
+	case isMP4(data):
+		info.Format = FormatMP4
+		tracks, duration = probeMP4(data)
+	default:
+		return Info{}, ErrUnknownFormat
+	}
+
+	var video, audio *track
+	for _, t := range tracks {
+		if t.video && video == nil {
+			video = t
+		} else if !t.video && audio == nil {
+			audio = t
+		}
+	}
+	if video != nil {
+		info.Vcodec = video.codec
+		info.PixFormat = video.pixFormat
+		info.Width, info.Height = video.width, video.height
+		info.VideoFrames = video.frames
+		info.FPS = float32(video.frameRate())
+		info.ZeroVideoFrame = audio != nil && info.PixFormat == "" && info.Height == 0
+	}
+	if audio != nil {
+		info.Acodec = audio.codec
+		info.SampleRate = audio.sampleRate
+		info.Channels = audio.channels
+		info.AudioFrames = audio.frames
+	}
+
+	// from the earliest start to the latest end, unless the container says
+	if duration == 0 {
+		var start, end time.Duration
+		timed := false
+		for _, t := range tracks {
+			if !t.timed || t.timescale == 0 {
+				continue
+			}
+			s, e := t.toDuration(t.start), t.toDuration(t.endTime())
+			if !timed || s < start {
+				start = s
+			}
+			if !timed || e > end {
+				end = e
+			}
+			timed = true
+		}
+		duration = end - start
+	}
+	info.Duration = duration
+	info.DurSecs = int64(duration / time.Second)
+	return info, nil
+}
+
+// ProbeFile is like Probe but reads the segment from a file.
+func ProbeFile(fname string) (Info, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return Info{}, err
+	}
+	return Probe(data)
+}
+
+// HasZeroVideoFrame is whether the segment has a video stream without any
+// frames alongside audio, like ffmpeg.HasZeroVideoFrameBytes. Data that
+// isn't MPEG-TS or MP4 has no such stream.
+func HasZeroVideoFrame(data []byte) (bool, error) {
+	info, err := Probe(data)
+	if err == ErrUnknownFormat {
+		return false, nil
+	}
+	return info.ZeroVideoFrame, err
+}
@@ -0,0 +1,236 @@
+package probe
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe_Samples(t *testing.T) {
+	tests := []struct {
+		name string
+		want Info
+	}{
+		{"duplicate-audio-dts.ts", Info{
+			Format: FormatMPEGTS, Acodec: "aac", Vcodec: "h264", PixFormat: "yuv420p",
+			Width: 1280, Height: 720, FPS: 30, DurSecs: 2, SampleRate: 44100, Channels: 2,
+			VideoFrames: 59, AudioFrames: 85,
+		}},
+		{"bad-cuvid.ts", Info{
+			Format: FormatMPEGTS, Acodec: "aac", Vcodec: "h264", PixFormat: "yuv420p",
+			Width: 1920, Height: 1080, FPS: 30, DurSecs: 16, SampleRate: 48000, Channels: 2,
+			VideoFrames: 500, AudioFrames: 777,
+		}},
+		// video timestamps without a DTS, on frames that are reordered
+		{"missing-dts.ts", Info{
+			Format: FormatMPEGTS, Vcodec: "h264", PixFormat: "yuv420p",
+			Width: 1920, Height: 1080, FPS: 60, DurSecs: 2, VideoFrames: 120,
+		}},
+		{"vertical-sample.ts", Info{
+			Format: FormatMPEGTS, Vcodec: "h264", PixFormat: "yuv420p",
+			Width: 16, Height: 4000, FPS: 30, DurSecs: 1, VideoFrames: 30,
+		}},
+		{"zero-frame.ts", Info{
+			Format: FormatMPEGTS, Acodec: "aac", Vcodec: "h264",
+			DurSecs: 1, SampleRate: 44100, Channels: 2, AudioFrames: 72,
+			ZeroVideoFrame: true,
+		}},
+		// fragmented
+		{"videotest.mp4", Info{
+			Format: FormatMP4, Acodec: "aac", Vcodec: "h264", PixFormat: "yuv420p",
+			Width: 374, Height: 666, FPS: 23.360655, DurSecs: 1, SampleRate: 44100, Channels: 1,
+			VideoFrames: 42, AudioFrames: 76,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ProbeFile(filepath.Join("..", "data", tt.name))
+			require.NoError(t, err)
+			assert.True(t, info.Duration >= time.Duration(tt.want.DurSecs)*time.Second)
+			info.Duration = 0
+			assert.Equal(t, tt.want, info)
+		})
+	}
+}
+
+func TestProbe_Duration(t *testing.T) {
+	// last audio frame ends last, 1024 samples after its PTS
+	info, err := ProbeFile("../data/duplicate-audio-dts.ts")
+	require.NoError(t, err)
+	assert.Equal(t, 2008555555*time.Nanosecond, info.Duration)
+}
+
+func TestProbe_Errors(t *testing.T) {
+	_, err := Probe(nil)
+	assert.Equal(t, ErrEmptyData, err)
+	_, err = Probe([]byte("not a media file"))
+	assert.Equal(t, ErrUnknownFormat, err)
+	_, err = ProbeFile("/non/existent")
+	assert.Error(t, err)
+
+	zero, err := HasZeroVideoFrame(make([]byte, 16*1024*1024))
+	assert.NoError(t, err)
+	assert.False(t, zero)
+	_, err = HasZeroVideoFrame(nil)
+	assert.Equal(t, ErrEmptyData, err)
+
+	data, err := ioutil.ReadFile("../data/zero-frame.ts")
+	require.NoError(t, err)
+	zero, err = HasZeroVideoFrame(data)
+	assert.NoError(t, err)
+	assert.True(t, zero)
+	data, err = ioutil.ReadFile("../data/bad-cuvid.ts")
+	require.NoError(t, err)
+	zero, err = HasZeroVideoFrame(data)
+	assert.NoError(t, err)
+	assert.False(t, zero)
+}
+
+// Writes the bits of a parameter set
+type bitWriter struct {
+	b    []byte
+	bits int
+}
+
+func (w *bitWriter) put(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.bits%8)
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	n := 0
+	for (v+1)>>uint(n+1) != 0 {
+		n++
+	}
+	w.put(0, n)
+	w.put(v+1, n+1)
+}
+
+// Adds emulation prevention bytes, as a NAL unit has them
+func (w *bitWriter) nal() []byte {
+	var out []byte
+	zeros := 0
+	for _, c := range w.b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func TestProbe_H264SPS(t *testing.T) {
+	// High 4:2:2 at 10 bits, 1920x1080 cropped from 1920x1088
+	w := &bitWriter{}
+	w.put(0x67, 8)
+	w.put(122, 8) // profile
+	w.put(0, 16)  // constraints, level
+	w.ue(0)       // id
+	w.ue(2)       // 4:2:2
+	w.ue(2)       // luma depth
+	w.ue(2)       // chroma depth
+	w.put(0, 1)
+	w.put(1, 1) // scaling matrix
+	w.put(1, 1) // the first list, ended by its first delta of -8
+	w.ue(16)
+	for i := 0; i < 7; i++ {
+		w.put(0, 1)
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // poc type
+	w.ue(0)
+	w.ue(4)
+	w.put(0, 1)
+	w.ue(119) // width in MBs
+	w.ue(67)  // height in MBs
+	w.put(1, 1)
+	w.put(1, 1)
+	w.put(1, 1) // cropping
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(8) // lines, as 4:2:2 has full height chroma
+	w.put(0, 1)
+	sps, err := parseH264SPS(w.nal())
+	require.NoError(t, err)
+	assert.Equal(t, spsInfo{width: 1920, height: 1080, pixFormat: "yuv422p10le"}, sps)
+
+	// Main, interlaced 4:2:0 in full range
+	w = &bitWriter{}
+	w.put(0x67, 8)
+	w.put(77, 8)
+	w.put(0, 16)
+	w.ue(0)
+	w.ue(0)
+	w.ue(2) // poc type
+	w.ue(1)
+	w.put(0, 1)
+	w.ue(44) // 720
+	w.ue(17) // 288 lines a field
+	w.put(0, 1)
+	w.put(0, 1)
+	w.put(1, 1)
+	w.put(1, 1) // cropping
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.put(1, 1) // VUI
+	w.put(1, 1)
+	w.put(255, 8) // extended SAR
+	w.put(0, 32)
+	w.put(0, 1)
+	w.put(1, 1)
+	w.put(5, 3)
+	w.put(1, 1) // full range
+	sps, err = parseH264SPS(w.nal())
+	require.NoError(t, err)
+	assert.Equal(t, spsInfo{width: 720, height: 576, pixFormat: "yuvj420p"}, sps)
+
+	_, err = parseH264SPS([]byte{0x67, 100})
+	assert.Error(t, err)
+}
+
+func TestProbe_HEVCSPS(t *testing.T) {
+	// Main 10 with one sub-layer, 3840x2160 cropped from 3840x2176
+	w := &bitWriter{}
+	w.put(33<<9|1, 16)
+	w.put(0, 4)
+	w.put(1, 3) // sub-layers
+	w.put(1, 1)
+	w.put(0, 96)
+	w.put(1, 1) // sub-layer profile
+	w.put(0, 1)
+	for i := 1; i < 8; i++ {
+		w.put(0, 2)
+	}
+	w.put(0, 88)
+	w.ue(0)
+	w.ue(1) // 4:2:0
+	w.ue(3840)
+	w.ue(2176)
+	w.put(1, 1)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(8)
+	w.ue(2) // luma depth
+	sps, err := parseHEVCSPS(w.nal())
+	require.NoError(t, err)
+	assert.Equal(t, spsInfo{width: 3840, height: 2160, pixFormat: "yuv420p10le"}, sps)
+}
@@ -0,0 +1,305 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errShortSPS = errors.New("short SPS")
+
+// Reads the bits of a NAL unit, skipping emulation prevention bytes
+type bitReader struct {
+	b     []byte
+	pos   int
+	zeros int
+	cur   byte
+	left  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.left == 0 {
+		for {
+			if r.pos >= len(r.b) {
+				return 0, errShortSPS
+			}
+			c := r.b[r.pos]
+			r.pos++
+			if r.zeros >= 2 && c == 3 {
+				r.zeros = 0
+				continue
+			}
+			if c == 0 {
+				r.zeros++
+			} else {
+				r.zeros = 0
+			}
+			r.cur, r.left = c, 8
+			break
+		}
+	}
+	r.left--
+	return uint(r.cur>>uint(r.left)) & 1, nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) skip(n int) error {
+	_, err := r.bits(n)
+	return err
+}
+
+// Exp-Golomb coded unsigned value
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errShortSPS
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<uint(zeros) - 1 + v, err
+}
+
+// Exp-Golomb coded signed value
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2, err
+	}
+	return -int(v / 2), err
+}
+
+// Picture details of a sequence parameter set
+type spsInfo struct {
+	width, height int
+	pixFormat     string
+}
+
+// FFmpeg name of the pixel format of pictures with the chroma format and
+// bit depth, empty if FFmpeg has none
+func pixFormat(chroma uint, depth uint, fullRange bool) string {
+	names := []string{"gray", "yuv420p", "yuv422p", "yuv444p"}
+	if chroma >= uint(len(names)) {
+		return ""
+	}
+	name := names[chroma]
+	switch {
+	case depth > 8:
+		if chroma == 0 && depth != 10 && depth != 12 {
+			return ""
+		}
+		return fmt.Sprintf("%s%dle", name, depth)
+	case fullRange && chroma > 0:
+		// the H.264 decoder still marks full range with the JPEG formats
+		return name[:3] + "j" + name[3:]
+	}
+	return name
+}
+
+// Size of the luma plane covered by the chroma samples, horizontally and
+// vertically
+func chromaSubsampling(chroma uint) (int, int) {
+	switch chroma {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+// Parses an H.264 SPS, starting with its NAL header
+func parseH264SPS(nal []byte) (spsInfo, error) {
+	var info spsInfo
+	r := &bitReader{b: nal}
+	if err := r.skip(8); err != nil {
+		return info, err
+	}
+	profile, err := r.bits(8)
+	if err != nil {
+		return info, err
+	}
+	r.skip(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+	chroma, depth, separate := uint(1), uint(8), false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma, _ = r.ue()
+		if chroma == 3 {
+			sep, _ := r.bit()
+			separate = sep == 1
+		}
+		d, _ := r.ue()
+		depth += d
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if matrix, _ := r.bit(); matrix == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if present, _ := r.bit(); present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, _ := r.se()
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch pocType, _ := r.ue(); pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n, _ := r.ue()
+		for i := uint(0); i < n; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	mbWidth, _ := r.ue()
+	mbHeight, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return info, err
+	}
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var crop [4]uint
+	if cropping, _ := r.bit(); cropping == 1 {
+		for i := range crop {
+			crop[i], _ = r.ue()
+		}
+	}
+	fields := 2 - int(frameMbsOnly)
+	cropX, cropY := 1, fields
+	if chroma != 0 && !separate {
+		sx, sy := chromaSubsampling(chroma)
+		cropX, cropY = sx, sy*fields
+	}
+	info.width = int(mbWidth+1)*16 - cropX*int(crop[0]+crop[1])
+	info.height = fields*int(mbHeight+1)*16 - cropY*int(crop[2]+crop[3])
+	if info.width <= 0 || info.height <= 0 {
+		return spsInfo{}, errShortSPS
+	}
+
+	// the range is early on in the VUI
+	fullRange := false
+	if vui, _ := r.bit(); vui == 1 {
+		if aspect, _ := r.bit(); aspect == 1 {
+			if idc, _ := r.bits(8); idc == 255 { // Extended_SAR
+				r.skip(32)
+			}
+		}
+		if overscan, _ := r.bit(); overscan == 1 {
+			r.skip(1)
+		}
+		if signal, _ := r.bit(); signal == 1 {
+			r.skip(3) // video_format
+			full, _ := r.bit()
+			fullRange = full == 1
+		}
+	}
+	info.pixFormat = pixFormat(chroma, depth, fullRange)
+	return info, nil
+}
+
+// Parses an HEVC SPS, starting with its NAL header
+func parseHEVCSPS(nal []byte) (spsInfo, error) {
+	var info spsInfo
+	r := &bitReader{b: nal}
+	r.skip(16) // NAL header
+	r.skip(4)  // sps_video_parameter_set_id
+	subLayers, _ := r.bits(3)
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level: the general profile and level, then those of the
+	// sub-layers that have them
+	r.skip(96)
+	var profilePresent, levelPresent [8]uint
+	for i := uint(0); i < subLayers; i++ {
+		profilePresent[i], _ = r.bit()
+		levelPresent[i], _ = r.bit()
+	}
+	if subLayers > 0 {
+		for i := subLayers; i < 8; i++ {
+			r.skip(2)
+		}
+	}
+	for i := uint(0); i < subLayers; i++ {
+		if profilePresent[i] == 1 {
+			r.skip(88)
+		}
+		if levelPresent[i] == 1 {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chroma, _ := r.ue()
+	separate := false
+	if chroma == 3 {
+		sep, _ := r.bit()
+		separate = sep == 1
+	}
+	width, _ := r.ue()
+	height, _ := r.ue()
+	var crop [4]uint
+	if window, _ := r.bit(); window == 1 {
+		for i := range crop {
+			crop[i], _ = r.ue()
+		}
+	}
+	d, err := r.ue()
+	if err != nil {
+		return info, err
+	}
+	sx, sy := 1, 1
+	if !separate {
+		sx, sy = chromaSubsampling(chroma)
+	}
+	info.width = int(width) - sx*int(crop[0]+crop[1])
+	info.height = int(height) - sy*int(crop[2]+crop[3])
+	if info.width <= 0 || info.height <= 0 {
+		return spsInfo{}, errShortSPS
+	}
+	info.pixFormat = pixFormat(chroma, 8+d, false)
+	return info, nil
+}
@@ -0,0 +1,300 @@
+package probe
+
+import (
+	"github.com/livepeer/joy4/codec/aacparser"
+	"github.com/livepeer/joy4/format/ts/tsio"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// Codec names of the PMT stream types, as FFmpeg gives them
+var tsCodecs = map[uint8]string{
+	0x01: "mpeg2video",
+	0x02: "mpeg2video",
+	0x03: "mp3",
+	0x04: "mp3",
+	0x0f: "aac",
+	0x10: "mpeg4",
+	0x11: "aac_latm",
+	0x1b: "h264",
+	0x24: "hevc",
+	0x81: "ac3",
+	0x87: "eac3",
+}
+
+func isVideoStreamType(typ uint8) bool {
+	switch typ {
+	case 0x01, 0x02, 0x10, 0x1b, 0x24:
+		return true
+	}
+	return false
+}
+
+// Offset of the first packet, if data looks like a TS
+func tsStart(data []byte) (int, bool) {
+	for i := 0; i < tsPacketSize && i < len(data); i++ {
+		if data[i] != tsSyncByte {
+			continue
+		}
+		if i+tsPacketSize >= len(data) || data[i+tsPacketSize] == tsSyncByte {
+			return i, i+tsPacketSize <= len(data)
+		}
+	}
+	return 0, false
+}
+
+func isTS(data []byte) bool {
+	_, ok := tsStart(data)
+	return ok
+}
+
+// Calls fn with each packet of the TS, skipping bytes that aren't part of one
+func tsPackets(data []byte, fn func(pkt []byte)) {
+	i, _ := tsStart(data)
+	for i+tsPacketSize <= len(data) {
+		if data[i] != tsSyncByte {
+			i++
+			continue
+		}
+		fn(data[i : i+tsPacketSize])
+		i += tsPacketSize
+	}
+}
+
+// Streams of the first PMT, with the stream types and PIDs
+func tsStreams(data []byte) []tsio.ElementaryStreamInfo {
+	pmtPID := -1
+	var streams []tsio.ElementaryStreamInfo
+	found := false
+	tsPackets(data, func(pkt []byte) {
+		if found {
+			return
+		}
+		pid, start, _, hdrlen, err := tsio.ParseTSHeader(pkt)
+		if err != nil || !start || hdrlen >= len(pkt) {
+			return
+		}
+		if pid != tsio.PAT_PID && int(pid) != pmtPID {
+			return
+		}
+		payload := pkt[hdrlen:]
+		tableid, _, psilen, datalen, err := tsio.ParsePSI(payload)
+		if err != nil || psilen+datalen > len(payload) {
+			return
+		}
+		section := payload[psilen : psilen+datalen]
+		switch {
+		case pid == tsio.PAT_PID && tableid == tsio.TableIdPAT && pmtPID < 0:
+			var pat tsio.PAT
+			if _, err := pat.Unmarshal(section); err != nil {
+				return
+			}
+			for _, e := range pat.Entries {
+				if e.ProgramNumber != 0 {
+					pmtPID = int(e.ProgramMapPID)
+					break
+				}
+			}
+		case int(pid) == pmtPID && tableid == tsio.TableIdPMT:
+			streams, found = parsePMT(section)
+		}
+	})
+	return streams
+}
+
+// Streams of a PMT section. tsio.PMT rejects descriptors that end the
+// section, so this skips them itself.
+func parsePMT(section []byte) ([]tsio.ElementaryStreamInfo, bool) {
+	if len(section) < 4 {
+		return nil, false
+	}
+	n := 4 + (int(section[2]&0x03)<<8 | int(section[3]))
+	var streams []tsio.ElementaryStreamInfo
+	for n+5 <= len(section) {
+		streams = append(streams, tsio.ElementaryStreamInfo{
+			StreamType:    section[n],
+			ElementaryPID: uint16(section[n+1]&0x1f)<<8 | uint16(section[n+2]),
+		})
+		n += 5 + (int(section[n+3]&0x03)<<8 | int(section[n+4]))
+	}
+	return streams, n == len(section)
+}
+
+func probeTS(data []byte) []*track {
+	pids := map[uint16]*track{}
+	types := map[uint16]uint8{}
+	var tracks []*track
+	for _, s := range tsStreams(data) {
+		codec, ok := tsCodecs[s.StreamType]
+		if !ok {
+			continue
+		}
+		t := &track{codec: codec, video: isVideoStreamType(s.StreamType), timescale: 90000}
+		pids[s.ElementaryPID] = t
+		types[s.ElementaryPID] = s.StreamType
+		tracks = append(tracks, t)
+	}
+
+	// reassemble the PES packets of the streams
+	pes := map[uint16][]byte{}
+	flush := func(pid uint16) {
+		if b := pes[pid]; len(b) > 0 {
+			tsPES(pids[pid], types[pid], b)
+		}
+		pes[pid] = nil
+	}
+	tsPackets(data, func(pkt []byte) {
+		pid, start, _, hdrlen, err := tsio.ParseTSHeader(pkt)
+		if err != nil || pids[pid] == nil || hdrlen >= len(pkt) || pkt[3]&0x10 == 0 {
+			return
+		}
+		if start {
+			flush(pid)
+			pes[pid] = []byte{}
+		}
+		if pes[pid] != nil {
+			pes[pid] = append(pes[pid], pkt[hdrlen:]...)
+		}
+	})
+	for pid := range pids {
+		flush(pid)
+	}
+	return tracks
+}
+
+// Timestamp of the 5 bytes at b
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// Adds a PES packet of the stream to its track
+func tsPES(t *track, typ uint8, b []byte) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return
+	}
+	hdrlen := 9 + int(b[8])
+	if hdrlen > len(b) {
+		return
+	}
+	es := b[hdrlen:]
+
+	var frames int
+	var duration int64
+	if t.video {
+		frames = 1
+		if t.height == 0 {
+			if sps, ok := findSPS(es, t.codec); ok {
+				t.width, t.height, t.pixFormat = sps.width, sps.height, sps.pixFormat
+			}
+		}
+	} else {
+		var samples int
+		frames, samples = audioFrames(t, typ, es)
+		if t.sampleRate > 0 {
+			duration = int64(samples) * 90000 / int64(t.sampleRate)
+		}
+	}
+	t.frames += frames
+
+	if b[7]&0x80 != 0 && hdrlen >= 14 {
+		t.timestamp(readTimestamp(b[9:]), duration)
+	}
+}
+
+// Finds and parses the first SPS in the elementary stream data
+func findSPS(es []byte, codec string) (spsInfo, bool) {
+	for _, nal := range splitNALs(es) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch {
+		case codec == "h264" && nal[0]&0x1f == 7:
+			sps, err := parseH264SPS(nal)
+			return sps, err == nil
+		case codec == "hevc" && (nal[0]>>1)&0x3f == 33:
+			sps, err := parseHEVCSPS(nal)
+			return sps, err == nil
+		}
+	}
+	return spsInfo{}, false
+}
+
+// NAL units of Annex B data, without their start codes
+func splitNALs(es []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && es[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, es[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(es) {
+		nals = append(nals, es[start:])
+	}
+	return nals
+}
+
+// Counts the audio frames in the data, filling in the sample rate and
+// channels of the track from the first. Returns the frames and the samples
+// they hold.
+func audioFrames(t *track, typ uint8, es []byte) (frames, samples int) {
+	for len(es) > 0 {
+		var size, n int
+		switch typ {
+		case 0x0f:
+			if len(es) < aacparser.ADTSHeaderLength {
+				return
+			}
+			config, _, framelen, nsamples, err := aacparser.ParseADTSHeader(es)
+			if err != nil || framelen <= 0 {
+				return
+			}
+			if t.sampleRate == 0 {
+				t.sampleRate, t.channels = config.SampleRate, config.ChannelLayout.Count()
+			}
+			size, n = framelen, nsamples
+		case 0x03, 0x04:
+			h, ok := parseMPEGAudioHeader(es)
+			if !ok {
+				return
+			}
+			if t.sampleRate == 0 {
+				t.sampleRate, t.channels = h.sampleRate, h.channels
+				t.codec = h.codec
+			}
+			size, n = h.size, h.samples
+		case 0x81:
+			h, ok := parseAC3Header(es)
+			if !ok {
+				return
+			}
+			if t.sampleRate == 0 {
+				t.sampleRate, t.channels = h.sampleRate, h.channels
+			}
+			size, n = h.size, 1536
+		default:
+			// unparsed audio counts a frame per PES packet
+			return 1, 0
+		}
+		frames++
+		samples += n
+		if size > len(es) {
+			return
+		}
+		es = es[size:]
+	}
+	return
+}
@@ -0,0 +1,359 @@
+// Package scte35 reads SCTE-35 splice messages, which broadcast streams use
+// to signal ad breaks, and carries them in MPEG-TS segments.
+//
+// Cues demuxed from an input can be inspected with Parse and written into a
+// segment of another timeline with InsertTS, which moves their splice times
+// along with the segment:
+//
+//	event, err := scte35.Parse(section)
+//	out, err := scte35.InsertTS(segment, cues, inputStart)
+package scte35
+
+import (
+	"errors"
+	"time"
+
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+var ErrInvalidSection = errors.New("SCTE35InvalidSection")
+var ErrCRC = errors.New("SCTE35InvalidCRC")
+
+const (
+	tableID = 0xfc
+	// Timestamps are 33 bits of a 90kHz clock
+	tsMask = 1<<33 - 1
+)
+
+// Command is the splice_command_type of a section.
+type Command uint8
+
+const (
+	SpliceNull           Command = 0x00
+	SpliceSchedule       Command = 0x04
+	SpliceInsert         Command = 0x05
+	TimeSignal           Command = 0x06
+	BandwidthReservation Command = 0x07
+	PrivateCommand       Command = 0xff
+)
+
+// Segmentation type IDs that start and end breaks
+var (
+	segmentationStarts = map[uint8]bool{
+		0x22: true, // break start
+		0x30: true, // provider advertisement start
+		0x32: true, // distributor advertisement start
+		0x34: true, // provider placement opportunity start
+		0x36: true, // distributor placement opportunity start
+		0x38: true, // provider overlay placement opportunity start
+		0x3a: true, // distributor overlay placement opportunity start
+		0x44: true, // provider ad block start
+		0x46: true, // distributor ad block start
+	}
+	segmentationEnds = map[uint8]bool{
+		0x23: true, 0x31: true, 0x33: true, 0x35: true, 0x37: true,
+		0x39: true, 0x3b: true, 0x45: true, 0x47: true,
+	}
+)
+
+// Event is a splice event, as described by a splice_info_section.
+type Event struct {
+	Command Command
+	Tier    uint16
+	// Added to the splice times by the sender, in 90kHz ticks
+	PTSAdjustment int64
+	// Splice time in 90kHz ticks, PTSAdjustment included, or -1 for events
+	// that splice immediately or don't give a time
+	PTS int64
+
+	// splice_insert
+	EventID         uint32
+	Cancel          bool
+	OutOfNetwork    bool
+	Immediate       bool
+	BreakDuration   time.Duration
+	AutoReturn      bool
+	UniqueProgramID uint16
+	AvailNum        uint8
+	AvailsExpected  uint8
+
+	// Segmentation descriptors, which carry the meaning of time_signal
+	// events
+	Segmentations []Segmentation
+
+	// The section the event was read from
+	Section []byte
+}
+
+// Segmentation is a segmentation_descriptor of a splice_info_section.
+type Segmentation struct {
+	EventID          uint32
+	Cancel           bool
+	TypeID           uint8
+	Duration         time.Duration
+	UPIDType         uint8
+	UPID             []byte
+	SegmentNum       uint8
+	SegmentsExpected uint8
+}
+
+// Out is whether the event starts a break, going out of the network.
+func (e *Event) Out() bool {
+	if e.Command == SpliceInsert {
+		return !e.Cancel && e.OutOfNetwork
+	}
+	s := e.segmentation()
+	return s != nil && segmentationStarts[s.TypeID]
+}
+
+// In is whether the event ends a break, returning to the network.
+func (e *Event) In() bool {
+	if e.Command == SpliceInsert {
+		return !e.Cancel && !e.OutOfNetwork
+	}
+	s := e.segmentation()
+	return s != nil && segmentationEnds[s.TypeID]
+}
+
+// Duration is how long the break an Out event starts lasts, zero if the
+// event doesn't say.
+func (e *Event) Duration() time.Duration {
+	if e.Command == SpliceInsert {
+		return e.BreakDuration
+	}
+	if s := e.segmentation(); s != nil {
+		return s.Duration
+	}
+	return 0
+}
+
+// First segmentation descriptor that starts or ends a break
+func (e *Event) segmentation() *Segmentation {
+	if e.Command != TimeSignal {
+		return nil
+	}
+	for i, s := range e.Segmentations {
+		if !s.Cancel && (segmentationStarts[s.TypeID] || segmentationEnds[s.TypeID]) {
+			return &e.Segmentations[i]
+		}
+	}
+	return nil
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks * 100000 / 9)
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// 33 bit timestamp in the low bit of b[0] and the 4 bytes after it
+func read33(b []byte) int64 {
+	return int64(b[0]&1)<<32 | int64(be32(b[1:]))
+}
+
+// The section at the start of b, checked for its length and CRC
+func section(b []byte) ([]byte, error) {
+	if len(b) < 3 || b[0] != tableID {
+		return nil, ErrInvalidSection
+	}
+	n := 3 + (int(b[1]&0x0f)<<8 | int(b[2]))
+	if n < 20 || n > len(b) {
+		return nil, ErrInvalidSection
+	}
+	if mpegts.CRC32(b[:n]) != 0 {
+		return nil, ErrCRC
+	}
+	return b[:n], nil
+}
+
+// Parse reads the splice_info_section at the start of b. Encrypted sections
+// only have their header read.
+func Parse(b []byte) (*Event, error) {
+	sec, err := section(b)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		Command:       Command(sec[13]),
+		Tier:          uint16(sec[10])<<4 | uint16(sec[11]>>4),
+		PTSAdjustment: read33(sec[4:]),
+		PTS:           -1,
+		Section:       append([]byte(nil), sec...),
+	}
+	if sec[4]&0x80 != 0 { // encrypted
+		return e, nil
+	}
+	// the command, whose length old senders leave as 0xfff
+	r := &reader{b: sec[14 : len(sec)-4]}
+	cmd := r
+	if n := int(sec[11]&0x0f)<<8 | int(sec[12]); n != 0xfff {
+		cmd = &reader{b: r.bytes(n)}
+	}
+	switch e.Command {
+	case SpliceInsert:
+		e.spliceInsert(cmd)
+	case TimeSignal:
+		e.PTS = cmd.spliceTime()
+	case SpliceNull:
+	default:
+		if cmd == r {
+			return e, nil // can't tell where the descriptors are
+		}
+	}
+	if r.err != nil || cmd.err != nil {
+		return nil, ErrInvalidSection
+	}
+	if e.PTS >= 0 {
+		e.PTS = (e.PTS + e.PTSAdjustment) & tsMask
+	}
+
+	// descriptors follow the command
+	loop := r.bytes(int(r.u16()))
+	for len(loop) >= 2 && r.err == nil {
+		tag, n := loop[0], int(loop[1])
+		if 2+n > len(loop) {
+			break
+		}
+		if d := loop[2 : 2+n]; tag == 0x02 && len(d) >= 4 && string(d[:4]) == "CUEI" {
+			e.segmentationDescriptor(&reader{b: d[4:]})
+		}
+		loop = loop[2+n:]
+	}
+	if r.err != nil {
+		return nil, ErrInvalidSection
+	}
+	return e, nil
+}
+
+func (e *Event) spliceInsert(r *reader) {
+	e.EventID = r.u32()
+	if e.Cancel = r.u8()&0x80 != 0; e.Cancel {
+		return
+	}
+	flags := r.u8()
+	e.OutOfNetwork = flags&0x80 != 0
+	program := flags&0x40 != 0
+	duration := flags&0x20 != 0
+	e.Immediate = flags&0x10 != 0
+	if program && !e.Immediate {
+		e.PTS = r.spliceTime()
+	}
+	if !program {
+		// the time of the first component stands for the event
+		n := int(r.u8())
+		for i := 0; i < n; i++ {
+			r.u8()
+			if !e.Immediate {
+				if pts := r.spliceTime(); i == 0 {
+					e.PTS = pts
+				}
+			}
+		}
+	}
+	if duration {
+		b := r.bytes(5)
+		if len(b) == 5 {
+			e.AutoReturn = b[0]&0x80 != 0
+			e.BreakDuration = ticksToDuration(read33(b))
+		}
+	}
+	e.UniqueProgramID = r.u16()
+	e.AvailNum = r.u8()
+	e.AvailsExpected = r.u8()
+}
+
+func (e *Event) segmentationDescriptor(r *reader) {
+	s := Segmentation{EventID: r.u32()}
+	if s.Cancel = r.u8()&0x80 != 0; !s.Cancel {
+		flags := r.u8()
+		if flags&0x80 == 0 { // components
+			r.skip(6 * int(r.u8()))
+		}
+		if flags&0x40 != 0 {
+			b := r.bytes(5)
+			if len(b) == 5 {
+				s.Duration = ticksToDuration(int64(b[0])<<32 | int64(be32(b[1:])))
+			}
+		}
+		s.UPIDType = r.u8()
+		s.UPID = append([]byte(nil), r.bytes(int(r.u8()))...)
+		s.TypeID = r.u8()
+		s.SegmentNum = r.u8()
+		s.SegmentsExpected = r.u8()
+	}
+	if r.err == nil {
+		e.Segmentations = append(e.Segmentations, s)
+	}
+}
+
+// Rebase returns a copy of the section at the start of b with delta added
+// to its pts_adjustment, so that its splice times move by delta 90kHz ticks.
+func Rebase(b []byte, delta int64) ([]byte, error) {
+	sec, err := section(b)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), sec...)
+	adj := (read33(sec[4:]) + delta) & tsMask
+	out[4] = out[4]&0xfe | byte(adj>>32)
+	out[5], out[6], out[7], out[8] = byte(adj>>24), byte(adj>>16), byte(adj>>8), byte(adj)
+	crc := mpegts.CRC32(out[:len(out)-4])
+	out[len(out)-4], out[len(out)-3], out[len(out)-2], out[len(out)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	return out, nil
+}
+
+// Reads the fields of a section, remembering if it ran out
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = ErrInvalidSection
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return be32(b)
+	}
+	return 0
+}
+
+// splice_time(), -1 if no time is given
+func (r *reader) spliceTime() int64 {
+	b := r.bytes(1)
+	if b == nil || b[0]&0x80 == 0 {
+		return -1
+	}
+	low := r.bytes(4)
+	if low == nil {
+		return -1
+	}
+	return int64(b[0]&1)<<32 | int64(be32(low))
+}
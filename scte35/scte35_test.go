@@ -0,0 +1,228 @@
+package scte35
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/livepeer/lpms/internal/mpegts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splice_info_section around a command and its descriptors
+func buildSection(cmd Command, body, descriptors []byte, adj int64) []byte {
+	b := []byte{tableID, 0, 0, 0, byte(adj >> 32 & 1), byte(adj >> 24), byte(adj >> 16), byte(adj >> 8), byte(adj),
+		0, 0xff, 0xf0 | byte(len(body)>>8), byte(len(body)), byte(cmd)}
+	b = append(b, body...)
+	b = append(b, byte(len(descriptors)>>8), byte(len(descriptors)))
+	b = append(b, descriptors...)
+	n := len(b) + 4 - 3
+	b[1], b[2] = 0x30|byte(n>>8), byte(n)
+	crc := mpegts.CRC32(b)
+	return append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func spliceTime(pts int64) []byte {
+	return []byte{0xfe | byte(pts>>32&1), byte(pts >> 24), byte(pts >> 16), byte(pts >> 8), byte(pts)}
+}
+
+func spliceInsert(id uint32, out bool, pts, duration int64) []byte {
+	flags := byte(0x4f) // program splice
+	if out {
+		flags |= 0x80
+	}
+	if duration > 0 {
+		flags |= 0x20
+	}
+	b := []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id), 0x7f, flags}
+	b = append(b, spliceTime(pts)...)
+	if duration > 0 {
+		b = append(b, spliceTime(duration)...) // auto return
+	}
+	return append(b, 0, 7, 1, 2)
+}
+
+func segmentationDescriptor(typeID uint8, duration int64) []byte {
+	d := []byte{'C', 'U', 'E', 'I', 0, 0, 0, 9, 0x7f, 0xff}
+	d = append(d, byte(duration>>32), byte(duration>>24), byte(duration>>16), byte(duration>>8), byte(duration))
+	d = append(d, 0x09, 3, 'a', 'd', '1', typeID, 1, 2)
+	return append([]byte{0x02, byte(len(d))}, d...)
+}
+
+func TestParse_SpliceInsert(t *testing.T) {
+	sec := buildSection(SpliceInsert, spliceInsert(42, true, 180000, 30*90000), nil, 9000)
+	e, err := Parse(append(sec, 0xff, 0xff)) // stuffing after the section
+	require.NoError(t, err)
+	assert.Equal(t, SpliceInsert, e.Command)
+	assert.Equal(t, uint16(0xfff), e.Tier)
+	assert.Equal(t, int64(9000), e.PTSAdjustment)
+	assert.Equal(t, int64(189000), e.PTS)
+	assert.Equal(t, uint32(42), e.EventID)
+	assert.True(t, e.Out())
+	assert.False(t, e.In())
+	assert.True(t, e.AutoReturn)
+	assert.Equal(t, 30*time.Second, e.Duration())
+	assert.Equal(t, uint16(7), e.UniqueProgramID)
+	assert.Equal(t, uint8(1), e.AvailNum)
+	assert.Equal(t, uint8(2), e.AvailsExpected)
+	assert.Equal(t, sec, e.Section)
+
+	e, err = Parse(buildSection(SpliceInsert, spliceInsert(42, false, 1<<33-1, 0), nil, 1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), e.PTS, "splice times wrap around")
+	assert.True(t, e.In())
+	assert.Equal(t, time.Duration(0), e.Duration())
+
+	// a cancelled event is neither
+	e, err = Parse(buildSection(SpliceInsert, []byte{0, 0, 0, 42, 0xff}, nil, 0))
+	require.NoError(t, err)
+	assert.True(t, e.Cancel)
+	assert.False(t, e.Out() || e.In())
+	assert.Equal(t, int64(-1), e.PTS)
+}
+
+func TestParse_TimeSignal(t *testing.T) {
+	desc := segmentationDescriptor(0x34, 15*90000)
+	e, err := Parse(buildSection(TimeSignal, spliceTime(90000), desc, 0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(90000), e.PTS)
+	require.Len(t, e.Segmentations, 1)
+	s := e.Segmentations[0]
+	assert.Equal(t, uint32(9), s.EventID)
+	assert.Equal(t, uint8(0x34), s.TypeID)
+	assert.Equal(t, uint8(0x09), s.UPIDType)
+	assert.Equal(t, []byte("ad1"), s.UPID)
+	assert.Equal(t, uint8(1), s.SegmentNum)
+	assert.Equal(t, uint8(2), s.SegmentsExpected)
+	assert.True(t, e.Out())
+	assert.Equal(t, 15*time.Second, e.Duration())
+
+	e, err = Parse(buildSection(TimeSignal, spliceTime(90000), segmentationDescriptor(0x35, 0), 0))
+	require.NoError(t, err)
+	assert.True(t, e.In())
+
+	// time signals without segmentation say nothing of breaks
+	e, err = Parse(buildSection(TimeSignal, []byte{0x7f}, nil, 0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), e.PTS)
+	assert.False(t, e.Out() || e.In())
+
+	e, err = Parse(buildSection(SpliceNull, nil, nil, 0))
+	require.NoError(t, err)
+	assert.Equal(t, SpliceNull, e.Command)
+}
+
+func TestParse_Errors(t *testing.T) {
+	sec := buildSection(TimeSignal, spliceTime(90000), nil, 0)
+	bad := append([]byte(nil), sec...)
+	bad[len(bad)-1] ^= 1
+	_, err := Parse(bad)
+	assert.Equal(t, ErrCRC, err)
+	_, err = Parse(sec[:len(sec)-1])
+	assert.Equal(t, ErrInvalidSection, err)
+	_, err = Parse(nil)
+	assert.Equal(t, ErrInvalidSection, err)
+	bad = append([]byte{0x02}, sec[1:]...)
+	_, err = Parse(bad)
+	assert.Equal(t, ErrInvalidSection, err)
+
+	// command running past the section
+	_, err = Parse(buildSection(SpliceInsert, []byte{0, 0, 0, 1, 0x7f, 0xcf}, nil, 0))
+	assert.Equal(t, ErrInvalidSection, err)
+	_, err = Rebase(bad, 0)
+	assert.Equal(t, ErrInvalidSection, err)
+}
+
+func TestRebase(t *testing.T) {
+	sec := buildSection(SpliceInsert, spliceInsert(1, true, 90000, 0), nil, 100)
+	moved, err := Rebase(sec, -90100)
+	require.NoError(t, err)
+	e, err := Parse(moved)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<33-90000), e.PTSAdjustment)
+	assert.Equal(t, int64(0), e.PTS)
+	assert.Equal(t, byte(100), sec[8], "the section is copied")
+}
+
+func TestInsertTS(t *testing.T) {
+	data, err := ioutil.ReadFile("../data/bad-cuvid.ts")
+	require.NoError(t, err)
+	_, err = InsertTS(data[:100], nil, 0)
+	assert.Equal(t, ErrInvalidTS, err)
+	_, err = InsertTS(make([]byte, packetSize), nil, 0)
+	assert.Equal(t, ErrInvalidTS, err)
+
+	// cues two and four seconds into a segment that started at 1000
+	cues := []Cue{
+		{PTS: 1000 + 2*90000, Section: buildSection(SpliceInsert, spliceInsert(1, true, 1000+2*90000, 90000), nil, 0)},
+		{PTS: 1000 + 4*90000, Section: buildSection(SpliceInsert, spliceInsert(1, false, 1000+4*90000, 0), nil, 0)},
+	}
+	out, err := InsertTS(data, cues, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, len(data)+2*packetSize, len(out))
+
+	var pkts [][]byte
+	for i := 0; i < len(out); i += packetSize {
+		pkts = append(pkts, out[i:i+packetSize])
+	}
+	pmtPID, ok := findPMTPID(pkts)
+	require.True(t, ok)
+	first, max := int64(-1), int64(-1)
+	var after *Event
+	var cuePID uint16
+	var events []*Event
+	for _, pkt := range pkts {
+		if mpegts.PID(pkt) == pmtPID {
+			cuePID = cueStream(mpegts.Section(pkt))
+			assert.Contains(t, string(mpegts.Section(pkt)), registration)
+			continue
+		}
+		if cuePID != 0 && mpegts.PID(pkt) == cuePID {
+			e, err := Parse(mpegts.Section(pkt))
+			require.NoError(t, err)
+			// after the frames before the cue, ahead of the ones after it
+			assert.True(t, max < e.PTS, "cue at %d after %d", e.PTS, max)
+			events = append(events, e)
+			after = e
+			continue
+		}
+		if pts := pesPTS(mpegts.Payload(pkt)); pkt[1]&0x40 != 0 && pts >= 0 {
+			if first < 0 || pts < first {
+				first = pts
+			}
+			if after != nil {
+				assert.True(t, pts >= after.PTS)
+				after = nil
+			}
+			if pts > max {
+				max = pts
+			}
+		}
+	}
+	require.NotEqual(t, uint16(0), cuePID)
+	require.Len(t, events, 2)
+	assert.True(t, events[0].Out())
+	assert.True(t, events[1].In())
+	assert.Equal(t, int64(-1000), diff(events[0].PTSAdjustment, first))
+	assert.Equal(t, first+2*90000, events[0].PTS)
+	assert.Equal(t, first+4*90000, events[1].PTS)
+
+	// the stream is reused by later cues, continuing its counter
+	again, err := InsertTS(out, cues[:1], 1000)
+	require.NoError(t, err)
+	cc := -1
+	for i := 0; i < len(again); i += packetSize {
+		pkt := again[i : i+packetSize]
+		if mpegts.PID(pkt) == pmtPID {
+			assert.Equal(t, cuePID, cueStream(mpegts.Section(pkt)))
+		}
+		if mpegts.PID(pkt) == cuePID {
+			if cc >= 0 {
+				assert.Equal(t, (cc+1)&0x0f, int(pkt[3]&0x0f))
+			}
+			cc = int(pkt[3] & 0x0f)
+		}
+	}
+	assert.Equal(t, 2, cc)
+}
@@ -0,0 +1,229 @@
+package scte35
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+var ErrInvalidTS = errors.New("SCTE35InvalidTS")
+var ErrPMT = errors.New("SCTE35UnsupportedPMT")
+
+const (
+	packetSize = mpegts.PacketSize
+	syncByte   = mpegts.SyncByte
+	// Stream type of SCTE-35 in a PMT, along with the registration that
+	// tells it apart from other private sections
+	streamType   = 0x86
+	registration = "CUEI"
+)
+
+// Cue is a splice_info_section carried in a TS, at the PTS of the stream
+// around it in 90kHz ticks.
+type Cue struct {
+	PTS     int64
+	Section []byte
+}
+
+// Difference a - b of two timestamps, taking wraparound into account
+func diff(a, b int64) int64 {
+	d := (a - b) & tsMask
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return d
+}
+
+// PTS of the PES packet starting in the payload, -1 if it has none
+func pesPTS(payload []byte) int64 {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 ||
+		payload[7]&0x80 == 0 {
+		return -1
+	}
+	b := payload[9:]
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// PID of the PMT, from the first PAT of the packets
+func findPMTPID(pkts [][]byte) (uint16, bool) {
+	for _, pkt := range pkts {
+		sec := mpegts.Section(pkt)
+		if mpegts.PID(pkt) != tsio.PAT_PID || len(sec) < 12 || sec[0] != tsio.TableIdPAT {
+			continue
+		}
+		var pat tsio.PAT
+		if _, err := pat.Unmarshal(sec[8 : len(sec)-4]); err != nil {
+			continue
+		}
+		for _, e := range pat.Entries {
+			if e.ProgramNumber != 0 {
+				return e.ProgramMapPID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// PID of the SCTE-35 stream of a PMT section, 0 if it has none
+func cueStream(sec []byte) uint16 {
+	for _, s := range mpegts.Streams(sec) {
+		if s.Type == streamType {
+			return s.PID
+		}
+	}
+	return 0
+}
+
+// PMT section with a SCTE-35 stream on pid added
+func addToPMT(sec []byte, pid uint16) []byte {
+	info := mpegts.ProgramInfo(sec)
+	if !bytes.Contains(info, []byte(registration)) {
+		info = append(append([]byte{}, info...), 0x05, 4)
+		info = append(info, registration...)
+	}
+	return mpegts.NewPMT(sec, info, append(mpegts.Streams(sec), mpegts.Stream{Type: streamType, PID: pid}))
+}
+
+// Packets of a section on pid, with continuity counters from cc on
+func sectionPackets(sec []byte, pid uint16, cc *byte) [][]byte {
+	var pkts [][]byte
+	data := append([]byte{0}, sec...) // pointer field
+	for start := true; len(data) > 0; start = false {
+		pkt := make([]byte, packetSize)
+		pkt[0], pkt[1], pkt[2] = syncByte, byte(pid>>8)&0x1f, byte(pid)
+		if start {
+			pkt[1] |= 0x40
+		}
+		pkt[3] = 0x10 | *cc
+		*cc = (*cc + 1) & 0x0f
+		n := copy(pkt[4:], data)
+		for i := 4 + n; i < packetSize; i++ {
+			pkt[i] = 0xff
+		}
+		data = data[n:]
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+// InsertTS returns a copy of the TS segment in data that carries the cues
+// in a SCTE-35 stream of its program, which is added to the PMT if it has
+// none. The cues are timed on the timeline of a segment that started at
+// start, in 90kHz ticks. They move to the timeline of data, along with the
+// splice times in their sections, and are placed ahead of the first PES
+// packet at or after their time.
+func InsertTS(data []byte, cues []Cue, start int64) ([]byte, error) {
+	if len(data) == 0 || len(data)%packetSize != 0 {
+		return nil, ErrInvalidTS
+	}
+	var pkts [][]byte
+	for i := 0; i < len(data); i += packetSize {
+		if data[i] != syncByte {
+			return nil, ErrInvalidTS
+		}
+		pkts = append(pkts, data[i:i+packetSize])
+	}
+	pmtPID, ok := findPMTPID(pkts)
+	if !ok {
+		return nil, ErrPMT
+	}
+
+	// the SCTE-35 stream of the PMT, or a new one, and where the segment
+	// starts
+	var cuePID uint16
+	var pmt []byte
+	var cc byte
+	first := int64(-1)
+	used := map[uint16]bool{}
+	for _, pkt := range pkts {
+		used[mpegts.PID(pkt)] = true
+		if mpegts.PID(pkt) == pmtPID && pmt == nil {
+			if sec := mpegts.Section(pkt); len(sec) >= 16 && sec[0] == tsio.TableIdPMT {
+				pmt = sec
+				cuePID = cueStream(sec)
+			}
+		}
+		if pkt[1]&0x40 != 0 {
+			if pts := pesPTS(mpegts.Payload(pkt)); pts >= 0 && (first < 0 || diff(pts, first) < 0) {
+				first = pts
+			}
+		}
+	}
+	if pmt == nil {
+		return nil, ErrPMT
+	}
+	if cuePID == 0 {
+		cuePID = 0x100
+		for used[cuePID] {
+			cuePID++
+		}
+		if 1+len(addToPMT(pmt, cuePID)) > packetSize-4 {
+			return nil, ErrPMT
+		}
+	}
+	var delta int64
+	if first >= 0 {
+		delta = diff(first, start)
+	}
+	moved := make([]Cue, len(cues))
+	for i, c := range cues {
+		sec, err := Rebase(c.Section, delta)
+		if err != nil {
+			return nil, err
+		}
+		moved[i] = Cue{PTS: (c.PTS + delta) & tsMask, Section: sec}
+	}
+
+	out := make([]byte, 0, len(data)+packetSize*(len(cues)+1))
+	next := 0
+	for _, pkt := range pkts {
+		p := mpegts.PID(pkt)
+		if p == pmtPID && pkt[1]&0x40 != 0 {
+			if sec := mpegts.Section(pkt); len(sec) >= 16 && sec[0] == tsio.TableIdPMT {
+				if cueStream(sec) == 0 {
+					pkt = pmtPacket(pkt, addToPMT(sec, cuePID))
+				}
+			}
+		}
+		if pkt[1]&0x40 != 0 && p != pmtPID && p != tsio.PAT_PID {
+			if pts := pesPTS(mpegts.Payload(pkt)); pts >= 0 {
+				for ; next < len(moved) && diff(moved[next].PTS, pts) <= 0; next++ {
+					for _, cp := range sectionPackets(moved[next].Section, cuePID, &cc) {
+						out = append(out, cp...)
+					}
+				}
+			}
+		}
+		if p == cuePID {
+			// counted again, around the cues in between
+			pkt = append([]byte(nil), pkt...)
+			if pkt[3]&0x10 != 0 {
+				pkt[3] = pkt[3]&0xf0 | cc
+				cc = (cc + 1) & 0x0f
+			}
+		}
+		out = append(out, pkt...)
+	}
+	for ; next < len(moved); next++ {
+		for _, cp := range sectionPackets(moved[next].Section, cuePID, &cc) {
+			out = append(out, cp...)
+		}
+	}
+	return out, nil
+}
+
+// Packet like pkt, carrying the section instead
+func pmtPacket(pkt, sec []byte) []byte {
+	out := make([]byte, packetSize)
+	copy(out, pkt[:4])
+	out[3] = out[3]&0xcf | 0x10 // payload only
+	out[4] = 0
+	n := copy(out[5:], sec)
+	for i := 5 + n; i < packetSize; i++ {
+		out[i] = 0xff
+	}
+	return out
+}
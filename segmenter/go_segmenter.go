@@ -0,0 +1,216 @@
+package segmenter
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/joy4/av"
+	"github.com/livepeer/joy4/format/ts"
+	"github.com/livepeer/lpms/stream"
+)
+
+// SegmentBufferSize is how many segments GoSegmenter holds for a slow
+// reader before it holds up the stream.
+var SegmentBufferSize = 8
+
+// GoSegmenter segments an RTMP stream into MPEG-TS in process, without
+// FFmpeg, the file system or a second RTMP connection. The stream is read
+// into it like into any muxer. Segments are cut at the first keyframe after
+// they reach the target length, and delivered on Segments with durations
+// from the timestamps of the packets. With EnforceKeyframe, only IDR frames
+// count as keyframes.
+type GoSegmenter struct {
+	StrmID string
+	SegLen time.Duration
+	opt    SegmenterOptions
+
+	mu       sync.Mutex
+	segments chan *VideoSegment
+	closed   bool
+	streams  []av.CodecData
+	codec    av.CodecType
+	hasVideo bool
+	seqNo    uint64
+
+	// The segment being muxed, where it starts and whether with a keyframe
+	buf      *bytes.Buffer
+	muxer    *ts.Muxer
+	start    time.Duration
+	started  bool
+	keyframe bool
+	gotVideo bool
+
+	// Time and duration of the last packet of each stream
+	last  []time.Duration
+	delta []time.Duration
+	seen  []bool
+}
+
+func NewGoSegmenter(strmID string, opt SegmenterOptions) *GoSegmenter {
+	if opt.SegLength == 0 {
+		opt.SegLength = time.Second * 4
+	}
+	return &GoSegmenter{
+		StrmID:   strmID,
+		SegLen:   opt.SegLength,
+		opt:      opt,
+		seqNo:    uint64(opt.StartSeq),
+		segments: make(chan *VideoSegment, SegmentBufferSize),
+	}
+}
+
+//Segments returns the channel the segments are delivered on, which is closed once the stream ends.
+func (s *GoSegmenter) Segments() <-chan *VideoSegment {
+	return s.segments
+}
+
+//WriteHeader sets up the streams of the segments. Only H.264 and AAC can be segmented.
+func (s *GoSegmenter) WriteHeader(streams []av.CodecData) error {
+	if err := ts.NewMuxer(ioutil.Discard).WriteHeader(streams); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams = streams
+	s.last = make([]time.Duration, len(streams))
+	s.delta = make([]time.Duration, len(streams))
+	s.seen = make([]bool, len(streams))
+	s.hasVideo = false
+	for _, st := range streams {
+		if st.Type().IsVideo() {
+			s.hasVideo = true
+			s.codec = st.Type()
+		}
+	}
+	if !s.hasVideo && len(streams) > 0 {
+		s.codec = streams[0].Type()
+	}
+	return nil
+}
+
+//WritePacket muxes the packet into the current segment, cutting it first if the packet can start the next one.
+func (s *GoSegmenter) WritePacket(pkt av.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || int(pkt.Idx) >= len(s.streams) || pkt.Idx < 0 {
+		return nil
+	}
+	typ := s.streams[pkt.Idx].Type()
+	keyframe := pkt.IsKeyFrame
+	if s.opt.EnforceKeyframe && typ.IsVideo() {
+		keyframe = isKeyframe(typ, pkt)
+	}
+	// audio only streams can be cut anywhere
+	cut := keyframe && typ.IsVideo() || !s.hasVideo
+	if s.started && cut && pkt.Time-s.start >= s.SegLen {
+		s.flush(pkt.Time)
+	}
+	if s.muxer == nil {
+		s.buf = &bytes.Buffer{}
+		s.muxer = ts.NewMuxer(s.buf)
+		if err := s.muxer.WriteHeader(s.streams); err != nil {
+			return err
+		}
+		if !s.started {
+			s.start, s.started = pkt.Time, true
+		}
+		s.keyframe, s.gotVideo = !s.hasVideo, false
+	}
+	if typ.IsVideo() && !s.gotVideo {
+		s.keyframe, s.gotVideo = isKeyframe(typ, pkt), true
+	}
+	if s.seen[pkt.Idx] && pkt.Time > s.last[pkt.Idx] {
+		s.delta[pkt.Idx] = pkt.Time - s.last[pkt.Idx]
+	}
+	s.last[pkt.Idx], s.seen[pkt.Idx] = pkt.Time, true
+	return s.muxer.WritePacket(pkt)
+}
+
+//WriteTrailer delivers the last segment and closes Segments.
+func (s *GoSegmenter) WriteTrailer() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.muxer != nil {
+		// the last segment ends with its last packet
+		end := s.start
+		for i, t := range s.last {
+			if s.seen[i] && t+s.delta[i] > end {
+				end = t + s.delta[i]
+			}
+		}
+		s.flush(end)
+	}
+	s.closed = true
+	close(s.segments)
+	return nil
+}
+
+//Close ends the stream like WriteTrailer.
+func (s *GoSegmenter) Close() error {
+	return s.WriteTrailer()
+}
+
+// Delivers the current segment, which ends at end. Segments without a
+// leading keyframe are dropped if the options say so, leaving a gap in the
+// sequence numbers.
+func (s *GoSegmenter) flush(end time.Duration) {
+	if err := s.muxer.WriteTrailer(); err != nil {
+		glog.Errorf("Error writing segment trailer: %v", err)
+	}
+	seg := &VideoSegment{
+		Codec:              s.codec,
+		Format:             stream.HLS,
+		Length:             end - s.start,
+		Data:               s.buf.Bytes(),
+		Name:               s.StrmID + "_" + strconv.FormatUint(s.seqNo, 10) + ".ts",
+		SeqNo:              s.seqNo,
+		StartsWithKeyframe: s.keyframe,
+	}
+	if seg.StartsWithKeyframe || !s.opt.EnforceKeyframe || !s.opt.DropNonKeyframe {
+		s.segments <- seg
+	} else {
+		glog.Warningf("Dropping segment %v without a leading keyframe", seg.Name)
+	}
+	s.seqNo++
+	s.start = end
+	s.buf, s.muxer = nil, nil
+}
+
+// GoRTMPSegmenter segments RTMP streams into HLS streams with GoSegmenter.
+// It can stand in for the FFmpeg segmenter of core.LPMS as a
+// core.RTMPSegmenter.
+type GoRTMPSegmenter struct{}
+
+//SegmentRTMPToHLS adds the segments of rs to hs until the stream ends or ctx is done.
+func (GoRTMPSegmenter) SegmentRTMPToHLS(ctx context.Context, rs stream.RTMPVideoStream, hs stream.HLSVideoStream, segOptions SegmenterOptions) error {
+	if rs == nil || hs == nil {
+		return ErrSegmenter
+	}
+	s := NewGoSegmenter(hs.GetStreamID(), segOptions)
+	eof, err := rs.ReadRTMPFromStream(ctx, s)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// the stream waits to tell about its end
+		select {
+		case <-eof:
+		case <-ctx.Done():
+		}
+	}()
+	for seg := range s.Segments() {
+		ss := stream.HLSSegment{SeqNo: seg.SeqNo, Data: seg.Data, Name: seg.Name, Duration: seg.Length.Seconds()}
+		if err := hs.AddHLSSegment(&ss); err != nil {
+			glog.Errorf("Error adding segment: %v", err)
+		}
+	}
+	return nil
+}
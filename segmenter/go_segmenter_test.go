@@ -0,0 +1,289 @@
+package segmenter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/livepeer/joy4/av"
+	"github.com/livepeer/joy4/av/avutil"
+	"github.com/livepeer/joy4/format"
+	"github.com/livepeer/joy4/format/ts"
+	"github.com/livepeer/lpms/stream"
+)
+
+// Writes the packets of test.flv into dst, returning the duration of the video
+func writeTestFLV(t *testing.T, dst av.Muxer) time.Duration {
+	format.RegisterAll()
+	file, err := avutil.Open("test.flv")
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer file.Close()
+	streams, err := file.Streams()
+	if err != nil {
+		t.Fatalf("Error reading headers: %v", err)
+	}
+	if err := dst.WriteHeader(streams); err != nil {
+		t.Fatalf("Error writing header: %v", err)
+	}
+	var first, last time.Duration
+	started := false
+	for {
+		pkt, err := file.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading packet: %v", err)
+		}
+		if streams[pkt.Idx].Type().IsVideo() {
+			if !started {
+				first, started = pkt.Time, true
+			}
+			last = pkt.Time
+		}
+		if err := dst.WritePacket(pkt); err != nil {
+			t.Fatalf("Error writing packet: %v", err)
+		}
+	}
+	if err := dst.WriteTrailer(); err != nil {
+		t.Fatalf("Error writing trailer: %v", err)
+	}
+	return last - first
+}
+
+// Packets of the segment, which has to be MPEG-TS
+func segmentPackets(t *testing.T, data []byte) ([]av.CodecData, []av.Packet) {
+	demux := ts.NewDemuxer(bytes.NewReader(data))
+	streams, err := demux.Streams()
+	if err != nil {
+		t.Fatalf("Error reading segment streams: %v", err)
+	}
+	var pkts []av.Packet
+	for {
+		pkt, err := demux.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading segment packet: %v", err)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return streams, pkts
+}
+
+func TestGoSegmenter(t *testing.T) {
+	s := NewGoSegmenter("test", SegmenterOptions{SegLength: 2 * time.Second, StartSeq: 5})
+	var segs []*VideoSegment
+	done := make(chan struct{})
+	go func() {
+		for seg := range s.Segments() {
+			segs = append(segs, seg)
+		}
+		close(done)
+	}()
+	duration := writeTestFLV(t, s)
+	<-done
+
+	if len(segs) < 3 {
+		t.Fatalf("Expecting several segments, got %v", len(segs))
+	}
+	var total time.Duration
+	for i, seg := range segs {
+		if seg.SeqNo != uint64(5+i) || seg.Name != fmt.Sprintf("test_%d.ts", 5+i) {
+			t.Errorf("Unexpected segment %v: %v", seg.SeqNo, seg.Name)
+		}
+		if seg.Format != stream.HLS || seg.Codec != av.H264 {
+			t.Errorf("Unexpected segment format %v codec %v", seg.Format, seg.Codec)
+		}
+		if seg.Length < s.SegLen && i < len(segs)-1 {
+			t.Errorf("Expecting segment %v to reach the target length, got %v", i, seg.Length)
+		}
+		total += seg.Length
+
+		// each segment holds both streams, starting with a keyframe
+		streams, pkts := segmentPackets(t, seg.Data)
+		if len(streams) != 2 {
+			t.Errorf("Expecting video and audio, got %v streams", len(streams))
+		}
+		for _, pkt := range pkts {
+			if streams[pkt.Idx].Type().IsVideo() {
+				if !pkt.IsKeyFrame {
+					t.Errorf("Expecting segment %v to start with a keyframe", i)
+				}
+				break
+			}
+		}
+	}
+	// durations add up to the stream, the last frame included
+	if total < duration || total > duration+100*time.Millisecond {
+		t.Errorf("Expecting segments to last %v, got %v", duration, total)
+	}
+
+	// nothing gets through once the stream ended
+	if err := s.WritePacket(av.Packet{}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestGoSegmenter_Defaults(t *testing.T) {
+	s := NewGoSegmenter("test", SegmenterOptions{})
+	if s.SegLen != 4*time.Second || s.seqNo != 0 {
+		t.Errorf("Unexpected defaults %v %v", s.SegLen, s.seqNo)
+	}
+	// ends without segments if the stream never sent any
+	s.WriteTrailer()
+	if _, ok := <-s.Segments(); ok {
+		t.Errorf("Expecting no segments")
+	}
+}
+
+// Joins the stream mid-GOP, leaving out the packets before the second video
+// frame
+type midGOP struct {
+	*GoSegmenter
+	streams []av.CodecData
+	frames  int
+}
+
+func (m *midGOP) WriteHeader(streams []av.CodecData) error {
+	m.streams = streams
+	return m.GoSegmenter.WriteHeader(streams)
+}
+
+func (m *midGOP) WritePacket(pkt av.Packet) error {
+	if m.streams[pkt.Idx].Type().IsVideo() {
+		m.frames++
+	}
+	if m.frames < 2 {
+		return nil
+	}
+	return m.GoSegmenter.WritePacket(pkt)
+}
+
+func segmentMidGOP(t *testing.T, opt SegmenterOptions) []*VideoSegment {
+	s := NewGoSegmenter("test", opt)
+	var segs []*VideoSegment
+	done := make(chan struct{})
+	go func() {
+		for seg := range s.Segments() {
+			segs = append(segs, seg)
+		}
+		close(done)
+	}()
+	writeTestFLV(t, &midGOP{GoSegmenter: s})
+	<-done
+	return segs
+}
+
+func TestGoSegmenter_EnforceKeyframe(t *testing.T) {
+	// marked either way
+	for _, opt := range []SegmenterOptions{
+		{SegLength: 2 * time.Second},
+		{SegLength: 2 * time.Second, EnforceKeyframe: true},
+		{SegLength: 2 * time.Second, DropNonKeyframe: true},
+	} {
+		segs := segmentMidGOP(t, opt)
+		if len(segs) < 3 {
+			t.Fatalf("Expecting several segments, got %v", len(segs))
+		}
+		for i, seg := range segs {
+			if seg.StartsWithKeyframe != (i > 0) || startsWithKeyframe(seg.Data) != (i > 0) {
+				t.Errorf("Unexpected keyframe at the start of segment %v with %+v", i, opt)
+			}
+		}
+	}
+
+	// and dropped if asked to
+	segs := segmentMidGOP(t, SegmenterOptions{SegLength: 2 * time.Second, EnforceKeyframe: true, DropNonKeyframe: true})
+	if len(segs) < 2 || segs[0].SeqNo != 1 {
+		t.Fatalf("Expecting the first segment to be dropped")
+	}
+	for _, seg := range segs {
+		if !seg.StartsWithKeyframe {
+			t.Errorf("Expecting segment %v to start with a keyframe", seg.SeqNo)
+		}
+	}
+
+	// intra frames that aren't IDR don't count
+	s := NewGoSegmenter("test", SegmenterOptions{SegLength: time.Second, EnforceKeyframe: true})
+	file, err := avutil.Open("test.flv")
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer file.Close()
+	streams, err := file.Streams()
+	if err != nil || !streams[0].Type().IsVideo() {
+		t.Fatalf("Expecting video first in test file, got %v", err)
+	}
+	if err := s.WriteHeader(streams[:1]); err != nil {
+		t.Fatalf("Error writing header: %v", err)
+	}
+	idr := []byte{0, 0, 0, 2, 0x65, 0x88}
+	intra := []byte{0, 0, 0, 2, 0x41, 0x9a}
+	for i, data := range [][]byte{idr, intra, intra, idr, intra} {
+		s.WritePacket(av.Packet{IsKeyFrame: i != 2 && i != 4, Time: time.Duration(i) * time.Second, Data: data})
+	}
+	s.WriteTrailer()
+	var lengths []time.Duration
+	for seg := range s.Segments() {
+		lengths = append(lengths, seg.Length)
+		if !seg.StartsWithKeyframe {
+			t.Errorf("Expecting segment %v to start with a keyframe", seg.SeqNo)
+		}
+	}
+	if len(lengths) != 2 || lengths[0] != 3*time.Second || lengths[1] != 2*time.Second {
+		t.Errorf("Expecting cuts only at IDR frames, got %v", lengths)
+	}
+}
+
+type testAppData struct{}
+
+func (testAppData) StreamID() string { return "test" }
+
+func TestGoRTMPSegmenter(t *testing.T) {
+	rs := stream.NewBasicRTMPVideoStream(testAppData{})
+	hs := stream.NewBasicHLSVideoStream("test", 100)
+	var added []*stream.HLSSegment
+	hs.SetSubscriber(func(seg *stream.HLSSegment, eof bool) {
+		if seg != nil {
+			added = append(added, seg)
+		}
+	})
+	if err := (GoRTMPSegmenter{}).SegmentRTMPToHLS(context.Background(), nil, hs, SegmenterOptions{}); err != ErrSegmenter {
+		t.Errorf("Expecting ErrSegmenter, got %v", err)
+	}
+
+	format.RegisterAll()
+	file, err := avutil.Open("test.flv")
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	eof, err := rs.WriteRTMPToStream(context.Background(), file)
+	if err != nil {
+		t.Fatalf("Error writing to stream: %v", err)
+	}
+	go func() { <-eof }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := (GoRTMPSegmenter{}).SegmentRTMPToHLS(ctx, rs, hs, SegmenterOptions{SegLength: 2 * time.Second}); err != nil {
+		t.Fatalf("Error segmenting: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Expecting the stream to end before the timeout")
+	}
+	if len(added) < 3 {
+		t.Fatalf("Expecting segments to be added, got %v", len(added))
+	}
+	for i, seg := range added {
+		if seg.SeqNo != uint64(i) || seg.Duration <= 0 || len(seg.Data) == 0 {
+			t.Errorf("Unexpected segment %v", seg)
+		}
+	}
+}
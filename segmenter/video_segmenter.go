@@ -15,6 +15,8 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/livepeer/joy4/av"
+	"github.com/livepeer/joy4/codec/h264parser"
+	"github.com/livepeer/joy4/format/ts"
 	"github.com/livepeer/lpms/ffmpeg"
 	"github.com/livepeer/lpms/stream"
 	"github.com/livepeer/m3u8"
@@ -28,7 +30,8 @@ var PlaylistRetryCount = 5
 var PlaylistRetryWait = 500 * time.Millisecond
 
 type SegmenterOptions struct {
-	EnforceKeyframe bool //Enforce each segment starts with a keyframe
+	EnforceKeyframe bool //Enforce each segment starts with a keyframe, cutting only at keyframes even past SegLength
+	DropNonKeyframe bool //With EnforceKeyframe, drop segments that still don't start with a keyframe
 	SegLength       time.Duration
 	StartSeq        int
 }
@@ -40,6 +43,9 @@ type VideoSegment struct {
 	Data   []byte
 	Name   string
 	SeqNo  uint64
+	// Whether decoders can start from the first video frame, which they
+	// can't for segments cut mid-GOP. Segments without video start anywhere.
+	StartsWithKeyframe bool
 }
 
 type VideoPlaylist struct {
@@ -53,6 +59,7 @@ type VideoSegmenter interface {
 }
 
 //FFMpegVideoSegmenter segments a RTMP stream by invoking FFMpeg and monitoring the file system.
+//FFMpeg cuts segments at video keyframes; with EnforceKeyframe, only at IDR frames.
 type FFMpegVideoSegmenter struct {
 	WorkDir        string
 	LocalRtmpUrl   string
@@ -62,13 +69,14 @@ type FFMpegVideoSegmenter struct {
 	curPlWaitTime  time.Duration
 	curSegWaitTime time.Duration
 	SegLen         time.Duration
+	opt            SegmenterOptions
 }
 
 func NewFFMpegVideoSegmenter(workDir string, strmID string, localRtmpUrl string, opt SegmenterOptions) *FFMpegVideoSegmenter {
 	if opt.SegLength == 0 {
 		opt.SegLength = time.Second * 4
 	}
-	return &FFMpegVideoSegmenter{WorkDir: workDir, StrmID: strmID, LocalRtmpUrl: localRtmpUrl, SegLen: opt.SegLength, curSegment: opt.StartSeq}
+	return &FFMpegVideoSegmenter{WorkDir: workDir, StrmID: strmID, LocalRtmpUrl: localRtmpUrl, SegLen: opt.SegLength, curSegment: opt.StartSeq, opt: opt}
 }
 
 //RTMPToHLS invokes FFMpeg to do the segmenting. This method blocks until the segmenter exits.
@@ -84,7 +92,11 @@ func (s *FFMpegVideoSegmenter) RTMPToHLS(ctx context.Context, cleanup bool) erro
 	outp := fmt.Sprintf("%s/%s.m3u8", s.WorkDir, s.StrmID)
 	ts_tmpl := fmt.Sprintf("%s/%s", s.WorkDir, s.StrmID) + "_%d.ts"
 	seglen := strconv.FormatFloat(s.SegLen.Seconds(), 'f', 6, 64)
-	ret := ffmpeg.RTMPToHLS(s.LocalRtmpUrl, outp, ts_tmpl, seglen, s.curSegment)
+	segment := ffmpeg.RTMPToHLS
+	if s.opt.EnforceKeyframe {
+		segment = ffmpeg.RTMPToHLSEnforceKeyframe
+	}
+	ret := segment(s.LocalRtmpUrl, outp, ts_tmpl, seglen, s.curSegment)
 	if cleanup {
 		s.Cleanup()
 	}
@@ -93,6 +105,16 @@ func (s *FFMpegVideoSegmenter) RTMPToHLS(ctx context.Context, cleanup bool) erro
 
 //PollSegment monitors the filesystem and returns a new segment as it becomes available
 func (s *FFMpegVideoSegmenter) PollSegment(ctx context.Context) (*VideoSegment, error) {
+	for {
+		seg, err := s.pollNextSegment(ctx)
+		if err != nil || seg == nil || seg.StartsWithKeyframe || !s.opt.EnforceKeyframe || !s.opt.DropNonKeyframe {
+			return seg, err
+		}
+		glog.Warningf("Dropping segment %v without a leading keyframe", seg.Name)
+	}
+}
+
+func (s *FFMpegVideoSegmenter) pollNextSegment(ctx context.Context) (*VideoSegment, error) {
 	var length time.Duration
 	curTsfn := s.WorkDir + "/" + s.StrmID + "_" + strconv.Itoa(s.curSegment) + ".ts"
 	nextTsfn := s.WorkDir + "/" + s.StrmID + "_" + strconv.Itoa(s.curSegment+1) + ".ts"
@@ -128,7 +150,7 @@ func (s *FFMpegVideoSegmenter) PollSegment(ctx context.Context) (*VideoSegment,
 
 	s.curSegment = s.curSegment + 1
 	// glog.Infof("Segment: %v, len:%v", name, len(seg))
-	return &VideoSegment{Codec: av.H264, Format: stream.HLS, Length: length, Data: seg, Name: name, SeqNo: uint64(s.curSegment - 1)}, err
+	return &VideoSegment{Codec: av.H264, Format: stream.HLS, Length: length, Data: seg, Name: name, SeqNo: uint64(s.curSegment - 1), StartsWithKeyframe: startsWithKeyframe(seg)}, err
 }
 
 //PollPlaylist monitors the filesystem and returns a new playlist as it becomes available
@@ -247,3 +269,43 @@ func (s *FFMpegVideoSegmenter) Cleanup() {
 		os.Remove(fn)
 	}
 }
+
+// Whether decoders can start from the video packet. For H.264 that takes an
+// IDR picture; RTMP flags other intra frames as keyframes too.
+func isKeyframe(typ av.CodecType, pkt av.Packet) bool {
+	if typ != av.H264 {
+		return pkt.IsKeyFrame
+	}
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == 5 { // IDR slice
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the first video packet of the MPEG-TS segment is a keyframe
+func startsWithKeyframe(data []byte) bool {
+	demux := ts.NewDemuxer(bytes.NewReader(data))
+	streams, err := demux.Streams()
+	if err != nil {
+		return false
+	}
+	video := false
+	for _, st := range streams {
+		video = video || st.Type().IsVideo()
+	}
+	if !video {
+		return true
+	}
+	for {
+		pkt, err := demux.ReadPacket()
+		if err != nil {
+			return false
+		}
+		if typ := streams[pkt.Idx].Type(); typ.IsVideo() {
+			return isKeyframe(typ, pkt)
+		}
+	}
+}
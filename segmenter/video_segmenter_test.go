@@ -525,3 +525,43 @@ func TestMissingKeyframe(t *testing.T) {
 		return
 	}
 }
+
+func TestEnforceKeyframe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lp-"+t.Name())
+	if err != nil {
+		t.Fatalf("Unable to get tempfile %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// open GOPs, where only the first keyframe is an IDR frame
+	fname := path.Join(dir, "open-gop.flv")
+	cmd := "-i test.flv -t 6 -c:a copy -c:v libx264 -x264-params keyint=30:min-keyint=30:scenecut=0:open_gop=1 -y " + fname
+	if err := exec.Command("ffmpeg", strings.Split(cmd, " ")...).Run(); err != nil {
+		t.Fatalf("Unable to run 'ffmpeg %v' - %v", cmd, err)
+	}
+
+	ffmpeg.InitFFmpeg()
+	err = ffmpeg.RTMPToHLS(fname, path.Join(dir, "any.m3u8"), path.Join(dir, "any")+"_%d.ts", "1", 0)
+	if err != nil {
+		t.Fatalf("Error segmenting - %v", err)
+	}
+	seg, err := ioutil.ReadFile(path.Join(dir, "any_1.ts"))
+	if err != nil {
+		t.Fatalf("Expecting segments cut at the intra frames - %v", err)
+	}
+	if startsWithKeyframe(seg) {
+		t.Errorf("Expecting a segment starting with an intra frame not to start with a keyframe")
+	}
+
+	err = ffmpeg.RTMPToHLSEnforceKeyframe(fname, path.Join(dir, "idr.m3u8"), path.Join(dir, "idr")+"_%d.ts", "1", 0)
+	if err != nil {
+		t.Fatalf("Error segmenting - %v", err)
+	}
+	seg, err = ioutil.ReadFile(path.Join(dir, "idr_0.ts"))
+	if err != nil || !startsWithKeyframe(seg) {
+		t.Errorf("Expecting a segment starting with the IDR frame - %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "idr_1.ts")); !os.IsNotExist(err) {
+		t.Errorf("Expecting segments cut only at IDR frames - %v", err)
+	}
+}
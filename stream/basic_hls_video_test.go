@@ -1,8 +1,17 @@
 package stream
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/livepeer/lpms/encryption"
+	"github.com/livepeer/lpms/scte35"
 	"github.com/livepeer/m3u8"
 )
 
@@ -171,3 +180,157 @@ func TestWindowSize(t *testing.T) {
 		t.Errorf("Expecting test2, but got %v", ml.Variants[0].URI)
 	}
 }
+
+func TestCueTags(t *testing.T) {
+	strm := NewBasicHLSVideoStream("test", 8)
+	out := &scte35.Event{Command: scte35.SpliceInsert, OutOfNetwork: true, BreakDuration: 6 * time.Second, Section: []byte{0xfc, 1}}
+	in := &scte35.Event{Command: scte35.SpliceInsert}
+	short := &scte35.Event{Command: scte35.SpliceInsert, OutOfNetwork: true, BreakDuration: 4 * time.Second, Section: []byte{0xfc, 2}}
+	events := [][]*scte35.Event{nil, {out}, nil, {in}, {in}, {short}, nil, nil}
+	for i, e := range events {
+		seg := &HLSSegment{SeqNo: uint64(i), Name: fmt.Sprintf("test%d.ts", i), Duration: 2, SpliceEvents: e}
+		if err := strm.AddHLSSegment(seg); err != nil {
+			t.Fatalf("Error adding segment: %v", err)
+		}
+	}
+	pl, err := strm.GetStreamPlaylist()
+	if err != nil {
+		t.Fatalf("Error getting playlist: %v", err)
+	}
+	var tags []string
+	for _, l := range strings.Split(pl.String(), "\n") {
+		if strings.HasPrefix(l, "#EXT-X-CUE") || strings.HasPrefix(l, "#EXT-OATCLS") || strings.HasPrefix(l, "test") {
+			tags = append(tags, l)
+		}
+	}
+	expected := []string{
+		"test0.ts",
+		"#EXT-OATCLS-SCTE35:/AE=",
+		"#EXT-X-CUE-OUT:6",
+		"test1.ts",
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=2,Duration=6,SCTE35=/AE=",
+		"test2.ts",
+		"#EXT-X-CUE-IN",
+		"test3.ts",
+		// no break to return from
+		"test4.ts",
+		"#EXT-OATCLS-SCTE35:/AI=",
+		"#EXT-X-CUE-OUT:4",
+		"test5.ts",
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=2,Duration=4,SCTE35=/AI=",
+		"test6.ts",
+		// returns after the duration of the break
+		"#EXT-X-CUE-IN",
+		"test7.ts",
+	}
+	if strings.Join(tags, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting cue tags\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(tags, "\n"))
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	strm := NewBasicHLSVideoStream("test", 4)
+	if err := strm.SetEncryption(&HLSEncryption{Method: encryption.AES128}); err != ErrHLSEncryption {
+		t.Errorf("Expecting ErrHLSEncryption without keys, got %v", err)
+	}
+	if err := strm.SetEncryption(&HLSEncryption{Method: "NONE", Keys: encryption.NewLocalKeyProvider("/keys/")}); err != ErrHLSEncryption {
+		t.Errorf("Expecting ErrHLSEncryption for unknown method, got %v", err)
+	}
+	keys := encryption.NewLocalKeyProvider("/keys/")
+	if err := strm.SetEncryption(&HLSEncryption{Method: encryption.AES128, Keys: keys, RotateEvery: 2}); err != nil {
+		t.Fatalf("Error setting encryption: %v", err)
+	}
+	var subscribed []*HLSSegment
+	strm.SetSubscriber(func(seg *HLSSegment, eof bool) { subscribed = append(subscribed, seg) })
+	data := []byte("segment data")
+	for i := 0; i < 4; i++ {
+		seg := &HLSSegment{SeqNo: uint64(i), Name: fmt.Sprintf("test%d.ts", i), Data: data, Duration: 2}
+		if err := strm.AddHLSSegment(seg); err != nil {
+			t.Fatalf("Error adding segment: %v", err)
+		}
+		if !bytes.Equal(seg.Data, data) {
+			t.Errorf("Expecting the added segment to be left alone")
+		}
+	}
+
+	// stored encrypted, with the key of their period and their own IV
+	for i := 0; i < 4; i++ {
+		seg, err := strm.GetHLSSegment(fmt.Sprintf("test%d.ts", i))
+		if err != nil {
+			t.Fatalf("Error getting segment: %v", err)
+		}
+		if subscribed[i] != seg {
+			t.Errorf("Expecting the subscriber to get the stored segment")
+		}
+		key := keys.Lookup(fmt.Sprintf("/keys/test/%d.key", i/2))
+		if key == nil {
+			t.Fatalf("Expecting key for period %d", i/2)
+		}
+		block, _ := aes.NewCipher(key.Key)
+		out := make([]byte, len(seg.Data))
+		cipher.NewCBCDecrypter(block, encryption.SequenceIV(uint64(i))).CryptBlocks(out, seg.Data)
+		if !bytes.Equal(out[:len(data)], data) {
+			t.Errorf("Expecting segment %d to decrypt, got %q", i, out)
+		}
+	}
+	if keys.Lookup("/keys/test/2.key") != nil {
+		t.Errorf("Expecting keys to rotate every other segment")
+	}
+
+	pl, err := strm.GetStreamPlaylist()
+	if err != nil {
+		t.Fatalf("Error getting playlist: %v", err)
+	}
+	var tags []string
+	for _, l := range strings.Split(pl.String(), "\n") {
+		if strings.HasPrefix(l, "#EXT-X-KEY") {
+			tags = append(tags, l)
+		}
+	}
+	expected := []string{
+		`#EXT-X-KEY:METHOD=AES-128,URI="/keys/test/0.key",IV=0x00000000000000000000000000000000`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/keys/test/0.key",IV=0x00000000000000000000000000000001`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/keys/test/1.key",IV=0x00000000000000000000000000000002`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/keys/test/1.key",IV=0x00000000000000000000000000000003`,
+	}
+	if strings.Join(tags, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting key tags\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(tags, "\n"))
+	}
+	if pl.Version() != 3 {
+		t.Errorf("Expecting version 3, got %v", pl.Version())
+	}
+
+	// keys go away with the last segment of their period in the playlist
+	for i := 4; i < 7; i++ {
+		if err := strm.AddHLSSegment(&HLSSegment{SeqNo: uint64(i), Name: fmt.Sprintf("test%d.ts", i), Data: data, Duration: 2}); err != nil {
+			t.Fatalf("Error adding segment: %v", err)
+		}
+		if i == 4 && (keys.Lookup("/keys/test/0.key") == nil || keys.Lookup("/keys/test/1.key") == nil) {
+			t.Errorf("Expecting keys of the segments left in the playlist")
+		}
+	}
+	if keys.Lookup("/keys/test/0.key") != nil || keys.Lookup("/keys/test/1.key") == nil {
+		t.Errorf("Expecting only the key of period 0 to expire")
+	}
+
+	// SAMPLE-AES only goes into MPEG-TS, and needs a newer playlist
+	strm = NewBasicHLSVideoStream("test", 1)
+	strm.SetEncryption(&HLSEncryption{Method: encryption.SampleAES, Keys: keys})
+	if err := strm.AddHLSSegment(&HLSSegment{Name: "bad.ts", Data: data}); err != encryption.ErrInvalidTS {
+		t.Errorf("Expecting ErrInvalidTS, got %v", err)
+	}
+	if _, err := strm.GetHLSSegment("bad.ts"); err != ErrNotFound {
+		t.Errorf("Expecting segment that failed to encrypt to be left out")
+	}
+	ts, err := ioutil.ReadFile("../data/bad-cuvid.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strm.AddHLSSegment(&HLSSegment{Name: "test.ts", Data: ts, Duration: 2}); err != nil {
+		t.Fatalf("Error adding segment: %v", err)
+	}
+	pl, _ = strm.GetStreamPlaylist()
+	if !strings.Contains(pl.String(), `#EXT-X-KEY:METHOD=SAMPLE-AES,URI="/keys/test/0.key"`) || pl.Version() != 5 {
+		t.Errorf("Expecting SAMPLE-AES key in version 5 playlist, got\n%v", pl)
+	}
+}
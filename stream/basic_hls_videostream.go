@@ -1,11 +1,14 @@
 package stream
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/livepeer/lpms/encryption"
+	"github.com/livepeer/lpms/scte35"
 	"github.com/livepeer/m3u8"
 )
 
@@ -17,6 +20,15 @@ const DefaultSegWaitTime = time.Second * 10
 const SegWaitInterval = time.Second
 
 var ErrAddHLSSegment = errors.New("ErrAddHLSSegment")
+var ErrHLSEncryption = errors.New("ErrHLSEncryption")
+
+//HLSEncryption is how the segments of a stream get encrypted
+type HLSEncryption struct {
+	Method encryption.Method
+	Keys   encryption.KeyProvider
+	// Segments encrypted with each key before it rotates, 0 to never rotate
+	RotateEvery uint64
+}
 
 //BasicHLSVideoStream is a basic implementation of HLSVideoStream
 type BasicHLSVideoStream struct {
@@ -27,6 +39,12 @@ type BasicHLSVideoStream struct {
 	strmID     string
 	subscriber func(*HLSSegment, bool)
 	winSize    uint
+
+	// The break the stream is out on, and how long it has been out
+	cueOut     *scte35.Event
+	cueElapsed float64
+
+	encryption *HLSEncryption
 }
 
 func NewBasicHLSVideoStream(strmID string, wSize uint) *BasicHLSVideoStream {
@@ -50,6 +68,18 @@ func (s *BasicHLSVideoStream) SetSubscriber(f func(seg *HLSSegment, eof bool)) {
 	s.subscriber = f
 }
 
+//SetEncryption encrypts the segments added from now on. Segments are stored
+//and handed to the subscriber encrypted, and the playlist gets their keys.
+func (s *BasicHLSVideoStream) SetEncryption(enc *HLSEncryption) error {
+	if enc == nil || enc.Keys == nil || (enc.Method != encryption.AES128 && enc.Method != encryption.SampleAES) {
+		return ErrHLSEncryption
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.encryption = enc
+	return nil
+}
+
 //GetStreamID returns the streamID
 func (s *BasicHLSVideoStream) GetStreamID() string { return s.strmID }
 
@@ -86,8 +116,16 @@ func (s *BasicHLSVideoStream) AddHLSSegment(seg *HLSSegment) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	var key *m3u8.Key
+	if s.encryption != nil {
+		var err error
+		if seg, key, err = s.encrypt(seg); err != nil {
+			return err
+		}
+	}
+
 	//Add segment to media playlist and buffer
-	s.plCache.AppendSegment(&m3u8.MediaSegment{SeqId: seg.SeqNo, Duration: seg.Duration, URI: seg.Name})
+	s.plCache.AppendSegment(&m3u8.MediaSegment{SeqId: seg.SeqNo, Duration: seg.Duration, URI: seg.Name, SCTE: s.cueTag(seg), Key: key})
 	s.segNames = append(s.segNames, seg.Name)
 	s.segMap[seg.Name] = seg
 	if s.plCache.Count() > s.winSize {
@@ -95,6 +133,7 @@ func (s *BasicHLSVideoStream) AddHLSSegment(seg *HLSSegment) error {
 		toRemove := s.segNames[0]
 		delete(s.segMap, toRemove)
 		s.segNames = s.segNames[1:]
+		s.expireKeys()
 	}
 
 	//Call subscriber
@@ -105,6 +144,79 @@ func (s *BasicHLSVideoStream) AddHLSSegment(seg *HLSSegment) error {
 	return nil
 }
 
+// Copy of the segment with its data encrypted, along with its key tag. Each
+// segment gets its own IV, so each gets a tag.
+func (s *BasicHLSVideoStream) encrypt(seg *HLSSegment) (*HLSSegment, *m3u8.Key, error) {
+	var period uint64
+	if s.encryption.RotateEvery > 0 {
+		period = seg.SeqNo / s.encryption.RotateEvery
+	}
+	key, err := s.encryption.Keys.Key(s.strmID, period)
+	if err != nil {
+		return nil, nil, err
+	}
+	iv := encryption.SequenceIV(seg.SeqNo)
+	data, err := encryption.Encrypt(s.encryption.Method, seg.Data, key.Key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.encryption.Method == encryption.SampleAES && s.plCache.Version() < 5 {
+		// SAMPLE-AES is only allowed from version 5 on
+		s.plCache.SetVersion(5)
+	}
+	enc := *seg
+	enc.Data = data
+	return &enc, &m3u8.Key{Method: string(s.encryption.Method), URI: key.URI, IV: fmt.Sprintf("0x%x", iv)}, nil
+}
+
+// Lets the key provider drop the keys of periods no segment in the playlist
+// uses anymore.
+func (s *BasicHLSVideoStream) expireKeys() {
+	if s.encryption == nil || s.encryption.RotateEvery == 0 || len(s.segNames) == 0 {
+		return
+	}
+	oldest := s.segMap[s.segNames[0]].SeqNo
+	s.encryption.Keys.Expire(s.strmID, oldest/s.encryption.RotateEvery)
+}
+
+// Cue tag of the segment, from the breaks its splice events start and end.
+// Breaks that give a duration end after it even without an event.
+func (s *BasicHLSVideoStream) cueTag(seg *HLSSegment) *m3u8.SCTE {
+	var tag *m3u8.SCTE
+	if s.cueOut != nil && s.cueOut.Duration() > 0 && s.cueElapsed >= s.cueOut.Duration().Seconds() {
+		tag = &m3u8.SCTE{Syntax: m3u8.SCTE35_OATCLS, CueType: m3u8.SCTE35Cue_End}
+		s.cueOut = nil
+	}
+	for _, e := range seg.SpliceEvents {
+		if e.Out() {
+			s.cueOut, s.cueElapsed = e, 0
+			tag = &m3u8.SCTE{
+				Syntax:  m3u8.SCTE35_OATCLS,
+				CueType: m3u8.SCTE35Cue_Start,
+				Cue:     base64.StdEncoding.EncodeToString(e.Section),
+				Time:    e.Duration().Seconds(),
+			}
+		} else if e.In() && s.cueOut != nil {
+			s.cueOut = nil
+			tag = &m3u8.SCTE{Syntax: m3u8.SCTE35_OATCLS, CueType: m3u8.SCTE35Cue_End}
+		}
+	}
+	if s.cueOut == nil {
+		return tag
+	}
+	if tag == nil {
+		tag = &m3u8.SCTE{
+			Syntax:  m3u8.SCTE35_OATCLS,
+			CueType: m3u8.SCTE35Cue_Mid,
+			Cue:     base64.StdEncoding.EncodeToString(s.cueOut.Section),
+			Time:    s.cueOut.Duration().Seconds(),
+			Elapsed: s.cueElapsed,
+		}
+	}
+	s.cueElapsed += seg.Duration
+	return tag
+}
+
 func (s *BasicHLSVideoStream) End() {
 	if s.subscriber != nil {
 		s.subscriber(nil, true)
@@ -7,6 +7,7 @@ import (
 
 	"time"
 
+	"github.com/livepeer/lpms/scte35"
 	"github.com/livepeer/m3u8"
 )
 
@@ -76,6 +77,8 @@ type HLSSegment struct {
 	Data        []byte
 	Duration    float64
 	IsZeroFrame bool
+	// SCTE-35 events splicing during the segment, in order
+	SpliceEvents []*scte35.Event
 }
 
 //Compare playlists by segments
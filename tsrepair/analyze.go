@@ -0,0 +1,517 @@
+package tsrepair
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+// Indicators of ETSI TR 101 290, and of other problems AnalyzeTS finds
+const (
+	TSSyncLoss           = "1.1 TS_sync_loss"
+	SyncByteError        = "1.2 Sync_byte_error"
+	PATError             = "1.3 PAT_error"
+	ContinuityCountError = "1.4 Continuity_count_error"
+	PMTError             = "1.5 PMT_error"
+	PIDError             = "1.6 PID_error"
+	TransportError       = "2.1 Transport_error"
+	PCRRepetitionError   = "2.3 PCR_repetition_error"
+	PCRDiscontinuity     = "2.3 PCR_discontinuity_indicator_error"
+	PTSError             = "2.5 PTS_error"
+	TimestampGap         = "Timestamp_gap"
+	TimestampBackwards   = "Timestamp_backwards"
+	TimestampRepeat      = "Timestamp_repeat"
+	MissingTimestamps    = "Missing_timestamps"
+	TruncatedPacket      = "Truncated_packet"
+)
+
+// Limits of TR 101 290
+const (
+	tableInterval        = 500 * time.Millisecond
+	pidInterval          = 5 * time.Second
+	pcrInterval          = 40 * time.Millisecond
+	pcrJump              = 100 * time.Millisecond
+	ptsInterval          = 700 * time.Millisecond
+	syncPackets          = 5
+	timestampGapFrames   = 4
+	minTimestampGap      = 100 * time.Millisecond
+	maxReportedKeyframes = 1000
+)
+
+// Analysis is what AnalyzeTS found in a segment.
+type Analysis struct {
+	Packets int
+	// Bytes outside of any packet
+	DroppedBytes int
+	// Time spanned by the PCRs of the PCR PID, zero without any
+	Duration time.Duration
+	PMTPID   int
+	PCRPID   int
+	// In order of PID
+	PIDs     []*PIDInfo
+	Problems []Problem
+}
+
+// PIDInfo describes the packets of a PID.
+type PIDInfo struct {
+	PID uint16
+	// PAT, PMT, video, audio, data or null
+	Kind string
+	// Stream type in the PMT, zero if the PID isn't listed
+	StreamType uint8
+	Packets    int
+	// Continuity counter errors
+	ContinuityErrors int
+	// PCRs, and the shortest and longest time between them
+	PCRs                           int
+	MinPCRInterval, MaxPCRInterval time.Duration
+	// PES packets, and how many of them lack timestamps
+	PES               int
+	MissingTimestamps int
+	// Earliest and latest PTS, and the first and last decode timestamps. For
+	// PES packets without a DTS, that is their PTS.
+	MinPTS, MaxPTS    time.Duration
+	FirstDTS, LastDTS time.Duration
+	// PTS of video frames that decoding can start from
+	Keyframes []time.Duration
+}
+
+// Problem is a kind of problem found in a segment.
+type Problem struct {
+	// TR 101 290 priority, zero for problems outside of it
+	Priority  int
+	Indicator string
+	// PID affected, -1 for the whole segment
+	PID int
+	// Occurrences, and the packet and details of the first one
+	Count  int
+	Packet int
+	Detail string
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %d time(s), first at packet %d", p.Indicator, p.Count, p.Packet)
+	if p.PID >= 0 {
+		s = fmt.Sprintf("PID %d %s", p.PID, s)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / 90000
+}
+
+type analyzer struct {
+	a        *Analysis
+	pids     map[uint16]*PIDInfo
+	problems map[string]*Problem
+	order    []string
+}
+
+// Counts a problem, keeping the details of its first occurrence
+func (z *analyzer) problem(priority int, indicator string, pid int, pkt int, format string, args ...interface{}) {
+	key := fmt.Sprintf("%s/%d", indicator, pid)
+	if p, ok := z.problems[key]; ok {
+		p.Count++
+		return
+	}
+	z.problems[key] = &Problem{
+		Priority:  priority,
+		Indicator: indicator,
+		PID:       pid,
+		Count:     1,
+		Packet:    pkt,
+		Detail:    fmt.Sprintf(format, args...),
+	}
+	z.order = append(z.order, key)
+}
+
+func (z *analyzer) pid(pid uint16) *PIDInfo {
+	info, ok := z.pids[pid]
+	if !ok {
+		info = &PIDInfo{PID: pid}
+		z.pids[pid] = info
+	}
+	return info
+}
+
+// Splits data into packets like splitPackets, reporting sync problems.
+// Sync is lost when a packet doesn't start with a sync byte after
+// syncPackets packets that did.
+func (z *analyzer) sync(data []byte) []*packet {
+	var pkts []*packet
+	good := 0
+	for off := 0; off < len(data); {
+		if off+packetSize > len(data) {
+			z.problem(0, TruncatedPacket, -1, len(pkts), "%d bytes at the end", len(data)-off)
+			z.a.DroppedBytes += len(data) - off
+			break
+		}
+		if data[off] == syncByte {
+			pkts = append(pkts, &packet{b: data[off : off+packetSize]})
+			good++
+			off += packetSize
+			continue
+		}
+		z.problem(1, SyncByteError, -1, len(pkts), "0x%02x at byte %d", data[off], off)
+		if good >= syncPackets {
+			z.problem(1, TSSyncLoss, -1, len(pkts), "at byte %d", off)
+		}
+		good = 0
+		next := off + 1
+		for next < len(data) && !(data[next] == syncByte &&
+			(next+packetSize >= len(data) || data[next+packetSize] == syncByte)) {
+			next++
+		}
+		z.a.DroppedBytes += next - off
+		off = next
+	}
+	return pkts
+}
+
+// AnalyzeTS reports the PIDs of a TS segment, their timing and keyframes,
+// and problems found in it: TR 101 290 priority 1 errors, some of priority 2,
+// and timestamp gaps and jumps.
+func AnalyzeTS(data []byte) *Analysis {
+	a := &Analysis{PMTPID: -1, PCRPID: -1}
+	z := &analyzer{a: a, pids: map[uint16]*PIDInfo{}, problems: map[string]*Problem{}}
+	pkts := z.sync(data)
+	a.Packets = len(pkts)
+
+	// tables
+	pmtPID, _, havePAT := findPAT(pkts)
+	var streams []tsio.ElementaryStreamInfo
+	if havePAT {
+		a.PMTPID = int(pmtPID)
+		for _, p := range pkts {
+			if tableid, _, section, ok := psiSection(p, pmtPID); ok && tableid == tsio.TableIdPMT {
+				if pcr, s, ok := parsePMT(section); ok {
+					a.PCRPID, streams = int(pcr), s
+					break
+				}
+			}
+		}
+	}
+	for _, s := range streams {
+		info := z.pid(s.ElementaryPID)
+		info.StreamType = s.StreamType
+	}
+
+	z.packets(pkts, havePAT, pmtPID)
+	times := packetTimes(pkts, a.PCRPID)
+	if len(times) > 0 {
+		a.Duration = times[len(times)-1] - times[0]
+	}
+	z.tables(pkts, times, havePAT, pmtPID, streams)
+	z.timestamps(pkts)
+
+	for _, info := range z.pids {
+		a.PIDs = append(a.PIDs, info)
+	}
+	sort.Slice(a.PIDs, func(i, j int) bool { return a.PIDs[i].PID < a.PIDs[j].PID })
+	for _, key := range z.order {
+		a.Problems = append(a.Problems, *z.problems[key])
+	}
+	sort.SliceStable(a.Problems, func(i, j int) bool {
+		pi, pj := a.Problems[i].Priority, a.Problems[j].Priority
+		return pi != 0 && (pj == 0 || pi < pj)
+	})
+	return a
+}
+
+// Per packet checks: transport errors, continuity counters and PCRs
+func (z *analyzer) packets(pkts []*packet, havePAT bool, pmtPID uint16) {
+	type ccState struct {
+		cc      byte
+		last    []byte
+		repeats int
+	}
+	ccs := map[uint16]*ccState{}
+	lastPCR := map[uint16]int64{}
+	for i, p := range pkts {
+		pid := mpegts.PID(p.b)
+		info := z.pid(pid)
+		info.Packets++
+		if p.b[1]&0x80 != 0 {
+			z.problem(2, TransportError, int(pid), i, "transport_error_indicator set")
+		}
+		if pid == nullPID {
+			continue
+		}
+
+		cc := p.b[3] & 0x0f
+		s, ok := ccs[pid]
+		switch {
+		case !ok || mpegts.Discontinuity(p.b):
+			ccs[pid] = &ccState{cc: cc, last: p.b}
+		case mpegts.HasPayload(p.b) && cc == s.cc && string(p.b) == string(s.last):
+			s.repeats++
+			if s.repeats > 1 {
+				info.ContinuityErrors++
+				z.problem(1, ContinuityCountError, int(pid), i, "packet repeated %d times", s.repeats+1)
+			}
+		default:
+			want := s.cc
+			if mpegts.HasPayload(p.b) {
+				want = (s.cc + 1) & 0x0f
+			}
+			if cc != want {
+				info.ContinuityErrors++
+				z.problem(1, ContinuityCountError, int(pid), i, "counter %d, expected %d", cc, want)
+			}
+			s.cc, s.last, s.repeats = cc, p.b, 0
+		}
+
+		if af := mpegts.AdaptationField(p.b); len(af) >= 7 && af[0]&0x10 != 0 {
+			pcr := readPCR(af[1:])
+			if prev, ok := lastPCR[pid]; ok {
+				pcr = unwrap(pcr, prev)
+				d := ticksToDuration(pcr - prev)
+				if !mpegts.Discontinuity(p.b) {
+					if d < 0 || d > pcrJump {
+						z.problem(2, PCRDiscontinuity, int(pid), i, "PCR moved by %v", d)
+					}
+					if info.PCRs == 1 || d < info.MinPCRInterval {
+						info.MinPCRInterval = d
+					}
+					if d > info.MaxPCRInterval {
+						info.MaxPCRInterval = d
+					}
+					if d > pcrInterval {
+						z.problem(2, PCRRepetitionError, int(pid), i, "%v between PCRs", d)
+					}
+				}
+			}
+			lastPCR[pid] = pcr
+			info.PCRs++
+		}
+
+		switch {
+		case pid == tsio.PAT_PID:
+			info.Kind = "PAT"
+		case havePAT && pid == pmtPID:
+			info.Kind = "PMT"
+		}
+	}
+	if info, ok := z.pids[nullPID]; ok {
+		info.Kind = "null"
+	}
+}
+
+// 90kHz base of the PCR at b
+func readPCR(b []byte) int64 {
+	return int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4]>>7)
+}
+
+// Time of each packet, interpolated between the PCRs of the PCR PID. Nil
+// without at least two PCRs.
+func packetTimes(pkts []*packet, pcrPID int) []time.Duration {
+	type point struct {
+		i   int
+		pcr int64
+	}
+	var points []point
+	for i, p := range pkts {
+		if pcrPID >= 0 && int(mpegts.PID(p.b)) != pcrPID {
+			continue
+		}
+		af := mpegts.AdaptationField(p.b)
+		if len(af) < 7 || af[0]&0x10 == 0 {
+			continue
+		}
+		pcr := readPCR(af[1:])
+		if len(points) > 0 {
+			pcr = unwrap(pcr, points[len(points)-1].pcr)
+		}
+		if pcrPID < 0 {
+			pcrPID = int(mpegts.PID(p.b))
+		}
+		points = append(points, point{i, pcr})
+	}
+	if len(points) < 2 || points[len(points)-1].i == points[0].i {
+		return nil
+	}
+	first, last := points[0], points[len(points)-1]
+	perPacket := float64(last.pcr-first.pcr) / float64(last.i-first.i)
+	times := make([]time.Duration, len(pkts))
+	k := 0
+	for i := range pkts {
+		for k+1 < len(points)-1 && points[k+1].i <= i {
+			k++
+		}
+		a, b := points[k], points[k+1]
+		rate := perPacket
+		if b.i > a.i && i >= a.i && i <= b.i {
+			rate = float64(b.pcr-a.pcr) / float64(b.i-a.i)
+		}
+		times[i] = ticksToDuration(a.pcr + int64(rate*float64(i-a.i)))
+	}
+	return times
+}
+
+// Checks PAT and PMT repetition, and that the PIDs of the PMT show up
+func (z *analyzer) tables(pkts []*packet, times []time.Duration, havePAT bool, pmtPID uint16, streams []tsio.ElementaryStreamInfo) {
+	if !havePAT {
+		z.problem(1, PATError, tsio.PAT_PID, 0, "no PAT")
+	} else if z.a.PCRPID < 0 {
+		z.problem(1, PMTError, int(pmtPID), 0, "no PMT")
+	}
+
+	// time of the previous occurrence, starting from the segment start
+	var start time.Duration
+	if len(times) > 0 {
+		start = times[0]
+	}
+	lastSeen := map[uint16]time.Duration{}
+	seen := map[uint16]bool{}
+	check := func(pid uint16, i int, limit time.Duration, priority int, indicator, what string) {
+		if times == nil {
+			return
+		}
+		prev, ok := lastSeen[pid]
+		if !ok {
+			prev = start
+		}
+		if d := times[i] - prev; d > limit {
+			z.problem(priority, indicator, int(pid), i, "%s after %v", what, d)
+		}
+		lastSeen[pid] = times[i]
+	}
+	listed := map[uint16]bool{}
+	for _, s := range streams {
+		listed[s.ElementaryPID] = true
+	}
+	for i, p := range pkts {
+		pid := mpegts.PID(p.b)
+		seen[pid] = true
+		scrambled := p.b[3]&0xc0 != 0
+		switch {
+		case pid == tsio.PAT_PID:
+			if scrambled {
+				z.problem(1, PATError, int(pid), i, "scrambled PAT")
+			}
+			if tableid, _, _, ok := psiSection(p, pid); ok {
+				if tableid != tsio.TableIdPAT {
+					z.problem(1, PATError, int(pid), i, "table id %d on the PAT PID", tableid)
+				}
+				check(pid, i, tableInterval, 1, PATError, "PAT")
+			}
+		case havePAT && pid == pmtPID:
+			if scrambled {
+				z.problem(1, PMTError, int(pid), i, "scrambled PMT")
+			}
+			if tableid, _, _, ok := psiSection(p, pid); ok && tableid == tsio.TableIdPMT {
+				check(pid, i, tableInterval, 1, PMTError, "PMT")
+			}
+		case listed[pid]:
+			check(pid, i, pidInterval, 1, PIDError, "packet")
+		}
+	}
+	for _, s := range streams {
+		if !seen[s.ElementaryPID] {
+			z.problem(1, PIDError, int(s.ElementaryPID), 0, "PID in the PMT is missing")
+		}
+	}
+}
+
+// Checks the PES timestamps of each PID, and finds video keyframes
+func (z *analyzer) timestamps(pkts []*packet) {
+	streams, ids := findPES(pkts)
+	for pid, hs := range streams {
+		info := z.pid(pid)
+		info.PES = len(hs)
+		if info.Kind == "" {
+			info.Kind = "audio"
+			if isVideoStream(ids[pid]) {
+				info.Kind = "video"
+			}
+		}
+		d := ticksToDuration(frameDuration(hs))
+		var prev *pes
+		var lastPTS time.Duration
+		for _, h := range hs {
+			if !h.hasTimestamps() {
+				info.MissingTimestamps++
+				z.problem(0, MissingTimestamps, int(pid), h.first, "PES without PTS")
+				continue
+			}
+			pts, dts := ticksToDuration(h.pts), ticksToDuration(h.decodeTS())
+			if prev == nil {
+				info.MinPTS, info.MaxPTS, info.FirstDTS = pts, pts, dts
+			} else {
+				if pts < info.MinPTS {
+					info.MinPTS = pts
+				}
+				if pts > info.MaxPTS {
+					info.MaxPTS = pts
+				}
+				gap := dts - info.LastDTS
+				switch {
+				case gap == 0:
+					z.problem(0, TimestampRepeat, int(pid), h.first, "decode timestamp %v repeated", dts)
+				case gap < 0:
+					z.problem(0, TimestampBackwards, int(pid), h.first, "decode timestamp went back %v to %v", -gap, dts)
+				case d > 0 && gap > timestampGapFrames*d && gap > minTimestampGap:
+					z.problem(0, TimestampGap, int(pid), h.first, "%v between decode timestamps, %v typical", gap, d)
+				}
+				if info.Kind == "video" && pts-lastPTS > ptsInterval {
+					z.problem(2, PTSError, int(pid), h.first, "%v between PTS", pts-lastPTS)
+				}
+			}
+			info.LastDTS, lastPTS, prev = dts, pts, h
+			if info.Kind == "video" && len(info.Keyframes) < maxReportedKeyframes && isKeyframe(pkts[h.first], info.StreamType) {
+				info.Keyframes = append(info.Keyframes, pts)
+			}
+		}
+	}
+	for _, info := range z.pids {
+		switch {
+		case info.Kind != "":
+		case isVideo(info.StreamType):
+			info.Kind = "video"
+		case isAudio(info.StreamType):
+			info.Kind = "audio"
+		default:
+			info.Kind = "data"
+		}
+	}
+}
+
+// Whether the video PES starting in the packet is a random access point:
+// flagged as one, or holding an H.264 IDR slice or HEVC IRAP picture.
+func isKeyframe(p *packet, streamType uint8) bool {
+	if af := mpegts.AdaptationField(p.b); len(af) > 0 && af[0]&0x40 != 0 {
+		return true
+	}
+	payload := mpegts.Payload(p.b)
+	if len(payload) < 9 || 9+int(payload[8]) >= len(payload) {
+		return false
+	}
+	es := payload[9+int(payload[8]):]
+	if streamType == 0 {
+		streamType = videoStreamType(es)
+	}
+	for i := 0; i+3 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		hdr := es[i+3]
+		switch streamType {
+		case tsio.ElementaryStreamTypeH264:
+			if hdr&0x1f == 5 {
+				return true
+			}
+		case streamTypeHEVC:
+			if typ := (hdr >> 1) & 0x3f; typ >= 16 && typ <= 23 {
+				return true
+			}
+		}
+	}
+	return false
+}
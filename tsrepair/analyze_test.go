@@ -0,0 +1,109 @@
+package tsrepair
+
+import (
+	"testing"
+
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Problem with the indicator on the PID, nil if there is none
+func findProblem(a *Analysis, indicator string, pid int) *Problem {
+	for i, p := range a.Problems {
+		if p.Indicator == indicator && p.PID == pid {
+			return &a.Problems[i]
+		}
+	}
+	return nil
+}
+
+func TestAnalyzeTS_Clean(t *testing.T) {
+	data := readSample(t, "transmux.ts")
+	a := AnalyzeTS(data)
+	assert.Equal(t, len(data)/packetSize, a.Packets)
+	assert.Equal(t, 0, a.DroppedBytes)
+	assert.Equal(t, tsio.PMT_PID, a.PMTPID)
+	assert.Equal(t, 0xff, a.PCRPID)
+	for _, p := range a.Problems {
+		assert.NotEqual(t, 1, p.Priority, p.String())
+	}
+
+	var video *PIDInfo
+	for _, info := range a.PIDs {
+		if info.PID == 0xff {
+			video = info
+		}
+	}
+	require.NotNil(t, video)
+	assert.Equal(t, "video", video.Kind)
+	assert.Equal(t, uint8(tsio.ElementaryStreamTypeH264), video.StreamType)
+	assert.Equal(t, 0, video.ContinuityErrors)
+	assert.Equal(t, 0, video.MissingTimestamps)
+	assert.True(t, video.PCRs > 0)
+	assert.True(t, video.MaxPTS > video.MinPTS)
+	require.Len(t, video.Keyframes, 2)
+	assert.Equal(t, video.MinPTS, video.Keyframes[0])
+}
+
+func TestAnalyzeTS_Packets(t *testing.T) {
+	data := readSample(t, "transmux.ts")
+	var damaged []byte
+	damaged = append(damaged, data[:40*packetSize]...)
+	damaged = append(damaged, data[41*packetSize:]...) // packet 40 missing
+	a := AnalyzeTS(damaged)
+	lost := &packet{b: data[40*packetSize : 41*packetSize]}
+	p := findProblem(a, ContinuityCountError, int(mpegts.PID(lost.b)))
+	require.NotNil(t, p)
+	assert.Equal(t, 1, p.Count)
+	assert.Equal(t, 40, p.Packet)
+	assert.Equal(t, 1, a.Problems[0].Priority)
+
+	damaged = append([]byte(nil), data...)
+	damaged[60*packetSize] = 0x48 // not a sync byte
+	damaged = damaged[:len(damaged)-100]
+	a = AnalyzeTS(damaged)
+	p = findProblem(a, SyncByteError, -1)
+	require.NotNil(t, p)
+	assert.Equal(t, 1, p.Count)
+	assert.Equal(t, 60, p.Packet)
+	assert.NotNil(t, findProblem(a, TSSyncLoss, -1))
+	assert.NotNil(t, findProblem(a, TruncatedPacket, -1))
+	assert.Equal(t, packetSize+packetSize-100, a.DroppedBytes)
+}
+
+func TestAnalyzeTS_Tables(t *testing.T) {
+	data := readSample(t, "bad-cuvid.ts")
+	var stripped []byte
+	for i := 0; i+packetSize <= len(data); i += packetSize {
+		if b := data[i : i+packetSize]; mpegts.PID(b) != tsio.PAT_PID {
+			stripped = append(stripped, b...)
+		}
+	}
+	a := AnalyzeTS(stripped)
+	assert.Equal(t, -1, a.PMTPID)
+	assert.NotNil(t, findProblem(a, PATError, tsio.PAT_PID))
+}
+
+func TestAnalyzeTS_Timestamps(t *testing.T) {
+	a := AnalyzeTS(readSample(t, "duplicate-audio-dts.ts"))
+	p := findProblem(a, TimestampRepeat, 256)
+	require.NotNil(t, p)
+	assert.Equal(t, 18, p.Count)
+	assert.Nil(t, findProblem(a, TimestampBackwards, 256))
+
+	// fixed by Repair
+	out, _, err := Repair(readSample(t, "duplicate-audio-dts.ts"))
+	require.NoError(t, err)
+	assert.Nil(t, findProblem(AnalyzeTS(out), TimestampRepeat, 256))
+
+	a = AnalyzeTS(readSample(t, "missing-sei-and-pes.ts"))
+	p = findProblem(a, MissingTimestamps, 256)
+	require.NotNil(t, p)
+	assert.Equal(t, 4, p.Count)
+
+	// video PID without any packets
+	a = AnalyzeTS(readSample(t, "zero-frame.ts"))
+	assert.NotNil(t, findProblem(a, PIDError, 256))
+}
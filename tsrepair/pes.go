@@ -0,0 +1,466 @@
+package tsrepair
+
+import (
+	"sort"
+
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+const (
+	// PES timestamps are 33 bits of 90kHz ticks
+	tsMask = 1<<33 - 1
+	// Longest gap between PES packets taken as a frame duration
+	maxFrameDuration = 10 * 90000
+)
+
+// Timestamps of a PES packet
+type pes struct {
+	// Packet starting the PES packet, and offset of its PES header
+	first  int
+	offset int
+	flags  byte
+	// PTS, and DTS if the PES has one. Unwrapped, so they compare across
+	// 33 bit wraparounds.
+	pts, dts int64
+	// Whether a PES without timestamps starts a frame, rather than holding
+	// the rest of a frame split over several PES packets
+	startsFrame bool
+}
+
+// Decode timestamp: the DTS, or the PTS if the two are the same
+func (p *pes) decodeTS() int64 {
+	if p.flags == 3 {
+		return p.dts
+	}
+	return p.pts
+}
+
+func (p *pes) hasTimestamps() bool {
+	return p.flags >= 2
+}
+
+// Timestamp of the 5 bytes at b
+func readTS(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// Writes a timestamp with the 4 bit prefix of its field
+func putTS(b []byte, prefix byte, ts int64) {
+	ts &= tsMask
+	b[0] = prefix<<4 | byte(ts>>29)&0x0e | 1
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xfe | 1
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1) | 1
+}
+
+// Closest value to near with the same 33 bits as ts
+func unwrap(ts, near int64) int64 {
+	d := (ts - near) & tsMask
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return near + d
+}
+
+// Stream id of audio and video PES packets, which carry timestamps
+func isAudioStream(streamid byte) bool {
+	return streamid >= 0xc0 && streamid <= 0xdf || streamid == 0xbd
+}
+
+func isVideoStream(streamid byte) bool {
+	return streamid >= 0xe0 && streamid <= 0xef
+}
+
+// Whether the elementary stream data starts with a start code, or the sync
+// word of an audio frame
+func startsFrame(streamid byte, es []byte) bool {
+	if len(es) < 4 {
+		return false
+	}
+	if isVideoStream(streamid) {
+		return es[0] == 0 && es[1] == 0 && (es[2] == 1 || es[2] == 0 && es[3] == 1)
+	}
+	return es[0] == 0xff && es[1]&0xe0 == 0xe0 || es[0] == 0x0b && es[1] == 0x77
+}
+
+// PES packets of each audio and video PID, and their stream ids
+func findPES(pkts []*packet) (map[uint16][]*pes, map[uint16]byte) {
+	streams := map[uint16][]*pes{}
+	ids := map[uint16]byte{}
+	for i, p := range pkts {
+		if !mpegts.Start(p.b) {
+			continue
+		}
+		payload := mpegts.Payload(p.b)
+		if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			continue
+		}
+		if sid := payload[3]; !isAudioStream(sid) && !isVideoStream(sid) {
+			continue
+		}
+		if 9+int(payload[8]) > len(payload) {
+			continue
+		}
+		h := &pes{first: i, offset: packetSize - len(payload), flags: payload[7] >> 6}
+		switch {
+		case h.flags == 2 && len(payload) >= 14:
+			h.pts = readTS(payload[9:])
+		case h.flags == 3 && len(payload) >= 19:
+			h.pts = readTS(payload[9:])
+			h.dts = readTS(payload[14:])
+		case h.flags != 0:
+			// broken or cut off header, leave it alone
+			continue
+		}
+		if h.flags == 0 {
+			h.startsFrame = startsFrame(payload[3], payload[9+int(payload[8]):])
+		}
+		pid := mpegts.PID(p.b)
+		if prev := streams[pid]; h.hasTimestamps() {
+			// unwrap against the latest timestamps of the PID
+			for j := len(prev) - 1; j >= 0; j-- {
+				if !prev[j].hasTimestamps() {
+					continue
+				}
+				if h.flags == 3 {
+					h.dts = unwrap(h.dts, prev[j].decodeTS())
+					h.pts = unwrap(h.pts, h.dts)
+				} else {
+					h.pts = unwrap(h.pts, prev[j].decodeTS())
+				}
+				break
+			}
+		}
+		streams[pid] = append(streams[pid], h)
+		ids[pid] = payload[3]
+	}
+	return streams, ids
+}
+
+// Typical gap between the decode timestamps of consecutive PES packets,
+// zero if there aren't enough timestamps to tell
+func frameDuration(hs []*pes) int64 {
+	var gaps []int64
+	var prev *pes
+	for _, h := range hs {
+		if !h.hasTimestamps() {
+			prev = nil
+			continue
+		}
+		if prev != nil {
+			if d := h.decodeTS() - prev.decodeTS(); d > 0 && d <= maxFrameDuration {
+				gaps = append(gaps, d)
+			}
+		}
+		prev = h
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+// Fixes audio timestamps that repeat or go backwards, and gives PES packets
+// without timestamps some, estimated from the neighbouring packets of the
+// PID. Packets gaining a timestamp get a PTS equal to their DTS, which is
+// exact for audio and an approximation for video with reordered frames.
+// Video packets with only a PTS that would decode out of order get a DTS,
+// and video packets with a PTS before their DTS are put back in order.
+func repairTimestamps(pkts []*packet, r *Report) []*packet {
+	streams, ids := findPES(pkts)
+	grown := map[int]bool{}
+	for pid, hs := range streams {
+		d := frameDuration(hs)
+		if d == 0 {
+			continue
+		}
+		if isAudioStream(ids[pid]) {
+			r.DuplicateAudioDTS += fixDuplicates(pkts, hs, d)
+		}
+		video := isVideoStream(ids[pid])
+		if video {
+			r.PTSBeforeDTS += fixPTSBeforeDTS(pkts, hs)
+		}
+		missing := fixMissing(hs, d)
+		if video {
+			missing = append(missing, fixPTSOnly(hs, d)...)
+		}
+		for _, i := range missing {
+			grown[i] = true
+			r.MissingDTS++
+		}
+	}
+	if len(grown) == 0 {
+		return pkts
+	}
+
+	// rebuild the PES packets whose headers have grown
+	replaced := map[int][]*packet{}
+	for pid, hs := range streams {
+		for _, h := range hs {
+			if grown[h.first] {
+				repacketize(pkts, pid, h, replaced)
+			}
+		}
+	}
+	out := make([]*packet, 0, len(pkts)+len(grown))
+	for i, p := range pkts {
+		if ps, ok := replaced[i]; ok {
+			out = append(out, ps...)
+		} else {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Fixes repeated or backwards audio timestamps. Encoders repeating a
+// timestamp usually stamped a nearby frame a frame early or late, leaving a
+// gap of two frames next to a collision, so the frames between the gap and
+// the repeat move by a frame to close both. Anything else moves to a frame
+// after the previous timestamp. Returns the number of timestamps that
+// repeated or went backwards.
+func fixDuplicates(pkts []*packet, hs []*pes, d int64) int {
+	// how far to look for a gap around a repeated timestamp
+	const reach = 8
+	var stamped []*pes
+	for _, h := range hs {
+		if h.hasTimestamps() {
+			stamped = append(stamped, h)
+		}
+	}
+	ts := make([]int64, len(stamped))
+	for i, h := range stamped {
+		ts[i] = h.decodeTS()
+	}
+	gap := func(i int) bool {
+		return ts[i]-ts[i-1] > d+d/2
+	}
+	found := 0
+	for i := 1; i < len(ts); i++ {
+		if stamped[i].decodeTS() <= stamped[i-1].decodeTS() {
+			found++
+		}
+		if ts[i] > ts[i-1] {
+			continue
+		}
+		if ts[i] == ts[i-1] {
+			back, fwd := -1, -1
+			for j := i - 1; j >= 1 && j >= i-reach; j-- {
+				if gap(j) {
+					back = j
+					break
+				}
+			}
+			for k := i + 1; k < len(ts) && k <= i+reach; k++ {
+				if gap(k) {
+					fwd = k
+					break
+				}
+			}
+			switch {
+			case back >= 0 && (fwd < 0 || i-back <= fwd-i):
+				for j := back; j < i; j++ {
+					ts[j] -= d
+				}
+			case fwd >= 0:
+				for k := i; k < fwd; k++ {
+					ts[k] += d
+				}
+			}
+		}
+		if ts[i] <= ts[i-1] {
+			ts[i] = ts[i-1] + d
+		}
+	}
+	for i, h := range stamped {
+		if ts[i] != h.decodeTS() {
+			setTimestamps(pkts, h, ts[i])
+		}
+	}
+	return found
+}
+
+// Moves the decode timestamp of the PES to ts, keeping the PTS offset, and
+// rewrites its header in place
+func setTimestamps(pkts []*packet, h *pes, ts int64) {
+	shift := ts - h.decodeTS()
+	h.pts += shift
+	hdr := pkts[h.first].b[h.offset:]
+	if h.flags == 3 {
+		h.dts += shift
+		putTS(hdr[9:], 0x3, h.pts)
+		putTS(hdr[14:], 0x1, h.dts)
+	} else {
+		putTS(hdr[9:], 0x2, h.pts)
+	}
+}
+
+// Estimates timestamps for PES packets starting frames without any, from
+// the closest earlier frame with timestamps, or the closest later one for
+// frames at the start. Returns the first packets of the PES packets to be
+// given the estimates.
+func fixMissing(hs []*pes, d int64) []int {
+	var frames []*pes
+	for _, h := range hs {
+		if h.hasTimestamps() || h.startsFrame {
+			frames = append(frames, h)
+		}
+	}
+	next := -1
+	for i, h := range frames {
+		if h.hasTimestamps() {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return nil
+	}
+	for i := next - 1; i >= 0; i-- {
+		frames[i].pts = frames[i+1].decodeTS() - d
+	}
+	for i := next + 1; i < len(frames); i++ {
+		if !frames[i].hasTimestamps() {
+			frames[i].pts = frames[i-1].decodeTS() + d
+		}
+	}
+	var missing []int
+	for _, h := range frames {
+		if !h.hasTimestamps() {
+			h.flags = 2
+			missing = append(missing, h.first)
+		}
+	}
+	return missing
+}
+
+// Moves the DTS of video PES packets presented before they are decoded back
+// to their PTS, as long as decoding stays in order, and their PTS forward to
+// the DTS otherwise. Rewrites the headers in place and returns the number of
+// packets fixed.
+func fixPTSBeforeDTS(pkts []*packet, hs []*pes) int {
+	fixed := 0
+	var prev *pes
+	for _, h := range hs {
+		if !h.hasTimestamps() {
+			continue
+		}
+		if h.flags == 3 && h.pts < h.dts {
+			fixed++
+			if prev == nil || h.pts > prev.decodeTS() {
+				h.dts = h.pts
+			} else {
+				h.pts = h.dts
+			}
+			hdr := pkts[h.first].b[h.offset:]
+			putTS(hdr[9:], 0x3, h.pts)
+			putTS(hdr[14:], 0x1, h.dts)
+		}
+		prev = h
+	}
+	return fixed
+}
+
+// Gives video PES packets with only a PTS a DTS when their PTS, standing in
+// for it, would decode them after the next packet. The DTS goes a frame after
+// the previous decode timestamp, or halfway to the next one if that's closer.
+// Returns the first packets of the PES packets to be given a DTS.
+func fixPTSOnly(hs []*pes, d int64) []int {
+	var stamped []*pes
+	for _, h := range hs {
+		if h.hasTimestamps() {
+			stamped = append(stamped, h)
+		}
+	}
+	var fixed []int
+	for i := 1; i+1 < len(stamped); i++ {
+		h, prev, next := stamped[i], stamped[i-1].decodeTS(), stamped[i+1].decodeTS()
+		if h.flags != 2 || h.pts < next {
+			continue
+		}
+		dts := prev + d
+		if dts >= next {
+			dts = prev + (next-prev)/2
+		}
+		if dts > prev {
+			h.flags, h.dts = 3, dts
+			fixed = append(fixed, h.first)
+		}
+	}
+	return fixed
+}
+
+// Rebuilds the packets of a PES packet to fit the timestamps added to its
+// header. The packets keep their adaptation fields, and any bytes that no
+// longer fit go into packets following the last one.
+func repacketize(pkts []*packet, pid uint16, h *pes, replaced map[int][]*packet) {
+	idx := []int{h.first}
+	for i := h.first + 1; i < len(pkts); i++ {
+		if p := pkts[i]; mpegts.PID(p.b) == pid {
+			if mpegts.Start(p.b) {
+				break
+			}
+			idx = append(idx, i)
+		}
+	}
+	var data []byte
+	for _, i := range idx {
+		data = append(data, mpegts.Payload(pkts[i].b)...)
+	}
+
+	// timestamps go first among the optional fields, replacing those there
+	var old int
+	switch data[7] >> 6 {
+	case 2:
+		old = 5
+	case 3:
+		old = 10
+	}
+	var ts []byte
+	if h.flags == 3 {
+		ts = make([]byte, 10)
+		putTS(ts, 0x3, h.pts)
+		putTS(ts[5:], 0x1, h.dts)
+	} else {
+		ts = make([]byte, 5)
+		putTS(ts, 0x2, h.pts)
+	}
+	added := len(ts) - old
+	grown := make([]byte, 0, len(data)+added)
+	grown = append(grown, data[:9]...)
+	grown = append(grown, ts...)
+	grown = append(grown, data[9+old:]...)
+	grown[7] = grown[7]&0x3f | h.flags<<6
+	grown[8] += byte(added)
+	if n := int(grown[4])<<8 | int(grown[5]); n > 0 {
+		n += added
+		if n > 0xffff {
+			n = 0
+		}
+		grown[4], grown[5] = byte(n>>8), byte(n)
+	}
+
+	data = grown
+	for k, i := range idx {
+		orig := pkts[i]
+		af := mpegts.AdaptationField(orig.b)
+		if len(data) == 0 && len(af) == 0 {
+			replaced[i] = nil
+			continue
+		}
+		p, n := newPacket(pid, k == 0, af, data)
+		p.b[3] |= orig.b[3] & 0x0f
+		data = data[n:]
+		replaced[i] = []*packet{p}
+	}
+	last := idx[len(idx)-1]
+	for len(data) > 0 {
+		p, n := newPacket(pid, false, nil, data)
+		data = data[n:]
+		replaced[last] = append(replaced[last], p)
+	}
+}
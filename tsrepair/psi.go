@@ -0,0 +1,252 @@
+package tsrepair
+
+import (
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+// Stream types not defined by joy4
+const (
+	streamTypeMPEG2Video = 0x02
+	streamTypeMPEG1Audio = 0x03
+	streamTypeHEVC       = 0x24
+	streamTypeMPEG2Audio = 0x04
+	streamTypeLATMAAC    = 0x11
+	streamTypeAC3        = 0x81
+)
+
+// Most streams fitting a PMT in a single packet
+const maxStreams = (packetSize - 4 - tsio.PSIHeaderLength - 4 - 4) / 5
+
+// Adds a PAT and PMT to segments missing them. The PMT lists the streams
+// found in the PES packets of the segment.
+func repairTables(pkts []*packet, r *Report) []*packet {
+	pmtPID, program, havePAT := findPAT(pkts)
+	havePMT := false
+	if havePAT {
+		havePMT = findTable(pkts, pmtPID, tsio.TableIdPMT)
+	} else {
+		pmtPID, havePMT = findPMT(pkts)
+		program = 1
+	}
+	if havePAT && havePMT {
+		return pkts
+	}
+
+	var tables []*packet
+	if !havePMT {
+		streams := findStreams(pkts)
+		if len(streams) == 0 {
+			return pkts
+		}
+		if len(streams) > maxStreams {
+			streams = streams[:maxStreams]
+		}
+		if !havePAT {
+			pmtPID = unusedPID(pkts, tsio.PMT_PID)
+		}
+		tables = append(tables, pmtPacket(pmtPID, program, streams))
+		r.InsertedPMT = true
+	}
+	if !havePAT {
+		tables = append([]*packet{patPacket(program, pmtPID)}, tables...)
+		r.InsertedPAT = true
+	}
+	return append(tables, pkts...)
+}
+
+// Parses the PSI section starting in the packet, if any
+func psiSection(p *packet, pid uint16) (tableid uint8, tableext uint16, section []byte, ok bool) {
+	if mpegts.PID(p.b) != pid || !mpegts.Start(p.b) {
+		return 0, 0, nil, false
+	}
+	payload := mpegts.Payload(p.b)
+	tableid, tableext, hdrlen, datalen, err := tsio.ParsePSI(payload)
+	if err != nil || hdrlen+datalen > len(payload) {
+		return 0, 0, nil, false
+	}
+	return tableid, tableext, payload[hdrlen : hdrlen+datalen], true
+}
+
+// PMT PID and program number of the first program in the PAT
+func findPAT(pkts []*packet) (uint16, uint16, bool) {
+	for _, p := range pkts {
+		tableid, _, section, ok := psiSection(p, tsio.PAT_PID)
+		if !ok || tableid != tsio.TableIdPAT {
+			continue
+		}
+		var pat tsio.PAT
+		if _, err := pat.Unmarshal(section); err != nil {
+			continue
+		}
+		for _, e := range pat.Entries {
+			if e.ProgramNumber != 0 {
+				return e.ProgramMapPID, e.ProgramNumber, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func findTable(pkts []*packet, pid uint16, tableid uint8) bool {
+	for _, p := range pkts {
+		if id, _, _, ok := psiSection(p, pid); ok && id == tableid {
+			return true
+		}
+	}
+	return false
+}
+
+// PID of a PMT not listed in any PAT
+func findPMT(pkts []*packet) (uint16, bool) {
+	for _, p := range pkts {
+		pid := mpegts.PID(p.b)
+		if pid == tsio.PAT_PID || pid == nullPID {
+			continue
+		}
+		tableid, _, section, ok := psiSection(p, pid)
+		if !ok || tableid != tsio.TableIdPMT {
+			continue
+		}
+		if _, _, ok := parsePMT(section); ok {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+// PCR PID and streams of a PMT section, skipping descriptors. tsio.PMT
+// rejects descriptors that end the section, which most PMTs with any have.
+func parsePMT(section []byte) (uint16, []tsio.ElementaryStreamInfo, bool) {
+	if len(section) < 4 {
+		return 0, nil, false
+	}
+	pcr := uint16(section[0]&0x1f)<<8 | uint16(section[1])
+	n := 4 + (int(section[2]&0x03)<<8 | int(section[3]))
+	var streams []tsio.ElementaryStreamInfo
+	for n+5 <= len(section) {
+		streams = append(streams, tsio.ElementaryStreamInfo{
+			StreamType:    section[n],
+			ElementaryPID: uint16(section[n+1]&0x1f)<<8 | uint16(section[n+2]),
+		})
+		n += 5 + (int(section[n+3]&0x03)<<8 | int(section[n+4]))
+	}
+	return pcr, streams, n == len(section)
+}
+
+// Elementary streams of the PES packets, in order of appearance
+func findStreams(pkts []*packet) []tsio.ElementaryStreamInfo {
+	var streams []tsio.ElementaryStreamInfo
+	seen := map[uint16]bool{}
+	for _, p := range pkts {
+		pid := mpegts.PID(p.b)
+		if seen[pid] || !mpegts.Start(p.b) {
+			continue
+		}
+		payload := mpegts.Payload(p.b)
+		if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			continue
+		}
+		seen[pid] = true
+		es := payload[9:]
+		if hdrlen := 9 + int(payload[8]); hdrlen < len(payload) {
+			es = payload[hdrlen:]
+		}
+		if typ := streamType(payload[3], es); typ != 0 {
+			streams = append(streams, tsio.ElementaryStreamInfo{StreamType: typ, ElementaryPID: pid})
+		}
+	}
+	return streams
+}
+
+// Guesses the stream type from the stream id and the start of the
+// elementary stream. Zero if unknown.
+func streamType(streamid uint8, es []byte) uint8 {
+	switch {
+	case streamid >= 0xe0 && streamid <= 0xef:
+		return videoStreamType(es)
+	case streamid >= 0xc0 && streamid <= 0xdf:
+		// ADTS has layer 0, MPEG audio doesn't
+		if len(es) >= 2 && es[0] == 0xff && es[1]&0xf6 == 0xf0 {
+			return tsio.ElementaryStreamTypeAdtsAAC
+		}
+		return streamTypeMPEG1Audio
+	case streamid == 0xbd:
+		if len(es) >= 2 && es[0] == 0x0b && es[1] == 0x77 {
+			return streamTypeAC3
+		}
+	}
+	return 0
+}
+
+// MPEG-2 video starts with a sequence header, HEVC with an AUD or VPS whose
+// two byte NAL header has a layer id of 0. Anything else is taken to be H.264.
+func videoStreamType(es []byte) uint8 {
+	for i := 0; i+4 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		hdr := es[i+3:]
+		if hdr[0] == 0xb3 {
+			return streamTypeMPEG2Video
+		}
+		typ := (hdr[0] >> 1) & 0x3f
+		if hdr[0]&0x81 == 0 && hdr[1] == 1 && (typ == 35 || typ == 32) {
+			return streamTypeHEVC
+		}
+		break
+	}
+	return tsio.ElementaryStreamTypeH264
+}
+
+// First PID from pid on that the segment doesn't use
+func unusedPID(pkts []*packet, pid uint16) uint16 {
+	used := map[uint16]bool{}
+	for _, p := range pkts {
+		used[mpegts.PID(p.b)] = true
+	}
+	for used[pid] {
+		pid++
+	}
+	return pid
+}
+
+// Packet holding a single PSI section
+func psiPacket(pid uint16, tableid uint8, tableext uint16, section func(b []byte) int) *packet {
+	payload := make([]byte, packetSize-4)
+	for i := range payload {
+		payload[i] = 0xff
+	}
+	n := section(payload[tsio.PSIHeaderLength:])
+	tsio.FillPSI(payload, tableid, tableext, n)
+	p, _ := newPacket(pid, true, nil, payload)
+	return p
+}
+
+func patPacket(program, pmtPID uint16) *packet {
+	pat := tsio.PAT{Entries: []tsio.PATEntry{{ProgramNumber: program, ProgramMapPID: pmtPID}}}
+	return psiPacket(tsio.PAT_PID, tsio.TableIdPAT, tsio.TableExtPAT, pat.Marshal)
+}
+
+func pmtPacket(pid, program uint16, streams []tsio.ElementaryStreamInfo) *packet {
+	pmt := tsio.PMT{PCRPID: streams[0].ElementaryPID, ElementaryStreamInfos: streams}
+	for _, s := range streams {
+		if isVideo(s.StreamType) {
+			pmt.PCRPID = s.ElementaryPID
+			break
+		}
+	}
+	return psiPacket(pid, tsio.TableIdPMT, program, pmt.Marshal)
+}
+
+func isVideo(typ uint8) bool {
+	return typ == tsio.ElementaryStreamTypeH264 || typ == streamTypeHEVC || typ == streamTypeMPEG2Video
+}
+
+func isAudio(typ uint8) bool {
+	switch typ {
+	case tsio.ElementaryStreamTypeAdtsAAC, streamTypeMPEG1Audio, streamTypeMPEG2Audio, streamTypeLATMAAC, streamTypeAC3:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Package tsrepair sanitizes MPEG-TS segments ahead of transcoding.
+//
+// Segments from unreliable sources often carry damage that demuxers either
+// choke on or handle inconsistently: partial packets, broken continuity
+// counters, PES packets without timestamps, audio timestamps that repeat, and
+// missing program tables. Repair fixes what it can in a copy of the segment
+// and reports what it changed, so that
+//
+//	data, report, err := tsrepair.Repair(segment)
+//
+// can run before handing the segment to the transcoder.
+package tsrepair
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/livepeer/lpms/internal/mpegts"
+)
+
+var ErrNoPackets = errors.New("TSRepairNoPackets")
+
+const (
+	packetSize = mpegts.PacketSize
+	syncByte   = mpegts.SyncByte
+	nullPID    = mpegts.NullPID
+)
+
+// Report describes what Repair changed in a segment.
+type Report struct {
+	// Partial packets, and other bytes between packets, that were dropped
+	TruncatedPackets int
+	DroppedBytes     int
+	// Packets whose continuity counter was rewritten
+	ContinuityErrors int
+	// PES packets that were given timestamps they lacked. Packets without any
+	// get a PTS at their estimated decode time, which serves as their DTS too.
+	// Video packets with only a PTS, which would decode after the next packet
+	// with the PTS standing in for the DTS, get a DTS of their own.
+	MissingDTS int
+	// Video PES packets presented before they are decoded. The DTS moves
+	// back to the PTS, or the PTS forward to the DTS where moving the DTS
+	// would reorder decoding.
+	PTSBeforeDTS int
+	// Audio PES packets whose timestamp repeated or went backwards. Fixing
+	// them may move the timestamps of a few neighbouring packets too.
+	DuplicateAudioDTS int
+	// Program tables added to a segment that had none
+	InsertedPAT bool
+	InsertedPMT bool
+}
+
+// Changed is whether Repair changed anything.
+func (r Report) Changed() bool {
+	return r != Report{}
+}
+
+// A packet of the repaired segment
+type packet struct {
+	b []byte
+	// Created by the repair rather than taken from the input, so its
+	// continuity counter isn't an error of the input
+	created bool
+}
+
+// Builds a packet carrying the adaptation field af, without stuffing, and as
+// much of payload as fits. Returns the packet and the payload bytes it holds.
+func newPacket(pid uint16, start bool, af, payload []byte) (*packet, int) {
+	b, n := mpegts.NewPacket(pid, start, af, payload)
+	return &packet{b: b, created: true}, n
+}
+
+// Repair returns a repaired copy of the TS segment in data, along with a
+// report of what was changed. Segments that need no repair are returned as
+// an identical copy with an empty report.
+func Repair(data []byte) ([]byte, Report, error) {
+	var r Report
+	pkts := splitPackets(data, &r)
+	if len(pkts) == 0 {
+		return nil, r, ErrNoPackets
+	}
+	pkts = repairTimestamps(pkts, &r)
+	pkts = repairTables(pkts, &r)
+	repairContinuity(pkts, &r)
+
+	out := make([]byte, 0, len(pkts)*packetSize)
+	for _, p := range pkts {
+		out = append(out, p.b...)
+	}
+	return out, r, nil
+}
+
+// Splits data into packets, dropping partial packets and anything else that
+// isn't on a packet boundary. A position is taken to be a packet boundary if
+// it has a sync byte, and so does the next one.
+func splitPackets(data []byte, r *Report) []*packet {
+	synced := func(i int) bool {
+		if i+packetSize > len(data) || data[i] != syncByte {
+			return false
+		}
+		next := i + packetSize
+		return next == len(data) || data[next] == syncByte ||
+			// trailing bytes too short to be a packet
+			next+packetSize > len(data)
+	}
+	var pkts []*packet
+	for i := 0; i < len(data); {
+		if synced(i) {
+			b := make([]byte, packetSize)
+			copy(b, data[i:])
+			pkts = append(pkts, &packet{b: b})
+			i += packetSize
+			continue
+		}
+		j := i + 1
+		for j < len(data) && !synced(j) {
+			j++
+		}
+		r.TruncatedPackets++
+		r.DroppedBytes += j - i
+		i = j
+	}
+	return pkts
+}
+
+// Rewrites continuity counters so they increment by one for each packet
+// carrying payload, apart from where the input signals a discontinuity.
+// Packets repeated as is keep the counter of the original. Counters after an
+// error are renumbered, so each error of the input counts once.
+func repairContinuity(pkts []*packet, r *Report) {
+	type state struct {
+		// Counter of the previous packet, as it came in and as it goes out
+		in, out byte
+		// Previous packet as it came in
+		last []byte
+	}
+	pids := map[uint16]*state{}
+	for _, p := range pkts {
+		pid := mpegts.PID(p.b)
+		if pid == nullPID {
+			continue
+		}
+		in := append([]byte(nil), p.b...)
+		cc := p.b[3] & 0x0f
+		s, ok := pids[pid]
+		if !ok || mpegts.Discontinuity(p.b) {
+			pids[pid] = &state{in: cc, out: cc, last: in}
+			continue
+		}
+		repeated := bytes.Equal(in, s.last)
+		want, expected := s.out, s.in
+		if mpegts.HasPayload(p.b) && !repeated {
+			want, expected = (s.out+1)&0x0f, (s.in+1)&0x0f
+		}
+		if cc != expected && !p.created {
+			r.ContinuityErrors++
+		}
+		p.b[3] = p.b[3]&0xf0 | want
+		s.in, s.out, s.last = cc, want, in
+	}
+}
@@ -0,0 +1,231 @@
+package tsrepair
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/livepeer/joy4/format/ts/tsio"
+	"github.com/livepeer/lpms/internal/mpegts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readSample(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("..", "data", name))
+	require.NoError(t, err)
+	return data
+}
+
+// Repairs data, checking the result needs no further repair
+func repair(t *testing.T, data []byte) ([]byte, Report) {
+	t.Helper()
+	out, r, err := Repair(data)
+	require.NoError(t, err)
+	again, r2, err := Repair(out)
+	require.NoError(t, err)
+	assert.False(t, r2.Changed(), "%+v", r2)
+	assert.Equal(t, out, again)
+	return out, r
+}
+
+// Checks the decode timestamps of each PID with timestamps increase, and
+// come no later than the presentation timestamps
+func checkTimestamps(t *testing.T, data []byte) {
+	t.Helper()
+	streams, _ := findPES(splitPackets(data, &Report{}))
+	for pid, hs := range streams {
+		for i, h := range hs {
+			require.True(t, h.hasTimestamps(), "pid %d pes %d", pid, i)
+			require.True(t, h.pts >= h.decodeTS(), "pid %d pes %d", pid, i)
+			if i > 0 {
+				require.True(t, h.decodeTS() > hs[i-1].decodeTS(), "pid %d pes %d", pid, i)
+			}
+		}
+	}
+}
+
+// Header of the nth video PES packet of data, which is edited in place
+func videoPES(t *testing.T, data []byte, n int) (*pes, []byte) {
+	t.Helper()
+	pkts := splitPackets(data, &Report{})
+	streams, ids := findPES(pkts)
+	for pid, hs := range streams {
+		if isVideoStream(ids[pid]) {
+			h := hs[n]
+			return h, data[h.first*packetSize+h.offset:]
+		}
+	}
+	require.Fail(t, "no video")
+	return nil, nil
+}
+
+func TestRepair_Clean(t *testing.T) {
+	// the odd timestamps of missing-dts.ts are those of decoded frames; its
+	// PES headers are fine
+	for _, name := range []string{"transmux.ts", "bad-cuvid.ts", "zero-frame.ts", "missing-dts.ts", "kryp-1.ts"} {
+		data := readSample(t, name)
+		out, r := repair(t, data)
+		assert.False(t, r.Changed(), name)
+		assert.Equal(t, data, out, name)
+	}
+
+	_, _, err := Repair(make([]byte, 1000))
+	assert.Equal(t, ErrNoPackets, err)
+}
+
+func TestRepair_DuplicateAudioDTS(t *testing.T) {
+	data := readSample(t, "duplicate-audio-dts.ts")
+	out, r := repair(t, data)
+	assert.Equal(t, Report{DuplicateAudioDTS: 18}, r)
+	assert.Equal(t, len(data), len(out))
+	checkTimestamps(t, out)
+}
+
+func TestRepair_MissingTimestamps(t *testing.T) {
+	// four video frames without timestamps, following one with a DTS of 0.3s
+	data := readSample(t, "missing-sei-and-pes.ts")
+	out, r := repair(t, data)
+	assert.Equal(t, Report{MissingDTS: 4}, r)
+	checkTimestamps(t, out)
+
+	streams, ids := findPES(splitPackets(out, &Report{}))
+	for pid, hs := range streams {
+		if !isVideoStream(ids[pid]) {
+			continue
+		}
+		start := hs[0].dts
+		for i, want := range []int64{27000, 36000, 45000, 54000, 63000, 72000} {
+			assert.Equal(t, want, hs[i+3].decodeTS()-start, i)
+		}
+	}
+}
+
+func TestRepair_MissingDTS(t *testing.T) {
+	// a reordered P frame with only its PTS, a frame after the previous DTS
+	data := readSample(t, "missing-dts.ts")
+	h, hdr := videoPES(t, data, 3)
+	require.Equal(t, byte(3), h.flags)
+	require.True(t, h.pts > h.dts)
+	hdr[7] = hdr[7]&0x3f | 0x80
+	copy(hdr[14:19], []byte{0xff, 0xff, 0xff, 0xff, 0xff})
+
+	out, r := repair(t, data)
+	assert.Equal(t, Report{MissingDTS: 1}, r)
+	checkTimestamps(t, out)
+	got, _ := videoPES(t, out, 3)
+	assert.Equal(t, byte(3), got.flags)
+	assert.Equal(t, h.pts, got.pts)
+	assert.InDelta(t, h.dts, got.dts, 100)
+
+}
+
+func TestRepair_PTSBeforeDTS(t *testing.T) {
+	data := readSample(t, "missing-dts.ts")
+	// a millisecond early, which the DTS can move back to
+	h, hdr := videoPES(t, data, 2)
+	early := h.dts - 90
+	putTS(hdr[9:], 0x3, early)
+	// before the previous DTS, so the PTS moves instead
+	h2, hdr2 := videoPES(t, data, 4)
+	putTS(hdr2[9:], 0x3, h.dts)
+
+	out, r := repair(t, data)
+	assert.Equal(t, Report{PTSBeforeDTS: 2}, r)
+	assert.Equal(t, len(data), len(out))
+	checkTimestamps(t, out)
+	got, _ := videoPES(t, out, 2)
+	assert.Equal(t, early, got.pts)
+	assert.Equal(t, early, got.dts)
+	got, _ = videoPES(t, out, 4)
+	assert.Equal(t, h2.dts, got.pts)
+	assert.Equal(t, h2.dts, got.dts)
+}
+
+func TestRepair_Packets(t *testing.T) {
+	data := readSample(t, "transmux.ts")
+	n := len(data) / packetSize
+	require.True(t, n > 100)
+
+	var damaged []byte
+	damaged = append(damaged, 0x47, 1, 2, 3)           // junk ahead of the first packet
+	damaged = append(damaged, data[:40*packetSize]...) // fine
+	damaged = append(damaged, data[41*packetSize:]...) // packet 40 missing
+	damaged = damaged[:len(damaged)-100]               // last packet cut off
+	out, r := repair(t, damaged)
+	assert.Equal(t, 2, r.TruncatedPackets)
+	assert.Equal(t, 4+packetSize-100, r.DroppedBytes)
+	assert.Equal(t, 1, r.ContinuityErrors)
+	assert.Equal(t, (n-2)*packetSize, len(out))
+
+	// packets only lose their continuity counters
+	for i := 0; i < n-2; i++ {
+		j := i
+		if i >= 40 {
+			j++
+		}
+		got, want := out[i*packetSize:(i+1)*packetSize], data[j*packetSize:(j+1)*packetSize]
+		assert.Equal(t, want[:3], got[:3], i)
+		assert.Equal(t, want[4:], got[4:], i)
+	}
+}
+
+// Stream types of the PMT on the PID, by stream PID
+func pmtStreams(t *testing.T, pkts []*packet, pid uint16) (uint16, map[uint16]uint8) {
+	t.Helper()
+	for _, p := range pkts {
+		tableid, _, section, ok := psiSection(p, pid)
+		if !ok || tableid != tsio.TableIdPMT {
+			continue
+		}
+		pcr, streams, ok := parsePMT(section)
+		require.True(t, ok)
+		types := map[uint16]uint8{}
+		for _, s := range streams {
+			types[s.ElementaryPID] = s.StreamType
+		}
+		return pcr, types
+	}
+	require.Fail(t, "no PMT")
+	return 0, nil
+}
+
+func TestRepair_Tables(t *testing.T) {
+	data := readSample(t, "bad-cuvid.ts")
+	pkts := splitPackets(data, &Report{})
+	pmtPID, program, ok := findPAT(pkts)
+	require.True(t, ok)
+	pcrPID, types := pmtStreams(t, pkts, pmtPID)
+	require.Len(t, types, 2)
+
+	// drop the tables, then the PAT only
+	var stripped, noPAT []byte
+	for _, p := range pkts {
+		if mpegts.PID(p.b) != tsio.PAT_PID {
+			noPAT = append(noPAT, p.b...)
+			if mpegts.PID(p.b) != pmtPID {
+				stripped = append(stripped, p.b...)
+			}
+		}
+	}
+
+	out, r := repair(t, stripped)
+	assert.Equal(t, Report{InsertedPAT: true, InsertedPMT: true}, r)
+	assert.Equal(t, len(stripped)+2*packetSize, len(out))
+	pkts = splitPackets(out, &Report{})
+	newPMT, _, ok := findPAT(pkts[:1])
+	require.True(t, ok)
+	assert.Equal(t, uint16(tsio.PMT_PID), newPMT)
+	newPCR, newTypes := pmtStreams(t, pkts[1:2], newPMT)
+	assert.Equal(t, types, newTypes)
+	assert.Equal(t, pcrPID, newPCR)
+
+	// a PAT pointing at the PMT that's there
+	out, r = repair(t, noPAT)
+	assert.Equal(t, Report{InsertedPAT: true}, r)
+	gotPMT, gotProgram, ok := findPAT(splitPackets(out, &Report{}))
+	require.True(t, ok)
+	assert.Equal(t, pmtPID, gotPMT)
+	assert.Equal(t, program, gotProgram)
+}
@@ -97,6 +97,39 @@ func (s *VidPlayer) HandleHLSPlay(
 	})
 }
 
+//HandleHLSKeys is the handler when players fetch the keys of encrypted HLS
+//streams, served under /keys/. Return ErrNotFound for keys that don't exist.
+func (s *VidPlayer) HandleHLSKeys(getKey func(url *url.URL) ([]byte, error)) {
+	s.mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		handleKey(w, r, getKey)
+	})
+}
+
+func handleKey(w http.ResponseWriter, r *http.Request, getKey func(url *url.URL) ([]byte, error)) {
+	glog.V(4).Infof("LPMS got HTTP key request @ %v", r.URL.Path)
+
+	key, err := getKey(r.URL)
+	if err != nil {
+		if err == ErrNotFound {
+			http.Error(w, "ErrNotFound", 404)
+		} else if err == ErrBadRequest {
+			http.Error(w, "ErrBadRequest", 400)
+		} else {
+			glog.Errorf("Error getting key %v: %v", r.URL, err)
+			http.Error(w, "Error getting key", 500)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+	if _, err := w.Write(key); err != nil {
+		glog.Errorf("Error writing key %v: %v", r.URL, err)
+	}
+}
+
 func handleLive(w http.ResponseWriter, r *http.Request,
 	getMasterPlaylist func(url *url.URL) (*m3u8.MasterPlaylist, error),
 	getMediaPlaylist func(url *url.URL) (*m3u8.MediaPlaylist, error),
@@ -1,6 +1,7 @@
 package vidplayer
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 
 	joy4rtmp "github.com/livepeer/joy4/format/rtmp"
+	"github.com/livepeer/lpms/encryption"
 	"github.com/livepeer/lpms/stream"
 	"github.com/livepeer/m3u8"
 )
@@ -151,6 +153,41 @@ func TestHLS(t *testing.T) {
 	}
 }
 
+func TestHLSKeys(t *testing.T) {
+	keys := encryption.NewLocalKeyProvider("/keys/")
+	key, err := keys.Key("test", 0)
+	if err != nil {
+		t.Fatalf("Error making key: %v", err)
+	}
+	mux := http.NewServeMux()
+	player := NewVidPlayer(nil, "", mux)
+	player.HandleHLSKeys(func(url *url.URL) ([]byte, error) {
+		if k := keys.Lookup(url.Path); k != nil {
+			return k.Key, nil
+		}
+		return nil, ErrNotFound
+	})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", key.URI, nil))
+	if rec.Result().StatusCode != 200 {
+		t.Errorf("Expecting 200, but got %v", rec.Result().StatusCode)
+	}
+	res, _ := ioutil.ReadAll(rec.Result().Body)
+	if !bytes.Equal(key.Key, res) {
+		t.Errorf("Expecting key %x, got %x", key.Key, res)
+	}
+	if ctyp := rec.Header().Get("Content-Type"); ctyp != "application/octet-stream" {
+		t.Errorf("Got '%s' instead of expected content type", ctyp)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/keys/test/1.key", nil))
+	if rec.Result().StatusCode != 404 {
+		t.Errorf("Expecting 404, but got %v", rec.Result().StatusCode)
+	}
+}
+
 type TestRWriter struct {
 	bytes  []byte
 	header map[string][]string